@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
+	"remote-tunnel/internal/policy"
+	"remote-tunnel/internal/transport"
 	"remote-tunnel/internal/tunnel"
 )
 
@@ -25,15 +29,39 @@ func (i *arrayFlags) Set(value string) error {
 func main() {
 	var (
 		id            = flag.String("id", "", "Agent ID")
-		relayURL      = flag.String("relay-url", "", "Relay WebSocket URL (e.g., wss://relay.example.com/ws/agent)")
+		relayURL      = flag.String("relay-url", "", "Relay WebSocket URL (e.g., wss://relay.example.com/ws/agent; comma-separate several relays for failover)")
 		token         = flag.String("token", "", "Auth token (or set TUNNEL_TOKEN env)")
 		insecure      = flag.Bool("insecure", false, "Skip TLS certificate verification (for self-signed certificates)")
 		compress      = flag.Bool("compress", false, "Enable gzip compression for data transfer")
+		certFile      = flag.String("cert", "", "Client certificate for mTLS (CN/SAN is the agent ID)")
+		keyFile       = flag.String("key", "", "Client certificate private key for mTLS")
+		caFile        = flag.String("ca", "", "CA certificate the relay certificate must be signed by")
+		metricsAddr   = flag.String("metrics", "", "Serve Prometheus metrics on this address (e.g., 127.0.0.1:9091)")
+		policyFile    = flag.String("policy", "", "JSON policy file with allow/deny rules (reloaded on SIGHUP); replaces -allow")
 		allowed       arrayFlags
+		allowListen   arrayFlags
 	)
 	flag.Var(&allowed, "allow", "Allowed target addresses (can be specified multiple times)")
+	flag.Var(&allowListen, "allow-listen", "Addresses clients may listen on for reverse forwarding (can be specified multiple times)")
 	flag.Parse()
 
+	// Load the client certificate and relay CA for mTLS
+	var tlsConfig *tls.Config
+	if *certFile != "" || *caFile != "" {
+		var err error
+		tlsConfig, err = transport.CreateClientTLSConfig(*certFile, *keyFile, *caFile, *insecure)
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+	}
+
+	// The certificate names the agent when -id is not given
+	if *id == "" && tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
+		if leaf := tlsConfig.Certificates[0].Leaf; leaf != nil {
+			*id = leaf.Subject.CommonName
+		}
+	}
+
 	// Validate required flags
 	if *id == "" {
 		log.Fatal("Agent ID required: use -id flag")
@@ -46,19 +74,26 @@ func main() {
 	if *token == "" {
 		*token = os.Getenv("TUNNEL_TOKEN")
 	}
-	if *token == "" {
-		log.Fatal("Token required: use -token flag or TUNNEL_TOKEN env var")
+	if *token == "" && *certFile == "" {
+		log.Fatal("Token required: use -token flag, TUNNEL_TOKEN env var or -cert")
 	}
 
 	// Default allowed hosts if none specified
-	if len(allowed) == 0 {
+	if len(allowed) == 0 && *policyFile == "" {
 		allowed = append(allowed, "127.0.0.1:")
 		log.Printf("No -allow flags specified, defaulting to 127.0.0.1:")
 	}
 
 	log.Printf("Starting agent with ID: %s", *id)
 	log.Printf("Relay URL: %s", *relayURL)
-	log.Printf("Allowed targets: %v", []string(allowed))
+	if *policyFile != "" {
+		log.Printf("Policy file: %s", *policyFile)
+	} else {
+		log.Printf("Allowed targets: %v", []string(allowed))
+	}
+	if len(allowListen) > 0 {
+		log.Printf("Allowed reverse listen addresses: %v", []string(allowListen))
+	}
 	if *insecure {
 		log.Printf("TLS certificate verification disabled (insecure mode)")
 	}
@@ -74,6 +109,44 @@ func main() {
 	if *compress {
 		agent.SetCompression(true)
 	}
+	if tlsConfig != nil {
+		log.Printf("Using mTLS certificate %s, relay CA %s", *certFile, *caFile)
+		agent.SetTLSConfig(tlsConfig)
+	}
+	agent.SetAllowedListen([]string(allowListen))
+
+	if *policyFile != "" {
+		engine, err := policy.NewFileEngine(*policyFile)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		log.Printf("Loaded %d policy rules", engine.RuleCount())
+		agent.SetPolicy(engine)
+
+		// Reload the policy on SIGHUP without dropping connections
+		go func() {
+			hupCh := make(chan os.Signal, 1)
+			signal.Notify(hupCh, syscall.SIGHUP)
+			for range hupCh {
+				if err := engine.Reload(); err != nil {
+					log.Printf("Policy reload failed, keeping previous policy: %v", err)
+					continue
+				}
+				log.Printf("Policy reloaded: %d rules", engine.RuleCount())
+			}
+		}()
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", agent.HandleMetrics)
+		go func() {
+			log.Printf("Serving /metrics on %s", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Printf("Metrics listener failed: %v", err)
+			}
+		}()
+	}
 
 	// Handle graceful shutdown
 	go func() {
@@ -3,36 +3,63 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"remote-tunnel/internal/transport"
 	"remote-tunnel/internal/tunnel"
 )
 
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
 func main() {
 	var (
 		localAddr = flag.String("L", "", "Local listen address (e.g., :2222)")
-		relayURL  = flag.String("relay-url", "", "Relay WebSocket URL (e.g., wss://relay.example.com/ws/client)")
+		relayURL  = flag.String("relay-url", "", "Relay WebSocket URL (e.g., wss://relay.example.com/ws/client; comma-separate several relays for failover)")
 		agentID   = flag.String("agent", "", "Target agent ID")
 		target    = flag.String("target", "", "Target address (e.g., 127.0.0.1:22)")
 		token     = flag.String("token", "", "Auth token (or set TUNNEL_TOKEN env)")
 		insecure  = flag.Bool("insecure", false, "Skip TLS certificate verification (for self-signed certificates)")
 		compress  = flag.Bool("compress", false, "Enable gzip compression for data transfer")
+		certFile  = flag.String("cert", "", "Client certificate for mTLS")
+		keyFile   = flag.String("key", "", "Client certificate private key for mTLS")
+		caFile    = flag.String("ca", "", "CA certificate the relay certificate must be signed by")
+		udp       = flag.Bool("udp", false, "Forward UDP datagrams on -L instead of TCP connections")
+		proxy     = flag.Bool("proxy", false, "Run -L as a SOCKS5 / HTTP CONNECT proxy (target taken from each request)")
+		profile   = flag.String("profile", "", "JSON profile file listing forwards to serve over one relay connection (reloaded on SIGHUP)")
+		status    = flag.String("status", "", "Serve forward status as JSON on this address (e.g., 127.0.0.1:9090)")
+		metrics   = flag.String("metrics", "", "Serve Prometheus metrics on this address (e.g., 127.0.0.1:9090)")
+		reverse   arrayFlags
 	)
+	flag.Var(&reverse, "R", "Reverse forward agent_listen_addr=local_addr (e.g., 0.0.0.0:8080=127.0.0.1:3000, can be specified multiple times)")
 	flag.Parse()
 
 	// Validate required flags
-	if *localAddr == "" {
-		log.Fatal("Local address required: use -L flag")
+	if *localAddr == "" && len(reverse) == 0 && *profile == "" {
+		log.Fatal("Local address required: use -L flag (or -R for reverse forwarding, or -profile)")
+	}
+	if *localAddr != "" && *profile != "" {
+		log.Fatal("-L cannot be combined with -profile: add the forward to the profile")
 	}
 	if *relayURL == "" {
 		log.Fatal("Relay URL required: use -relay-url flag")
 	}
-	if *agentID == "" {
+	if *agentID == "" && (*localAddr != "" || len(reverse) > 0) {
 		log.Fatal("Agent ID required: use -agent flag")
 	}
-	if *target == "" {
+	if *localAddr != "" && !*proxy && *target == "" {
 		log.Fatal("Target address required: use -target flag")
 	}
 
@@ -40,15 +67,24 @@ func main() {
 	if *token == "" {
 		*token = os.Getenv("TUNNEL_TOKEN")
 	}
-	if *token == "" {
-		log.Fatal("Token required: use -token flag or TUNNEL_TOKEN env var")
+	if *token == "" && *certFile == "" {
+		log.Fatal("Token required: use -token flag, TUNNEL_TOKEN env var or -cert")
 	}
 
 	log.Printf("Starting client")
 	log.Printf("Local address: %s", *localAddr)
 	log.Printf("Relay URL: %s", *relayURL)
 	log.Printf("Agent ID: %s", *agentID)
-	log.Printf("Target: %s", *target)
+	if *udp && *proxy {
+		log.Fatal("-udp cannot be combined with -proxy")
+	}
+	if *proxy {
+		log.Printf("Proxy mode: SOCKS5 and HTTP CONNECT on %s", *localAddr)
+	} else if *udp {
+		log.Printf("Target: %s (udp)", *target)
+	} else {
+		log.Printf("Target: %s", *target)
+	}
 	if *insecure {
 		log.Printf("TLS certificate verification disabled (insecure mode)")
 	}
@@ -64,6 +100,80 @@ func main() {
 	if *compress {
 		client.SetCompression(true)
 	}
+	if *certFile != "" || *caFile != "" {
+		tlsConfig, err := transport.CreateClientTLSConfig(*certFile, *keyFile, *caFile, *insecure)
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+		log.Printf("Using mTLS certificate %s, relay CA %s", *certFile, *caFile)
+		client.SetTLSConfig(tlsConfig)
+	}
+	if *proxy {
+		client.SetProxyMode(true)
+	}
+	if *udp {
+		client.SetUDP(true)
+	}
+	for _, spec := range reverse {
+		remoteAddr, local, ok := strings.Cut(spec, "=")
+		if !ok || remoteAddr == "" || local == "" {
+			log.Fatalf("Invalid -R value %q: expected agent_listen_addr=local_addr", spec)
+		}
+		log.Printf("Reverse forward: agent %s -> local %s", remoteAddr, local)
+		client.AddReverseForward(remoteAddr, local)
+	}
+
+	// Serve the forwards listed in the profile, reloading them on SIGHUP
+	if *profile != "" {
+		forwards, err := tunnel.LoadProfile(*profile)
+		if err != nil {
+			log.Fatalf("Failed to load profile: %v", err)
+		}
+		log.Printf("Loaded %d forwards from profile %s", len(forwards.Forwards), *profile)
+		if err := client.ApplyForwards(forwards.Forwards); err != nil {
+			log.Printf("Some forwards failed to start: %v", err)
+		}
+
+		go func() {
+			hupCh := make(chan os.Signal, 1)
+			signal.Notify(hupCh, syscall.SIGHUP)
+			for range hupCh {
+				forwards, err := tunnel.LoadProfile(*profile)
+				if err != nil {
+					log.Printf("Profile reload failed, keeping previous forwards: %v", err)
+					continue
+				}
+				if err := client.ApplyForwards(forwards.Forwards); err != nil {
+					log.Printf("Some forwards failed to start: %v", err)
+				}
+				log.Printf("Profile reloaded: %d forwards", len(forwards.Forwards))
+			}
+		}()
+	}
+
+	// Local status and metrics endpoints share a listener when given the
+	// same address
+	listeners := make(map[string]*http.ServeMux)
+	serveLocal := func(addr, path string, handler http.HandlerFunc) {
+		mux, exists := listeners[addr]
+		if !exists {
+			mux = http.NewServeMux()
+			listeners[addr] = mux
+			go func() {
+				log.Printf("Serving %s on %s", path, addr)
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					log.Printf("Local listener %s failed: %v", addr, err)
+				}
+			}()
+		}
+		mux.HandleFunc(path, handler)
+	}
+	if *status != "" {
+		serveLocal(*status, "/status", client.HandleStatus)
+	}
+	if *metrics != "" {
+		serveLocal(*metrics, "/metrics", client.HandleMetrics)
+	}
 
 	// Handle graceful shutdown
 	go func() {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -13,29 +15,79 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/limit"
 	"remote-tunnel/internal/relay"
 	"remote-tunnel/internal/transport"
 )
 
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := runTokenCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Token command failed: %v", err)
+		}
+		return
+	}
+
 	var (
 		addr     = flag.String("addr", ":443", "Server address")
 		certFile = flag.String("cert", "server.crt", "TLS certificate file")
 		keyFile  = flag.String("key", "server.key", "TLS private key file")
 		token    = flag.String("token", "", "Auth token (or set TUNNEL_TOKEN env)")
-		compress = flag.Bool("compress", false, "Enable gzip compression for data transfer")
+		compress = flag.Bool("compress", false, "Allow per-stream gzip compression negotiated between clients and agents")
+		clientCA = flag.String("client-ca", "", "CA that signs agent/client certificates; requires mTLS authentication")
+		fallback = flag.Bool("allow-token-fallback", false, "With -client-ca, accept tokens from connections that present no certificate")
+		credFile = flag.String("credentials", "", "Per-identity credentials file managed with 'relay token'")
+		selfURL  = flag.String("self-url", "", "Base URL peers use to reach this relay (e.g., wss://relay-a.example.com)")
+		peerTok  = flag.String("peer-token", "", "Token relays use to authenticate each other (or set TUNNEL_PEER_TOKEN env)")
+		peerCA   = flag.String("peer-ca", "", "CA certificate peer relay certificates must be signed by")
+		peerSkip = flag.Bool("peer-insecure", false, "Skip TLS certificate verification when dialing peer relays")
+		drain    = flag.Duration("drain-timeout", 30*time.Second, "How long to wait for open streams to finish on shutdown")
+		maxStrm  = flag.Int("max-streams", 0, "Maximum concurrent streams through the relay (0 = unlimited)")
+		maxAgent = flag.Int("max-agent-streams", 0, "Maximum concurrent streams per agent (0 = unlimited)")
+		maxCli   = flag.Int("max-client-streams", 0, "Maximum concurrent streams per client identity (0 = unlimited)")
+		agentBW  = flag.String("agent-bandwidth", "", "Bandwidth limit per agent and direction, e.g. 10M for 10 MiB/s (default unlimited)")
+		clientBW = flag.String("client-bandwidth", "", "Bandwidth limit per client identity and direction, e.g. 2M (default unlimited)")
+		metricsT = flag.String("metrics-token", "", "Bearer token required to scrape /metrics (or set TUNNEL_METRICS_TOKEN env; default open)")
+		peers    arrayFlags
 	)
+	flag.Var(&peers, "peer", "Peer relay base URL sharing the agent registry (can be specified multiple times)")
 	flag.Parse()
 
+	if *peerTok == "" {
+		*peerTok = os.Getenv("TUNNEL_PEER_TOKEN")
+	}
+	if *metricsT == "" {
+		*metricsT = os.Getenv("TUNNEL_METRICS_TOKEN")
+	}
+	if len(peers) > 0 && (*peerTok == "" || *selfURL == "") {
+		log.Fatal("-peer requires -peer-token and -self-url")
+	}
+	if *peerTok != "" && *clientCA != "" && !*fallback {
+		log.Fatal("-peer-token with -client-ca requires -allow-token-fallback: peer relays present no certificate")
+	}
+
 	// Get token from env if not provided
 	if *token == "" {
 		*token = os.Getenv("TUNNEL_TOKEN")
 	}
-	if *token == "" {
-		log.Fatal("Token required: use -token flag or TUNNEL_TOKEN env var")
+	if *token == "" && *credFile == "" && *clientCA == "" {
+		log.Fatal("Token required: use -token flag, TUNNEL_TOKEN env var, -credentials or -client-ca")
 	}
 
 	// Generate self-signed cert if not exists
@@ -48,7 +100,23 @@ func main() {
 	}
 
 	// Load TLS config
-	tlsConfig, err := transport.CreateTLSConfig(*certFile, *keyFile)
+	var (
+		tlsConfig *tls.Config
+		err       error
+	)
+	if *clientCA != "" {
+		if *fallback {
+			log.Printf("mTLS enabled: client certificates signed by %s are accepted, tokens without a certificate too", *clientCA)
+		} else {
+			if *token != "" || *credFile != "" {
+				log.Fatal("-client-ca requires client certificates; add -allow-token-fallback to also accept -token or -credentials")
+			}
+			log.Printf("mTLS required: only client certificates signed by %s are accepted", *clientCA)
+		}
+		tlsConfig, err = transport.CreateMutualTLSConfig(*certFile, *keyFile, *clientCA, *fallback)
+	} else {
+		tlsConfig, err = transport.CreateTLSConfig(*certFile, *keyFile)
+	}
 	if err != nil {
 		log.Fatalf("Failed to load TLS config: %v", err)
 	}
@@ -62,11 +130,73 @@ func main() {
 		server = relay.NewServer(*token)
 	}
 
+	agentRate, err := limit.ParseRate(*agentBW)
+	if err != nil {
+		log.Fatalf("Invalid -agent-bandwidth: %v", err)
+	}
+	clientRate, err := limit.ParseRate(*clientBW)
+	if err != nil {
+		log.Fatalf("Invalid -client-bandwidth: %v", err)
+	}
+	server.SetQuotas(relay.Quotas{
+		MaxStreams:       *maxStrm,
+		MaxAgentStreams:  *maxAgent,
+		MaxClientStreams: *maxCli,
+		AgentBandwidth:   agentRate,
+		ClientBandwidth:  clientRate,
+	})
+	if *maxStrm > 0 || *maxAgent > 0 || *maxCli > 0 || agentRate > 0 || clientRate > 0 {
+		log.Printf("Quotas: streams %d total, %d per agent, %d per client; bandwidth %d B/s per agent, %d B/s per client (0 = unlimited)",
+			*maxStrm, *maxAgent, *maxCli, agentRate, clientRate)
+	}
+
+	if *credFile != "" {
+		store, err := auth.OpenStore(*credFile)
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
+		}
+		log.Printf("Loaded %d credentials from %s", len(store.List()), *credFile)
+		if *token != "" {
+			log.Printf("Shared token is also accepted for clients, not agents; drop -token once all clients use their own")
+		}
+		server.SetCredentials(store)
+	}
+
+	// Peers dial this relay with the peer token to reach its agents
+	if *peerTok != "" {
+		peerTLS, err := transport.CreateClientTLSConfig("", "", *peerCA, *peerSkip)
+		if err != nil {
+			log.Fatalf("Failed to load peer TLS config: %v", err)
+		}
+		server.SetPeerAuth(*peerTok, peerTLS)
+
+		if len(peers) > 0 {
+			registry := relay.NewPeerRegistry([]string(peers), *peerTok, peerTLS)
+			go registry.Run(context.Background())
+
+			server.SetRegistry(registry, *selfURL)
+			log.Printf("Sharing agent registry with peers %v as %s", []string(peers), *selfURL)
+		}
+	}
+
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws/agent", server.HandleAgent)
 	mux.HandleFunc("/ws/client", server.HandleClient)
+	mux.HandleFunc("/registry", server.HandleRegistry)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if *metricsT != "" && !transport.TokenEqual(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), *metricsT) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		server.HandleMetrics(w, r)
+	})
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		// Fail health checks while draining so load balancers move traffic away
+		if server.Draining() {
+			http.Error(w, "Draining", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
@@ -84,8 +214,12 @@ func main() {
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 
-		log.Printf("Shutting down server...")
-		server.Close()
+		log.Printf("Shutting down server, draining for up to %v...", *drain)
+		ctx, cancel := context.WithTimeout(context.Background(), *drain)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Drain incomplete: %v", err)
+		}
+		cancel()
 		httpServer.Close()
 	}()
 
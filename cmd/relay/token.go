@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"remote-tunnel/internal/auth"
+)
+
+const tokenUsage = `Usage:
+  relay token issue  -credentials FILE -id ID -role agent|client -agents ID[,ID...] [-ttl 720h]
+  relay token revoke -credentials FILE -id ID
+  relay token list   -credentials FILE
+
+A running relay picks up changes to the credentials file within a few seconds.
+`
+
+// runTokenCommand manages the credentials file used by -credentials
+func runTokenCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("missing token subcommand")
+	}
+
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	var (
+		credentials = fs.String("credentials", "credentials.json", "Credentials file")
+		id          = fs.String("id", "", "Credential ID")
+		role        = fs.String("role", "client", "Credential role: agent or client")
+		agents      = fs.String("agents", "", "Comma-separated agent IDs the credential may register as (agent) or reach (client); * for any")
+		ttl         = fs.Duration("ttl", 0, "Token lifetime, e.g. 720h (0 = no expiry)")
+	)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, tokenUsage) }
+	fs.Parse(args[1:])
+
+	store, err := auth.OpenStore(*credentials)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "issue":
+		agentIDs := splitList(*agents)
+		if len(agentIDs) == 0 && *role == string(auth.RoleAgent) {
+			// An agent credential usually registers under its own ID
+			agentIDs = []string{*id}
+		}
+
+		token, err := store.Issue(*id, auth.Role(*role), agentIDs, *ttl)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Issued %s token %s for agents %v\n", *role, *id, agentIDs)
+		fmt.Println(token)
+	case "revoke":
+		if err := store.Revoke(*id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Revoked %s\n", *id)
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tROLE\tAGENTS\tCREATED\tEXPIRES\tSTATUS")
+		now := time.Now()
+		for _, cred := range store.List() {
+			expires := "never"
+			if cred.ExpiresAt != nil {
+				expires = cred.ExpiresAt.Format(time.RFC3339)
+			}
+
+			status := "active"
+			switch {
+			case cred.RevokedAt != nil:
+				status = "revoked"
+			case cred.ExpiresAt != nil && !now.Before(*cred.ExpiresAt):
+				status = "expired"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", cred.ID, cred.Role,
+				strings.Join(cred.Agents, ","), cred.CreatedAt.Format(time.RFC3339), expires, status)
+		}
+		w.Flush()
+	default:
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("unknown token subcommand %q", args[0])
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -15,6 +15,17 @@ import (
 	"remote-tunnel/internal/tunnel"
 )
 
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
 func main() {
 	config := parseFlags()
 	validateConfig(config)
@@ -44,12 +55,32 @@ func main() {
 	defer sshClient.Close()
 
 	log.Printf("SSH connection established!")
-	log.Printf("Starting interactive session...")
-	log.Printf("Press Ctrl+C to exit")
+
+	if err := startForwards(sshClient, config.Forwards); err != nil {
+		sshClient.Close()
+		log.Fatalf("Port forwarding failed: %v", err)
+	}
+
+	// File transfer subcommands run instead of a shell
+	if len(config.Command) > 0 {
+		if err := runTransferCommand(sshClient, config); err != nil {
+			sshClient.Close()
+			log.Fatalf("Transfer failed: %v", err)
+		}
+		return
+	}
 
 	// Handle graceful shutdown
 	go handleShutdown(sigCh, sshClient)
 
+	if config.NoShell {
+		log.Printf("Forwarding ports only. Press Ctrl+C to exit")
+		select {}
+	}
+
+	log.Printf("Starting interactive session...")
+	log.Printf("Press Ctrl+C to exit")
+
 	// Start interactive SSH session
 	if err := sshClient.StartInteractiveSession(); err != nil {
 		log.Fatalf("SSH session error: %v", err)
@@ -59,16 +90,33 @@ func main() {
 }
 
 type SSHClientConfig struct {
-	RelayURL    string
-	AgentID     string
-	Token       string
-	Insecure    bool
-	Compress    bool
-	Username    string
-	Password    string
-	PrivateKey  string
-	LogEnabled  bool
-	LogDir      string
+	RelayURL     string
+	AgentID      string
+	Token        string
+	Insecure     bool
+	Compress     bool
+	Username     string
+	Password     string
+	PrivateKey   string
+	LogEnabled   bool
+	LogDir       string
+	Target       string
+	KnownHosts   string
+	HostKeyCheck string
+	Certificate  string
+	UseAgent     bool
+	ForwardAgent bool
+	AuthMethods  string
+	Resume       bool
+	Verify       bool
+	Pull         bool
+	Command      []string
+
+	LocalForwards   arrayFlags
+	RemoteForwards  arrayFlags
+	DynamicForwards arrayFlags
+	Forwards        []ssh.Forward
+	NoShell         bool
 }
 
 func parseFlags() *SSHClientConfig {
@@ -84,8 +132,23 @@ func parseFlags() *SSHClientConfig {
 	flag.StringVar(&config.PrivateKey, "key", "", "Path to SSH private key file")
 	flag.BoolVar(&config.LogEnabled, "log", true, "Enable command logging")
 	flag.StringVar(&config.LogDir, "log-dir", "ssh-logs", "Directory for SSH session logs")
+	flag.StringVar(&config.Target, "target", "127.0.0.1:22", "SSH server address on the agent side")
+	flag.StringVar(&config.KnownHosts, "known-hosts", ssh.DefaultKnownHostsFile(), "known_hosts files, comma-separated; new keys are added to the first")
+	flag.StringVar(&config.HostKeyCheck, "host-key-check", ssh.HostKeyAsk, "Host key checking: yes (strict), ask, accept-new or no")
+	flag.StringVar(&config.Certificate, "cert", "", "Path to SSH certificate for -key (default: <key>-cert.pub if present)")
+	flag.BoolVar(&config.UseAgent, "ssh-agent", os.Getenv("SSH_AUTH_SOCK") != "", "Authenticate with keys from the ssh-agent at SSH_AUTH_SOCK")
+	flag.BoolVar(&config.ForwardAgent, "forward-agent", false, "Forward the ssh-agent to the SSH server")
+	flag.StringVar(&config.AuthMethods, "auth", "", "Allowed authentication methods, comma-separated (publickey, keyboard-interactive, password)")
+	flag.BoolVar(&config.Resume, "resume", false, "get/put/sync: continue partial copies instead of starting over")
+	flag.BoolVar(&config.Verify, "verify", true, "get/put/sync: compare SHA-256 checksums after each copy")
+	flag.BoolVar(&config.Pull, "pull", false, "sync: download the remote directory instead of uploading")
+	flag.Var(&config.LocalForwards, "L", "Forward [bind:]port:host:hostport to host:hostport as seen from the SSH server (can be repeated)")
+	flag.Var(&config.RemoteForwards, "R", "Forward [bind:]port on the SSH server to host:hostport on this machine (can be repeated)")
+	flag.Var(&config.DynamicForwards, "D", "Run a SOCKS5 proxy on [bind:]port that connects from the SSH server (can be repeated)")
+	flag.BoolVar(&config.NoShell, "N", false, "Only forward ports; do not start a shell")
 	
 	flag.Parse()
+	config.Command = flag.Args()
 
 	// Get token from environment if not provided
 	if config.Token == "" {
@@ -100,10 +163,27 @@ func validateConfig(config *SSHClientConfig) {
 		showUsage()
 		os.Exit(1)
 	}
+
+	forwards, err := parseForwards(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Forwards = forwards
+	if config.NoShell && len(forwards) == 0 {
+		log.Fatal("-N needs at least one -L, -R or -D forward")
+	}
+	if config.NoShell && len(config.Command) > 0 {
+		log.Fatal("-N cannot be combined with a command")
+	}
+	if err := validateTransferCommand(config.Command); err != nil {
+		fmt.Println(err)
+		showUsage()
+		os.Exit(1)
+	}
 }
 
 func showUsage() {
-	fmt.Println("Usage: ssh-client -relay-url <url> -agent <id> -token <token> [options]")
+	fmt.Println("Usage: ssh-client -relay-url <url> -agent <id> -token <token> [options] [command]")
 	fmt.Println("\nRequired:")
 	fmt.Println("  -relay-url    Relay WebSocket URL")
 	fmt.Println("  -agent        Target agent ID") 
@@ -114,11 +194,30 @@ func showUsage() {
 	fmt.Println("  -key          Path to SSH private key file")
 	fmt.Println("  -log          Enable command logging (default: true)")
 	fmt.Println("  -log-dir      Log directory (default: ssh-logs)")
+	fmt.Println("  -target       SSH server address on the agent side (default: 127.0.0.1:22)")
+	fmt.Println("  -known-hosts  known_hosts files (default: ~/.ssh/known_hosts)")
+	fmt.Println("  -host-key-check  yes, ask, accept-new or no (default: ask)")
+	fmt.Println("  -cert         SSH certificate (default: <key>-cert.pub)")
+	fmt.Println("  -ssh-agent    Use keys from ssh-agent (default: true if SSH_AUTH_SOCK is set)")
+	fmt.Println("  -forward-agent  Forward ssh-agent to the server")
+	fmt.Println("  -auth         Allowed methods, e.g. publickey (default: all)")
+	fmt.Println("\nCommands (default: interactive shell):")
+	fmt.Println("  get REMOTE LOCAL    Download a file over SFTP")
+	fmt.Println("  put LOCAL REMOTE    Upload a file over SFTP")
+	fmt.Println("  sync LOCAL REMOTE   Upload changed files below LOCAL (-pull downloads instead)")
+	fmt.Println("  -resume       Continue partial copies")
+	fmt.Println("  -verify       Compare SHA-256 checksums (default: true)")
+	fmt.Println("\nPort Forwarding (over the SSH connection):")
+	fmt.Println("  -L [bind:]port:host:hostport  Local port to host:hostport seen from the SSH server")
+	fmt.Println("  -R [bind:]port:host:hostport  Port on the SSH server to host:hostport seen from here")
+	fmt.Println("  -D [bind:]port                SOCKS5 proxy connecting from the SSH server")
+	fmt.Println("  -N            Only forward ports, no shell")
 	fmt.Println("\nTunnel Options:")
 	fmt.Println("  -insecure     Skip TLS verification")
 	fmt.Println("  -compress     Enable compression")
 	fmt.Println("\nExample:")
 	fmt.Println("  ssh-client -relay-url wss://relay.example.com/ws/client -agent my-agent -token secret123 -user admin")
+	fmt.Println("  ssh-client -relay-url wss://relay.example.com/ws/client -agent my-agent -token secret123 -user admin -resume get /var/log/app.log .")
 }
 
 func logConfig(config *SSHClientConfig) {
@@ -134,7 +233,7 @@ func logConfig(config *SSHClientConfig) {
 
 func establishTunnel(config *SSHClientConfig) (net.Conn, error) {
 	// Create tunnel client with correct parameters
-	client := tunnel.NewClient("127.0.0.1:0", config.RelayURL, config.AgentID, "127.0.0.1:22", config.Token)
+	client := tunnel.NewClient("127.0.0.1:0", config.RelayURL, config.AgentID, config.Target, config.Token)
 	if config.Insecure {
 		client.SetInsecure(true)
 	}
@@ -149,28 +248,61 @@ func establishTunnel(config *SSHClientConfig) (net.Conn, error) {
 func createSSHConfig(config *SSHClientConfig, tunnelConn net.Conn) *ssh.SSHConfig {
 	sshUsername := getSSHUsername(config.Username)
 	sshPassword := config.Password
-	var privateKeyData string
+	var privateKeyData, certificateData string
 
-	// Read private key if provided
+	// Read private key if provided; passwords and passphrases are prompted
+	// for during authentication when needed
 	if config.PrivateKey != "" {
 		keyData, err := os.ReadFile(config.PrivateKey)
 		if err != nil {
 			log.Fatalf("Failed to read private key: %v", err)
 		}
 		privateKeyData = string(keyData)
-	} else if sshPassword == "" {
-		// Prompt for password if no key provided
-		sshPassword = getSSHPassword()
+		certificateData = readCertificate(config.Certificate, config.PrivateKey)
+	}
+
+	var authMethods []string
+	if config.AuthMethods != "" {
+		authMethods = strings.Split(config.AuthMethods, ",")
+	}
+
+	knownHosts, err := ssh.NewKnownHosts(config.HostKeyCheck, strings.Split(config.KnownHosts, ",")...)
+	if err != nil {
+		log.Fatalf("Failed to load known hosts: %v", err)
 	}
 
 	return &ssh.SSHConfig{
-		Username:     sshUsername,
-		Password:     sshPassword,
-		PrivateKey:   privateKeyData,
-		TunnelConn:   tunnelConn,
-		LogEnabled:   config.LogEnabled,
-		LogDirectory: config.LogDir,
+		Username:       sshUsername,
+		Password:       sshPassword,
+		PrivateKey:     privateKeyData,
+		TunnelConn:     tunnelConn,
+		LogEnabled:     config.LogEnabled,
+		LogDirectory:   config.LogDir,
+		KnownHosts:     knownHosts,
+		HostKeyAddress: ssh.HostKeyAddress(config.AgentID, config.Target),
+		Certificate:    certificateData,
+		UseAgent:       config.UseAgent,
+		ForwardAgent:   config.ForwardAgent,
+		AuthMethods:    authMethods,
+	}
+}
+
+// readCertificate loads the certificate for a private key, falling back to
+// the OpenSSH <key>-cert.pub naming when no path is given
+func readCertificate(path, keyPath string) string {
+	if path == "" {
+		data, err := os.ReadFile(keyPath + "-cert.pub")
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read certificate: %v", err)
 	}
+	return string(data)
 }
 
 func getSSHUsername(username string) string {
@@ -183,15 +315,6 @@ func getSSHUsername(username string) string {
 	return username
 }
 
-func getSSHPassword() string {
-	fmt.Print("SSH Password: ")
-	passwordBytes, err := readPassword()
-	if err != nil {
-		log.Fatalf("Failed to read password: %v", err)
-	}
-	return string(passwordBytes)
-}
-
 func handleShutdown(sigCh chan os.Signal, sshClient *ssh.SSHClient) {
 	<-sigCh
 	log.Printf("\nShutting down SSH client...")
@@ -213,12 +336,38 @@ func createTunnelConnection(client *tunnel.Client) (net.Conn, error) {
 	return nil, fmt.Errorf("deprecated: use connectToTunnel directly")
 }
 
-func readPassword() ([]byte, error) {
-	// Simple password reading - in production use golang.org/x/term.ReadPassword
-	reader := bufio.NewReader(os.Stdin)
-	password, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// parseForwards parses the -L, -R and -D flags
+func parseForwards(config *SSHClientConfig) ([]ssh.Forward, error) {
+	var forwards []ssh.Forward
+	for _, flags := range []struct {
+		kind  string
+		specs arrayFlags
+	}{
+		{ssh.ForwardLocal, config.LocalForwards},
+		{ssh.ForwardRemote, config.RemoteForwards},
+		{ssh.ForwardDynamic, config.DynamicForwards},
+	} {
+		for _, spec := range flags.specs {
+			fwd, err := ssh.ParseForward(flags.kind, spec)
+			if err != nil {
+				return nil, err
+			}
+			forwards = append(forwards, fwd)
+		}
+	}
+	return forwards, nil
+}
+
+// startForwards serves the forwards on the SSH connection
+func startForwards(client *ssh.SSHClient, forwards []ssh.Forward) error {
+	for _, fwd := range forwards {
+		addr, err := client.StartForward(fwd)
+		if err != nil {
+			return err
+		}
+		if fwd.Kind == ssh.ForwardRemote {
+			log.Printf("Remote forward listening on %s", addr)
+		}
 	}
-	return []byte(strings.TrimSpace(password)), nil
+	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"remote-tunnel/internal/ssh"
+)
+
+// validateTransferCommand checks the get/put/sync arguments before
+// connecting
+func validateTransferCommand(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch args[0] {
+	case "get", "put", "sync":
+		if len(args) != 3 {
+			return fmt.Errorf("%s takes two paths", args[0])
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runTransferCommand copies files over SFTP on the established connection
+func runTransferCommand(client *ssh.SSHClient, config *SSHClientConfig) error {
+	opts := ssh.TransferOptions{
+		Resume:   config.Resume,
+		Verify:   config.Verify,
+		Progress: os.Stderr,
+	}
+
+	var (
+		result *ssh.TransferResult
+		err    error
+	)
+	args := config.Command
+	switch args[0] {
+	case "get":
+		result, err = client.Get(args[1], args[2], opts)
+	case "put":
+		result, err = client.Put(args[1], args[2], opts)
+	case "sync":
+		result, err = client.Sync(args[1], args[2], config.Pull, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s complete: %d files copied (%d bytes), %d up to date", args[0], result.Files, result.Bytes, result.Skipped)
+	return nil
+}
@@ -15,7 +15,25 @@ import (
 	"remote-tunnel/internal/tunnel"
 )
 
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplayCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
 	config := parseFlags()
 	validateConfig(config)
 	
@@ -26,12 +44,60 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	// The username is part of the control socket name
+	config.Username = getSSHUsername(config.Username)
+	if config.ControlPath == "" {
+		config.ControlPath = ssh.DefaultControlPath(config.AgentID, config.Username, config.Target)
+	}
+
+	ptyClient := connect(config)
+	defer ptyClient.Close()
+
+	if err := startForwards(ptyClient, config.Forwards); err != nil {
+		ptyClient.Close()
+		log.Fatalf("Port forwarding failed: %v", err)
+	}
+
+	// Handle graceful shutdown
+	go handleShutdown(sigCh, ptyClient)
+
+	if config.NoShell {
+		log.Printf("Forwarding ports only. Press Ctrl+C to exit")
+		select {}
+	}
+
+	log.Printf("Starting interactive PTY session...")
+	log.Printf("You can now run Linux commands. Press Ctrl+C to exit")
+
+	// Start interactive PTY session
+	if err := ptyClient.StartInteractivePTY(); err != nil {
+		log.Fatalf("PTY session error: %v", err)
+	}
+
+	log.Printf("PTY session ended")
+
+	// A control master stays up until the sessions it shares have ended
+	ptyClient.WaitShared()
+}
+
+// connect opens the SSH connection, or reuses the one of a running control
+// master in auto mode
+func connect(config *SSHPTYConfig) *ssh.PTYClient {
+	// Forwards need a connection of their own
+	if config.ControlMaster == ssh.ControlAuto && len(config.Forwards) == 0 && ssh.ControlMasterRunning(config.ControlPath) {
+		ptyClient, err := ssh.NewPTYClientControl(createPTYConfig(config, nil), config.ControlPath)
+		if err != nil {
+			log.Fatalf("Failed to create PTY client: %v", err)
+		}
+		log.Printf("Using control master at %s", config.ControlPath)
+		return ptyClient
+	}
+
 	// Create and connect tunnel
 	tunnelConn, err := establishTunnel(config)
 	if err != nil {
 		log.Fatalf("Failed to connect to tunnel: %v", err)
 	}
-	defer tunnelConn.Close()
 
 	log.Printf("Tunnel connected, establishing SSH connection...")
 
@@ -39,36 +105,55 @@ func main() {
 	ptyConfig := createPTYConfig(config, tunnelConn)
 	ptyClient, err := ssh.NewPTYClient(ptyConfig)
 	if err != nil {
+		tunnelConn.Close()
 		log.Fatalf("Failed to create PTY client: %v", err)
 	}
-	defer ptyClient.Close()
 
 	log.Printf("SSH connection established!")
-	log.Printf("Starting interactive PTY session...")
-	log.Printf("You can now run Linux commands. Press Ctrl+C to exit")
-
-	// Handle graceful shutdown
-	go handleShutdown(sigCh, ptyClient)
 
-	// Start interactive PTY session
-	if err := ptyClient.StartInteractivePTY(); err != nil {
-		log.Fatalf("PTY session error: %v", err)
+	if config.ControlMaster != ssh.ControlNo {
+		if err := ptyClient.ServeControl(config.ControlPath); err != nil {
+			if config.ControlMaster == ssh.ControlYes {
+				ptyClient.Close()
+				log.Fatalf("Failed to start control master: %v", err)
+			}
+			log.Printf("Warning: control master not started: %v", err)
+		} else {
+			log.Printf("Sharing connection on %s", config.ControlPath)
+		}
 	}
-
-	log.Printf("PTY session ended")
+	return ptyClient
 }
 
 type SSHPTYConfig struct {
-	RelayURL    string
-	AgentID     string
-	Token       string
-	Insecure    bool
-	Compress    bool
-	Username    string
-	Password    string
-	PrivateKey  string
-	LogEnabled  bool
-	LogDir      string
+	RelayURL     string
+	AgentID      string
+	Token        string
+	Insecure     bool
+	Compress     bool
+	Username     string
+	Password     string
+	PrivateKey   string
+	LogEnabled   bool
+	LogDir       string
+	Target       string
+	KnownHosts   string
+	HostKeyCheck string
+	Certificate  string
+	UseAgent     bool
+	ForwardAgent bool
+	AuthMethods  string
+	Record       bool
+	RecordInput  bool
+
+	ControlMaster string
+	ControlPath   string
+
+	LocalForwards   arrayFlags
+	RemoteForwards  arrayFlags
+	DynamicForwards arrayFlags
+	Forwards        []ssh.Forward
+	NoShell         bool
 }
 
 func parseFlags() *SSHPTYConfig {
@@ -84,6 +169,21 @@ func parseFlags() *SSHPTYConfig {
 	flag.StringVar(&config.PrivateKey, "key", "", "Path to SSH private key file")
 	flag.BoolVar(&config.LogEnabled, "log", true, "Enable command logging")
 	flag.StringVar(&config.LogDir, "log-dir", "pty-logs", "Directory for SSH session logs")
+	flag.BoolVar(&config.Record, "record", true, "Record the session as an asciicast file in the log directory")
+	flag.BoolVar(&config.RecordInput, "record-input", false, "Also record keystrokes, including anything typed without echo")
+	flag.StringVar(&config.Target, "target", "127.0.0.1:22", "SSH server address on the agent side")
+	flag.StringVar(&config.KnownHosts, "known-hosts", ssh.DefaultKnownHostsFile(), "known_hosts files, comma-separated; new keys are added to the first")
+	flag.StringVar(&config.HostKeyCheck, "host-key-check", ssh.HostKeyAsk, "Host key checking: yes (strict), ask, accept-new or no")
+	flag.StringVar(&config.Certificate, "cert", "", "Path to SSH certificate for -key (default: <key>-cert.pub if present)")
+	flag.BoolVar(&config.UseAgent, "ssh-agent", os.Getenv("SSH_AUTH_SOCK") != "", "Authenticate with keys from the ssh-agent at SSH_AUTH_SOCK")
+	flag.BoolVar(&config.ForwardAgent, "forward-agent", false, "Forward the ssh-agent to the SSH server")
+	flag.StringVar(&config.AuthMethods, "auth", "", "Allowed authentication methods, comma-separated (publickey, keyboard-interactive, password)")
+	flag.StringVar(&config.ControlMaster, "control-master", ssh.ControlNo, "Share the SSH connection with later runs: no, auto (reuse a running master or become one) or yes")
+	flag.StringVar(&config.ControlPath, "control-path", "", "Control socket path (default: ~/.ssh/remote-tunnel/cm-<hash>.sock)")
+	flag.Var(&config.LocalForwards, "L", "Forward [bind:]port:host:hostport to host:hostport as seen from the SSH server (can be repeated)")
+	flag.Var(&config.RemoteForwards, "R", "Forward [bind:]port on the SSH server to host:hostport on this machine (can be repeated)")
+	flag.Var(&config.DynamicForwards, "D", "Run a SOCKS5 proxy on [bind:]port that connects from the SSH server (can be repeated)")
+	flag.BoolVar(&config.NoShell, "N", false, "Only forward ports; do not start a shell")
 	
 	flag.Parse()
 
@@ -100,6 +200,21 @@ func validateConfig(config *SSHPTYConfig) {
 		showUsage()
 		os.Exit(1)
 	}
+
+	forwards, err := parseForwards(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Forwards = forwards
+	if config.NoShell && len(forwards) == 0 {
+		log.Fatal("-N needs at least one -L, -R or -D forward")
+	}
+
+	switch config.ControlMaster {
+	case ssh.ControlNo, ssh.ControlAuto, ssh.ControlYes:
+	default:
+		log.Fatalf("Invalid -control-master %q: use no, auto or yes", config.ControlMaster)
+	}
 }
 
 func showUsage() {
@@ -114,11 +229,29 @@ func showUsage() {
 	fmt.Println("  -key          Path to SSH private key file")
 	fmt.Println("  -log          Enable command logging (default: true)")
 	fmt.Println("  -log-dir      Log directory (default: pty-logs)")
+	fmt.Println("  -record       Record an asciicast session in the log directory (default: true)")
+	fmt.Println("  -record-input Also record keystrokes")
+	fmt.Println("  -target       SSH server address on the agent side (default: 127.0.0.1:22)")
+	fmt.Println("  -known-hosts  known_hosts files (default: ~/.ssh/known_hosts)")
+	fmt.Println("  -host-key-check  yes, ask, accept-new or no (default: ask)")
+	fmt.Println("  -cert         SSH certificate (default: <key>-cert.pub)")
+	fmt.Println("  -ssh-agent    Use keys from ssh-agent (default: true if SSH_AUTH_SOCK is set)")
+	fmt.Println("  -forward-agent  Forward ssh-agent to the server")
+	fmt.Println("  -auth         Allowed methods, e.g. publickey (default: all)")
+	fmt.Println("  -control-master  Share one connection between runs: no, auto or yes (default: no)")
+	fmt.Println("  -control-path    Control socket (default: ~/.ssh/remote-tunnel/cm-<hash>.sock)")
+	fmt.Println("\nPort Forwarding (over the SSH connection):")
+	fmt.Println("  -L [bind:]port:host:hostport  Local port to host:hostport seen from the SSH server")
+	fmt.Println("  -R [bind:]port:host:hostport  Port on the SSH server to host:hostport seen from here")
+	fmt.Println("  -D [bind:]port                SOCKS5 proxy connecting from the SSH server")
+	fmt.Println("  -N            Only forward ports, no shell")
 	fmt.Println("\nTunnel Options:")
 	fmt.Println("  -insecure     Skip TLS verification")
 	fmt.Println("  -compress     Enable compression")
 	fmt.Println("\nExample:")
 	fmt.Println("  ssh-pty -relay-url wss://relay.example.com/ws/client -agent my-agent -token secret123 -user admin")
+	fmt.Println("  ssh-pty -relay-url wss://relay.example.com/ws/client -agent my-agent -token secret123 -user admin -control-master auto")
+	fmt.Println("  ssh-pty replay -speed 2 pty-logs/pty-session_2024-01-01_12-00-00.cast")
 	fmt.Println("\nLinux Commands:")
 	fmt.Println("  After connection, you can run any Linux command:")
 	fmt.Println("  $ ls -la")
@@ -134,6 +267,9 @@ func logConfig(config *SSHPTYConfig) {
 	log.Printf("SSH User: %s", config.Username)
 	if config.LogEnabled {
 		log.Printf("Command logging: enabled (directory: %s)", config.LogDir)
+		if config.Record {
+			log.Printf("Session recording: enabled")
+		}
 	} else {
 		log.Printf("Command logging: disabled")
 	}
@@ -141,7 +277,7 @@ func logConfig(config *SSHPTYConfig) {
 
 func establishTunnel(config *SSHPTYConfig) (net.Conn, error) {
 	// Create tunnel client with correct parameters
-	client := tunnel.NewClient("127.0.0.1:0", config.RelayURL, config.AgentID, "127.0.0.1:22", config.Token)
+	client := tunnel.NewClient("127.0.0.1:0", config.RelayURL, config.AgentID, config.Target, config.Token)
 	if config.Insecure {
 		client.SetInsecure(true)
 	}
@@ -156,30 +292,65 @@ func establishTunnel(config *SSHPTYConfig) (net.Conn, error) {
 func createPTYConfig(config *SSHPTYConfig, tunnelConn net.Conn) *ssh.PTYConfig {
 	sshUsername := getSSHUsername(config.Username)
 	sshPassword := config.Password
-	var privateKeyData string
+	var privateKeyData, certificateData string
 
-	// Read private key if provided
+	// Read private key if provided; passwords and passphrases are prompted
+	// for during authentication when needed
 	if config.PrivateKey != "" {
 		keyData, err := os.ReadFile(config.PrivateKey)
 		if err != nil {
 			log.Fatalf("Failed to read private key: %v", err)
 		}
 		privateKeyData = string(keyData)
-	} else if sshPassword == "" {
-		// Prompt for password if no key provided
-		sshPassword = getSSHPassword()
+		certificateData = readCertificate(config.Certificate, config.PrivateKey)
+	}
+
+	var authMethods []string
+	if config.AuthMethods != "" {
+		authMethods = strings.Split(config.AuthMethods, ",")
+	}
+
+	knownHosts, err := ssh.NewKnownHosts(config.HostKeyCheck, strings.Split(config.KnownHosts, ",")...)
+	if err != nil {
+		log.Fatalf("Failed to load known hosts: %v", err)
 	}
 
 	return &ssh.PTYConfig{
-		Username:     sshUsername,
-		Password:     sshPassword,
-		PrivateKey:   privateKeyData,
-		TunnelConn:   tunnelConn,
-		LogEnabled:   config.LogEnabled,
-		LogDirectory: config.LogDir,
+		Username:       sshUsername,
+		Password:       sshPassword,
+		PrivateKey:     privateKeyData,
+		TunnelConn:     tunnelConn,
+		LogEnabled:     config.LogEnabled,
+		LogDirectory:   config.LogDir,
+		KnownHosts:     knownHosts,
+		HostKeyAddress: ssh.HostKeyAddress(config.AgentID, config.Target),
+		Certificate:    certificateData,
+		UseAgent:       config.UseAgent,
+		ForwardAgent:   config.ForwardAgent,
+		AuthMethods:    authMethods,
+		Record:         config.Record,
+		RecordInput:    config.RecordInput,
 	}
 }
 
+// readCertificate loads the certificate for a private key, falling back to
+// the OpenSSH <key>-cert.pub naming when no path is given
+func readCertificate(path, keyPath string) string {
+	if path == "" {
+		data, err := os.ReadFile(keyPath + "-cert.pub")
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read certificate: %v", err)
+	}
+	return string(data)
+}
+
 func getSSHUsername(username string) string {
 	if username == "" {
 		fmt.Print("SSH Username: ")
@@ -190,15 +361,6 @@ func getSSHUsername(username string) string {
 	return username
 }
 
-func getSSHPassword() string {
-	fmt.Print("SSH Password: ")
-	passwordBytes, err := readPassword()
-	if err != nil {
-		log.Fatalf("Failed to read password: %v", err)
-	}
-	return string(passwordBytes)
-}
-
 func handleShutdown(sigCh chan os.Signal, ptyClient *ssh.PTYClient) {
 	<-sigCh
 	log.Printf("\nShutting down SSH PTY client...")
@@ -206,12 +368,38 @@ func handleShutdown(sigCh chan os.Signal, ptyClient *ssh.PTYClient) {
 	os.Exit(0)
 }
 
-func readPassword() ([]byte, error) {
-	// Simple password reading - in production use golang.org/x/term.ReadPassword
-	reader := bufio.NewReader(os.Stdin)
-	password, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// parseForwards parses the -L, -R and -D flags
+func parseForwards(config *SSHPTYConfig) ([]ssh.Forward, error) {
+	var forwards []ssh.Forward
+	for _, flags := range []struct {
+		kind  string
+		specs arrayFlags
+	}{
+		{ssh.ForwardLocal, config.LocalForwards},
+		{ssh.ForwardRemote, config.RemoteForwards},
+		{ssh.ForwardDynamic, config.DynamicForwards},
+	} {
+		for _, spec := range flags.specs {
+			fwd, err := ssh.ParseForward(flags.kind, spec)
+			if err != nil {
+				return nil, err
+			}
+			forwards = append(forwards, fwd)
+		}
+	}
+	return forwards, nil
+}
+
+// startForwards serves the forwards on the SSH connection
+func startForwards(client *ssh.PTYClient, forwards []ssh.Forward) error {
+	for _, fwd := range forwards {
+		addr, err := client.StartForward(fwd)
+		if err != nil {
+			return err
+		}
+		if fwd.Kind == ssh.ForwardRemote {
+			log.Printf("Remote forward listening on %s", addr)
+		}
 	}
-	return []byte(strings.TrimSpace(password)), nil
+	return nil
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"remote-tunnel/internal/ssh"
+)
+
+const replayUsage = `Usage:
+  ssh-pty replay [-speed 2] [-idle 2s] FILE.cast
+
+Plays back a session recorded with -record (asciicast v2, also playable with asciinema).
+`
+
+// runReplayCommand plays a session recording in the terminal
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		speed = fs.Float64("speed", 1, "Playback speed multiplier")
+		idle  = fs.Duration("idle", 2*time.Second, "Shorten pauses longer than this (0 = keep original timing)")
+	)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, replayUsage) }
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, replayUsage)
+		return fmt.Errorf("missing recording file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ssh.Replay(f, os.Stdout, *speed, *idle)
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleAgent  Role = "agent"
+	RoleClient Role = "client"
+)
+
+// Kind records how an identity was authenticated
+type Kind string
+
+const (
+	KindSharedToken Kind = "shared-token"
+	KindCredential  Kind = "credential"
+	KindCertificate Kind = "certificate"
+	KindPeer        Kind = "peer"
+)
+
+// AnyAgent in a credential's agent list matches every agent ID
+const AnyAgent = "*"
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpired      = errors.New("token expired")
+	ErrRevoked      = errors.New("token revoked")
+	ErrWrongRole    = errors.New("token not valid for this endpoint")
+)
+
+// Credential is one identity in the store. Only the SHA-256 of the token
+// secret is kept; the token itself is shown once when it is issued.
+type Credential struct {
+	ID        string     `json:"id"`
+	Role      Role       `json:"role"`
+	Agents    []string   `json:"agents"` // agent IDs an agent may register as, or a client may reach
+	SecretSHA string     `json:"secret_sha256"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Identity is an authenticated credential
+type Identity struct {
+	ID     string
+	Kind   Kind
+	Role   Role
+	Agents []string
+}
+
+// AllowsAgent reports whether the identity may register as, or connect to, agentID
+func (i *Identity) AllowsAgent(agentID string) bool {
+	for _, allowed := range i.Agents {
+		if allowed == AnyAgent || allowed == agentID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credential) check(now time.Time) error {
+	if c.RevokedAt != nil {
+		return ErrRevoked
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return ErrExpired
+	}
+	return nil
+}
+
+type storeFile struct {
+	Credentials []*Credential `json:"credentials"`
+}
+
+// Store is a file-backed credentials store. Tokens have the form
+// "<credential id>.<secret>".
+type Store struct {
+	filename string
+	mu       sync.RWMutex
+	creds    map[string]*Credential
+	modTime  time.Time
+	size     int64
+}
+
+// OpenStore loads the store from filename; a missing file is an empty store
+func OpenStore(filename string) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		creds:    make(map[string]*Credential),
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload re-reads the store file. The current credentials are kept on error.
+func (s *Store) Reload() error {
+	info, err := os.Stat(s.filename)
+	if os.IsNotExist(err) {
+		s.mu.Lock()
+		s.creds = make(map[string]*Credential)
+		s.modTime, s.size = time.Time{}, 0
+		s.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat credentials: %w", err)
+	}
+
+	data, err := os.ReadFile(s.filename)
+	if err != nil {
+		return fmt.Errorf("read credentials: %w", err)
+	}
+
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse credentials: %w", err)
+	}
+
+	creds := make(map[string]*Credential, len(file.Credentials))
+	for _, cred := range file.Credentials {
+		if cred.ID == "" {
+			return fmt.Errorf("parse credentials: credential without id")
+		}
+		if cred.Role != RoleAgent && cred.Role != RoleClient {
+			return fmt.Errorf("credential %s: invalid role %q", cred.ID, cred.Role)
+		}
+		creds[cred.ID] = cred
+	}
+
+	s.mu.Lock()
+	s.creds = creds
+	s.modTime, s.size = info.ModTime(), info.Size()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Changed reports whether the store file differs from the last load
+func (s *Store) Changed() bool {
+	info, err := os.Stat(s.filename)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err != nil {
+		return !s.modTime.IsZero()
+	}
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Authenticate checks token for an endpoint that accepts role
+func (s *Store) Authenticate(token string, role Role) (*Identity, error) {
+	id, secret, ok := splitToken(token)
+
+	s.mu.RLock()
+	cred, exists := s.creds[id]
+	s.mu.RUnlock()
+
+	// Compare against a dummy hash for unknown IDs so both paths cost the same
+	want := make([]byte, sha256.Size)
+	if exists {
+		if decoded, err := hex.DecodeString(cred.SecretSHA); err == nil && len(decoded) == sha256.Size {
+			want = decoded
+		}
+	}
+	got := sha256.Sum256([]byte(secret))
+
+	if subtle.ConstantTimeCompare(got[:], want) != 1 || !ok || !exists {
+		return nil, ErrInvalidToken
+	}
+
+	if err := cred.check(time.Now()); err != nil {
+		return nil, err
+	}
+	if cred.Role != role {
+		return nil, ErrWrongRole
+	}
+
+	return &Identity{
+		ID:     cred.ID,
+		Kind:   KindCredential,
+		Role:   cred.Role,
+		Agents: append([]string(nil), cred.Agents...),
+	}, nil
+}
+
+// Check reports whether the credential id is still usable, so sessions can
+// be closed once their token expires or is revoked
+func (s *Store) Check(id string) error {
+	s.mu.RLock()
+	cred, exists := s.creds[id]
+	s.mu.RUnlock()
+
+	if !exists {
+		return ErrRevoked
+	}
+	return cred.check(time.Now())
+}
+
+// Issue creates a credential and returns its token. An existing credential
+// with the same id is replaced, which rotates its token. A ttl of zero
+// never expires.
+func (s *Store) Issue(id string, role Role, agents []string, ttl time.Duration) (string, error) {
+	if id == "" || strings.ContainsAny(id, ". \t") {
+		return "", fmt.Errorf("invalid credential id %q", id)
+	}
+	if role != RoleAgent && role != RoleClient {
+		return "", fmt.Errorf("invalid role %q", role)
+	}
+	if len(agents) == 0 {
+		return "", fmt.Errorf("credential %s needs at least one agent ID", id)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(secret))
+
+	now := time.Now().UTC()
+	cred := &Credential{
+		ID:        id,
+		Role:      role,
+		Agents:    agents,
+		SecretSHA: hex.EncodeToString(sum[:]),
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		cred.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	s.creds[id] = cred
+	s.mu.Unlock()
+
+	if err := s.save(); err != nil {
+		return "", err
+	}
+
+	return id + "." + secret, nil
+}
+
+// Revoke marks the credential id as revoked
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	cred, exists := s.creds[id]
+	if exists && cred.RevokedAt == nil {
+		now := time.Now().UTC()
+		cred.RevokedAt = &now
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("credential %s not found", id)
+	}
+
+	return s.save()
+}
+
+// List returns all credentials sorted by id
+func (s *Store) List() []Credential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Credential, 0, len(s.creds))
+	for _, cred := range s.creds {
+		list = append(list, *cred)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// save writes the store atomically so a running relay never reads a
+// partially written file
+func (s *Store) save() error {
+	creds := s.List()
+
+	file := storeFile{Credentials: make([]*Credential, len(creds))}
+	for i := range creds {
+		file.Credentials[i] = &creds[i]
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode credentials: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.filename), ".credentials-*")
+	if err != nil {
+		return fmt.Errorf("write credentials: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write credentials: %w", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write credentials: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write credentials: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.filename); err != nil {
+		return fmt.Errorf("write credentials: %w", err)
+	}
+
+	return nil
+}
+
+func splitToken(token string) (id, secret string, ok bool) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 || i == len(token)-1 {
+		return "", token, false
+	}
+	return token[:i], token[i+1:], true
+}
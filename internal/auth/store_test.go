@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssueAuthenticateRevoke(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials.json")
+
+	store, err := OpenStore(filename)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+
+	token, err := store.Issue("site-a", RoleAgent, []string{"site-a"}, 0)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	identity, err := store.Authenticate(token, RoleAgent)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if identity.ID != "site-a" || !identity.AllowsAgent("site-a") || identity.AllowsAgent("site-b") {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	if _, err := store.Authenticate(token, RoleClient); err != ErrWrongRole {
+		t.Errorf("expected ErrWrongRole, got %v", err)
+	}
+	if _, err := store.Authenticate(token+"x", RoleAgent); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	if _, err := store.Authenticate("unknown.secret", RoleAgent); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for unknown id, got %v", err)
+	}
+
+	// A second store sees the revocation after reloading the file
+	other, err := OpenStore(filename)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+
+	if err := store.Revoke("site-a"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+
+	if !other.Changed() {
+		t.Fatalf("expected store file change to be detected")
+	}
+	if err := other.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, err := other.Authenticate(token, RoleAgent); err != ErrRevoked {
+		t.Errorf("expected ErrRevoked, got %v", err)
+	}
+	if err := other.Check("site-a"); err != ErrRevoked {
+		t.Errorf("expected Check to report ErrRevoked, got %v", err)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "credentials.json"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+
+	token, err := store.Issue("laptop", RoleClient, []string{AnyAgent}, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if _, err := store.Authenticate(token, RoleClient); err != ErrExpired {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestRotateReplacesToken(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "credentials.json"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+
+	oldToken, _ := store.Issue("laptop", RoleClient, []string{"site-a"}, 0)
+	newToken, err := store.Issue("laptop", RoleClient, []string{"site-a"}, 0)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	if _, err := store.Authenticate(oldToken, RoleClient); err != ErrInvalidToken {
+		t.Errorf("expected old token to be rejected, got %v", err)
+	}
+	if _, err := store.Authenticate(newToken, RoleClient); err != nil {
+		t.Errorf("expected new token to be accepted, got %v", err)
+	}
+}
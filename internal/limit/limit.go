@@ -0,0 +1,164 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst lets a full io.Copy buffer through a slow bucket in one piece
+const minBurst = 32 * 1024
+
+// Bucket is a token bucket holding up to burst bytes, refilled at rate bytes
+// per second. Takers may run the bucket into debt; later takers wait until
+// the debt is paid, so a busy stream cannot starve the others sharing it.
+// A nil Bucket is unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a bucket refilled at rate bytes per second, or nil
+// (unlimited) when rate is not positive. It starts full and holds one
+// second of traffic, or 32 KiB if that is more.
+func NewBucket(rate int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := float64(rate)
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// reserve takes n tokens and returns how long the taker must wait for them
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Full reports whether the bucket has refilled to its burst, so replacing
+// it with a new bucket would not grant any extra traffic
+func (b *Bucket) Full() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+b.now().Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Wait takes n tokens, blocking until they are available or ctx is done
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	delay := b.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Conn returns conn with the bytes read from it taken from every bucket in
+// read and the bytes written to it taken from every bucket in write
+func Conn(ctx context.Context, conn net.Conn, read, write []*Bucket) net.Conn {
+	return &limitedConn{Conn: conn, ctx: ctx, read: read, write: write}
+}
+
+type limitedConn struct {
+	net.Conn
+	ctx         context.Context
+	read, write []*Bucket
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, b := range c.read {
+		if werr := b.Wait(c.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	for _, b := range c.write {
+		if err := b.Wait(c.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// ParseRate parses a bandwidth in bytes per second such as "512K", "10MB",
+// "1G/s" or "65536". Units are powers of 1024; "0" or "" means unlimited.
+func ParseRate(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "/S")
+	v = strings.TrimSuffix(v, "B")
+	if v == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch v[len(v)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
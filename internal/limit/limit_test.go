@@ -0,0 +1,120 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBucket(64 * 1024)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// The burst passes immediately
+	if delay := b.reserve(64 * 1024); delay != 0 {
+		t.Errorf("burst delayed by %v", delay)
+	}
+
+	// The next half second of traffic waits half a second
+	if delay := b.reserve(32 * 1024); delay != 500*time.Millisecond {
+		t.Errorf("expected 500ms delay, got %v", delay)
+	}
+
+	// Debt is paid before later takers get tokens
+	now = now.Add(500 * time.Millisecond)
+	if delay := b.reserve(16 * 1024); delay != 250*time.Millisecond {
+		t.Errorf("expected 250ms delay, got %v", delay)
+	}
+
+	// Idle time refills up to the burst only
+	now = now.Add(time.Hour)
+	if delay := b.reserve(64 * 1024); delay != 0 {
+		t.Errorf("refilled bucket delayed by %v", delay)
+	}
+	if delay := b.reserve(1024); delay == 0 {
+		t.Error("bucket refilled beyond its burst")
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBucket(64 * 1024)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	if !b.Full() {
+		t.Error("new bucket not full")
+	}
+
+	b.reserve(96 * 1024)
+	now = now.Add(time.Second)
+	if b.Full() {
+		t.Error("bucket in debt reported full")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !b.Full() {
+		t.Error("refilled bucket not full")
+	}
+
+	var unlimited *Bucket
+	if !unlimited.Full() {
+		t.Error("nil bucket not full")
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	var b *Bucket
+	if NewBucket(0) != nil {
+		t.Error("expected nil bucket for zero rate")
+	}
+	if err := b.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil bucket wait failed: %v", err)
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	b := NewBucket(1024)
+	b.Wait(context.Background(), minBurst)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := b.Wait(ctx, 1024*1024); err == nil {
+		t.Error("expected wait to be cancelled")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"65536", 65536},
+		{"512K", 512 * 1024},
+		{"10MB", 10 * 1024 * 1024},
+		{"1.5M/s", 1536 * 1024},
+		{"1g", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.input)
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"fast", "-1M", "10X"} {
+		if _, err := ParseRate(input); err == nil {
+			t.Errorf("ParseRate(%q) should fail", input)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DurationBuckets are histogram buckets in seconds suited to dial latencies
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metrics and serves them in the Prometheus text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// WriteText writes every metric in registration order
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.value.Add(1) }
+func (c *Counter) Add(n uint64)  { c.value.Add(n) }
+func (c *Counter) Value() uint64 { return c.value.Load() }
+
+type counter struct {
+	name, help string
+	*Counter
+}
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// NewCounter registers a counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &counter{name: name, help: help, Counter: &Counter{}}
+	r.add(c)
+	return c.Counter
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu       sync.RWMutex
+	counters map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	values []string
+	*Counter
+}
+
+// NewCounterVec registers a counter with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: make(map[string]*labeledCounter),
+	}
+	r.add(v)
+	return v
+}
+
+// With returns the counter for the label values, given in label order
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, exists := v.counters[key]
+	v.mu.RUnlock()
+	if exists {
+		return c.Counter
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, exists = v.counters[key]; !exists {
+		c = &labeledCounter{values: append([]string(nil), values...), Counter: &Counter{}}
+		v.counters[key] = c
+	}
+	return c.Counter
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, v.name, v.help, "counter")
+	for _, key := range keys {
+		c := v.counters[key]
+		fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, c.values), c.Value())
+	}
+	v.mu.RUnlock()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Set(n int64)  { g.value.Store(n) }
+func (g *Gauge) Add(n int64)  { g.value.Add(n) }
+func (g *Gauge) Inc()         { g.value.Add(1) }
+func (g *Gauge) Dec()         { g.value.Add(-1) }
+func (g *Gauge) Value() int64 { return g.value.Load() }
+
+type gauge struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// NewGauge registers a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.add(&gauge{name: name, help: help, value: func() float64 { return float64(g.Value()) }})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is computed on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.add(&gauge{name: name, help: help, value: value})
+}
+
+// Histogram counts observations in cumulative buckets. Buckets, sum and
+// count change under one lock, so a scrape never sees a bucket ahead of
+// the total.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	r.add(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+// CountConn returns conn with the bytes read from it added to read and the
+// bytes written to it added to written
+func CountConn(conn net.Conn, read, written *Counter) net.Conn {
+	return &countingConn{Conn: conn, read: read, written: written}
+}
+
+type countingConn struct {
+	net.Conn
+	read, written *Counter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
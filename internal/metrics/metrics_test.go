@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	dials := r.NewCounter("dials_total", "Dials.")
+	dials.Add(3)
+
+	failures := r.NewCounterVec("dial_failures_total", "Failed dials.", "reason")
+	failures.With("timeout").Inc()
+	failures.With("agent_not_found").Add(2)
+	failures.With("timeout").Inc()
+
+	streams := r.NewGauge("streams", "Open streams.")
+	streams.Inc()
+	streams.Inc()
+	streams.Dec()
+
+	r.NewGaugeFunc("agents", "Agents.", func() float64 { return 4 })
+
+	latency := r.NewHistogram("dial_seconds", "Dial latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(2)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	want := `# HELP dials_total Dials.
+# TYPE dials_total counter
+dials_total 3
+# HELP dial_failures_total Failed dials.
+# TYPE dial_failures_total counter
+dial_failures_total{reason="agent_not_found"} 2
+dial_failures_total{reason="timeout"} 2
+# HELP streams Open streams.
+# TYPE streams gauge
+streams 1
+# HELP agents Agents.
+# TYPE agents gauge
+agents 4
+# HELP dial_seconds Dial latency.
+# TYPE dial_seconds histogram
+dial_seconds_bucket{le="0.1"} 2
+dial_seconds_bucket{le="1"} 3
+dial_seconds_bucket{le="+Inf"} 4
+dial_seconds_sum 2.65
+dial_seconds_count 4
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("bytes_total", "Bytes.", "agent", "direction").With("a\"b\\c\n", "in").Inc()
+
+	var b strings.Builder
+	r.WriteText(&b)
+
+	if !strings.Contains(b.String(), `bytes_total{agent="a\"b\\c\n",direction="in"} 1`) {
+		t.Errorf("labels not escaped:\n%s", b.String())
+	}
+}
+
+func TestCountConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	var read, written Counter
+	conn := CountConn(c1, &read, &written)
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 5)
+		c2.Read(buf)
+		c2.Write([]byte("hi"))
+	}()
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 2)
+	conn.Read(buf)
+
+	if written.Value() != 5 || read.Value() != 2 {
+		t.Errorf("expected 5 written and 2 read, got %d and %d", written.Value(), read.Value())
+	}
+}
+
+func TestHistogramScrapeDuringObserve(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			h.Observe(float64(i%3) * 0.5)
+		}
+	}()
+
+	for scraping := true; scraping; {
+		select {
+		case <-done:
+			scraping = false
+		default:
+		}
+
+		var b strings.Builder
+		h.write(&b)
+		var buckets []uint64
+		var count uint64
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			var value uint64
+			if strings.HasPrefix(line, "latency_seconds_bucket") {
+				fmt.Sscanf(line[strings.LastIndex(line, " ")+1:], "%d", &value)
+				buckets = append(buckets, value)
+			} else if strings.HasPrefix(line, "latency_seconds_count") {
+				fmt.Sscanf(line, "latency_seconds_count %d", &count)
+			}
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] < buckets[i-1] {
+				t.Fatalf("buckets not cumulative: %v", buckets)
+			}
+		}
+		if buckets[len(buckets)-1] != count {
+			t.Fatalf("+Inf bucket %d, count %d", buckets[len(buckets)-1], count)
+		}
+	}
+}
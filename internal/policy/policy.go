@@ -0,0 +1,370 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+const resolveTimeout = 5 * time.Second
+
+// Rule matches targets by hostname glob, CIDR and port range. Every
+// non-empty criterion must match for the rule to apply.
+type Rule struct {
+	Name   string   `json:"name"`
+	Action Action   `json:"action"`
+	Hosts  []string `json:"hosts,omitempty"` // hostname globs, e.g. "*.db.internal"
+	CIDRs  []string `json:"cidrs,omitempty"` // e.g. "10.0.0.0/24"
+	Ports  []string `json:"ports,omitempty"` // e.g. "22", "8000-8100", "*"
+
+	nets  []*net.IPNet
+	ports []portRange
+}
+
+type portRange struct {
+	low, high int
+}
+
+// Policy is the agent's allow-list. Deny rules are checked first, then
+// allow rules in order; Default applies when nothing matches.
+type Policy struct {
+	Default Action `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Decision is the outcome of evaluating a target against the policy
+type Decision struct {
+	Allowed bool
+	Rule    string
+	Reason  string
+	// DialAddr is the resolved ip:port the agent should connect to, so a
+	// second DNS lookup cannot return an address the policy never saw
+	DialAddr string
+}
+
+// ParsePolicy parses and validates a JSON policy document
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse policy: %w", err)
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// LoadFile reads a JSON policy file
+func LoadFile(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+
+	return ParsePolicy(data)
+}
+
+// FromAllowList builds a policy from "-allow" style entries such as
+// "127.0.0.1:22", "10.0.0.0/24:5432", "db.internal:" or "10.0.0.5:8000-8100".
+// Entries match the exact host or network, never a string prefix.
+func FromAllowList(entries []string) (*Policy, error) {
+	p := &Policy{Default: ActionDeny}
+
+	for _, entry := range entries {
+		host, port := entry, ""
+		if h, pt, err := net.SplitHostPort(entry); err == nil {
+			host, port = h, pt
+		}
+
+		rule := Rule{
+			Name:   "allow " + entry,
+			Action: ActionAllow,
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			rule.CIDRs = []string{singleHostCIDR(ip)}
+		} else if _, _, err := net.ParseCIDR(host); err == nil {
+			rule.CIDRs = []string{host}
+		} else if host != "" {
+			rule.Hosts = []string{host}
+		}
+
+		if port != "" && port != "*" {
+			rule.Ports = []string{port}
+		}
+
+		p.Rules = append(p.Rules, rule)
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func singleHostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+func (p *Policy) compile() error {
+	switch p.Default {
+	case "":
+		p.Default = ActionDeny
+	case ActionAllow, ActionDeny:
+	default:
+		return fmt.Errorf("invalid default action %q", p.Default)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return fmt.Errorf("rule %s: invalid action %q", rule.Name, rule.Action)
+		}
+
+		rule.nets = nil
+		for _, cidr := range rule.CIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.nets = append(rule.nets, ipNet)
+		}
+
+		for j, host := range rule.Hosts {
+			host = strings.ToLower(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid host pattern %q", rule.Name, host)
+			}
+			rule.Hosts[j] = host
+		}
+
+		rule.ports = nil
+		for _, spec := range rule.Ports {
+			pr, err := parsePortRange(spec)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.ports = append(rule.ports, pr)
+		}
+	}
+
+	return nil
+}
+
+func parsePortRange(spec string) (portRange, error) {
+	if spec == "*" {
+		return portRange{1, 65535}, nil
+	}
+
+	lowStr, highStr, isRange := strings.Cut(spec, "-")
+	low, err := strconv.Atoi(lowStr)
+	if err != nil || low < 1 || low > 65535 {
+		return portRange{}, fmt.Errorf("invalid port %q", spec)
+	}
+
+	high := low
+	if isRange {
+		high, err = strconv.Atoi(highStr)
+		if err != nil || high < low || high > 65535 {
+			return portRange{}, fmt.Errorf("invalid port range %q", spec)
+		}
+	}
+
+	return portRange{low, high}, nil
+}
+
+// matches reports whether the rule applies. For deny rules a single
+// resolved address inside the CIDRs is enough; allow rules need all of them.
+func (r *Rule) matches(host string, ips []net.IP, port int) bool {
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, pr := range r.ports {
+			if port >= pr.low && port <= pr.high {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		hostMatch := false
+		for _, pattern := range r.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				hostMatch = true
+				break
+			}
+		}
+		if !hostMatch {
+			return false
+		}
+	}
+
+	if len(r.nets) > 0 {
+		inside := 0
+		for _, ip := range ips {
+			for _, ipNet := range r.nets {
+				if ipNet.Contains(ip) {
+					inside++
+					break
+				}
+			}
+		}
+
+		if r.Action == ActionDeny {
+			return inside > 0
+		}
+		return len(ips) > 0 && inside == len(ips)
+	}
+
+	return true
+}
+
+// Engine evaluates targets against a policy that can be swapped at runtime
+type Engine struct {
+	filename string
+	mu       sync.RWMutex
+	policy   *Policy
+
+	// lookup resolves hostnames; replaced in tests
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+func NewEngine(p *Policy) *Engine {
+	return &Engine{
+		policy: p,
+		lookup: defaultLookup,
+	}
+}
+
+// NewFileEngine loads a policy file; Reload re-reads the same file
+func NewFileEngine(filename string) (*Engine, error) {
+	p, err := LoadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	e := NewEngine(p)
+	e.filename = filename
+	return e, nil
+}
+
+func defaultLookup(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// Reload re-reads the policy file. The current policy is kept on error.
+func (e *Engine) Reload() error {
+	if e.filename == "" {
+		return fmt.Errorf("policy was not loaded from a file")
+	}
+
+	p, err := LoadFile(e.filename)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.policy = p
+	e.mu.Unlock()
+
+	return nil
+}
+
+// RuleCount returns the number of rules in the active policy
+func (e *Engine) RuleCount() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.policy.Rules)
+}
+
+// Evaluate resolves targetAddr and decides whether it may be dialed or
+// listened on. An empty host, as in ":8080", stands for the unspecified
+// IPv4 and IPv6 addresses.
+func (e *Engine) Evaluate(ctx context.Context, targetAddr string) Decision {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return Decision{Reason: fmt.Sprintf("invalid target address: %v", err)}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return Decision{Reason: fmt.Sprintf("invalid port %q", portStr)}
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	if host == "" {
+		ips = []net.IP{net.IPv4zero, net.IPv6unspecified}
+	} else if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		ips, err = e.lookup(lookupCtx, host)
+		cancel()
+		if err != nil || len(ips) == 0 {
+			return Decision{Reason: fmt.Sprintf("resolve %s: %v", host, err)}
+		}
+	}
+
+	e.mu.RLock()
+	p := e.policy
+	e.mu.RUnlock()
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Action == ActionDeny && rule.matches(host, ips, port) {
+			return Decision{Rule: rule.Name, Reason: "denied by rule " + rule.Name}
+		}
+	}
+
+	dialAddr := net.JoinHostPort(ips[0].String(), portStr)
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Action == ActionAllow && rule.matches(host, ips, port) {
+			return Decision{Allowed: true, Rule: rule.Name, DialAddr: dialAddr}
+		}
+	}
+
+	if p.Default == ActionAllow {
+		return Decision{Allowed: true, Rule: "default", DialAddr: dialAddr}
+	}
+
+	return Decision{Rule: "default", Reason: "no rule allows " + targetAddr}
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func testEngine(t *testing.T, doc string) *Engine {
+	t.Helper()
+
+	p, err := ParsePolicy([]byte(doc))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+
+	e := NewEngine(p)
+	e.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "db.internal":
+			return []net.IP{net.ParseIP("10.0.0.20")}, nil
+		case "sneaky.example.com":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return e
+}
+
+func TestEvaluate(t *testing.T) {
+	e := testEngine(t, `{
+		"default": "deny",
+		"rules": [
+			{"name": "no-gateway", "action": "deny", "cidrs": ["10.0.0.1/32"]},
+			{"name": "lan-db", "action": "allow", "cidrs": ["10.0.0.0/24"], "ports": ["5432", "8000-8100"]},
+			{"name": "internal-ssh", "action": "allow", "hosts": ["*.internal"], "ports": ["22"]}
+		]
+	}`)
+
+	tests := []struct {
+		target  string
+		allowed bool
+		rule    string
+	}{
+		{"10.0.0.20:5432", true, "lan-db"},
+		{"10.0.0.20:8050", true, "lan-db"},
+		{"10.0.0.20:22", false, "default"},
+		{"10.0.0.1:5432", false, "no-gateway"},
+		{"sneaky.example.com:5432", false, "no-gateway"},
+		{"db.internal:22", true, "internal-ssh"},
+		{"db.internal:5432", true, "lan-db"},
+		{"10.0.0.100:3306", false, "default"},
+		{"unknown.host:22", false, ""},
+	}
+
+	for _, tt := range tests {
+		d := e.Evaluate(context.Background(), tt.target)
+		if d.Allowed != tt.allowed || d.Rule != tt.rule {
+			t.Errorf("Evaluate(%s) = allowed %v rule %q (%s), want allowed %v rule %q",
+				tt.target, d.Allowed, d.Rule, d.Reason, tt.allowed, tt.rule)
+		}
+	}
+
+	if d := e.Evaluate(context.Background(), "db.internal:22"); d.DialAddr != "10.0.0.20:22" {
+		t.Errorf("DialAddr = %s, want resolved 10.0.0.20:22", d.DialAddr)
+	}
+}
+
+func TestFromAllowListIsExact(t *testing.T) {
+	p, err := FromAllowList([]string{"10.0.0.1", "127.0.0.1:", "192.168.1.0/24:22"})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	e := NewEngine(p)
+
+	tests := map[string]bool{
+		"10.0.0.1:80":    true,
+		"10.0.0.100:80":  false,
+		"127.0.0.1:3306": true,
+		"192.168.1.7:22": true,
+		"192.168.1.7:23": false,
+	}
+
+	for target, want := range tests {
+		if got := e.Evaluate(context.Background(), target).Allowed; got != want {
+			t.Errorf("Evaluate(%s) allowed = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestParsePolicyRejectsBadRules(t *testing.T) {
+	bad := []string{
+		`{"rules": [{"action": "maybe"}]}`,
+		`{"rules": [{"action": "allow", "cidrs": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"action": "allow", "ports": ["9000-80"]}]}`,
+		`{"default": "sometimes"}`,
+	}
+
+	for _, doc := range bad {
+		if _, err := ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("Expected error for %s", doc)
+		}
+	}
+}
+
+func TestEvaluateEmptyHost(t *testing.T) {
+	p, err := FromAllowList([]string{":8080", "127.0.0.1:9000", "0.0.0.0:9100"})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	e := NewEngine(p)
+	e.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		t.Errorf("unexpected lookup of %q", host)
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	tests := map[string]bool{
+		":8080":          true,
+		"0.0.0.0:8080":   true,
+		"[::]:8080":      true,
+		":8081":          false,
+		":9000":          false, // every interface, not just loopback
+		"127.0.0.1:9000": true,
+		":9100":          false, // also listens on ::
+	}
+
+	for target, want := range tests {
+		if got := e.Evaluate(context.Background(), target).Allowed; got != want {
+			t.Errorf("Evaluate(%s) allowed = %v, want %v", target, got, want)
+		}
+	}
+
+	deny := testEngine(t, `{
+		"default": "allow",
+		"rules": [{"name": "no-wildcard", "action": "deny", "cidrs": ["0.0.0.0/32"]}]
+	}`)
+	if d := deny.Evaluate(context.Background(), ":8080"); d.Allowed || d.Rule != "no-wildcard" {
+		t.Errorf("Evaluate(:8080) = %+v, want denied by no-wildcard", d)
+	}
+}
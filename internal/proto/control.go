@@ -10,6 +10,30 @@ const (
 	MsgPing     MsgType = "PING"
 	MsgPong     MsgType = "PONG"
 	MsgError    MsgType = "ERROR"
+
+	// Reverse forwarding: the client asks an agent to listen, and the agent
+	// reports every connection it accepts on that listener as INBOUND.
+	MsgListen   MsgType = "LISTEN"
+	MsgUnlisten MsgType = "UNLISTEN"
+	MsgInbound  MsgType = "INBOUND"
+
+	// PENDING answers a LISTEN for an agent that is not connected: the relay
+	// keeps the listener and sends LISTEN once the agent registers.
+	MsgPending MsgType = "PENDING"
+
+	// GOING_AWAY is sent by a draining relay: no new DIALs are accepted, but
+	// open streams keep running, so peers should connect elsewhere now.
+	MsgGoingAway MsgType = "GOING_AWAY"
+
+	// HELLO negotiates the protocol version and capabilities. The accepting
+	// side sends it first; a peer that never answers speaks version 1.
+	MsgHello MsgType = "HELLO"
+)
+
+// Transport networks carried in DIAL; an empty Network means TCP.
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
 )
 
 type Control struct {
@@ -17,6 +41,19 @@ type Control struct {
 	AgentID    string  `json:"agent_id,omitempty"`
 	StreamID   string  `json:"stream_id,omitempty"`
 	TargetAddr string  `json:"target_addr,omitempty"`
+	Network    string  `json:"network,omitempty"`
+	ListenAddr string  `json:"listen_addr,omitempty"`
+	ListenerID string  `json:"listener_id,omitempty"`
 	Token      string  `json:"token,omitempty"`
 	Error      string  `json:"error,omitempty"`
+
+	// Compression carries the codecs offered in DIAL (comma separated,
+	// preferred first) and the single codec chosen in ACCEPT.
+	Compression string `json:"compression,omitempty"`
+
+	// HELLO carries the highest and lowest protocol versions spoken and the
+	// capabilities supported (comma separated).
+	Version      int    `json:"version,omitempty"`
+	MinVersion   int    `json:"min_version,omitempty"`
+	Capabilities string `json:"capabilities,omitempty"`
 }
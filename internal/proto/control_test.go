@@ -2,6 +2,7 @@ package proto
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -34,6 +35,23 @@ func TestControlMarshaling(t *testing.T) {
 				StreamID: "stream-123",
 			},
 		},
+		{
+			name: "Listen message",
+			ctrl: Control{
+				Type:       MsgListen,
+				AgentID:    "test-agent",
+				ListenerID: "listener-1",
+				ListenAddr: "0.0.0.0:8080",
+			},
+		},
+		{
+			name: "Inbound message",
+			ctrl: Control{
+				Type:       MsgInbound,
+				StreamID:   "stream-456",
+				ListenerID: "listener-1",
+			},
+		},
 		{
 			name: "Error message",
 			ctrl: Control{
@@ -41,6 +59,13 @@ func TestControlMarshaling(t *testing.T) {
 				Error: "Connection failed",
 			},
 		},
+		{
+			name: "Going away message",
+			ctrl: Control{
+				Type:  MsgGoingAway,
+				Error: "relay shutting down",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -71,6 +96,57 @@ func TestControlMarshaling(t *testing.T) {
 			if result.TargetAddr != tt.ctrl.TargetAddr {
 				t.Errorf("TargetAddr mismatch: got %s, want %s", result.TargetAddr, tt.ctrl.TargetAddr)
 			}
+			if result.ListenAddr != tt.ctrl.ListenAddr {
+				t.Errorf("ListenAddr mismatch: got %s, want %s", result.ListenAddr, tt.ctrl.ListenAddr)
+			}
+			if result.ListenerID != tt.ctrl.ListenerID {
+				t.Errorf("ListenerID mismatch: got %s, want %s", result.ListenerID, tt.ctrl.ListenerID)
+			}
 		})
 	}
 }
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    int
+		minVersion int
+		want       int
+		wantErr    bool
+	}{
+		{name: "same build", version: Version, minVersion: MinVersion, want: Version},
+		{name: "older peer", version: 1, minVersion: 1, want: 1},
+		{name: "newer peer", version: Version + 3, minVersion: 1, want: Version},
+		{name: "min version omitted", version: 1, want: 1},
+		{name: "peer too new", version: Version + 3, minVersion: Version + 1, wantErr: true},
+		{name: "no version", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateVersion(&Control{Type: MsgHello, Version: tt.version, MinVersion: tt.minVersion})
+			if tt.wantErr {
+				var versionErr *VersionError
+				if !errors.As(err, &versionErr) {
+					t.Errorf("expected VersionError, got %v", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps := ParseCapabilities(NewHello().Capabilities)
+	for _, c := range Capabilities {
+		if !caps[c] {
+			t.Errorf("capability %s missing", c)
+		}
+	}
+	if len(ParseCapabilities("")) != 0 {
+		t.Error("empty list should have no capabilities")
+	}
+}
@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Control protocol versions. Version 1 sends control messages as JSON
+// lines; version 2 sends them as length-prefixed frames after HELLO.
+const (
+	Version       = 2
+	MinVersion    = 1
+	VersionFramed = 2
+)
+
+// Capabilities announced in HELLO
+const (
+	CapCompression = "compression"
+	CapUDP         = "udp"
+	CapReverse     = "reverse"
+)
+
+// Capabilities lists what this build supports
+var Capabilities = []string{CapCompression, CapUDP, CapReverse}
+
+// VersionError reports a peer whose protocol versions do not overlap ours
+type VersionError struct {
+	PeerVersion    int
+	PeerMinVersion int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("incompatible control protocol: peer speaks versions %d-%d, this build %d-%d",
+		e.PeerMinVersion, e.PeerVersion, MinVersion, Version)
+}
+
+// NewHello returns the HELLO message this build sends
+func NewHello() *Control {
+	return &Control{
+		Type:         MsgHello,
+		Version:      Version,
+		MinVersion:   MinVersion,
+		Capabilities: strings.Join(Capabilities, ","),
+	}
+}
+
+// NegotiateVersion picks the highest version spoken by both sides of a
+// HELLO exchange
+func NegotiateVersion(hello *Control) (int, error) {
+	peerMin := hello.MinVersion
+	if peerMin == 0 {
+		peerMin = hello.Version
+	}
+
+	version := min(hello.Version, Version)
+	if version < max(peerMin, MinVersion) || version < 1 {
+		return 0, &VersionError{PeerVersion: hello.Version, PeerMinVersion: peerMin}
+	}
+	return version, nil
+}
+
+// ParseCapabilities splits the capabilities of a HELLO into a set
+func ParseCapabilities(list string) map[string]bool {
+	caps := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps[c] = true
+		}
+	}
+	return caps
+}
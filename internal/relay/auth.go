@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/transport"
+)
+
+// credentialCheckInterval is how often the credentials file is checked for
+// changes and live sessions are re-validated against it
+const credentialCheckInterval = 5 * time.Second
+
+// SetCredentials enables per-identity tokens. The store file is reloaded
+// when it changes, so tokens can be issued and revoked without a restart.
+// The shared token, if any, then only admits clients.
+func (s *Server) SetCredentials(store *auth.Store) {
+	s.credentials = store
+	go s.watchCredentials()
+}
+
+func (s *Server) watchCredentials() {
+	ticker := time.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.credentials.Changed() {
+				continue
+			}
+			if err := s.credentials.Reload(); err != nil {
+				log.Printf("Credentials reload failed, keeping previous set: %v", err)
+				continue
+			}
+			log.Printf("Credentials reloaded")
+		}
+	}
+}
+
+// authenticate identifies the peer of an agent or client endpoint. A
+// verified client certificate takes precedence over the token; the shared
+// token yields an identity that may use any agent, and with credentials
+// loaded it no longer registers agents, so a leaked copy cannot pose as one.
+func (s *Server) authenticate(r *http.Request, token string, role auth.Role) (*auth.Identity, error) {
+	if cert := transport.PeerCertificate(r); cert != nil {
+		return certificateIdentity(cert, role)
+	}
+
+	if token == "" {
+		return nil, auth.ErrInvalidToken
+	}
+
+	if role == auth.RoleClient && s.peerToken != "" && transport.TokenEqual(token, s.peerToken) {
+		return &auth.Identity{ID: "relay", Kind: auth.KindPeer, Role: role, Agents: []string{auth.AnyAgent}}, nil
+	}
+
+	if s.token != "" && transport.TokenEqual(token, s.token) {
+		if role == auth.RoleAgent && s.credentials != nil {
+			return nil, auth.ErrWrongRole
+		}
+		return &auth.Identity{Kind: auth.KindSharedToken, Role: role, Agents: []string{auth.AnyAgent}}, nil
+	}
+
+	if s.credentials == nil {
+		return nil, auth.ErrInvalidToken
+	}
+
+	return s.credentials.Authenticate(token, role)
+}
+
+// enforceCredential closes session once its credential expires or is
+// revoked. Shared-token and certificate sessions are not tracked.
+func (s *Server) enforceCredential(ctx context.Context, identity *auth.Identity, closer interface{ Close() error }) {
+	if identity.Kind != auth.KindCredential || s.credentials == nil {
+		return
+	}
+
+	ticker := time.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.credentials.Check(identity.ID); err != nil {
+				log.Printf("Closing %s session for %s: %v", identity.Role, identity.ID, err)
+				closer.Close()
+				return
+			}
+		}
+	}
+}
+
+// certificateIdentity maps a verified client certificate to an identity.
+// The organizational unit names the role ("agent" or "client"); an agent
+// may register under its CN or any DNS SAN, a client may reach any agent.
+func certificateIdentity(cert *x509.Certificate, role auth.Role) (*auth.Identity, error) {
+	certRole := auth.RoleClient
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if auth.Role(ou) == auth.RoleAgent {
+			certRole = auth.RoleAgent
+		}
+	}
+	if certRole != role {
+		return nil, auth.ErrWrongRole
+	}
+
+	names := transport.CertificateNames(cert)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("client certificate has no CN or DNS SAN")
+	}
+
+	identity := &auth.Identity{
+		ID:     names[0],
+		Kind:   auth.KindCertificate,
+		Role:   role,
+		Agents: names,
+	}
+	if role == auth.RoleClient {
+		identity.Agents = []string{auth.AnyAgent}
+	}
+
+	return identity, nil
+}
+
+func identityName(identity *auth.Identity) string {
+	if identity.Kind == auth.KindSharedToken {
+		return "shared token"
+	}
+	return fmt.Sprintf("%s %s", identity.Kind, identity.ID)
+}
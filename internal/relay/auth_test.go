@@ -0,0 +1,320 @@
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// testCA is an in-memory certificate authority for mTLS tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue signs a certificate; server certificates are valid for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, cn string, ou, dnsNames []string, server bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: ou},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeFiles stores cert, its key and the CA as PEM files for the
+// transport config loaders
+func (ca *testCA) writeFiles(t *testing.T, cert tls.Certificate) (certFile, keyFile, caFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: keyDER},
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: ca.cert.Raw},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+}
+
+func TestAuthenticateSharedToken(t *testing.T) {
+	s := NewServer("shared")
+	r := httptest.NewRequest("GET", "/agent", nil)
+
+	for _, role := range []auth.Role{auth.RoleAgent, auth.RoleClient} {
+		identity, err := s.authenticate(r, "shared", role)
+		if err != nil {
+			t.Fatalf("shared token refused for %s: %v", role, err)
+		}
+		if identity.Role != role || !identity.AllowsAgent("any-agent") {
+			t.Errorf("unexpected %s identity %+v", role, identity)
+		}
+	}
+	if _, err := s.authenticate(r, "wrong", auth.RoleClient); err != auth.ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestAuthenticateSharedTokenWithCredentials(t *testing.T) {
+	store, err := auth.OpenStore(filepath.Join(t.TempDir(), "credentials.json"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	token, err := store.Issue("site-a", auth.RoleAgent, []string{"site-a"}, 0)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	s := NewServer("shared")
+	s.credentials = store
+	r := httptest.NewRequest("GET", "/agent", nil)
+
+	// With credentials loaded the shared token only admits clients
+	if _, err := s.authenticate(r, "shared", auth.RoleAgent); err != auth.ErrWrongRole {
+		t.Errorf("shared token as agent: expected ErrWrongRole, got %v", err)
+	}
+	if _, err := s.authenticate(r, "shared", auth.RoleClient); err != nil {
+		t.Errorf("shared token as client refused: %v", err)
+	}
+
+	identity, err := s.authenticate(r, token, auth.RoleAgent)
+	if err != nil {
+		t.Fatalf("agent credential refused: %v", err)
+	}
+	if identity.ID != "site-a" || identity.AllowsAgent("site-b") {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	agent := ca.issue(t, "site-a", []string{"agent"}, []string{"site-a.example.com"}, false).Leaf
+	client := ca.issue(t, "alice", []string{"ops"}, nil, false).Leaf
+	nameless := ca.issue(t, "", []string{"agent"}, nil, false).Leaf
+
+	identity, err := certificateIdentity(agent, auth.RoleAgent)
+	if err != nil {
+		t.Fatalf("agent certificate refused: %v", err)
+	}
+	if identity.ID != "site-a" || identity.Kind != auth.KindCertificate {
+		t.Errorf("unexpected agent identity %+v", identity)
+	}
+	if !identity.AllowsAgent("site-a.example.com") || identity.AllowsAgent("site-b") {
+		t.Errorf("agent identity allows %v", identity.Agents)
+	}
+
+	identity, err = certificateIdentity(client, auth.RoleClient)
+	if err != nil {
+		t.Fatalf("client certificate refused: %v", err)
+	}
+	if identity.ID != "alice" || !identity.AllowsAgent("site-b") {
+		t.Errorf("unexpected client identity %+v", identity)
+	}
+
+	if _, err := certificateIdentity(agent, auth.RoleClient); err != auth.ErrWrongRole {
+		t.Errorf("agent certificate as client: expected ErrWrongRole, got %v", err)
+	}
+	if _, err := certificateIdentity(client, auth.RoleAgent); err != auth.ErrWrongRole {
+		t.Errorf("client certificate as agent: expected ErrWrongRole, got %v", err)
+	}
+	if _, err := certificateIdentity(nameless, auth.RoleAgent); err == nil {
+		t.Error("certificate without CN or SAN accepted")
+	}
+}
+
+func TestAuthenticateCertificateFirst(t *testing.T) {
+	ca := newTestCA(t)
+	agent := ca.issue(t, "site-a", []string{"agent"}, nil, false).Leaf
+	client := ca.issue(t, "alice", nil, nil, false).Leaf
+	s := NewServer("shared")
+
+	request := func(cert *x509.Certificate) *http.Request {
+		r := httptest.NewRequest("GET", "/agent", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+		return r
+	}
+
+	// A valid shared token does not override the certificate's identity
+	identity, err := s.authenticate(request(agent), "shared", auth.RoleAgent)
+	if err != nil {
+		t.Fatalf("agent certificate refused: %v", err)
+	}
+	if identity.Kind != auth.KindCertificate || identity.ID != "site-a" || identity.AllowsAgent("site-b") {
+		t.Errorf("expected certificate identity, got %+v", identity)
+	}
+
+	// nor does it rescue a certificate issued for the other role
+	if _, err := s.authenticate(request(client), "shared", auth.RoleAgent); err != auth.ErrWrongRole {
+		t.Errorf("client certificate with shared token: expected ErrWrongRole, got %v", err)
+	}
+}
+
+func TestHandleAgentCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := ca.writeFiles(t, ca.issue(t, "relay", nil, nil, true))
+	tlsConfig, err := transport.CreateMutualTLSConfig(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatalf("CreateMutualTLSConfig failed: %v", err)
+	}
+
+	s := NewServer("")
+	t.Cleanup(s.cancel)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(s.HandleAgent))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	url := "wss" + strings.TrimPrefix(server.URL, "https")
+
+	agentCert := ca.issue(t, "site-a", []string{"agent"}, []string{"site-a.example.com"}, false)
+	dial := func(cert *tls.Certificate) (*transport.MuxSession, error) {
+		config := &tls.Config{RootCAs: ca.pool()}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		// The connection lives as long as ctx
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		wsConn, err := transport.DialWSWithTLS(ctx, url, "", config, false)
+		if err != nil {
+			return nil, err
+		}
+		session, err := transport.NewMuxClient(wsConn)
+		if err != nil {
+			wsConn.Close()
+			return nil, err
+		}
+		t.Cleanup(func() {
+			wsConn.Close()
+			session.Close()
+		})
+		return session, nil
+	}
+	registered := func(id string) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			s.mu.RLock()
+			_, ok := s.agents[id]
+			s.mu.RUnlock()
+			if ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if _, err := dial(nil); err == nil {
+		t.Error("connection without a client certificate accepted")
+	}
+
+	// Without -id the agent registers under its certificate CN
+	session, err := dial(&agentCert)
+	if err != nil {
+		t.Fatalf("dial with certificate failed: %v", err)
+	}
+	session.SendControl(&proto.Control{Type: proto.MsgRegister})
+	if !registered("site-a") {
+		t.Error("agent not registered under its CN")
+	}
+
+	// A DNS SAN names the agent as well
+	session, err = dial(&agentCert)
+	if err != nil {
+		t.Fatalf("dial with certificate failed: %v", err)
+	}
+	session.SendControl(&proto.Control{Type: proto.MsgRegister, AgentID: "site-a.example.com"})
+	if !registered("site-a.example.com") {
+		t.Error("agent not registered under its SAN")
+	}
+
+	// Any other ID is refused
+	session, err = dial(&agentCert)
+	if err != nil {
+		t.Fatalf("dial with certificate failed: %v", err)
+	}
+	session.SendControl(&proto.Control{Type: proto.MsgRegister, AgentID: "site-b"})
+	// The relay sends ERROR and closes, possibly before the HELLO answer
+	if msg, err := session.ReceiveControl(); err == nil && msg.Type != proto.MsgError {
+		t.Errorf("expected ERROR for another agent ID, got %s", msg.Type)
+	}
+	s.mu.RLock()
+	_, ok := s.agents["site-b"]
+	s.mu.RUnlock()
+	if ok {
+		t.Error("agent registered under an ID its certificate does not name")
+	}
+}
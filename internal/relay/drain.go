@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"remote-tunnel/internal/proto"
+)
+
+const drainPollInterval = 250 * time.Millisecond
+
+// Draining reports whether Shutdown has started
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// ActiveStreams returns the number of streams currently bridged
+func (s *Server) ActiveStreams() int64 {
+	return s.activeStreams.Load()
+}
+
+// trackStream counts a bridged stream until the returned func is called
+func (s *Server) trackStream() func() {
+	s.activeStreams.Add(1)
+	return func() { s.activeStreams.Add(-1) }
+}
+
+// Shutdown drains the relay: new connections, DIALs and LISTENs are
+// refused, every agent and client is told GOING_AWAY so it can connect to
+// another relay, and open streams get until ctx is done to finish before
+// the remaining sessions are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.draining.Swap(true) {
+		return nil
+	}
+
+	goingAway := &proto.Control{
+		Type:  proto.MsgGoingAway,
+		Error: "relay shutting down",
+	}
+
+	s.mu.RLock()
+	for _, agent := range s.agents {
+		if err := agent.Session.SendControl(goingAway); err != nil {
+			log.Printf("Failed to send going away to agent %s: %v", agent.ID, err)
+		}
+	}
+	for client := range s.clients {
+		if err := client.Session.SendControl(goingAway); err != nil {
+			log.Printf("Failed to send going away to client: %v", err)
+		}
+	}
+	s.mu.RUnlock()
+
+	log.Printf("Draining: waiting for %d active streams", s.ActiveStreams())
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	var err error
+wait:
+	for s.ActiveStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Drain deadline reached, closing %d active streams", s.ActiveStreams())
+			err = ctx.Err()
+			break wait
+		}
+	}
+
+	s.Close()
+	return err
+}
@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+
+	"remote-tunnel/internal/metrics"
+)
+
+// DIAL failure reasons used as metric labels
+const (
+	dialDraining         = "draining"
+	dialNotPermitted     = "not_permitted"
+	dialAgentNotFound    = "agent_not_found"
+	dialAgentUnreachable = "agent_unreachable"
+	dialTimeout          = "timeout"
+	dialAgentGone        = "agent_disconnected"
+	dialRefused          = "refused"
+	dialError            = "error"
+	dialStream           = "stream"
+	dialQuota            = "quota"
+	dialUnsupported      = "unsupported"
+)
+
+type serverMetrics struct {
+	registry     *metrics.Registry
+	bytes        *metrics.CounterVec // agent, direction
+	dialLatency  *metrics.Histogram
+	dialFailures *metrics.CounterVec // reason
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+
+	r.NewGaugeFunc("tunnel_relay_agents", "Agents connected to this relay.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.agents))
+	})
+	r.NewGaugeFunc("tunnel_relay_clients", "Client sessions connected to this relay.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.clients))
+	})
+	r.NewGaugeFunc("tunnel_relay_active_streams", "Streams currently bridged between clients and agents.", func() float64 {
+		return float64(s.ActiveStreams())
+	})
+
+	return &serverMetrics{
+		registry: r,
+		bytes: r.NewCounterVec("tunnel_relay_agent_bytes_total",
+			"Bytes bridged per agent; direction in is received from the agent, out is sent to it.", "agent", "direction"),
+		dialLatency: r.NewHistogram("tunnel_relay_dial_duration_seconds",
+			"Time from a client's DIAL to the relay's ACCEPT.", metrics.DurationBuckets),
+		dialFailures: r.NewCounterVec("tunnel_relay_dial_failures_total",
+			"DIALs that were not accepted, by reason.", "reason"),
+	}
+}
+
+// countAgent counts the bytes bridged over an agent's stream
+func (m *serverMetrics) countAgent(agentID string, stream net.Conn) net.Conn {
+	return metrics.CountConn(stream, m.bytes.With(agentID, "in"), m.bytes.With(agentID, "out"))
+}
+
+// HandleMetrics serves the relay metrics in the Prometheus text format
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// SetRegistry shares this relay's agents through registry. selfURL is the
+// base URL peers use to reach this relay, e.g. wss://relay-a.example.com.
+func (s *Server) SetRegistry(registry Registry, selfURL string) {
+	s.registry = registry
+	s.selfURL = selfURL
+}
+
+// SetPeerAuth sets the token relays use to authenticate each other, and the
+// TLS config used when dialing peers
+func (s *Server) SetPeerAuth(token string, tlsConfig *tls.Config) {
+	s.peerToken = token
+	s.peerTLS = tlsConfig
+}
+
+// remoteAgent finds agentID on a peer relay. The returned session stands in
+// for the agent: DIALs sent on it are served by the peer. Dials that arrived
+// from a peer are never forwarded again, so relays cannot loop.
+func (s *Server) remoteAgent(client *ClientSession, agentID string) (*AgentSession, bool) {
+	if s.registry == nil || client.Identity.Kind == auth.KindPeer {
+		return nil, false
+	}
+
+	relayURL, ok := s.registry.Lookup(agentID)
+	if !ok || relayURL == s.selfURL {
+		return nil, false
+	}
+
+	link, err := s.peerLink(relayURL)
+	if err != nil {
+		log.Printf("Peer relay %s for agent %s unavailable: %v", relayURL, agentID, err)
+		return nil, false
+	}
+
+	log.Printf("Agent %s is on peer relay %s", agentID, relayURL)
+	return link, true
+}
+
+// peerLink returns the client session to a peer relay, dialing it if
+// needed. The dial runs without peersMu, so a slow or unreachable peer does
+// not hold up DIALs to the others; when two dials race, the first link
+// installed wins and the other is closed.
+func (s *Server) peerLink(relayURL string) (*AgentSession, error) {
+	if link := s.livePeer(relayURL); link != nil {
+		return link, nil
+	}
+
+	wsConn, err := transport.DialWSWithTLS(s.ctx, wsURL(relayURL)+"/ws/client", s.peerToken, s.peerTLS, false)
+	if err != nil {
+		return nil, fmt.Errorf("websocket dial: %w", err)
+	}
+
+	session, err := transport.NewMuxClientWithCompression(wsConn, false)
+	if err != nil {
+		wsConn.Close()
+		return nil, fmt.Errorf("mux client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	link := &AgentSession{
+		ID:      "peer " + relayURL,
+		Session: session,
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[string]chan *proto.Control),
+		streams: transport.NewStreamRouter(),
+	}
+
+	s.peersMu.Lock()
+	if existing, exists := s.peers[relayURL]; exists && !existing.Session.IsClosed() {
+		s.peersMu.Unlock()
+		cancel()
+		wsConn.Close()
+		session.Close()
+		return existing, nil
+	}
+	s.peers[relayURL] = link
+	s.peersMu.Unlock()
+
+	wsConn.StartPingPong()
+	go session.RouteStreams(link.streams)
+	go s.handlePeerReplies(relayURL, link, wsConn)
+
+	log.Printf("Connected to peer relay %s", relayURL)
+	return link, nil
+}
+
+// livePeer returns the open link to relayURL, or nil
+func (s *Server) livePeer(relayURL string) *AgentSession {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	if link, exists := s.peers[relayURL]; exists && !link.Session.IsClosed() {
+		return link
+	}
+	return nil
+}
+
+// handlePeerReplies delivers the peer's DIAL replies until the link fails
+func (s *Server) handlePeerReplies(relayURL string, link *AgentSession, wsConn *transport.WSConn) {
+	defer func() {
+		link.cancel()
+		link.Session.Close()
+		wsConn.Close()
+
+		s.peersMu.Lock()
+		if s.peers[relayURL] == link {
+			delete(s.peers, relayURL)
+		}
+		s.peersMu.Unlock()
+
+		log.Printf("Disconnected from peer relay %s", relayURL)
+	}()
+
+	for {
+		msg, err := link.Session.ReceiveControl()
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case proto.MsgAccept, proto.MsgRefuse, proto.MsgError:
+			link.deliver(msg)
+		case proto.MsgPing:
+			link.Session.SendControl(&proto.Control{Type: proto.MsgPong})
+		case proto.MsgPong:
+			// Keep alive received
+		default:
+			log.Printf("Peer relay %s unexpected message: %s", relayURL, msg.Type)
+		}
+	}
+}
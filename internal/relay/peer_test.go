@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeerLinkDialOutsideLock(t *testing.T) {
+	// A peer that accepts TCP connections but never answers the upgrade
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+
+	peer := NewServer("")
+	peer.SetPeerAuth("peer-secret", nil)
+	t.Cleanup(peer.cancel)
+	healthy := httptest.NewServer(http.HandlerFunc(peer.HandleClient))
+	t.Cleanup(healthy.Close)
+
+	s := NewServer("")
+	s.SetPeerAuth("peer-secret", nil)
+	t.Cleanup(s.cancel)
+
+	go s.peerLink(stalled.URL)
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled peer never dialed")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		first, err := s.peerLink(healthy.URL)
+		if err == nil {
+			var second *AgentSession
+			if second, err = s.peerLink(healthy.URL); err == nil && second != first {
+				t.Error("second peerLink dialed again instead of reusing the link")
+			}
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("peerLink to healthy peer failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peerLink to healthy peer blocked behind the stalled dial")
+	}
+}
@@ -0,0 +1,169 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/limit"
+)
+
+// Quotas limits how much of the relay agents and clients may use. Zero
+// means unlimited. Bandwidth is in bytes per second in each direction and
+// is shared by all streams of an agent or client identity.
+type Quotas struct {
+	MaxStreams       int
+	MaxAgentStreams  int
+	MaxClientStreams int
+	AgentBandwidth   int64
+	ClientBandwidth  int64
+}
+
+// quotaState counts concurrent streams and holds the bandwidth buckets of
+// each agent and client identity
+type quotaState struct {
+	Quotas
+
+	mu            sync.Mutex
+	total         int
+	agentStreams  map[string]int
+	clientStreams map[string]int
+	agentBuckets  map[string]*bucketPair
+	clientBuckets map[string]*bucketPair
+	lastPrune     time.Time
+}
+
+// bucketPruneInterval is how often buckets of idle identities are dropped
+const bucketPruneInterval = time.Minute
+
+// bucketPair limits traffic towards the agent (up) and from it (down)
+type bucketPair struct {
+	up, down *limit.Bucket
+}
+
+func newQuotaState(q Quotas) *quotaState {
+	return &quotaState{
+		Quotas:        q,
+		agentStreams:  make(map[string]int),
+		clientStreams: make(map[string]int),
+		agentBuckets:  make(map[string]*bucketPair),
+		clientBuckets: make(map[string]*bucketPair),
+	}
+}
+
+// SetQuotas sets the stream caps and bandwidth limits. It must be called
+// before the server starts accepting connections.
+func (s *Server) SetQuotas(q Quotas) {
+	s.quotas = newQuotaState(q)
+}
+
+// acquire reserves a stream between a client and agentID. When a stream
+// cap is reached it returns a nil release and the REFUSE reason.
+func (q *quotaState) acquire(agentID, clientKey string) (release func(), reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch {
+	case q.MaxStreams > 0 && q.total >= q.MaxStreams:
+		return nil, fmt.Sprintf("Stream limit reached: relay allows %d concurrent streams", q.MaxStreams)
+	case q.MaxAgentStreams > 0 && q.agentStreams[agentID] >= q.MaxAgentStreams:
+		return nil, fmt.Sprintf("Stream limit reached: agent %s allows %d concurrent streams", agentID, q.MaxAgentStreams)
+	case clientKey != "" && q.MaxClientStreams > 0 && q.clientStreams[clientKey] >= q.MaxClientStreams:
+		return nil, fmt.Sprintf("Stream limit reached: %s allows %d concurrent streams", clientKey, q.MaxClientStreams)
+	}
+
+	q.total++
+	q.agentStreams[agentID]++
+	if clientKey != "" {
+		q.clientStreams[clientKey]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.total--
+			if q.agentStreams[agentID]--; q.agentStreams[agentID] == 0 {
+				delete(q.agentStreams, agentID)
+			}
+			if clientKey != "" {
+				if q.clientStreams[clientKey]--; q.clientStreams[clientKey] == 0 {
+					delete(q.clientStreams, clientKey)
+				}
+			}
+		})
+	}, ""
+}
+
+// limit wraps an agent stream so its traffic is taken from the agent's and
+// the client's bandwidth buckets
+func (q *quotaState) limit(ctx context.Context, agentStream net.Conn, agentID, clientKey string) net.Conn {
+	if q.AgentBandwidth <= 0 && q.ClientBandwidth <= 0 {
+		return agentStream
+	}
+
+	q.mu.Lock()
+	if now := time.Now(); now.Sub(q.lastPrune) >= bucketPruneInterval {
+		q.lastPrune = now
+		q.pruneBuckets()
+	}
+	agent := bucketsFor(q.agentBuckets, agentID, q.AgentBandwidth)
+	read := []*limit.Bucket{agent.down}
+	write := []*limit.Bucket{agent.up}
+	if clientKey != "" {
+		client := bucketsFor(q.clientBuckets, clientKey, q.ClientBandwidth)
+		read = append(read, client.down)
+		write = append(write, client.up)
+	}
+	q.mu.Unlock()
+
+	return limit.Conn(ctx, agentStream, read, write)
+}
+
+func bucketsFor(buckets map[string]*bucketPair, key string, rate int64) *bucketPair {
+	pair, exists := buckets[key]
+	if !exists {
+		pair = &bucketPair{up: limit.NewBucket(rate), down: limit.NewBucket(rate)}
+		buckets[key] = pair
+	}
+	return pair
+}
+
+// pruneBuckets drops the buckets of identities without streams once they
+// have refilled, so a new bucket grants nothing the old one would not have.
+// q.mu must be held.
+func (q *quotaState) pruneBuckets() {
+	pruneIdle(q.agentBuckets, q.agentStreams)
+	pruneIdle(q.clientBuckets, q.clientStreams)
+}
+
+func pruneIdle(buckets map[string]*bucketPair, streams map[string]int) {
+	for key, pair := range buckets {
+		if streams[key] == 0 && pair.up.Full() && pair.down.Full() {
+			delete(buckets, key)
+		}
+	}
+}
+
+// clientQuotaKey names what a client's streams are counted against: its
+// identity, or its remote host when it uses the shared token, which every
+// such client presents. Dials forwarded by a peer relay were already
+// counted there.
+func clientQuotaKey(client *ClientSession) string {
+	switch client.Identity.Kind {
+	case auth.KindPeer:
+		return ""
+	case auth.KindSharedToken:
+		host, _, err := net.SplitHostPort(client.RemoteAddr)
+		if err != nil {
+			host = client.RemoteAddr
+		}
+		return "shared token from " + host
+	}
+	return identityName(client.Identity)
+}
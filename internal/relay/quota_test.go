@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"remote-tunnel/internal/auth"
+)
+
+func TestQuotaStreamCaps(t *testing.T) {
+	q := newQuotaState(Quotas{MaxStreams: 3, MaxAgentStreams: 2, MaxClientStreams: 1})
+
+	release, _ := q.acquire("agent-1", "client-a")
+	if release == nil {
+		t.Fatal("first stream refused")
+	}
+	if r, reason := q.acquire("agent-1", "client-a"); r != nil || reason == "" {
+		t.Error("client cap not enforced")
+	}
+	if r, _ := q.acquire("agent-1", "client-b"); r == nil {
+		t.Error("other client refused")
+	}
+	if r, reason := q.acquire("agent-1", "client-c"); r != nil || reason == "" {
+		t.Error("agent cap not enforced")
+	}
+
+	release()
+	release() // releasing twice counts once
+	if q.total != 1 || q.clientStreams["client-a"] != 0 {
+		t.Errorf("unexpected counts after release: total %d, client-a %d", q.total, q.clientStreams["client-a"])
+	}
+	if _, exists := q.clientStreams["client-a"]; exists {
+		t.Error("idle client stream counter kept")
+	}
+}
+
+func TestQuotaPruneBuckets(t *testing.T) {
+	q := newQuotaState(Quotas{AgentBandwidth: 64 * 1024, ClientBandwidth: 64 * 1024})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	// idle: no streams and full buckets
+	release, _ := q.acquire("idle-agent", "idle-client")
+	q.limit(context.Background(), conn, "idle-agent", "idle-client")
+	release()
+
+	// busy: an open stream
+	releaseBusy, _ := q.acquire("busy-agent", "busy-client")
+	defer releaseBusy()
+	q.limit(context.Background(), conn, "busy-agent", "busy-client")
+
+	// drained: no streams, but dropping the bucket would refill it early
+	release, _ = q.acquire("drained-agent", "drained-client")
+	q.limit(context.Background(), conn, "drained-agent", "drained-client")
+	release()
+	q.agentBuckets["drained-agent"].up.Wait(context.Background(), 64*1024)
+
+	q.mu.Lock()
+	q.pruneBuckets()
+	q.mu.Unlock()
+
+	for key, want := range map[string]bool{"idle-agent": false, "busy-agent": true, "drained-agent": true} {
+		if _, exists := q.agentBuckets[key]; exists != want {
+			t.Errorf("agent bucket %s kept = %v, want %v", key, exists, want)
+		}
+	}
+	for key, want := range map[string]bool{"idle-client": false, "busy-client": true, "drained-client": false} {
+		if _, exists := q.clientBuckets[key]; exists != want {
+			t.Errorf("client bucket %s kept = %v, want %v", key, exists, want)
+		}
+	}
+}
+
+func TestClientQuotaKey(t *testing.T) {
+	shared := &auth.Identity{Kind: auth.KindSharedToken, Role: auth.RoleClient}
+	credential := &auth.Identity{ID: "alice", Kind: auth.KindCredential, Role: auth.RoleClient}
+	peer := &auth.Identity{ID: "relay", Kind: auth.KindPeer, Role: auth.RoleClient}
+
+	tests := []struct {
+		name   string
+		client *ClientSession
+		want   string
+	}{
+		{"Shared token", &ClientSession{Identity: shared, RemoteAddr: "10.0.0.5:40000"}, "shared token from 10.0.0.5"},
+		{"Shared token, same host", &ClientSession{Identity: shared, RemoteAddr: "10.0.0.5:40001"}, "shared token from 10.0.0.5"},
+		{"Shared token, IPv6", &ClientSession{Identity: shared, RemoteAddr: "[2001:db8::7]:40000"}, "shared token from 2001:db8::7"},
+		{"Credential", &ClientSession{Identity: credential, RemoteAddr: "10.0.0.5:40000"}, "credential alice"},
+		{"Peer relay", &ClientSession{Identity: peer, RemoteAddr: "10.0.0.9:40000"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientQuotaKey(tt.client); got != tt.want {
+				t.Errorf("clientQuotaKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
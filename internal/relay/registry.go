@@ -0,0 +1,224 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remote-tunnel/internal/transport"
+)
+
+// registryPollInterval is how often a PeerRegistry asks peers for their agents
+const registryPollInterval = 3 * time.Second
+
+// Registry records which relay each agent is registered on, so a client
+// on one relay can reach an agent connected to another. Relays are named by
+// their base URL, e.g. wss://relay-a.example.com.
+type Registry interface {
+	Register(agentID, relayURL string) error
+	Unregister(agentID, relayURL string) error
+	Lookup(agentID string) (relayURL string, ok bool)
+}
+
+// MemoryRegistry is an in-process registry. Relays sharing one instance
+// see each other's agents; it stands in for a shared store in tests and
+// single-host setups.
+type MemoryRegistry struct {
+	mu     sync.RWMutex
+	agents map[string]string
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		agents: make(map[string]string),
+	}
+}
+
+func (m *MemoryRegistry) Register(agentID, relayURL string) error {
+	m.mu.Lock()
+	m.agents[agentID] = relayURL
+	m.mu.Unlock()
+	return nil
+}
+
+// Unregister removes agentID only if it is still registered on relayURL,
+// so a stale disconnect cannot remove a newer registration elsewhere
+func (m *MemoryRegistry) Unregister(agentID, relayURL string) error {
+	m.mu.Lock()
+	if m.agents[agentID] == relayURL {
+		delete(m.agents, agentID)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryRegistry) Lookup(agentID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	relayURL, ok := m.agents[agentID]
+	return relayURL, ok
+}
+
+// registrySnapshot is what a relay serves on /registry
+type registrySnapshot struct {
+	Relay  string   `json:"relay"`
+	Agents []string `json:"agents"`
+}
+
+// PeerRegistry learns remote agents by polling each peer relay's /registry
+// endpoint. Local agents are served by the relay itself, so Register and
+// Unregister are no-ops.
+type PeerRegistry struct {
+	peers  []string
+	token  string
+	client *http.Client
+
+	mu     sync.RWMutex
+	agents map[string]map[string]bool // peer URL -> agent IDs
+}
+
+func NewPeerRegistry(peers []string, token string, tlsConfig *tls.Config) *PeerRegistry {
+	return &PeerRegistry{
+		peers: peers,
+		token: token,
+		client: &http.Client{
+			Timeout:   registryPollInterval,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		agents: make(map[string]map[string]bool),
+	}
+}
+
+func (p *PeerRegistry) Register(agentID, relayURL string) error   { return nil }
+func (p *PeerRegistry) Unregister(agentID, relayURL string) error { return nil }
+
+func (p *PeerRegistry) Lookup(agentID string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, peer := range p.peers {
+		if p.agents[peer][agentID] {
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+// Run polls the peers until ctx is cancelled
+func (p *PeerRegistry) Run(ctx context.Context) {
+	ticker := time.NewTicker(registryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, peer := range p.peers {
+			p.poll(ctx, peer)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *PeerRegistry) poll(ctx context.Context, peer string) {
+	agents, err := p.fetch(ctx, peer)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		// An unreachable peer's agents are unreachable too
+		if len(p.agents[peer]) > 0 {
+			log.Printf("Peer relay %s unreachable, forgetting %d agents: %v", peer, len(p.agents[peer]), err)
+		}
+		delete(p.agents, peer)
+		return
+	}
+
+	p.agents[peer] = agents
+}
+
+func (p *PeerRegistry) fetch(ctx context.Context, peer string) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL(peer)+"/registry", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Tunnel-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry status %s", resp.Status)
+	}
+
+	var snapshot registrySnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("decode registry: %w", err)
+	}
+
+	agents := make(map[string]bool, len(snapshot.Agents))
+	for _, id := range snapshot.Agents {
+		agents[id] = true
+	}
+	return agents, nil
+}
+
+// HandleRegistry serves the IDs of agents registered on this relay to peers
+func (s *Server) HandleRegistry(w http.ResponseWriter, r *http.Request) {
+	if s.peerToken == "" || !transport.TokenEqual(r.Header.Get("X-Tunnel-Token"), s.peerToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.RLock()
+	snapshot := registrySnapshot{
+		Relay:  s.selfURL,
+		Agents: make([]string, 0, len(s.agents)),
+	}
+	for id := range s.agents {
+		snapshot.Agents = append(snapshot.Agents, id)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(snapshot.Agents)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// httpURL turns a relay base URL into the matching http(s) URL
+func httpURL(relayURL string) string {
+	relayURL = strings.TrimSuffix(relayURL, "/")
+	switch {
+	case strings.HasPrefix(relayURL, "wss://"):
+		return "https://" + strings.TrimPrefix(relayURL, "wss://")
+	case strings.HasPrefix(relayURL, "ws://"):
+		return "http://" + strings.TrimPrefix(relayURL, "ws://")
+	}
+	return relayURL
+}
+
+// wsURL turns a relay base URL into the matching ws(s) URL
+func wsURL(relayURL string) string {
+	relayURL = strings.TrimSuffix(relayURL, "/")
+	switch {
+	case strings.HasPrefix(relayURL, "https://"):
+		return "wss://" + strings.TrimPrefix(relayURL, "https://")
+	case strings.HasPrefix(relayURL, "http://"):
+		return "ws://" + strings.TrimPrefix(relayURL, "http://")
+	}
+	return relayURL
+}
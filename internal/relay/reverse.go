@@ -0,0 +1,264 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// ReverseListener is a listener opened on an agent on behalf of a client.
+// Connections accepted by the agent are carried back to the owning client.
+type ReverseListener struct {
+	ID         string
+	AgentID    string
+	ListenAddr string
+	Client     *ClientSession
+}
+
+func (s *Server) handleListen(client *ClientSession, msg *proto.Control) {
+	listenerID := msg.ListenerID
+	if listenerID == "" {
+		listenerID = uuid.New().String()
+	}
+
+	log.Printf("Listen request: agent=%s, listen=%s, listener=%s", msg.AgentID, msg.ListenAddr, listenerID)
+
+	if s.Draining() {
+		client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listenerID,
+			Error:      "Relay is shutting down",
+		})
+		return
+	}
+
+	if !client.Identity.AllowsAgent(msg.AgentID) {
+		log.Printf("Listen on agent %s not permitted for %s", msg.AgentID, identityName(client.Identity))
+		client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listenerID,
+			Error:      "Agent not permitted for this token",
+		})
+		return
+	}
+
+	listener := &ReverseListener{
+		ID:         listenerID,
+		AgentID:    msg.AgentID,
+		ListenAddr: msg.ListenAddr,
+		Client:     client,
+	}
+
+	// Listener IDs come from clients, so one client must not take over
+	// another's listener and its inbound connections
+	s.mu.Lock()
+	previous, taken := s.listeners[listenerID]
+	if taken && previous.Client != client {
+		s.mu.Unlock()
+		log.Printf("Listener %s already owned by another client", listenerID)
+		client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listenerID,
+			Error:      "Listener ID already in use",
+		})
+		return
+	}
+	s.listeners[listenerID] = listener
+	agent, exists := s.agents[msg.AgentID]
+	s.mu.Unlock()
+
+	// A client moving its listener to another agent closes the old one
+	if taken && previous.AgentID != listener.AgentID {
+		s.closeAgentListener(previous)
+	}
+
+	if !exists {
+		// Keep the registration so the listener is opened once the agent connects
+		client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgPending,
+			ListenerID: listenerID,
+		})
+		return
+	}
+
+	s.sendListen(agent, listener)
+}
+
+func (s *Server) sendListen(agent *AgentSession, listener *ReverseListener) {
+	if !agent.Session.PeerSupports(proto.CapReverse) {
+		listener.Client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listener.ID,
+			Error:      fmt.Sprintf("Agent %s does not support reverse forwarding", agent.ID),
+		})
+		return
+	}
+
+	err := agent.Session.SendControl(&proto.Control{
+		Type:       proto.MsgListen,
+		ListenerID: listener.ID,
+		ListenAddr: listener.ListenAddr,
+	})
+	if err != nil {
+		log.Printf("Failed to send listen to agent %s: %v", agent.ID, err)
+		listener.Client.Session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listener.ID,
+			Error:      "Failed to contact agent",
+		})
+	}
+}
+
+func (s *Server) handleUnlisten(client *ClientSession, msg *proto.Control) {
+	s.mu.Lock()
+	listener, exists := s.listeners[msg.ListenerID]
+	if exists && listener.Client == client {
+		delete(s.listeners, msg.ListenerID)
+	}
+	s.mu.Unlock()
+
+	if !exists || listener.Client != client {
+		return
+	}
+
+	s.closeAgentListener(listener)
+}
+
+func (s *Server) closeAgentListener(listener *ReverseListener) {
+	s.mu.RLock()
+	agent, exists := s.agents[listener.AgentID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return
+	}
+
+	agent.Session.SendControl(&proto.Control{
+		Type:       proto.MsgUnlisten,
+		ListenerID: listener.ID,
+	})
+}
+
+// removeClientListeners drops every listener owned by a disconnected client
+func (s *Server) removeClientListeners(client *ClientSession) {
+	var owned []*ReverseListener
+
+	s.mu.Lock()
+	for id, listener := range s.listeners {
+		if listener.Client == client {
+			owned = append(owned, listener)
+			delete(s.listeners, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, listener := range owned {
+		s.closeAgentListener(listener)
+	}
+}
+
+// replayListeners asks a newly registered agent to open its pending listeners
+func (s *Server) replayListeners(agent *AgentSession) {
+	var pending []*ReverseListener
+
+	s.mu.RLock()
+	for _, listener := range s.listeners {
+		if listener.AgentID == agent.ID {
+			pending = append(pending, listener)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, listener := range pending {
+		s.sendListen(agent, listener)
+	}
+}
+
+// forwardListenReply routes the agent's answer to a LISTEN back to the client
+func (s *Server) forwardListenReply(agent *AgentSession, msg *proto.Control) {
+	s.mu.RLock()
+	listener, exists := s.listeners[msg.ListenerID]
+	s.mu.RUnlock()
+
+	if !exists || listener.AgentID != agent.ID {
+		log.Printf("Agent %s reply for unknown listener %s", agent.ID, msg.ListenerID)
+		return
+	}
+
+	if msg.Type == proto.MsgRefuse {
+		log.Printf("Agent %s refused listener %s: %s", agent.ID, msg.ListenerID, msg.Error)
+	} else {
+		log.Printf("Agent %s listening on %s for listener %s", agent.ID, listener.ListenAddr, listener.ID)
+	}
+
+	listener.Client.Session.SendControl(&proto.Control{
+		Type:       msg.Type,
+		ListenerID: msg.ListenerID,
+		Error:      msg.Error,
+	})
+}
+
+func (s *Server) handleInbound(agent *AgentSession, msg *proto.Control) {
+	streamID := msg.StreamID
+
+	s.mu.RLock()
+	listener, exists := s.listeners[msg.ListenerID]
+	s.mu.RUnlock()
+
+	// Wait for the agent stream tagged with this stream ID
+	agentStream, err := agent.streams.Wait(streamID, transport.DialTimeout)
+	if err != nil {
+		log.Printf("Failed to get inbound agent stream: %v", err)
+		return
+	}
+	defer agentStream.Close()
+
+	if !exists || listener.AgentID != agent.ID {
+		log.Printf("Inbound connection for unknown listener %s", msg.ListenerID)
+		return
+	}
+
+	log.Printf("Inbound connection: agent=%s, listener=%s, stream=%s", agent.ID, listener.ID, streamID)
+
+	client := listener.Client
+	clientKey := clientQuotaKey(client)
+	release, reason := s.quotas.acquire(agent.ID, clientKey)
+	if release == nil {
+		log.Printf("Inbound connection %s dropped: %s", streamID, reason)
+		return
+	}
+	defer release()
+
+	// Open stream to client
+	clientStream, err := client.Session.OpenStreamWithID(streamID)
+	if err != nil {
+		log.Printf("Failed to open client stream: %v", err)
+		return
+	}
+	defer clientStream.Close()
+
+	// Send INBOUND to client
+	err = client.Session.SendControl(&proto.Control{
+		Type:       proto.MsgInbound,
+		StreamID:   streamID,
+		ListenerID: listener.ID,
+	})
+	if err != nil {
+		log.Printf("Failed to send inbound to client: %v", err)
+		return
+	}
+
+	log.Printf("Bridging inbound streams for %s", streamID)
+
+	defer s.trackStream()()
+
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+
+	agentConn := s.quotas.limit(ctx, s.metrics.countAgent(agent.ID, agentStream), agent.ID, clientKey)
+	transport.Bridge(ctx, clientStream, agentConn)
+}
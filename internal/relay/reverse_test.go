@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"remote-tunnel/internal/auth"
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// sessionPair connects a relay-side mux session to a peer over a pipe
+func sessionPair(t *testing.T) (relaySide, peer *transport.MuxSession) {
+	t.Helper()
+	relayConn, peerConn := net.Pipe()
+
+	relayCh := make(chan *transport.MuxSession, 1)
+	go func() {
+		session, err := transport.NewMuxServer(relayConn)
+		if err != nil {
+			t.Errorf("NewMuxServer failed: %v", err)
+		}
+		relayCh <- session
+	}()
+
+	peer, err := transport.NewMuxClient(peerConn)
+	if err != nil {
+		t.Fatalf("NewMuxClient failed: %v", err)
+	}
+	relaySide = <-relayCh
+	if relaySide == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		// Closing the pipe first ends blocked control reads
+		relayConn.Close()
+		peerConn.Close()
+		peer.Close()
+		relaySide.Close()
+	})
+	return relaySide, peer
+}
+
+// receiveAll delivers control messages until the session fails
+func receiveAll(session *transport.MuxSession) <-chan *proto.Control {
+	ch := make(chan *proto.Control, 16)
+	go func() {
+		defer close(ch)
+		for {
+			msg, err := session.ReceiveControl()
+			if err != nil {
+				return
+			}
+			ch <- msg
+		}
+	}()
+	return ch
+}
+
+func expectControl(t *testing.T, ch <-chan *proto.Control, want proto.MsgType, listenerID string) *proto.Control {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatalf("session closed waiting for %s", want)
+		}
+		if msg.Type != want || msg.ListenerID != listenerID {
+			t.Fatalf("got %s for listener %q, want %s for %q", msg.Type, msg.ListenerID, want, listenerID)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+	return nil
+}
+
+// testAgent registers an agent on s and returns the agent's end
+func testAgent(t *testing.T, s *Server, id string) (*AgentSession, *transport.MuxSession, <-chan *proto.Control) {
+	t.Helper()
+	relaySide, peer := sessionPair(t)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	t.Cleanup(cancel)
+	agent := &AgentSession{
+		ID:       id,
+		Identity: &auth.Identity{Role: auth.RoleAgent, Agents: []string{auth.AnyAgent}},
+		Session:  relaySide,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[string]chan *proto.Control),
+		streams:  transport.NewStreamRouter(),
+	}
+
+	s.mu.Lock()
+	s.agents[id] = agent
+	s.mu.Unlock()
+
+	go relaySide.RouteStreams(agent.streams)
+	go s.handleAgentRequests(agent)
+	return agent, peer, receiveAll(peer)
+}
+
+// testClient connects a client to s and returns the client's end
+func testClient(t *testing.T, s *Server) (*ClientSession, *transport.MuxSession, <-chan *proto.Control) {
+	t.Helper()
+	relaySide, peer := sessionPair(t)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	t.Cleanup(cancel)
+	client := &ClientSession{
+		Identity: &auth.Identity{Role: auth.RoleClient, Agents: []string{auth.AnyAgent}},
+		Session:  relaySide,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	go s.handleClientRequests(client)
+	return client, peer, receiveAll(peer)
+}
+
+func (s *Server) listenerOwner(id string) *ClientSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if listener, exists := s.listeners[id]; exists {
+		return listener.Client
+	}
+	return nil
+}
+
+func TestReverseListenInboundUnlisten(t *testing.T) {
+	s := NewServer("token")
+	t.Cleanup(func() { s.Close() })
+
+	_, agentPeer, toAgent := testAgent(t, s, "agent-1")
+	_, clientPeer, toClient := testClient(t, s)
+
+	clientPeer.SendControl(&proto.Control{
+		Type:       proto.MsgListen,
+		AgentID:    "agent-1",
+		ListenerID: "listener-1",
+		ListenAddr: "127.0.0.1:8080",
+	})
+	listen := expectControl(t, toAgent, proto.MsgListen, "listener-1")
+	if listen.ListenAddr != "127.0.0.1:8080" {
+		t.Errorf("agent asked to listen on %q", listen.ListenAddr)
+	}
+
+	agentPeer.SendControl(&proto.Control{Type: proto.MsgAccept, ListenerID: "listener-1"})
+	expectControl(t, toClient, proto.MsgAccept, "listener-1")
+
+	// The agent accepts a connection and opens its stream
+	agentPeer.SendControl(&proto.Control{Type: proto.MsgInbound, StreamID: "stream-1", ListenerID: "listener-1"})
+	agentStream, err := agentPeer.OpenStreamWithID("stream-1")
+	if err != nil {
+		t.Fatalf("OpenStreamWithID failed: %v", err)
+	}
+	defer agentStream.Close()
+
+	inbound := expectControl(t, toClient, proto.MsgInbound, "listener-1")
+	if inbound.StreamID != "stream-1" {
+		t.Errorf("INBOUND for stream %q", inbound.StreamID)
+	}
+
+	clientStream, err := clientPeer.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream failed: %v", err)
+	}
+	defer clientStream.Close()
+	if id, err := transport.ReadStreamHeader(clientStream); err != nil || id != "stream-1" {
+		t.Fatalf("client stream header %q, %v", id, err)
+	}
+
+	agentStream.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientStream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+	clientStream.Write([]byte("pong"))
+	if _, err := io.ReadFull(agentStream, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("agent read %q, %v", buf, err)
+	}
+
+	clientPeer.SendControl(&proto.Control{Type: proto.MsgUnlisten, ListenerID: "listener-1"})
+	expectControl(t, toAgent, proto.MsgUnlisten, "listener-1")
+	if owner := s.listenerOwner("listener-1"); owner != nil {
+		t.Error("listener still registered after UNLISTEN")
+	}
+}
+
+func TestReverseListenerIDOwnership(t *testing.T) {
+	s := NewServer("token")
+	t.Cleanup(func() { s.Close() })
+
+	_, _, toAgent := testAgent(t, s, "agent-1")
+	owner, ownerPeer, _ := testClient(t, s)
+	_, otherPeer, toOther := testClient(t, s)
+
+	ownerPeer.SendControl(&proto.Control{Type: proto.MsgListen, AgentID: "agent-1", ListenerID: "listener-1", ListenAddr: ":8080"})
+	expectControl(t, toAgent, proto.MsgListen, "listener-1")
+
+	// Another client reusing the ID is refused and the agent is not asked
+	// to reopen the listener
+	otherPeer.SendControl(&proto.Control{Type: proto.MsgListen, AgentID: "agent-1", ListenerID: "listener-1", ListenAddr: ":9090"})
+	refuse := expectControl(t, toOther, proto.MsgRefuse, "listener-1")
+	if refuse.Error == "" {
+		t.Error("REFUSE without reason")
+	}
+	if got := s.listenerOwner("listener-1"); got != owner {
+		t.Error("listener taken over by another client")
+	}
+
+	// Nor may it close someone else's listener
+	otherPeer.SendControl(&proto.Control{Type: proto.MsgUnlisten, ListenerID: "listener-1"})
+	select {
+	case msg := <-toAgent:
+		t.Fatalf("agent got %s for a foreign UNLISTEN", msg.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := s.listenerOwner("listener-1"); got != owner {
+		t.Error("listener removed by another client")
+	}
+}
+
+func TestRemoveClientListeners(t *testing.T) {
+	s := NewServer("token")
+	t.Cleanup(func() { s.Close() })
+
+	_, _, toAgent := testAgent(t, s, "agent-1")
+	client, clientPeer, _ := testClient(t, s)
+	other, otherPeer, _ := testClient(t, s)
+
+	clientPeer.SendControl(&proto.Control{Type: proto.MsgListen, AgentID: "agent-1", ListenerID: "mine", ListenAddr: ":8080"})
+	expectControl(t, toAgent, proto.MsgListen, "mine")
+	otherPeer.SendControl(&proto.Control{Type: proto.MsgListen, AgentID: "agent-1", ListenerID: "theirs", ListenAddr: ":9090"})
+	expectControl(t, toAgent, proto.MsgListen, "theirs")
+
+	s.removeClientListeners(client)
+
+	expectControl(t, toAgent, proto.MsgUnlisten, "mine")
+	if s.listenerOwner("mine") != nil {
+		t.Error("disconnected client's listener still registered")
+	}
+	if s.listenerOwner("theirs") != other {
+		t.Error("other client's listener was removed")
+	}
+}
+
+func TestReplayListeners(t *testing.T) {
+	s := NewServer("token")
+	t.Cleanup(func() { s.Close() })
+
+	client, clientPeer, toClient := testClient(t, s)
+
+	// The agent is not connected yet: the listener is kept for later
+	clientPeer.SendControl(&proto.Control{Type: proto.MsgListen, AgentID: "agent-1", ListenerID: "listener-1", ListenAddr: ":8080"})
+	expectControl(t, toClient, proto.MsgPending, "listener-1")
+	if s.listenerOwner("listener-1") != client {
+		t.Fatal("listener for an offline agent was not kept")
+	}
+
+	agent, agentPeer, toAgent := testAgent(t, s, "agent-1")
+	s.replayListeners(agent)
+
+	listen := expectControl(t, toAgent, proto.MsgListen, "listener-1")
+	if listen.ListenAddr != ":8080" {
+		t.Errorf("replayed listen on %q", listen.ListenAddr)
+	}
+
+	agentPeer.SendControl(&proto.Control{Type: proto.MsgAccept, ListenerID: "listener-1"})
+	expectControl(t, toClient, proto.MsgAccept, "listener-1")
+}
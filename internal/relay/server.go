@@ -2,64 +2,113 @@ package relay
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"remote-tunnel/internal/auth"
 	"remote-tunnel/internal/proto"
 	"remote-tunnel/internal/transport"
 )
 
 type Server struct {
-	token    string
-	agents   map[string]*AgentSession
-	mu       sync.RWMutex
+	token     string
+	agents    map[string]*AgentSession
+	clients   map[*ClientSession]bool
+	listeners map[string]*ReverseListener
+	mu        sync.RWMutex
+
+	// credentials holds per-identity tokens; nil means shared token only
+	credentials *auth.Store
+
+	// registry shares agent locations with peer relays; nil runs standalone
+	registry  Registry
+	selfURL   string
+	peerToken string
+	peerTLS   *tls.Config
+	peers     map[string]*AgentSession
+	peersMu   sync.Mutex
+
+	// draining is set by Shutdown; activeStreams counts bridged streams
+	draining      atomic.Bool
+	activeStreams atomic.Int64
+
+	metrics *serverMetrics
+	quotas  *quotaState
+
 	ctx      context.Context
 	cancel   context.CancelFunc
 	compress bool
 }
 
 type AgentSession struct {
-	ID      string
-	Session *transport.MuxSession
+	ID       string
+	Identity *auth.Identity
+	Session  *transport.MuxSession
 	ctx     context.Context
 	cancel  context.CancelFunc
+
+	// pending is the pending-dial table: DIALs waiting for the agent's
+	// ACCEPT, REFUSE or ERROR, keyed by stream ID
+	pending   map[string]chan *proto.Control
+	pendingMu sync.Mutex
+
+	// streams matches streams opened by the agent to their stream ID
+	streams *transport.StreamRouter
 }
 
 type ClientSession struct {
-	Session *transport.MuxSession
+	Identity   *auth.Identity
+	Session    *transport.MuxSession
+	RemoteAddr string
 	ctx     context.Context
 	cancel  context.CancelFunc
 }
 
 func NewServer(token string) *Server {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		token:    token,
-		agents:   make(map[string]*AgentSession),
-		ctx:      ctx,
-		cancel:   cancel,
-		compress: false,
-	}
+	return NewServerWithCompression(token, false)
 }
 
 func NewServerWithCompression(token string, compress bool) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		token:    token,
-		agents:   make(map[string]*AgentSession),
-		ctx:      ctx,
-		cancel:   cancel,
-		compress: compress,
+	s := &Server{
+		token:     token,
+		agents:    make(map[string]*AgentSession),
+		clients:   make(map[*ClientSession]bool),
+		listeners: make(map[string]*ReverseListener),
+		peers:     make(map[string]*AgentSession),
+		ctx:       ctx,
+		cancel:    cancel,
+		compress:  compress,
 	}
+	s.metrics = newServerMetrics(s)
+	s.quotas = newQuotaState(Quotas{})
+	return s
 }
 
 func (s *Server) HandleAgent(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := transport.AcceptWSWithCompression(w, r, s.token, s.compress)
+	if s.Draining() {
+		http.Error(w, "Relay is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var (
+		identity    *auth.Identity
+		headerToken string
+	)
+	wsConn, err := transport.AcceptWSWithAuth(w, r, func(token string) error {
+		var err error
+		identity, err = s.authenticate(r, token, auth.RoleAgent)
+		headerToken = token
+		return err
+	}, s.compress)
 	if err != nil {
-		log.Printf("Agent websocket accept failed: %v", err)
+		log.Printf("Agent websocket accept failed from %s: %v", r.RemoteAddr, err)
 		return
 	}
 	defer wsConn.Close()
@@ -92,7 +141,7 @@ func (s *Server) HandleAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if msg.Token != s.token {
+	if !transport.TokenEqual(msg.Token, headerToken) {
 		log.Printf("Invalid agent token")
 		session.SendControl(&proto.Control{
 			Type:  proto.MsgError,
@@ -102,6 +151,10 @@ func (s *Server) HandleAgent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	agentID := msg.AgentID
+	if agentID == "" && identity.Kind == auth.KindCertificate {
+		// The certificate names the agent
+		agentID = identity.ID
+	}
 	if agentID == "" {
 		log.Printf("Empty agent ID")
 		session.SendControl(&proto.Control{
@@ -111,36 +164,76 @@ func (s *Server) HandleAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Agent %s registered", agentID)
+	if !identity.AllowsAgent(agentID) {
+		log.Printf("Agent ID %s not permitted for %s", agentID, identityName(identity))
+		session.SendControl(&proto.Control{
+			Type:  proto.MsgError,
+			Error: "Agent ID not permitted for this token",
+		})
+		return
+	}
+
+	log.Printf("Agent %s registered (%s)", agentID, identityName(identity))
 
 	ctx, cancel := context.WithCancel(s.ctx)
 	agentSession := &AgentSession{
-		ID:      agentID,
-		Session: session,
-		ctx:     ctx,
-		cancel:  cancel,
+		ID:       agentID,
+		Identity: identity,
+		Session:  session,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[string]chan *proto.Control),
+		streams:  transport.NewStreamRouter(),
 	}
 
 	s.mu.Lock()
 	s.agents[agentID] = agentSession
 	s.mu.Unlock()
 
+	if s.registry != nil {
+		if err := s.registry.Register(agentID, s.selfURL); err != nil {
+			log.Printf("Failed to publish agent %s to registry: %v", agentID, err)
+		}
+	}
+
 	defer func() {
 		s.mu.Lock()
-		delete(s.agents, agentID)
+		current := s.agents[agentID] == agentSession
+		if current {
+			delete(s.agents, agentID)
+		}
 		s.mu.Unlock()
+		if current && s.registry != nil {
+			s.registry.Unregister(agentID, s.selfURL)
+		}
 		cancel()
 		log.Printf("Agent %s disconnected", agentID)
 	}()
 
+	go session.RouteStreams(agentSession.streams)
+	go s.enforceCredential(ctx, identity, session)
+
+	// Re-establish reverse listeners requested before the agent (re)connected
+	go s.replayListeners(agentSession)
+
 	// Handle agent requests
 	s.handleAgentRequests(agentSession)
 }
 
 func (s *Server) HandleClient(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := transport.AcceptWSWithCompression(w, r, s.token, s.compress)
+	if s.Draining() {
+		http.Error(w, "Relay is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var identity *auth.Identity
+	wsConn, err := transport.AcceptWSWithAuth(w, r, func(token string) error {
+		var err error
+		identity, err = s.authenticate(r, token, auth.RoleClient)
+		return err
+	}, s.compress)
 	if err != nil {
-		log.Printf("Client websocket accept failed: %v", err)
+		log.Printf("Client websocket accept failed from %s: %v", r.RemoteAddr, err)
 		return
 	}
 	defer wsConn.Close()
@@ -154,17 +247,29 @@ func (s *Server) HandleClient(w http.ResponseWriter, r *http.Request) {
 	}
 	defer session.Close()
 
-	log.Printf("Client connected")
+	log.Printf("Client connected (%s)", identityName(identity))
 
 	ctx, cancel := context.WithCancel(s.ctx)
 	clientSession := &ClientSession{
-		Session: session,
-		ctx:     ctx,
-		cancel:  cancel,
+		Identity:   identity,
+		Session:    session,
+		RemoteAddr: r.RemoteAddr,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 
+	go s.enforceCredential(ctx, identity, session)
+
+	s.mu.Lock()
+	s.clients[clientSession] = true
+	s.mu.Unlock()
+
 	defer func() {
+		s.mu.Lock()
+		delete(s.clients, clientSession)
+		s.mu.Unlock()
 		cancel()
+		s.removeClientListeners(clientSession)
 		log.Printf("Client disconnected")
 	}()
 
@@ -191,6 +296,20 @@ func (s *Server) handleAgentRequests(agent *AgentSession) {
 			agent.Session.SendControl(&proto.Control{Type: proto.MsgPong})
 		case proto.MsgPong:
 			// Keep alive received
+		case proto.MsgAccept, proto.MsgRefuse:
+			if msg.ListenerID != "" {
+				s.forwardListenReply(agent, msg)
+			} else {
+				agent.deliver(msg)
+			}
+		case proto.MsgError:
+			if msg.StreamID != "" {
+				agent.deliver(msg)
+			} else {
+				log.Printf("Agent %s error: %s", agent.ID, msg.Error)
+			}
+		case proto.MsgInbound:
+			go s.handleInbound(agent, msg)
 		default:
 			log.Printf("Agent %s unexpected message: %s", agent.ID, msg.Type)
 		}
@@ -224,6 +343,10 @@ func (s *Server) handleClientRequests(client *ClientSession) {
 		switch msg.Type {
 		case proto.MsgDial:
 			go s.handleDial(client, msg)
+		case proto.MsgListen:
+			go s.handleListen(client, msg)
+		case proto.MsgUnlisten:
+			go s.handleUnlisten(client, msg)
 		case proto.MsgPing:
 			err := client.Session.SendControl(&proto.Control{Type: proto.MsgPong})
 			if err != nil {
@@ -242,18 +365,45 @@ func (s *Server) handleDial(client *ClientSession, dialMsg *proto.Control) {
 	agentID := dialMsg.AgentID
 	streamID := dialMsg.StreamID
 	targetAddr := dialMsg.TargetAddr
+	start := time.Now()
 
 	if streamID == "" {
 		streamID = uuid.New().String()
 	}
 
-	log.Printf("Dial request: agent=%s, target=%s, stream=%s", agentID, targetAddr, streamID)
+	log.Printf("Dial request: agent=%s, target=%s, network=%s, stream=%s", agentID, targetAddr, dialMsg.Network, streamID)
+
+	if s.Draining() {
+		s.metrics.dialFailures.With(dialDraining).Inc()
+		client.Session.SendControl(&proto.Control{
+			Type:     proto.MsgRefuse,
+			StreamID: streamID,
+			Error:    "Relay is shutting down",
+		})
+		return
+	}
+
+	if !client.Identity.AllowsAgent(agentID) {
+		log.Printf("Dial to agent %s not permitted for %s", agentID, identityName(client.Identity))
+		s.metrics.dialFailures.With(dialNotPermitted).Inc()
+		client.Session.SendControl(&proto.Control{
+			Type:     proto.MsgRefuse,
+			StreamID: streamID,
+			Error:    "Agent not permitted for this token",
+		})
+		return
+	}
 
 	s.mu.RLock()
 	agent, exists := s.agents[agentID]
 	s.mu.RUnlock()
 
 	if !exists {
+		agent, exists = s.remoteAgent(client, agentID)
+	}
+
+	if !exists {
+		s.metrics.dialFailures.With(dialAgentNotFound).Inc()
 		client.Session.SendControl(&proto.Control{
 			Type:     proto.MsgRefuse,
 			StreamID: streamID,
@@ -262,14 +412,56 @@ func (s *Server) handleDial(client *ClientSession, dialMsg *proto.Control) {
 		return
 	}
 
-	// Send DIAL to agent
+	if dialMsg.Network == proto.NetworkUDP && !agent.Session.PeerSupports(proto.CapUDP) {
+		s.metrics.dialFailures.With(dialUnsupported).Inc()
+		client.Session.SendControl(&proto.Control{
+			Type:     proto.MsgRefuse,
+			StreamID: streamID,
+			Error:    fmt.Sprintf("Agent %s does not support UDP", agentID),
+		})
+		return
+	}
+
+	clientKey := clientQuotaKey(client)
+	release, reason := s.quotas.acquire(agentID, clientKey)
+	if release == nil {
+		log.Printf("Dial %s refused: %s", streamID, reason)
+		s.metrics.dialFailures.With(dialQuota).Inc()
+		client.Session.SendControl(&proto.Control{
+			Type:     proto.MsgRefuse,
+			StreamID: streamID,
+			Error:    reason,
+		})
+		return
+	}
+	defer release()
+
+	// Compression is end to end between client and agent; the relay only
+	// passes the client's offer on when it has compression enabled and the
+	// agent announced it
+	var offer string
+	if s.compress && agent.Session.PeerSupports(proto.CapCompression) {
+		offer = dialMsg.Compression
+	}
+
+	replyCh := agent.expect(streamID)
+	defer agent.forget(streamID)
+
+	agent.streams.Expect(streamID)
+	defer agent.streams.Forget(streamID)
+
+	// Send DIAL to agent, or to the peer relay it is registered on
 	err := agent.Session.SendControl(&proto.Control{
-		Type:       proto.MsgDial,
-		StreamID:   streamID,
-		TargetAddr: targetAddr,
+		Type:        proto.MsgDial,
+		AgentID:     agentID,
+		StreamID:    streamID,
+		TargetAddr:  targetAddr,
+		Network:     dialMsg.Network,
+		Compression: offer,
 	})
 	if err != nil {
 		log.Printf("Failed to send dial to agent: %v", err)
+		s.metrics.dialFailures.With(dialAgentUnreachable).Inc()
 		client.Session.SendControl(&proto.Control{
 			Type:     proto.MsgRefuse,
 			StreamID: streamID,
@@ -278,20 +470,40 @@ func (s *Server) handleDial(client *ClientSession, dialMsg *proto.Control) {
 		return
 	}
 
-	// Open stream to client
-	clientStream, err := client.Session.OpenStream()
-	if err != nil {
-		log.Printf("Failed to open client stream: %v", err)
+	// Wait for the agent to connect to the target
+	var reply *proto.Control
+	failure := dialRefused
+	select {
+	case reply = <-replyCh:
+		if reply.Type == proto.MsgError {
+			failure = dialError
+		}
+	case <-time.After(transport.DialTimeout):
+		reply = &proto.Control{Type: proto.MsgRefuse, Error: "Timeout waiting for agent"}
+		failure = dialTimeout
+	case <-agent.ctx.Done():
+		reply = &proto.Control{Type: proto.MsgRefuse, Error: "Agent disconnected"}
+		failure = dialAgentGone
+	}
+
+	if reply.Type != proto.MsgAccept {
+		log.Printf("Dial %s %s by agent: %s", streamID, reply.Type, reply.Error)
+		s.metrics.dialFailures.With(failure).Inc()
+		client.Session.SendControl(&proto.Control{
+			Type:     reply.Type,
+			StreamID: streamID,
+			Error:    reply.Error,
+		})
 		return
 	}
-	defer clientStream.Close()
 
-	// Accept stream from agent
-	agentStream, err := agent.Session.AcceptStream()
+	// Wait for the agent stream tagged with this stream ID
+	agentStream, err := agent.streams.Wait(streamID, transport.DialTimeout)
 	if err != nil {
-		log.Printf("Failed to accept agent stream: %v", err)
+		log.Printf("Failed to get agent stream: %v", err)
+		s.metrics.dialFailures.With(dialStream).Inc()
 		client.Session.SendControl(&proto.Control{
-			Type:     proto.MsgRefuse,
+			Type:     proto.MsgError,
 			StreamID: streamID,
 			Error:    "Failed to establish agent stream",
 		})
@@ -299,19 +511,71 @@ func (s *Server) handleDial(client *ClientSession, dialMsg *proto.Control) {
 	}
 	defer agentStream.Close()
 
-	// Send ACCEPT to client
+	// Open stream to client
+	clientStream, err := client.Session.OpenStreamWithID(streamID)
+	if err != nil {
+		log.Printf("Failed to open client stream: %v", err)
+		s.metrics.dialFailures.With(dialStream).Inc()
+		return
+	}
+	defer clientStream.Close()
+
+	// Send ACCEPT to client with the codec the agent chose
 	client.Session.SendControl(&proto.Control{
-		Type:     proto.MsgAccept,
-		StreamID: streamID,
+		Type:        proto.MsgAccept,
+		StreamID:    streamID,
+		Compression: reply.Compression,
 	})
+	s.metrics.dialLatency.Observe(time.Since(start).Seconds())
 
-	log.Printf("Bridging streams for %s", streamID)
+	log.Printf("Bridging streams for %s (compression: %s)", streamID, compressionName(reply.Compression))
+
+	// Bridge the streams; Shutdown waits for them to finish
+	defer s.trackStream()()
 
-	// Bridge the streams
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	transport.Bridge(ctx, clientStream, agentStream)
+	agentConn := s.quotas.limit(ctx, s.metrics.countAgent(agentID, agentStream), agentID, clientKey)
+	transport.Bridge(ctx, clientStream, agentConn)
+}
+
+func (a *AgentSession) expect(streamID string) chan *proto.Control {
+	ch := make(chan *proto.Control, 1)
+	a.pendingMu.Lock()
+	a.pending[streamID] = ch
+	a.pendingMu.Unlock()
+	return ch
+}
+
+func (a *AgentSession) forget(streamID string) {
+	a.pendingMu.Lock()
+	delete(a.pending, streamID)
+	a.pendingMu.Unlock()
+}
+
+// deliver hands an agent's ACCEPT, REFUSE or ERROR to the DIAL waiting for it
+func (a *AgentSession) deliver(msg *proto.Control) {
+	a.pendingMu.Lock()
+	ch, exists := a.pending[msg.StreamID]
+	a.pendingMu.Unlock()
+
+	if !exists {
+		log.Printf("Agent %s reply for unknown stream %s", a.ID, msg.StreamID)
+		return
+	}
+
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+func compressionName(codec string) string {
+	if codec == "" {
+		return "none"
+	}
+	return codec
 }
 
 func (s *Server) Close() error {
@@ -324,6 +588,18 @@ func (s *Server) Close() error {
 		agent.cancel()
 		agent.Session.Close()
 	}
+
+	for client := range s.clients {
+		client.cancel()
+		client.Session.Close()
+	}
+
+	s.peersMu.Lock()
+	for _, link := range s.peers {
+		link.cancel()
+		link.Session.Close()
+	}
+	s.peersMu.Unlock()
 	
 	return nil
 }
@@ -0,0 +1,254 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types of an asciicast v2 recording
+const (
+	CastOutput = "o"
+	CastInput  = "i"
+	CastResize = "r"
+)
+
+// CastHeader is the first line of an asciicast v2 file
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// CastEvent is one timed event of a recording
+type CastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// Recorder writes a terminal session in asciicast v2 format, playable with
+// asciinema or 'ssh-pty replay'. It is safe for concurrent use, and a nil
+// Recorder records nothing.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	now     func() time.Time
+	pending map[string][]byte
+	err     error
+}
+
+// NewRecorder writes the header of a width x height recording to w
+func NewRecorder(w io.Writer, width, height int, title string) (*Recorder, error) {
+	r := &Recorder{
+		w:       w,
+		now:     time.Now,
+		pending: make(map[string][]byte),
+	}
+	r.start = r.now()
+
+	header := CastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+		return nil, fmt.Errorf("write recording header: %w", err)
+	}
+	return r, nil
+}
+
+// Output records data written to the terminal
+func (r *Recorder) Output(data []byte) {
+	r.record(CastOutput, data)
+}
+
+// Input records data typed by the user
+func (r *Recorder) Input(data []byte) {
+	r.record(CastInput, data)
+}
+
+// Resize records a terminal size change
+func (r *Recorder) Resize(width, height int) {
+	r.record(CastResize, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// Err returns the first error writing the recording
+func (r *Recorder) Err() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(kind string, data []byte) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	// Event data must be valid UTF-8, so a multi-byte character split
+	// across reads is held back until the rest of it arrives
+	data = append(r.pending[kind], data...)
+	complete := utf8Prefix(data)
+	r.pending[kind] = append([]byte(nil), data[complete:]...)
+	if complete == 0 {
+		return
+	}
+
+	event := []interface{}{r.now().Sub(r.start).Seconds(), kind, string(data[:complete])}
+	line, err := json.Marshal(event)
+	if err != nil {
+		r.err = err
+		return
+	}
+	if _, err := fmt.Fprintf(r.w, "%s\n", line); err != nil {
+		r.err = fmt.Errorf("write recording: %w", err)
+	}
+}
+
+// utf8Prefix returns the length of data without a trailing incomplete
+// UTF-8 sequence
+func utf8Prefix(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// CastReader reads the events of an asciicast v2 recording
+type CastReader struct {
+	Header  CastHeader
+	scanner *bufio.Scanner
+}
+
+// NewCastReader reads the header of a recording
+func NewCastReader(r io.Reader) (*CastReader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty recording")
+	}
+
+	cr := &CastReader{scanner: scanner}
+	if err := json.Unmarshal(scanner.Bytes(), &cr.Header); err != nil {
+		return nil, fmt.Errorf("parse recording header: %w", err)
+	}
+	if cr.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", cr.Header.Version)
+	}
+	return cr, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the recording
+func (cr *CastReader) Next() (CastEvent, error) {
+	for cr.scanner.Scan() {
+		line := cr.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var fields []json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil || len(fields) != 3 {
+			return CastEvent{}, fmt.Errorf("parse recording event: %q", line)
+		}
+
+		var event CastEvent
+		if err := json.Unmarshal(fields[0], &event.Time); err != nil {
+			return CastEvent{}, fmt.Errorf("parse event time: %w", err)
+		}
+		if err := json.Unmarshal(fields[1], &event.Type); err != nil {
+			return CastEvent{}, fmt.Errorf("parse event type: %w", err)
+		}
+		if err := json.Unmarshal(fields[2], &event.Data); err != nil {
+			return CastEvent{}, fmt.Errorf("parse event data: %w", err)
+		}
+		return event, nil
+	}
+
+	if err := cr.scanner.Err(); err != nil {
+		return CastEvent{}, err
+	}
+	return CastEvent{}, io.EOF
+}
+
+// Replay writes the output of a recording to w with its original timing
+// divided by speed. Pauses longer than maxIdle are shortened to maxIdle
+// when it is positive.
+func Replay(r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	return replay(r, w, speed, maxIdle, time.Sleep)
+}
+
+func replay(r io.Reader, w io.Writer, speed float64, maxIdle time.Duration, sleep func(time.Duration)) error {
+	if speed <= 0 {
+		return fmt.Errorf("invalid replay speed %v", speed)
+	}
+
+	cr, err := NewCastReader(r)
+	if err != nil {
+		return err
+	}
+
+	var last float64
+	for {
+		event, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if event.Type != CastOutput {
+			continue
+		}
+
+		delay := time.Duration((event.Time - last) * float64(time.Second))
+		last = event.Time
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		if delay > 0 {
+			sleep(time.Duration(float64(delay) / speed))
+		}
+
+		if _, err := io.WriteString(w, event.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf, 120, 40, "admin@site-a/10.0.0.5:22")
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+
+	now := r.start
+	r.now = func() time.Time { return now }
+
+	now = now.Add(500 * time.Millisecond)
+	r.Output([]byte("$ ls\r\n"))
+
+	// A multi-byte character split across reads is recorded whole
+	now = now.Add(time.Second)
+	r.Output([]byte("caf\xc3"))
+	r.Output([]byte("\xa9\r\n"))
+
+	now = now.Add(time.Second)
+	r.Resize(100, 30)
+	r.Input([]byte("exit\r"))
+
+	if err := r.Err(); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+
+	cr, err := NewCastReader(&buf)
+	if err != nil {
+		t.Fatalf("NewCastReader failed: %v", err)
+	}
+	if cr.Header.Version != 2 || cr.Header.Width != 120 || cr.Header.Height != 40 {
+		t.Errorf("unexpected header %+v", cr.Header)
+	}
+
+	want := []CastEvent{
+		{0.5, CastOutput, "$ ls\r\n"},
+		{1.5, CastOutput, "caf"},
+		{1.5, CastOutput, "é\r\n"},
+		{2.5, CastResize, "100x30"},
+		{2.5, CastInput, "exit\r"},
+	}
+	for _, w := range want {
+		event, err := cr.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if event != w {
+			t.Errorf("expected %+v, got %+v", w, event)
+		}
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recording := `{"version": 2, "width": 80, "height": 24}
+[0.5, "o", "hello "]
+[1.0, "i", "x"]
+[1.5, "r", "100x30"]
+[11.0, "o", "world\r\n"]
+`
+
+	var out bytes.Buffer
+	var slept []time.Duration
+	sleep := func(d time.Duration) { slept = append(slept, d) }
+
+	if err := replay(strings.NewReader(recording), &out, 2, 2*time.Second, sleep); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if out.String() != "hello world\r\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	// Halved by the speed, with the long pause capped before that
+	want := []time.Duration{250 * time.Millisecond, time.Second}
+	if len(slept) != len(want) || slept[0] != want[0] || slept[1] != want[1] {
+		t.Errorf("expected pauses %v, got %v", want, slept)
+	}
+
+	if err := replay(strings.NewReader(`{"version": 1}`), &out, 1, 0, sleep); err == nil {
+		t.Error("expected error for asciicast v1")
+	}
+}
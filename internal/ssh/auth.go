@@ -0,0 +1,265 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// Authentication methods that can be listed in AuthMethods
+const (
+	AuthPublicKey           = "publickey"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthPassword            = "password"
+)
+
+// passwordAttempts is how often a prompted password may be retried
+const passwordAttempts = 3
+
+// Prompter asks the user a question during authentication. echo is false
+// for secrets such as passwords, passphrases and one-time codes.
+type Prompter func(question string, echo bool) (string, error)
+
+// authOptions are the authentication settings shared by SSHConfig and
+// PTYConfig
+type authOptions struct {
+	Password    string
+	PrivateKey  string
+	Passphrase  string
+	Certificate string
+	UseAgent    bool
+	Methods     []string
+	Prompt      Prompter
+}
+
+// configureAuth sets the authentication methods of sshConfig in the order
+// OpenSSH tries them. When keys come from an ssh-agent the returned closer
+// releases its connection and must be called once the handshake is done.
+func configureAuth(sshConfig *ssh.ClientConfig, opts authOptions) (io.Closer, error) {
+	allowed, err := allowedMethods(opts.Methods)
+	if err != nil {
+		return nil, err
+	}
+	prompt := opts.Prompt
+	if prompt == nil {
+		prompt = promptSecret
+	}
+
+	var agentConn net.Conn
+	if allowed[AuthPublicKey] {
+		var signers []ssh.Signer
+
+		if opts.PrivateKey != "" {
+			signer, err := parsePrivateKey(opts.PrivateKey, opts.Passphrase, opts.Certificate, prompt)
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, signer)
+		}
+
+		var agentSigners func() ([]ssh.Signer, error)
+		if opts.UseAgent {
+			agentConn, err = dialAgent()
+			if err != nil {
+				return nil, err
+			}
+			agentSigners = agent.NewClient(agentConn).Signers
+		}
+
+		if len(signers) > 0 || agentSigners != nil {
+			sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				// Keys given explicitly are offered before the agent's
+				if agentSigners == nil {
+					return signers, nil
+				}
+				held, err := agentSigners()
+				if err != nil {
+					log.Printf("ssh-agent: %v", err)
+					return signers, nil
+				}
+				return append(signers, held...), nil
+			}))
+		}
+	}
+
+	if allowed[AuthKeyboardInteractive] {
+		sshConfig.Auth = append(sshConfig.Auth, ssh.KeyboardInteractive(keyboardInteractive(opts.Password, prompt)))
+	}
+
+	if allowed[AuthPassword] {
+		if opts.Password != "" {
+			sshConfig.Auth = append(sshConfig.Auth, ssh.Password(opts.Password))
+		} else {
+			question := fmt.Sprintf("%s's password: ", sshConfig.User)
+			sshConfig.Auth = append(sshConfig.Auth, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+				return prompt(question, false)
+			}), passwordAttempts))
+		}
+	}
+
+	if len(sshConfig.Auth) == 0 {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, errors.New("no authentication method available")
+	}
+	if agentConn == nil {
+		return nil, nil
+	}
+	return agentConn, nil
+}
+
+func allowedMethods(methods []string) (map[string]bool, error) {
+	if len(methods) == 0 {
+		methods = []string{AuthPublicKey, AuthKeyboardInteractive, AuthPassword}
+	}
+
+	allowed := make(map[string]bool)
+	for _, method := range methods {
+		switch method = strings.TrimSpace(method); method {
+		case AuthPublicKey, AuthKeyboardInteractive, AuthPassword:
+			allowed[method] = true
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return allowed, nil
+}
+
+// parsePrivateKey decodes an OpenSSH or PEM private key, asking for the
+// passphrase if the key is encrypted and none was given. A certificate in
+// authorized_keys format is attached to the key.
+func parsePrivateKey(privateKey, passphrase, certificate string, prompt Prompter) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			passphrase, err = prompt("Enter passphrase for key: ", false)
+			if err != nil {
+				return nil, fmt.Errorf("read passphrase: %w", err)
+			}
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	if certificate == "" {
+		return signer, nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("parse certificate: not an OpenSSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("parse certificate: not a user certificate")
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate does not match private key: %w", err)
+	}
+	return certSigner, nil
+}
+
+// keyboardInteractive answers server challenges such as PAM password and
+// one-time code prompts. A configured password answers the first hidden
+// password question so it is not asked for twice.
+func keyboardInteractive(password string, prompt Prompter) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if name != "" {
+			fmt.Fprintln(os.Stderr, name)
+		}
+		if instruction != "" {
+			fmt.Fprintln(os.Stderr, instruction)
+		}
+
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if password != "" && !echos[i] && strings.Contains(strings.ToLower(question), "password") {
+				answers[i] = password
+				password = ""
+				continue
+			}
+
+			answer, err := prompt(question, echos[i])
+			if err != nil {
+				return nil, fmt.Errorf("read answer: %w", err)
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+}
+
+// dialAgent connects to the ssh-agent named by SSH_AUTH_SOCK
+func dialAgent() (net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("ssh-agent requested but SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	return conn, nil
+}
+
+// forwardAgent makes the local ssh-agent available to sessions that
+// request agent forwarding
+func forwardAgent(client *ssh.Client) error {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return errors.New("agent forwarding requested but SSH_AUTH_SOCK is not set")
+	}
+	return agent.ForwardToRemote(client, socket)
+}
+
+// newSession opens a session, asking the server to forward the local agent
+// to it when enabled
+func newSession(client *ssh.Client, forwardAgent bool) (*ssh.Session, error) {
+	session, err := client.NewSession()
+	if err != nil || !forwardAgent {
+		return session, err
+	}
+
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		log.Printf("Agent forwarding refused: %v", err)
+	}
+	return session, nil
+}
+
+// promptSecret asks a question on the terminal, hiding the answer unless
+// echo is set
+func promptSecret(question string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, question)
+
+	fd := int(os.Stdin.Fd())
+	if !echo && term.IsTerminal(fd) {
+		answer, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(answer), err
+	}
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	return strings.TrimRight(answer, "\r\n"), nil
+}
@@ -0,0 +1,267 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testPrivateKey returns a signer and its PEM encoding, encrypted when
+// passphrase is set
+func testPrivateKey(t *testing.T, passphrase string) (ssh.Signer, string) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return signer, string(pem.EncodeToMemory(block))
+}
+
+// testServer runs an SSH handshake against config and reports its result
+func testServer(t *testing.T, config *ssh.ServerConfig) (net.Conn, <-chan error) {
+	t.Helper()
+
+	config.AddHostKey(testSigner(t))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		server, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer server.Close()
+
+		conn, _, _, err := ssh.NewServerConn(server, config)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	return client, done
+}
+
+func testHandshake(t *testing.T, server *ssh.ServerConfig, opts authOptions) error {
+	t.Helper()
+
+	conn, done := testServer(t, server)
+	defer conn.Close()
+
+	config := &ssh.ClientConfig{User: "admin", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	closer, err := configureAuth(config, opts)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	sshConn, _, _, err := ssh.NewClientConn(conn, "remote", config)
+	if err != nil {
+		return err
+	}
+	sshConn.Close()
+	return <-done
+}
+
+func TestAllowedMethods(t *testing.T) {
+	allowed, err := allowedMethods([]string{"publickey", " keyboard-interactive"})
+	if err != nil {
+		t.Fatalf("allowedMethods failed: %v", err)
+	}
+	if !allowed[AuthPublicKey] || !allowed[AuthKeyboardInteractive] || allowed[AuthPassword] {
+		t.Errorf("unexpected methods %v", allowed)
+	}
+
+	if _, err := allowedMethods([]string{"hostbased"}); err == nil {
+		t.Error("expected error for unknown method")
+	}
+}
+
+func TestEncryptedPrivateKey(t *testing.T) {
+	signer, key := testPrivateKey(t, "secret")
+
+	prompted := 0
+	prompt := func(string, bool) (string, error) {
+		prompted++
+		return "secret", nil
+	}
+
+	parsed, err := parsePrivateKey(key, "", "", prompt)
+	if err != nil {
+		t.Fatalf("Failed to decrypt key: %v", err)
+	}
+	if prompted != 1 {
+		t.Errorf("expected one passphrase prompt, got %d", prompted)
+	}
+	if !bytes.Equal(parsed.PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+		t.Error("decrypted key does not match")
+	}
+
+	if _, err := parsePrivateKey(key, "wrong", "", prompt); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+}
+
+func TestCertificateAuth(t *testing.T) {
+	ca := testSigner(t)
+	user, key := testPrivateKey(t, "")
+
+	cert := &ssh.Certificate{
+		Key:             user.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"admin"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	server := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+
+	err := testHandshake(t, server, authOptions{
+		PrivateKey:  key,
+		Certificate: string(ssh.MarshalAuthorizedKey(cert)),
+		Methods:     []string{AuthPublicKey},
+	})
+	if err != nil {
+		t.Errorf("certificate authentication failed: %v", err)
+	}
+
+	// A certificate for another key is rejected up front
+	_, other := testPrivateKey(t, "")
+	_, err = parsePrivateKey(other, "", string(ssh.MarshalAuthorizedKey(cert)), nil)
+	if err == nil {
+		t.Error("expected error for certificate of another key")
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	user, key := testPrivateKey(t, "")
+	keyring := agent.NewKeyring()
+	raw, err := ssh.ParseRawPrivateKey([]byte(key))
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw}); err != nil {
+		t.Fatalf("Failed to add key to agent: %v", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	server := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), user.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+
+	err = testHandshake(t, server, authOptions{UseAgent: true, Methods: []string{AuthPublicKey}})
+	if err != nil {
+		t.Errorf("agent authentication failed: %v", err)
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	server := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: ", "Verification code: "}, []bool{false, false})
+			if err != nil {
+				return nil, err
+			}
+			if answers[0] != "hunter2" || answers[1] != "123456" {
+				return nil, errors.New("wrong answers")
+			}
+			return nil, nil
+		},
+	}
+
+	var asked []string
+	err := testHandshake(t, server, authOptions{
+		Password: "hunter2",
+		Methods:  []string{AuthKeyboardInteractive},
+		Prompt: func(question string, echo bool) (string, error) {
+			asked = append(asked, question)
+			return "123456", nil
+		},
+	})
+	if err != nil {
+		t.Errorf("keyboard-interactive authentication failed: %v", err)
+	}
+	if len(asked) != 1 || asked[0] != "Verification code: " {
+		t.Errorf("expected only the code to be prompted, got %q", asked)
+	}
+}
+
+func TestPasswordsForbidden(t *testing.T) {
+	server := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+
+	_, err := configureAuth(&ssh.ClientConfig{}, authOptions{Password: "hunter2", Methods: []string{AuthPublicKey}})
+	if err == nil {
+		t.Error("expected error when no allowed method is usable")
+	}
+
+	err = testHandshake(t, server, authOptions{Password: "hunter2"})
+	if err != nil {
+		t.Errorf("password authentication failed: %v", err)
+	}
+}
@@ -22,6 +22,10 @@ type SSHClient struct {
 	logFile      *os.File
 	logEnabled   bool
 	logDirectory string
+	forwardAgent bool
+	sftp         *SFTPClient
+	sftpSession  *ssh.Session
+	forwards     forwarder
 }
 
 type SSHConfig struct {
@@ -31,6 +35,28 @@ type SSHConfig struct {
 	TunnelConn   net.Conn
 	LogEnabled   bool
 	LogDirectory string
+
+	// KnownHosts verifies the host key under HostKeyAddress; nil skips
+	// host key verification
+	KnownHosts     *KnownHosts
+	HostKeyAddress string
+
+	// Passphrase decrypts PrivateKey and Certificate is its OpenSSH user
+	// certificate (the contents of id_*-cert.pub)
+	Passphrase  string
+	Certificate string
+
+	// UseAgent authenticates with the keys of the ssh-agent at
+	// SSH_AUTH_SOCK; ForwardAgent makes that agent available on the server
+	UseAgent     bool
+	ForwardAgent bool
+
+	// AuthMethods limits the methods tried (publickey,
+	// keyboard-interactive, password); empty allows all. Prompt asks for
+	// missing passwords, passphrases and keyboard-interactive answers; nil
+	// prompts on the terminal.
+	AuthMethods []string
+	Prompt      Prompter
 }
 
 func NewSSHClient(config *SSHConfig) (*SSHClient, error) {
@@ -49,31 +75,44 @@ func NewSSHClient(config *SSHConfig) (*SSHClient, error) {
 
 	// Create SSH client configuration
 	sshConfig := &ssh.ClientConfig{
-		User:            config.Username,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // For tunnel connections
-		Timeout:         30 * time.Second,
+		User:    config.Username,
+		Timeout: 30 * time.Second,
 	}
+	hostAddr := configureHostKey(sshConfig, config.KnownHosts, config.HostKeyAddress)
 
 	// Add authentication methods
-	if config.Password != "" {
-		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(config.Password))
+	agentConn, err := configureAuth(sshConfig, authOptions{
+		Password:    config.Password,
+		PrivateKey:  config.PrivateKey,
+		Passphrase:  config.Passphrase,
+		Certificate: config.Certificate,
+		UseAgent:    config.UseAgent,
+		Methods:     config.AuthMethods,
+		Prompt:      config.Prompt,
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	if config.PrivateKey != "" {
-		key, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
-		if err != nil {
-			return nil, fmt.Errorf("parse private key: %w", err)
-		}
-		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(key))
+	if agentConn != nil {
+		defer agentConn.Close()
 	}
 
 	// Connect via tunnel
-	sshConn, chans, reqs, err := ssh.NewClientConn(config.TunnelConn, "remote", sshConfig)
+	sshConn, chans, reqs, err := ssh.NewClientConn(config.TunnelConn, hostAddr, sshConfig)
 	if err != nil {
 		return nil, fmt.Errorf("ssh connection: %w", err)
 	}
 
 	client.sshClient = ssh.NewClient(sshConn, chans, reqs)
+
+	if config.ForwardAgent {
+		if err := forwardAgent(client.sshClient); err != nil {
+			client.sshClient.Close()
+			return nil, fmt.Errorf("agent forwarding: %w", err)
+		}
+		client.forwardAgent = true
+	}
+
 	return client, nil
 }
 
@@ -113,7 +152,7 @@ func (c *SSHClient) setupLogging() error {
 }
 
 func (c *SSHClient) StartInteractiveSession() error {
-	session, err := c.sshClient.NewSession()
+	session, err := newSession(c.sshClient, c.forwardAgent)
 	if err != nil {
 		return fmt.Errorf("create session: %w", err)
 	}
@@ -337,7 +376,7 @@ func (c *SSHClient) logOutput(stream string, data []byte) {
 }
 
 func (c *SSHClient) ExecuteCommand(command string) (string, error) {
-	session, err := c.sshClient.NewSession()
+	session, err := newSession(c.sshClient, c.forwardAgent)
 	if err != nil {
 		return "", fmt.Errorf("create session: %w", err)
 	}
@@ -364,6 +403,12 @@ func (c *SSHClient) ExecuteCommand(command string) (string, error) {
 	return string(output), nil
 }
 
+// StartForward serves a -L, -R or -D forward on the SSH connection until
+// Close and returns the address listened on
+func (c *SSHClient) StartForward(fwd Forward) (net.Addr, error) {
+	return c.forwards.start(c.sshClient, fwd)
+}
+
 func (c *SSHClient) Close() error {
 	if c.logFile != nil {
 		// Write session footer
@@ -375,6 +420,13 @@ func (c *SSHClient) Close() error {
 		c.logFile.Close()
 	}
 
+	if c.sftpSession != nil {
+		c.sftp.Close()
+		c.sftpSession.Close()
+	}
+
+	c.forwards.close()
+
 	if c.sshClient != nil {
 		return c.sshClient.Close()
 	}
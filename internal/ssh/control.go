@@ -0,0 +1,569 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Control master modes, as with OpenSSH's ControlMaster option
+const (
+	ControlNo   = "no"
+	ControlAuto = "auto"
+	ControlYes  = "yes"
+)
+
+// Frame types of the control socket protocol. After the client's open
+// frame the master answers with ack or failure, then both sides exchange
+// data until the master sends the exit status.
+const (
+	frameOpen    = 'O'
+	frameAck     = 'A'
+	frameFailure = 'F'
+	frameStdin   = 'i'
+	frameEOF     = 'c'
+	frameStdout  = 'o'
+	frameStderr  = 'e'
+	frameWindow  = 'w'
+	frameSignal  = 's'
+	frameExit    = 'x'
+)
+
+// maxFrame bounds control frames; data frames carry at most 32KiB
+const maxFrame = 64 * 1024
+
+// ptySession is the part of *ssh.Session used by PTYClient, also provided
+// by sessions shared through a control master
+type ptySession interface {
+	RequestPty(term string, h, w int, modes ssh.TerminalModes) error
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	StderrPipe() (io.Reader, error)
+	Shell() error
+	Wait() error
+	WindowChange(h, w int) error
+	Signal(sig ssh.Signal) error
+	CombinedOutput(cmd string) ([]byte, error)
+	Close() error
+}
+
+// controlOpen asks the master for a session
+type controlOpen struct {
+	User    string            `json:"user"`
+	Address string            `json:"address"`
+	Term    string            `json:"term,omitempty"`
+	Width   int               `json:"width,omitempty"`
+	Height  int               `json:"height,omitempty"`
+	Modes   ssh.TerminalModes `json:"modes,omitempty"`
+	Command string            `json:"command,omitempty"`
+}
+
+// ControlExitError reports a non-zero exit status of a shared session
+type ControlExitError struct {
+	Status int
+}
+
+func (e *ControlExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+// ExitStatus returns the remote exit status, like ssh.ExitError
+func (e *ControlExitError) ExitStatus() int {
+	return e.Status
+}
+
+// DefaultControlPath returns the control socket for a user on a target
+// behind an agent. The name is hashed to stay within unix socket limits.
+func DefaultControlPath(agentID, user, target string) string {
+	dir := os.TempDir()
+	if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, ".ssh")
+	}
+
+	sum := sha256.Sum256([]byte(user + "@" + HostKeyAddress(agentID, target)))
+	return filepath.Join(dir, "remote-tunnel", "cm-"+hex.EncodeToString(sum[:8])+".sock")
+}
+
+// ControlMasterRunning reports whether a master accepts connections at path
+func ControlMasterRunning(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// ServeControl makes the client a control master: later ssh-pty runs for
+// the same user and host open sessions on this connection through the
+// unix socket at path instead of reconnecting.
+func (c *PTYClient) ServeControl(path string) error {
+	if ControlMasterRunning(path) {
+		return fmt.Errorf("control master already running at %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create control directory: %w", err)
+	}
+	// A socket left behind by a master that died
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("restrict control socket: %w", err)
+	}
+
+	c.mutex.Lock()
+	c.controlListener = listener
+	c.mutex.Unlock()
+
+	c.logSession(fmt.Sprintf("Control master listening on %s", path))
+	go c.acceptControl(listener)
+	return nil
+}
+
+// WaitShared waits for sessions opened through the control socket to end
+// and stops accepting new ones
+func (c *PTYClient) WaitShared() {
+	c.mutex.Lock()
+	listener := c.controlListener
+	c.controlListener = nil
+	c.mutex.Unlock()
+
+	if listener == nil {
+		return
+	}
+	listener.Close()
+	c.shared.Wait()
+}
+
+func (c *PTYClient) acceptControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if err := checkControlPeer(conn); err != nil {
+			log.Printf("Control connection rejected: %v", err)
+			conn.Close()
+			continue
+		}
+
+		c.shared.Add(1)
+		go func() {
+			defer c.shared.Done()
+			c.serveShared(conn)
+		}()
+	}
+}
+
+// serveShared runs one session requested over the control socket
+func (c *PTYClient) serveShared(conn net.Conn) {
+	defer conn.Close()
+	fc := &frameConn{conn: conn}
+
+	typ, payload, err := fc.read()
+	if err != nil || typ != frameOpen {
+		return
+	}
+	var req controlOpen
+	if err := json.Unmarshal(payload, &req); err != nil {
+		fc.write(frameFailure, []byte("invalid open request"))
+		return
+	}
+	if req.User != c.controlUser || req.Address != c.controlAddress {
+		fc.write(frameFailure, []byte(fmt.Sprintf("control master is connected to %s@%s", c.controlUser, c.controlAddress)))
+		return
+	}
+
+	session, err := c.startShared(&req)
+	if err != nil {
+		fc.write(frameFailure, []byte(err.Error()))
+		return
+	}
+	defer session.Close()
+
+	c.logSession(fmt.Sprintf("Shared session opened (%s)", describeShared(&req)))
+	fc.write(frameAck, nil)
+
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	stderr, _ := session.StderrPipe()
+	if err := runShared(session, req.Command); err != nil {
+		fc.write(frameExit, exitPayload(err))
+		return
+	}
+
+	go func() {
+		for {
+			typ, payload, err := fc.read()
+			if err != nil {
+				session.Close()
+				return
+			}
+			switch typ {
+			case frameStdin:
+				stdin.Write(payload)
+			case frameEOF:
+				stdin.Close()
+			case frameWindow:
+				if len(payload) == 8 {
+					session.WindowChange(int(binary.BigEndian.Uint32(payload[4:])), int(binary.BigEndian.Uint32(payload)))
+				}
+			case frameSignal:
+				session.Signal(ssh.Signal(payload))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fc.copyFrom(frameStdout, stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		fc.copyFrom(frameStderr, stderr)
+	}()
+
+	err = session.Wait()
+	wg.Wait()
+	fc.write(frameExit, exitPayload(err))
+	c.logSession(fmt.Sprintf("Shared session closed (%s)", describeShared(&req)))
+}
+
+func (c *PTYClient) startShared(req *controlOpen) (*ssh.Session, error) {
+	session, err := newSession(c.sshClient, c.forwardAgent)
+	if err != nil {
+		return nil, fmt.Errorf("create session: %w", err)
+	}
+	if req.Term != "" {
+		if err := session.RequestPty(req.Term, req.Height, req.Width, req.Modes); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("request PTY: %w", err)
+		}
+	}
+	return session, nil
+}
+
+func runShared(session *ssh.Session, command string) error {
+	if command != "" {
+		return session.Start(command)
+	}
+	return session.Shell()
+}
+
+func describeShared(req *controlOpen) string {
+	if req.Command != "" {
+		return "command: " + req.Command
+	}
+	return "shell"
+}
+
+// exitPayload encodes a session's exit status and error message
+func exitPayload(err error) []byte {
+	status := 0
+	var exitErr interface{ ExitStatus() int }
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		status = exitErr.ExitStatus()
+	default:
+		status = 255
+	}
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(status))
+	if err != nil && status == 255 {
+		payload = append(payload, err.Error()...)
+	}
+	return payload
+}
+
+// checkControlPeer only lets the user running the master use its socket;
+// the socket's permissions already enforce this where peer credentials are
+// not available
+func checkControlPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	uid, err := peerUID(uc)
+	if err != nil || uid < 0 {
+		return nil
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("peer uid %d is not %d", uid, os.Getuid())
+	}
+	return nil
+}
+
+// NewPTYClientControl creates a PTY client whose sessions are opened by the
+// control master listening at path. Logging and recording work as for a
+// direct connection; authentication settings are not used.
+func NewPTYClientControl(config *PTYConfig, path string) (*PTYClient, error) {
+	client, err := newPTYClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.controlPath = path
+	return client, nil
+}
+
+// openSession starts a session directly or through the control master
+func (c *PTYClient) openSession() (ptySession, error) {
+	if c.controlPath == "" {
+		return newSession(c.sshClient, c.forwardAgent)
+	}
+
+	conn, err := net.Dial("unix", c.controlPath)
+	if err != nil {
+		return nil, fmt.Errorf("connect to control master: %w", err)
+	}
+	return &controlSession{
+		fc:   &frameConn{conn: conn},
+		req:  controlOpen{User: c.controlUser, Address: c.controlAddress},
+		done: make(chan error, 1),
+	}, nil
+}
+
+// controlSession is a session run by a control master on its connection
+type controlSession struct {
+	fc  *frameConn
+	req controlOpen
+
+	stdoutR, stderrR *io.PipeReader
+	stdoutW, stderrW *io.PipeWriter
+	done             chan error
+}
+
+func (s *controlSession) RequestPty(term string, h, w int, modes ssh.TerminalModes) error {
+	s.req.Term, s.req.Width, s.req.Height, s.req.Modes = term, w, h, modes
+	return nil
+}
+
+func (s *controlSession) StdinPipe() (io.WriteCloser, error) {
+	return &controlStdin{fc: s.fc}, nil
+}
+
+func (s *controlSession) StdoutPipe() (io.Reader, error) {
+	if s.stdoutR == nil {
+		s.stdoutR, s.stdoutW = io.Pipe()
+	}
+	return s.stdoutR, nil
+}
+
+func (s *controlSession) StderrPipe() (io.Reader, error) {
+	if s.stderrR == nil {
+		s.stderrR, s.stderrW = io.Pipe()
+	}
+	return s.stderrR, nil
+}
+
+func (s *controlSession) Shell() error {
+	return s.start("")
+}
+
+func (s *controlSession) start(command string) error {
+	s.req.Command = command
+	payload, err := json.Marshal(s.req)
+	if err != nil {
+		return err
+	}
+	if err := s.fc.write(frameOpen, payload); err != nil {
+		return fmt.Errorf("control master: %w", err)
+	}
+
+	typ, payload, err := s.fc.read()
+	if err != nil {
+		return fmt.Errorf("control master: %w", err)
+	}
+	if typ == frameFailure {
+		return fmt.Errorf("control master: %s", payload)
+	}
+	if typ != frameAck {
+		return fmt.Errorf("control master: unexpected frame %q", typ)
+	}
+
+	go s.readLoop()
+	return nil
+}
+
+func (s *controlSession) readLoop() {
+	err := errors.New("control master closed the session")
+	defer func() {
+		for _, w := range []*io.PipeWriter{s.stdoutW, s.stderrW} {
+			if w != nil {
+				w.Close()
+			}
+		}
+		s.done <- err
+	}()
+
+	for {
+		typ, payload, readErr := s.fc.read()
+		if readErr != nil {
+			return
+		}
+		switch typ {
+		case frameStdout:
+			if s.stdoutW != nil {
+				s.stdoutW.Write(payload)
+			}
+		case frameStderr:
+			if s.stderrW != nil {
+				s.stderrW.Write(payload)
+			}
+		case frameExit:
+			err = decodeExit(payload)
+			return
+		}
+	}
+}
+
+func decodeExit(payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("control master: invalid exit status")
+	}
+	status := int(binary.BigEndian.Uint32(payload))
+	if len(payload) > 4 {
+		return errors.New(string(payload[4:]))
+	}
+	if status == 0 {
+		return nil
+	}
+	return &ControlExitError{Status: status}
+}
+
+func (s *controlSession) Wait() error {
+	return <-s.done
+}
+
+func (s *controlSession) WindowChange(h, w int) error {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(w))
+	return s.fc.write(frameWindow, binary.BigEndian.AppendUint32(payload, uint32(h)))
+}
+
+func (s *controlSession) Signal(sig ssh.Signal) error {
+	return s.fc.write(frameSignal, []byte(sig))
+}
+
+func (s *controlSession) CombinedOutput(cmd string) ([]byte, error) {
+	var out bytes.Buffer
+	stdout, _ := s.StdoutPipe()
+	stderr, _ := s.StderrPipe()
+	if err := s.start(cmd); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for {
+				n, err := r.Read(buf)
+				mu.Lock()
+				out.Write(buf[:n])
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(r)
+	}
+
+	err := s.Wait()
+	wg.Wait()
+	return out.Bytes(), err
+}
+
+func (s *controlSession) Close() error {
+	return s.fc.conn.Close()
+}
+
+// controlStdin sends stdin to the master; Close signals EOF
+type controlStdin struct {
+	fc *frameConn
+}
+
+func (w *controlStdin) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += sftpChunk {
+		if err := w.fc.write(frameStdin, p[off:min(len(p), off+sftpChunk)]); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *controlStdin) Close() error {
+	return w.fc.write(frameEOF, nil)
+}
+
+// frameConn reads and writes length-prefixed frames: a uint32 length, the
+// frame type and the payload
+type frameConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+}
+
+func (fc *frameConn) write(typ byte, payload []byte) error {
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 5+len(payload)), uint32(1+len(payload)))
+	frame = append(frame, typ)
+	frame = append(frame, payload...)
+
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+	_, err := fc.conn.Write(frame)
+	return err
+}
+
+func (fc *frameConn) read() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(fc.conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxFrame {
+		return 0, nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(fc.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// copyFrom sends everything read from r as frames of type typ
+func (fc *frameConn) copyFrom(typ byte, r io.Reader) {
+	buf := make([]byte, sftpChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if fc.write(typ, buf[:n]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSessionServer accepts one SSH connection whose sessions run "exec"
+// requests by answering "ran: <command>" and exiting with status 3 for
+// "fail"; a shell echoes its input until EOF. It also serves direct-tcpip
+// channels and tcpip-forward requests for port forwarding.
+func testSessionServer(t *testing.T) *ssh.Client {
+	t.Helper()
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigner(t))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go func() {
+		server, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(server, config)
+		if err != nil {
+			server.Close()
+			return
+		}
+		go serveTestGlobal(conn, reqs)
+		for newChannel := range chans {
+			if newChannel.ChannelType() == "direct-tcpip" {
+				go serveTestDirect(newChannel)
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go serveTestSession(channel, requests)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "test", &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func serveTestSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	exit := func(status uint32) {
+		channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+	}
+	for req := range requests {
+		switch req.Type {
+		case "pty-req", "window-change":
+			req.Reply(true, nil)
+		case "exec":
+			req.Reply(true, nil)
+			command, _, _ := decodeString(req.Payload)
+			io.WriteString(channel, "ran: "+command+"\n")
+			if command == "fail" {
+				exit(3)
+			} else {
+				exit(0)
+			}
+			return
+		case "shell":
+			req.Reply(true, nil)
+			io.Copy(channel, channel)
+			exit(0)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestControlMaster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cm.sock")
+	master := &PTYClient{
+		sshClient:      testSessionServer(t),
+		controlUser:    "alice",
+		controlAddress: "agent/host:22",
+	}
+	if err := master.ServeControl(path); err != nil {
+		t.Fatalf("ServeControl failed: %v", err)
+	}
+	if !ControlMasterRunning(path) {
+		t.Fatal("control master not reachable")
+	}
+	if err := master.ServeControl(path); err == nil {
+		t.Error("expected a second master on the same path to fail")
+	}
+
+	slave := &PTYClient{controlPath: path, controlUser: "alice", controlAddress: "agent/host:22"}
+
+	session, err := slave.openSession()
+	if err != nil {
+		t.Fatalf("openSession failed: %v", err)
+	}
+	output, err := session.CombinedOutput("uptime")
+	session.Close()
+	if err != nil || string(output) != "ran: uptime\n" {
+		t.Errorf("unexpected result %q, %v", output, err)
+	}
+
+	session, _ = slave.openSession()
+	_, err = session.CombinedOutput("fail")
+	session.Close()
+	var exitErr interface{ ExitStatus() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+
+	// An interactive session forwards stdin and its EOF
+	session, _ = slave.openSession()
+	session.RequestPty("xterm", 24, 80, nil)
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell failed: %v", err)
+	}
+	if err := session.WindowChange(40, 120); err != nil {
+		t.Errorf("WindowChange failed: %v", err)
+	}
+	io.WriteString(stdin, "echo me")
+	stdin.Close()
+	echoed, _ := io.ReadAll(stdout)
+	if err := session.Wait(); err != nil || string(echoed) != "echo me" {
+		t.Errorf("unexpected shell result %q, %v", echoed, err)
+	}
+	session.Close()
+
+	// Sessions for another user or host are refused
+	other := &PTYClient{controlPath: path, controlUser: "bob", controlAddress: "agent/host:22"}
+	session, _ = other.openSession()
+	if _, err := session.CombinedOutput("uptime"); err == nil || !strings.Contains(err.Error(), "alice@agent/host:22") {
+		t.Errorf("expected a refusal, got %v", err)
+	}
+	session.Close()
+
+	master.WaitShared()
+	if ControlMasterRunning(path) {
+		t.Error("control socket still accepting after WaitShared")
+	}
+}
+
+func TestDefaultControlPath(t *testing.T) {
+	a := DefaultControlPath("agent", "alice", "10.0.0.5:22")
+	if a != DefaultControlPath("agent", "alice", "10.0.0.5") {
+		t.Error("default port should not change the control path")
+	}
+	if a == DefaultControlPath("agent", "bob", "10.0.0.5:22") || a == DefaultControlPath("other", "alice", "10.0.0.5:22") {
+		t.Error("control paths should differ per user and agent")
+	}
+	if !strings.HasSuffix(a, ".sock") {
+		t.Errorf("unexpected path %s", a)
+	}
+}
@@ -0,0 +1,353 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Forward kinds, named after the OpenSSH flags
+const (
+	ForwardLocal   = "L"
+	ForwardRemote  = "R"
+	ForwardDynamic = "D"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded          = 0x00
+	socks5ReplyGeneralFailure     = 0x01
+	socks5ReplyNotAllowed         = 0x02
+	socks5ReplyCommandUnsupported = 0x07
+	socks5ReplyAddrUnsupported    = 0x08
+
+	forwardDialTimeout    = 10 * time.Second
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// Forward is a port forward carried over the SSH connection. Listen is a
+// local address for -L and -D and an address on the SSH server for -R;
+// Target is dialed by the SSH server for -L and locally for -R.
+type Forward struct {
+	Kind   string
+	Listen string
+	Target string
+}
+
+func (f Forward) String() string {
+	switch f.Kind {
+	case ForwardLocal:
+		return fmt.Sprintf("local %s -> remote %s", f.Listen, f.Target)
+	case ForwardRemote:
+		return fmt.Sprintf("remote %s -> local %s", f.Listen, f.Target)
+	default:
+		return fmt.Sprintf("SOCKS5 %s", f.Listen)
+	}
+}
+
+// ParseForward parses a forward in OpenSSH syntax: [bind:]port:host:hostport
+// for -L and -R, [bind:]port for -D. IPv6 addresses go in brackets. The
+// listener binds to loopback unless bind is given; "*" binds to all
+// addresses.
+func ParseForward(kind, spec string) (Forward, error) {
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return Forward{}, fmt.Errorf("invalid -%s %q: %w", kind, spec, err)
+	}
+
+	bind := "127.0.0.1"
+	var port, host, hostPort string
+	switch {
+	case kind == ForwardDynamic && len(parts) == 1:
+		port = parts[0]
+	case kind == ForwardDynamic && len(parts) == 2:
+		bind, port = parts[0], parts[1]
+	case kind != ForwardDynamic && len(parts) == 3:
+		port, host, hostPort = parts[0], parts[1], parts[2]
+	case kind != ForwardDynamic && len(parts) == 4:
+		bind, port, host, hostPort = parts[0], parts[1], parts[2], parts[3]
+	default:
+		if kind == ForwardDynamic {
+			return Forward{}, fmt.Errorf("invalid -%s %q: expected [bind:]port", kind, spec)
+		}
+		return Forward{}, fmt.Errorf("invalid -%s %q: expected [bind:]port:host:hostport", kind, spec)
+	}
+
+	if kind != ForwardLocal && kind != ForwardRemote && kind != ForwardDynamic {
+		return Forward{}, fmt.Errorf("unknown forward kind %q", kind)
+	}
+	if bind == "*" || bind == "" {
+		bind = "0.0.0.0"
+	}
+	if !validPort(port, true) || (kind != ForwardDynamic && (host == "" || !validPort(hostPort, false))) {
+		return Forward{}, fmt.Errorf("invalid -%s %q: bad host or port", kind, spec)
+	}
+
+	fwd := Forward{Kind: kind, Listen: net.JoinHostPort(bind, port)}
+	if kind != ForwardDynamic {
+		fwd.Target = net.JoinHostPort(host, hostPort)
+	}
+	return fwd, nil
+}
+
+// splitForwardSpec splits on colons outside of brackets and removes the
+// brackets
+func splitForwardSpec(spec string) ([]string, error) {
+	var parts []string
+	var current strings.Builder
+	bracketed := false
+
+	for _, r := range spec {
+		switch {
+		case r == '[' && !bracketed:
+			bracketed = true
+		case r == ']' && bracketed:
+			bracketed = false
+		case r == ':' && !bracketed:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if bracketed {
+		return nil, errors.New("unterminated [")
+	}
+	return append(parts, current.String()), nil
+}
+
+// validPort accepts 1-65535, and 0 for an automatically chosen port when
+// listening
+func validPort(port string, listen bool) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil || n > 65535 {
+		return false
+	}
+	return n > 0 || (n == 0 && listen)
+}
+
+// forwarder serves port forwards over an SSH connection
+type forwarder struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+}
+
+// start listens for a forward and returns the address listened on, which
+// carries the chosen port when the forward asked for port 0
+func (f *forwarder) start(client *ssh.Client, fwd Forward) (net.Addr, error) {
+	var listener net.Listener
+	var err error
+	if fwd.Kind == ForwardRemote {
+		listener, err = client.Listen("tcp", fwd.Listen)
+	} else {
+		listener, err = net.Listen("tcp", fwd.Listen)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: %w", fwd, err)
+	}
+
+	f.mu.Lock()
+	f.listeners = append(f.listeners, listener)
+	f.mu.Unlock()
+
+	log.Printf("Forwarding %s", fwd)
+	go f.serve(client, fwd, listener)
+	return listener.Addr(), nil
+}
+
+func (f *forwarder) serve(client *ssh.Client, fwd Forward, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(client, fwd, conn)
+	}
+}
+
+func (f *forwarder) handle(client *ssh.Client, fwd Forward, conn net.Conn) {
+	defer conn.Close()
+
+	switch fwd.Kind {
+	case ForwardLocal:
+		target, err := client.Dial("tcp", fwd.Target)
+		if err != nil {
+			log.Printf("Forward to %s via SSH failed: %v", fwd.Target, err)
+			return
+		}
+		defer target.Close()
+		bridge(conn, target)
+
+	case ForwardRemote:
+		target, err := net.DialTimeout("tcp", fwd.Target, forwardDialTimeout)
+		if err != nil {
+			log.Printf("Forward from %s to %s failed: %v", fwd.Listen, fwd.Target, err)
+			return
+		}
+		defer target.Close()
+		bridge(conn, target)
+
+	case ForwardDynamic:
+		serveSOCKS5(conn, func(addr string) (net.Conn, error) {
+			return client.Dial("tcp", addr)
+		})
+	}
+}
+
+// close stops all forwards; connections already bridged keep running until
+// the SSH connection closes
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, listener := range f.listeners {
+		listener.Close()
+	}
+	f.listeners = nil
+}
+
+// bridge copies data both ways, passing on half-closes, until both
+// directions are done
+func bridge(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
+
+// serveSOCKS5 answers one SOCKS5 CONNECT request, dialing the requested
+// address through dial
+func serveSOCKS5(conn net.Conn, dial func(addr string) (net.Conn, error)) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socks5Version {
+		log.Printf("SOCKS5 greeting read failed: %v", err)
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		log.Printf("SOCKS5 methods read failed: %v", err)
+		return
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method == socks5AuthNoAcceptable {
+		return
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		log.Printf("SOCKS5 request read failed: %v", err)
+		return
+	}
+	if request[1] != socks5CmdConnect {
+		log.Printf("SOCKS5 command %d not supported", request[1])
+		writeSOCKS5Reply(conn, socks5ReplyCommandUnsupported)
+		return
+	}
+	targetAddr, err := readSOCKS5Addr(conn, request[3])
+	if err != nil {
+		log.Printf("SOCKS5 address read failed: %v", err)
+		writeSOCKS5Reply(conn, socks5ReplyAddrUnsupported)
+		return
+	}
+
+	target, err := dial(targetAddr)
+	if err != nil {
+		log.Printf("SOCKS5 CONNECT %s via SSH failed: %v", targetAddr, err)
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.Prohibited {
+			writeSOCKS5Reply(conn, socks5ReplyNotAllowed)
+		} else {
+			writeSOCKS5Reply(conn, socks5ReplyGeneralFailure)
+		}
+		return
+	}
+	defer target.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	bridge(conn, target)
+}
+
+func readSOCKS5Addr(r io.Reader, addrType byte) (string, error) {
+	var host string
+
+	switch addrType {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if addrType == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", addrType)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply sends a reply with an empty IPv4 bind address; the
+// outbound address is on the SSH server and not known here
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,261 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveTestDirect connects a direct-tcpip channel to its target
+func serveTestDirect(newChannel ssh.NewChannel) {
+	var req struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &req); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	if req.Host == "forbidden.example" {
+		newChannel.Reject(ssh.Prohibited, "administratively prohibited")
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	pipeTestChannel(channel, target)
+}
+
+// serveTestGlobal answers tcpip-forward requests by listening locally and
+// opening a forwarded-tcpip channel for each connection
+func serveTestGlobal(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			req.Reply(false, nil)
+			continue
+		}
+		var fwd struct {
+			Addr string
+			Port uint32
+		}
+		ssh.Unmarshal(req.Payload, &fwd)
+		listener, err := net.Listen("tcp", net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port))))
+		if err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		port := uint32(listener.Addr().(*net.TCPAddr).Port)
+		req.Reply(true, binary.BigEndian.AppendUint32(nil, port))
+
+		go func() {
+			defer listener.Close()
+			for {
+				local, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				payload := ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{fwd.Addr, port, "127.0.0.1", 1})
+				channel, requests, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					local.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				go pipeTestChannel(channel, local)
+			}
+		}()
+	}
+}
+
+func pipeTestChannel(channel ssh.Channel, conn net.Conn) {
+	defer channel.Close()
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, channel)
+	conn.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// testEchoServer echoes each connection until the client half-closes it
+func testEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// echoThrough sends a message over conn and returns what comes back
+func echoThrough(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return string(reply)
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		kind, spec string
+		want       Forward
+	}{
+		{"L", "8080:db.internal:5432", Forward{"L", "127.0.0.1:8080", "db.internal:5432"}},
+		{"L", "*:8080:db.internal:5432", Forward{"L", "0.0.0.0:8080", "db.internal:5432"}},
+		{"L", "[::1]:8080:[fd00::5]:22", Forward{"L", "[::1]:8080", "[fd00::5]:22"}},
+		{"R", "9000:localhost:3000", Forward{"R", "127.0.0.1:9000", "localhost:3000"}},
+		{"R", "0.0.0.0:0:localhost:3000", Forward{"R", "0.0.0.0:0", "localhost:3000"}},
+		{"D", "1080", Forward{"D", "127.0.0.1:1080", ""}},
+		{"D", "10.0.0.1:1080", Forward{"D", "10.0.0.1:1080", ""}},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.kind, tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseForward(%s, %s) = %+v, %v; want %+v", tt.kind, tt.spec, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []struct{ kind, spec string }{
+		{"L", "8080"},
+		{"L", "8080:host:0"},
+		{"L", "http:host:80"},
+		{"D", "1080:host:80"},
+		{"R", "[::1:8080:host:80"},
+		{"X", "8080:host:80"},
+	} {
+		if _, err := ParseForward(bad.kind, bad.spec); err == nil {
+			t.Errorf("ParseForward(%s, %s) should fail", bad.kind, bad.spec)
+		}
+	}
+}
+
+func TestForwards(t *testing.T) {
+	client := testSessionServer(t)
+	echoAddr := testEchoServer(t)
+
+	var f forwarder
+	defer f.close()
+
+	local, err := f.start(client, Forward{Kind: ForwardLocal, Listen: "127.0.0.1:0", Target: echoAddr})
+	if err != nil {
+		t.Fatalf("local forward failed: %v", err)
+	}
+	conn, err := net.Dial("tcp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := echoThrough(t, conn); got != "ping" {
+		t.Errorf("local forward echoed %q", got)
+	}
+
+	remote, err := f.start(client, Forward{Kind: ForwardRemote, Listen: "127.0.0.1:0", Target: echoAddr})
+	if err != nil {
+		t.Fatalf("remote forward failed: %v", err)
+	}
+	if remote.(*net.TCPAddr).Port == 0 {
+		t.Fatal("remote forward did not report its port")
+	}
+	conn, err = net.Dial("tcp", remote.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := echoThrough(t, conn); got != "ping" {
+		t.Errorf("remote forward echoed %q", got)
+	}
+}
+
+func TestDynamicForward(t *testing.T) {
+	client := testSessionServer(t)
+	echoAddr := testEchoServer(t)
+
+	var f forwarder
+	defer f.close()
+	proxy, err := f.start(client, Forward{Kind: ForwardDynamic, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("dynamic forward failed: %v", err)
+	}
+
+	connect := func(host string, port int) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", proxy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+		greeting := make([]byte, 2)
+		io.ReadFull(conn, greeting)
+
+		request := []byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomain, byte(len(host))}
+		request = append(request, host...)
+		conn.Write(binary.BigEndian.AppendUint16(request, uint16(port)))
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("SOCKS5 reply read failed: %v", err)
+		}
+		return conn, reply[1]
+	}
+
+	_, portStr, _ := net.SplitHostPort(echoAddr)
+	port, _ := strconv.Atoi(portStr)
+	conn, code := connect("localhost", port)
+	if code != socks5ReplySucceeded {
+		t.Fatalf("SOCKS5 CONNECT failed with %d", code)
+	}
+	if got := echoThrough(t, conn); got != "ping" {
+		t.Errorf("SOCKS5 forward echoed %q", got)
+	}
+
+	// Channels refused by the server map to "not allowed"
+	conn, code = connect("forbidden.example", 80)
+	conn.Close()
+	if code != socks5ReplyNotAllowed {
+		t.Errorf("expected not allowed, got %d", code)
+	}
+}
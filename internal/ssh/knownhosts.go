@@ -0,0 +1,426 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes, as in OpenSSH's StrictHostKeyChecking
+const (
+	HostKeyStrict    = "yes"        // unknown hosts are rejected
+	HostKeyAsk       = "ask"        // unknown hosts are confirmed at a prompt
+	HostKeyAcceptNew = "accept-new" // unknown hosts are trusted and recorded
+	HostKeyOff       = "no"         // host keys are not checked
+)
+
+const (
+	markerCA      = "cert-authority"
+	markerRevoked = "revoked"
+)
+
+// HostKeyChangedError reports a host key that differs from the keys
+// known_hosts has for the host
+type HostKeyChangedError struct {
+	Host        string
+	Fingerprint string
+	Known       []string // file:line of the known keys
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("REMOTE HOST IDENTIFICATION HAS CHANGED for %s: server key %s does not match known_hosts (%s); "+
+		"someone could be eavesdropping, or the host key was replaced. Remove the old entry if the change is expected",
+		e.Host, e.Fingerprint, strings.Join(e.Known, ", "))
+}
+
+type knownLine struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+	file     string
+	line     int
+}
+
+// KnownHosts checks host keys against OpenSSH known_hosts files. Hosts
+// behind the tunnel are keyed by HostKeyAddress, so an entry names the
+// agent and target instead of an address the client never sees. New keys
+// are written to the first file.
+type KnownHosts struct {
+	files  []string
+	mode   string
+	prompt func(question string) (bool, error)
+
+	mu    sync.Mutex
+	lines []knownLine
+}
+
+// NewKnownHosts reads files in OpenSSH known_hosts format; files that do
+// not exist yet are treated as empty
+func NewKnownHosts(mode string, files ...string) (*KnownHosts, error) {
+	switch mode {
+	case HostKeyStrict, HostKeyAsk, HostKeyAcceptNew, HostKeyOff:
+	default:
+		return nil, fmt.Errorf("invalid host key check mode %q", mode)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no known_hosts file")
+	}
+
+	k := &KnownHosts{
+		files:  files,
+		mode:   mode,
+		prompt: promptTerminal,
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read known_hosts: %w", err)
+		}
+		if err := k.parse(file, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// DefaultKnownHostsFile returns ~/.ssh/known_hosts
+func DefaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_hosts"
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// HostKeyAddress is the address a host behind agentID is known by, e.g.
+// "site-a/10.0.0.5:22", written to known_hosts as "site-a/10.0.0.5"
+func HostKeyAddress(agentID, target string) string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, "22"
+	}
+	return net.JoinHostPort(agentID+"/"+host, port)
+}
+
+// SetPrompt replaces the terminal prompt used in ask mode
+func (k *KnownHosts) SetPrompt(prompt func(question string) (bool, error)) {
+	k.prompt = prompt
+}
+
+func (k *KnownHosts) parse(file string, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file, lineNum, err)
+		}
+
+		k.lines = append(k.lines, knownLine{
+			marker:   marker,
+			patterns: hosts,
+			key:      key,
+			file:     file,
+			line:     lineNum,
+		})
+	}
+	return scanner.Err()
+}
+
+// Check is an ssh.HostKeyCallback. address must come from HostKeyAddress.
+// A host certificate is accepted when an @cert-authority entry for the
+// address signed it for the target host; otherwise the key it certifies is
+// checked like a plain host key.
+func (k *KnownHosts) Check(address string, remote net.Addr, key ssh.PublicKey) error {
+	if k.mode == HostKeyOff {
+		return nil
+	}
+
+	host := knownhosts.Normalize(address)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if k.revoked(cert.SignatureKey) {
+			return fmt.Errorf("host certificate for %s is signed by a revoked CA", host)
+		}
+		if k.authority(host, cert.SignatureKey) {
+			if cert.CertType != ssh.HostCert {
+				return fmt.Errorf("certificate presented by %s is not a host certificate", host)
+			}
+			checker := &ssh.CertChecker{}
+			if err := checker.CheckCert(targetHost(address), cert); err != nil {
+				return fmt.Errorf("host certificate for %s: %w", host, err)
+			}
+			return nil
+		}
+		key = cert.Key
+	}
+
+	if k.revoked(key) {
+		return fmt.Errorf("host key %s for %s is revoked", ssh.FingerprintSHA256(key), host)
+	}
+
+	var known []string
+	for _, l := range k.lines {
+		if l.marker != "" || !l.match(host) {
+			continue
+		}
+		if bytes.Equal(l.key.Marshal(), key.Marshal()) {
+			return nil
+		}
+		known = append(known, fmt.Sprintf("%s:%d", l.file, l.line))
+	}
+	if len(known) > 0 {
+		return &HostKeyChangedError{Host: host, Fingerprint: ssh.FingerprintSHA256(key), Known: known}
+	}
+
+	return k.unknown(host, key)
+}
+
+// unknown trusts a key for a host known_hosts has no entry for, as the
+// mode allows, and records it
+func (k *KnownHosts) unknown(host string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	switch k.mode {
+	case HostKeyStrict:
+		return fmt.Errorf("no host key known for %s (%s key %s) and host key checking is strict", host, key.Type(), fingerprint)
+	case HostKeyAsk:
+		question := fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\n"+
+			"Are you sure you want to continue connecting (yes/no)? ", host, key.Type(), fingerprint)
+		ok, err := k.prompt(question)
+		if err != nil {
+			return fmt.Errorf("host key prompt: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("host key for %s not accepted", host)
+		}
+	}
+
+	if err := k.add(host, key); err != nil {
+		return err
+	}
+	log.Printf("Permanently added '%s' (%s) to %s", host, key.Type(), k.files[0])
+	return nil
+}
+
+func (k *KnownHosts) add(host string, key ssh.PublicKey) error {
+	file := k.files[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("create known_hosts directory: %w", err)
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open known_hosts: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{host}, key)); err != nil {
+		return fmt.Errorf("write known_hosts: %w", err)
+	}
+
+	k.lines = append(k.lines, knownLine{patterns: []string{host}, key: key, file: file})
+	return nil
+}
+
+func (k *KnownHosts) authority(host string, key ssh.PublicKey) bool {
+	for _, l := range k.lines {
+		if l.marker == markerCA && l.match(host) && bytes.Equal(l.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KnownHosts) revoked(key ssh.PublicKey) bool {
+	for _, l := range k.lines {
+		if l.marker == markerRevoked && bytes.Equal(l.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostKeyAlgorithms returns the algorithms to ask the server for: the
+// types of the keys known for address, so a server with several keys
+// presents the one we can check. It is nil (the defaults, which prefer
+// certificates) when the host is unknown or a CA is trusted for it.
+func (k *KnownHosts) HostKeyAlgorithms(address string) []string {
+	if k.mode == HostKeyOff {
+		return nil
+	}
+
+	host := knownhosts.Normalize(address)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, l := range k.lines {
+		if !l.match(host) {
+			continue
+		}
+		switch l.marker {
+		case markerCA:
+			return nil
+		case "":
+			for _, algo := range keyAlgorithms(l.key.Type()) {
+				if !seen[algo] {
+					seen[algo] = true
+					algorithms = append(algorithms, algo)
+				}
+			}
+		}
+	}
+	return algorithms
+}
+
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// match applies the line's comma-separated host patterns to a normalized
+// host: one must match and no negated (!) pattern may
+func (l *knownLine) match(host string) bool {
+	matched := false
+	for _, pattern := range l.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchHost(strings.TrimPrefix(pattern, "!"), host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		return matchHashed(pattern, host)
+	}
+	return wildcardMatch(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+// matchHashed matches a HashKnownHosts entry, |1|base64(salt)|base64(hmac)
+func matchHashed(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// wildcardMatch matches * (any run of characters, including "/") and ?
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// targetHost is the host behind the agent, which host certificates name
+func targetHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if i := strings.LastIndex(host, "/"); i >= 0 {
+		host = host[i+1:]
+	}
+	return host
+}
+
+// promptTerminal asks a yes/no question on the terminal
+func promptTerminal(question string) (bool, error) {
+	fmt.Fprint(os.Stderr, question)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "yes":
+			return true, nil
+		case "no", "":
+			return false, nil
+		}
+		fmt.Fprint(os.Stderr, "Please type 'yes' or 'no': ")
+	}
+}
+
+// configureHostKey sets up host key checking for a connection and returns
+// the address to pass to ssh.NewClientConn
+func configureHostKey(sshConfig *ssh.ClientConfig, known *KnownHosts, address string) string {
+	if known == nil {
+		sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return "remote"
+	}
+
+	sshConfig.HostKeyCallback = known.Check
+	sshConfig.HostKeyAlgorithms = known.HostKeyAlgorithms(address)
+	return address
+}
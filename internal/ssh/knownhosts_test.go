@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func testKnownHosts(t *testing.T, mode, content string) (*KnownHosts, string) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if content != "" {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write known_hosts: %v", err)
+		}
+	}
+
+	k, err := NewKnownHosts(mode, file)
+	if err != nil {
+		t.Fatalf("Failed to load known_hosts: %v", err)
+	}
+	return k, file
+}
+
+func TestHostKeyAddress(t *testing.T) {
+	if got := knownhosts.Normalize(HostKeyAddress("site-a", "10.0.0.5:22")); got != "site-a/10.0.0.5" {
+		t.Errorf("unexpected known_hosts host %q", got)
+	}
+	if got := knownhosts.Normalize(HostKeyAddress("site-a", "db.internal:2222")); got != "[site-a/db.internal]:2222" {
+		t.Errorf("unexpected known_hosts host %q", got)
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	addr := HostKeyAddress("site-a", "10.0.0.5:22")
+
+	strict, _ := testKnownHosts(t, HostKeyStrict, "")
+	if err := strict.Check(addr, nil, key); err == nil {
+		t.Error("strict mode accepted an unknown host")
+	}
+
+	asked, _ := testKnownHosts(t, HostKeyAsk, "")
+	asked.SetPrompt(func(string) (bool, error) { return false, nil })
+	if err := asked.Check(addr, nil, key); err == nil {
+		t.Error("declined host key was accepted")
+	}
+
+	// Trust on first use records the key for the next connection
+	tofu, file := testKnownHosts(t, HostKeyAcceptNew, "")
+	if err := tofu.Check(addr, nil, key); err != nil {
+		t.Fatalf("accept-new rejected an unknown host: %v", err)
+	}
+
+	reloaded, err := NewKnownHosts(HostKeyStrict, file)
+	if err != nil {
+		t.Fatalf("Failed to reload known_hosts: %v", err)
+	}
+	if err := reloaded.Check(addr, nil, key); err != nil {
+		t.Errorf("recorded key rejected: %v", err)
+	}
+	if err := reloaded.Check(HostKeyAddress("site-b", "10.0.0.5:22"), nil, key); err == nil {
+		t.Error("key recorded for site-a accepted for site-b")
+	}
+}
+
+func TestChangedHostKey(t *testing.T) {
+	known := testSigner(t).PublicKey()
+	other := testSigner(t).PublicKey()
+
+	k, _ := testKnownHosts(t, HostKeyAcceptNew, knownhosts.Line([]string{"site-a/10.0.0.5"}, known)+"\n")
+
+	addr := HostKeyAddress("site-a", "10.0.0.5:22")
+	if err := k.Check(addr, nil, known); err != nil {
+		t.Errorf("known key rejected: %v", err)
+	}
+
+	var changed *HostKeyChangedError
+	if err := k.Check(addr, nil, other); !errors.As(err, &changed) {
+		t.Fatalf("expected HostKeyChangedError, got %v", err)
+	}
+	if !strings.HasSuffix(changed.Known[0], ":1") {
+		t.Errorf("expected known key location, got %v", changed.Known)
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	line := func(hosts string) string {
+		return fmt.Sprintf("%s %s", hosts, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+
+	tests := []struct {
+		name  string
+		hosts string
+		match bool
+	}{
+		{"Exact", "site-a/10.0.0.5", true},
+		{"Wildcard agent", "site-a/*", true},
+		{"Other agent", "site-b/*", false},
+		{"Negated", "site-a/*,!site-a/10.0.0.5", false},
+		{"Hashed", knownhosts.HashHostname("site-a/10.0.0.5"), true},
+		{"Non-default port", "[site-a/10.0.0.5]:2222", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, _ := testKnownHosts(t, HostKeyStrict, line(tt.hosts)+"\n")
+			err := k.Check(HostKeyAddress("site-a", "10.0.0.5:22"), nil, key)
+			if (err == nil) != tt.match {
+				t.Errorf("expected match=%v, got %v", tt.match, err)
+			}
+		})
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	ca := testSigner(t)
+	hostKey := testSigner(t).PublicKey()
+
+	cert := &ssh.Certificate{
+		Key:             hostKey,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"db.internal"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	caLine := "@cert-authority site-a/* " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	k, _ := testKnownHosts(t, HostKeyStrict, caLine)
+
+	// The principal is the target host behind the agent
+	if err := k.Check(HostKeyAddress("site-a", "db.internal:22"), nil, cert); err != nil {
+		t.Errorf("valid host certificate rejected: %v", err)
+	}
+	if err := k.Check(HostKeyAddress("site-a", "web.internal:22"), nil, cert); err == nil {
+		t.Error("certificate accepted for a host it does not name")
+	}
+	if err := k.Check(HostKeyAddress("site-b", "db.internal:22"), nil, cert); err == nil {
+		t.Error("certificate accepted for an agent the CA is not trusted for")
+	}
+
+	if algos := k.HostKeyAlgorithms(HostKeyAddress("site-a", "db.internal:22")); algos != nil {
+		t.Errorf("expected default algorithms for CA host, got %v", algos)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	k, _ := testKnownHosts(t, HostKeyStrict, knownhosts.Line([]string{"site-a/10.0.0.5"}, key)+"\n")
+
+	algos := k.HostKeyAlgorithms(HostKeyAddress("site-a", "10.0.0.5:22"))
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("expected [%s], got %v", ssh.KeyAlgoED25519, algos)
+	}
+	if algos := k.HostKeyAlgorithms(HostKeyAddress("site-b", "10.0.0.5:22")); algos != nil {
+		t.Errorf("expected default algorithms for unknown host, got %v", algos)
+	}
+}
@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,7 +19,7 @@ import (
 type PTYClient struct {
 	tunnelConn   net.Conn
 	sshClient    *ssh.Client
-	session      *ssh.Session
+	session      ptySession
 	logFile      *os.File
 	cmdLogFile   *os.File
 	outLogFile   *os.File
@@ -27,6 +28,21 @@ type PTYClient struct {
 	terminalFd   int
 	originalState *term.State
 	mutex        sync.Mutex
+	forwardAgent bool
+	castFile     *os.File
+	recorder     *Recorder
+	recordInput  bool
+	title        string
+
+	// Control master state: the socket sessions are shared on, or the
+	// socket of the master this client opens its sessions through
+	controlListener net.Listener
+	controlPath     string
+	controlUser     string
+	controlAddress  string
+	shared          sync.WaitGroup
+
+	forwards forwarder
 }
 
 type PTYConfig struct {
@@ -36,55 +52,111 @@ type PTYConfig struct {
 	TunnelConn   net.Conn
 	LogEnabled   bool
 	LogDirectory string
+
+	// KnownHosts verifies the host key under HostKeyAddress; nil skips
+	// host key verification
+	KnownHosts     *KnownHosts
+	HostKeyAddress string
+
+	// Passphrase decrypts PrivateKey and Certificate is its OpenSSH user
+	// certificate (the contents of id_*-cert.pub)
+	Passphrase  string
+	Certificate string
+
+	// UseAgent authenticates with the keys of the ssh-agent at
+	// SSH_AUTH_SOCK; ForwardAgent makes that agent available on the server
+	UseAgent     bool
+	ForwardAgent bool
+
+	// AuthMethods limits the methods tried (publickey,
+	// keyboard-interactive, password); empty allows all. Prompt asks for
+	// missing passwords, passphrases and keyboard-interactive answers; nil
+	// prompts on the terminal.
+	AuthMethods []string
+	Prompt      Prompter
+
+	// Record writes an asciicast v2 recording of the interactive session
+	// next to the logs; RecordInput also records keystrokes
+	Record      bool
+	RecordInput bool
 }
 
 func NewPTYClient(config *PTYConfig) (*PTYClient, error) {
-	client := &PTYClient{
-		tunnelConn:   config.TunnelConn,
-		logEnabled:   config.LogEnabled,
-		logDirectory: config.LogDirectory,
-		terminalFd:   int(os.Stdin.Fd()),
-	}
-
-	// Setup logging if enabled
-	if client.logEnabled {
-		if err := client.setupLogging(); err != nil {
-			return nil, fmt.Errorf("setup logging: %w", err)
-		}
+	client, err := newPTYClient(config)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create SSH client configuration
 	sshConfig := &ssh.ClientConfig{
 		User: config.Username,
 		Auth: []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		Timeout: 30 * time.Second,
 	}
+	hostAddr := configureHostKey(sshConfig, config.KnownHosts, config.HostKeyAddress)
 
 	// Add authentication methods
-	if config.Password != "" {
-		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(config.Password))
+	agentConn, err := configureAuth(sshConfig, authOptions{
+		Password:    config.Password,
+		PrivateKey:  config.PrivateKey,
+		Passphrase:  config.Passphrase,
+		Certificate: config.Certificate,
+		UseAgent:    config.UseAgent,
+		Methods:     config.AuthMethods,
+		Prompt:      config.Prompt,
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	if config.PrivateKey != "" {
-		key, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
-		if err != nil {
-			return nil, fmt.Errorf("parse private key: %w", err)
-		}
-		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(key))
+	if agentConn != nil {
+		defer agentConn.Close()
 	}
 
 	// Connect via tunnel
-	sshConn, chans, reqs, err := ssh.NewClientConn(config.TunnelConn, "remote", sshConfig)
+	sshConn, chans, reqs, err := ssh.NewClientConn(config.TunnelConn, hostAddr, sshConfig)
 	if err != nil {
 		return nil, fmt.Errorf("ssh connection: %w", err)
 	}
 
 	client.sshClient = ssh.NewClient(sshConn, chans, reqs)
+
+	if config.ForwardAgent {
+		if err := forwardAgent(client.sshClient); err != nil {
+			client.sshClient.Close()
+			return nil, fmt.Errorf("agent forwarding: %w", err)
+		}
+		client.forwardAgent = true
+	}
+
+	return client, nil
+}
+
+// newPTYClient sets up the parts of a client that do not depend on how
+// sessions are opened
+func newPTYClient(config *PTYConfig) (*PTYClient, error) {
+	client := &PTYClient{
+		tunnelConn:   config.TunnelConn,
+		logEnabled:   config.LogEnabled,
+		logDirectory: config.LogDirectory,
+		terminalFd:   int(os.Stdin.Fd()),
+		recordInput:  config.RecordInput,
+		title:        fmt.Sprintf("%s@%s", config.Username, config.HostKeyAddress),
+
+		controlUser:    config.Username,
+		controlAddress: config.HostKeyAddress,
+	}
+
+	// Setup logging if enabled
+	if client.logEnabled {
+		if err := client.setupLogging(config.Record); err != nil {
+			return nil, fmt.Errorf("setup logging: %w", err)
+		}
+	}
+
 	return client, nil
 }
 
-func (c *PTYClient) setupLogging() error {
+func (c *PTYClient) setupLogging(record bool) error {
 	if c.logDirectory == "" {
 		c.logDirectory = "ssh-logs"
 	}
@@ -120,6 +192,17 @@ func (c *PTYClient) setupLogging() error {
 	}
 	c.outLogFile = outLog
 
+	// Terminal recording, started with the interactive shell
+	if record {
+		castPath := filepath.Join(c.logDirectory, fmt.Sprintf("pty-session_%s.cast", timestamp))
+		castFile, err := os.OpenFile(castPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("create recording file: %w", err)
+		}
+		c.castFile = castFile
+		log.Printf("PTY session recording to: %s", castPath)
+	}
+
 	log.Printf("PTY session logging to: %s", sessionLogPath)
 	c.logSession("PTY session started")
 	
@@ -157,7 +240,7 @@ func (c *PTYClient) logOutput(output string) {
 
 func (c *PTYClient) StartInteractivePTY() error {
 	// Create new SSH session
-	session, err := c.sshClient.NewSession()
+	session, err := c.openSession()
 	if err != nil {
 		return fmt.Errorf("create session: %w", err)
 	}
@@ -177,6 +260,14 @@ func (c *PTYClient) StartInteractivePTY() error {
 	// Get terminal size
 	termWidth, termHeight := c.getTerminalSize()
 
+	if c.castFile != nil {
+		recorder, err := NewRecorder(c.castFile, termWidth, termHeight, c.title)
+		if err != nil {
+			return fmt.Errorf("start recording: %w", err)
+		}
+		c.recorder = recorder
+	}
+
 	// Request PTY
 	err = session.RequestPty("xterm-256color", termHeight, termWidth, ssh.TerminalModes{
 		ssh.ECHO:          1,     // Enable echo
@@ -250,7 +341,7 @@ func (c *PTYClient) StartInteractivePTY() error {
 	wg.Wait()
 
 	if err != nil {
-		if exitError, ok := err.(*ssh.ExitError); ok {
+		if exitError, ok := err.(interface{ ExitStatus() int }); ok {
 			c.logSession(fmt.Sprintf("Shell exited with code: %d", exitError.ExitStatus()))
 		} else {
 			c.logSession(fmt.Sprintf("Session error: %v", err))
@@ -302,6 +393,10 @@ func (c *PTYClient) handleInput(stdin io.WriteCloser) {
 			return
 		}
 
+		if c.recordInput {
+			c.recorder.Input(data)
+		}
+
 		// Process input for command logging
 		for _, b := range data {
 			if b == '\n' || b == '\r' {
@@ -340,6 +435,7 @@ func (c *PTYClient) handleOutput(stdout io.Reader) {
 		
 		// Write to local stdout
 		os.Stdout.Write(data)
+		c.recorder.Output(data)
 		
 		// Log output
 		c.logOutput(string(data))
@@ -362,6 +458,7 @@ func (c *PTYClient) handleError(stderr io.Reader) {
 		
 		// Write to local stderr
 		os.Stderr.Write(data)
+		c.recorder.Output(data)
 		
 		// Log error output
 		c.logOutput(fmt.Sprintf("[STDERR] %s", string(data)))
@@ -380,11 +477,12 @@ func (c *PTYClient) handleResize() {
 		log.Printf("Error changing window size: %v", err)
 	} else {
 		c.logSession(fmt.Sprintf("Terminal resized to %dx%d", width, height))
+		c.recorder.Resize(width, height)
 	}
 }
 
 func (c *PTYClient) ExecuteCommand(command string) error {
-	session, err := c.sshClient.NewSession()
+	session, err := c.openSession()
 	if err != nil {
 		return fmt.Errorf("create session: %w", err)
 	}
@@ -419,6 +517,16 @@ func (c *PTYClient) ExecuteCommand(command string) error {
 	return nil
 }
 
+// StartForward serves a -L, -R or -D forward on the SSH connection until
+// Close and returns the address listened on. Clients of a control master
+// cannot forward ports.
+func (c *PTYClient) StartForward(fwd Forward) (net.Addr, error) {
+	if c.sshClient == nil {
+		return nil, errors.New("port forwarding needs a direct connection, not a control master")
+	}
+	return c.forwards.start(c.sshClient, fwd)
+}
+
 func (c *PTYClient) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -438,12 +546,24 @@ func (c *PTYClient) Close() error {
 	if c.outLogFile != nil {
 		c.outLogFile.Close()
 	}
+	if c.castFile != nil {
+		if err := c.recorder.Err(); err != nil {
+			log.Printf("Session recording incomplete: %v", err)
+		}
+		c.castFile.Close()
+	}
 
 	// Close SSH session
 	if c.session != nil {
 		c.session.Close()
 	}
 
+	// Stop sharing the connection
+	if c.controlListener != nil {
+		c.controlListener.Close()
+	}
+	c.forwards.close()
+
 	// Close SSH client
 	if c.sshClient != nil {
 		return c.sshClient.Close()
@@ -0,0 +1,696 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+)
+
+// SFTP version 3 packet types (draft-ietf-secsh-filexfer-02), as spoken by
+// OpenSSH's sftp-server
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpMkdir    = 14
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// SFTP status codes
+const (
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+	sftpPermDenied = 3
+	sftpFailure    = 4
+)
+
+// Flags for OpenFile
+const (
+	SFTPRead   = 0x01
+	SFTPWrite  = 0x02
+	SFTPAppend = 0x04
+	SFTPCreate = 0x08
+	SFTPTrunc  = 0x10
+	SFTPExcl   = 0x20
+)
+
+// Attribute flags
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// sftpChunk is the read and write size; OpenSSH accepts up to 255KiB but
+// other servers only guarantee 32KiB
+const sftpChunk = 32 * 1024
+
+// maxSFTPPacket bounds the packets accepted from the server
+const maxSFTPPacket = 256 * 1024
+
+// StatusError is an error status returned by the SFTP server
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("sftp: %s (status %d)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("sftp: status %d", e.Code)
+}
+
+// Is lets errors.Is match fs.ErrNotExist and fs.ErrPermission
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == sftpNoSuchFile
+	case fs.ErrPermission:
+		return e.Code == sftpPermDenied
+	}
+	return false
+}
+
+// FileInfo describes a remote file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+// IsDir reports whether the file is a directory
+func (fi *FileInfo) IsDir() bool {
+	return fi.Mode.IsDir()
+}
+
+// sftpPacket is a response body after its type and request ID
+type sftpPacket struct {
+	typ  byte
+	data []byte
+	err  error
+}
+
+// SFTPClient speaks SFTP version 3 over a subsystem channel. Requests may
+// be issued concurrently; responses are matched by request ID.
+type SFTPClient struct {
+	w   io.WriteCloser
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint32
+	inflight map[uint32]chan sftpPacket
+	err      error
+}
+
+// NewSFTPClient performs the SFTP handshake on a subsystem channel
+func NewSFTPClient(r io.Reader, w io.WriteCloser) (*SFTPClient, error) {
+	c := &SFTPClient{w: w, inflight: make(map[uint32]chan sftpPacket)}
+
+	var init sftpBuffer
+	init.byte(sftpInit)
+	init.uint32(3)
+	if err := c.writePacket(init); err != nil {
+		return nil, fmt.Errorf("sftp init: %w", err)
+	}
+
+	typ, body, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("sftp init: %w", err)
+	}
+	if typ != sftpVersion {
+		return nil, fmt.Errorf("sftp init: unexpected packet type %d", typ)
+	}
+	version, _, err := decodeUint32(body)
+	if err != nil || version < 3 {
+		return nil, fmt.Errorf("sftp init: unsupported version %d", version)
+	}
+
+	go c.readLoop(r)
+	return c, nil
+}
+
+// Close ends the SFTP session
+func (c *SFTPClient) Close() error {
+	return c.w.Close()
+}
+
+func (c *SFTPClient) readLoop(r io.Reader) {
+	for {
+		typ, body, err := readSFTPPacket(r)
+		if err == nil && len(body) < 4 {
+			err = errors.New("short packet")
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("sftp connection: %w", err)
+			for id, ch := range c.inflight {
+				ch <- sftpPacket{err: c.err}
+				delete(c.inflight, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		id := binary.BigEndian.Uint32(body)
+		c.mu.Lock()
+		ch, exists := c.inflight[id]
+		delete(c.inflight, id)
+		c.mu.Unlock()
+
+		if exists {
+			ch <- sftpPacket{typ: typ, data: body[4:]}
+		}
+	}
+}
+
+// send issues a request and returns the channel its response arrives on
+func (c *SFTPClient) send(typ byte, fill func(*sftpBuffer)) (<-chan sftpPacket, error) {
+	ch := make(chan sftpPacket, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.inflight[id] = ch
+	c.mu.Unlock()
+
+	var b sftpBuffer
+	b.byte(typ)
+	b.uint32(id)
+	fill(&b)
+	if err := c.writePacket(b); err != nil {
+		c.mu.Lock()
+		delete(c.inflight, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (c *SFTPClient) request(typ byte, fill func(*sftpBuffer)) (sftpPacket, error) {
+	ch, err := c.send(typ, fill)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	resp := <-ch
+	return resp, resp.err
+}
+
+// writePacket frames and writes a packet; wmu keeps concurrent requests
+// from interleaving
+func (c *SFTPClient) writePacket(b sftpBuffer) error {
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	frame = append(frame, b...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// Stat returns information about a remote file, following symlinks
+func (c *SFTPClient) Stat(p string) (*FileInfo, error) {
+	return c.stat(sftpStat, p)
+}
+
+// Lstat returns information about a remote file without following symlinks
+func (c *SFTPClient) Lstat(p string) (*FileInfo, error) {
+	return c.stat(sftpLstat, p)
+}
+
+func (c *SFTPClient) stat(typ byte, p string) (*FileInfo, error) {
+	resp, err := c.request(typ, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	fi, err := expectAttrs(resp)
+	if err != nil {
+		return nil, err
+	}
+	fi.Name = path.Base(p)
+	return fi, nil
+}
+
+// RealPath resolves a remote path, such as "." for the home directory
+func (c *SFTPClient) RealPath(p string) (string, error) {
+	resp, err := c.request(sftpRealpath, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	names, err := expectNames(resp)
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("sftp: realpath returned %d names", len(names))
+	}
+	return names[0].Name, nil
+}
+
+// ReadDir lists a remote directory without "." and ".."
+func (c *SFTPClient) ReadDir(p string) ([]*FileInfo, error) {
+	resp, err := c.request(sftpOpendir, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	handle, err := expectHandle(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	var entries []*FileInfo
+	for {
+		resp, err := c.request(sftpReaddir, func(b *sftpBuffer) { b.string(handle) })
+		if err != nil {
+			return nil, err
+		}
+		names, err := expectNames(resp)
+		if isEOF(err) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range names {
+			if fi.Name != "." && fi.Name != ".." {
+				entries = append(entries, fi)
+			}
+		}
+	}
+}
+
+// Mkdir creates a remote directory
+func (c *SFTPClient) Mkdir(p string, perm fs.FileMode) error {
+	resp, err := c.request(sftpMkdir, func(b *sftpBuffer) {
+		b.string(p)
+		b.uint32(attrPermissions)
+		b.uint32(uint32(perm.Perm()))
+	})
+	if err != nil {
+		return err
+	}
+	return expectOK(resp)
+}
+
+// MkdirAll creates a remote directory and any missing parents
+func (c *SFTPClient) MkdirAll(p string, perm fs.FileMode) error {
+	fi, err := c.Stat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("sftp: %s is not a directory", p)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if parent := path.Dir(p); parent != p {
+		if err := c.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := c.Mkdir(p, perm); err != nil {
+		// Another writer may have created it meanwhile
+		if fi, statErr := c.Stat(p); statErr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Chtimes sets the access and modification times of a remote file
+func (c *SFTPClient) Chtimes(p string, atime, mtime time.Time) error {
+	resp, err := c.request(sftpSetstat, func(b *sftpBuffer) {
+		b.string(p)
+		b.uint32(attrACModTime)
+		b.uint32(uint32(atime.Unix()))
+		b.uint32(uint32(mtime.Unix()))
+	})
+	if err != nil {
+		return err
+	}
+	return expectOK(resp)
+}
+
+// Open opens a remote file for reading
+func (c *SFTPClient) Open(p string) (*SFTPFile, error) {
+	return c.OpenFile(p, SFTPRead, 0)
+}
+
+// OpenFile opens a remote file with SFTP* flags, creating it with perm
+func (c *SFTPClient) OpenFile(p string, flags uint32, perm fs.FileMode) (*SFTPFile, error) {
+	resp, err := c.request(sftpOpen, func(b *sftpBuffer) {
+		b.string(p)
+		b.uint32(flags)
+		if flags&SFTPCreate != 0 {
+			b.uint32(attrPermissions)
+			b.uint32(uint32(perm.Perm()))
+		} else {
+			b.uint32(0)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	handle, err := expectHandle(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &SFTPFile{client: c, handle: handle, path: p}, nil
+}
+
+func (c *SFTPClient) closeHandle(handle string) error {
+	resp, err := c.request(sftpClose, func(b *sftpBuffer) { b.string(handle) })
+	if err != nil {
+		return err
+	}
+	return expectOK(resp)
+}
+
+// SFTPFile is an open remote file
+type SFTPFile struct {
+	client *SFTPClient
+	handle string
+	path   string
+}
+
+// Stat returns information about the open file
+func (f *SFTPFile) Stat() (*FileInfo, error) {
+	resp, err := f.client.request(sftpFstat, func(b *sftpBuffer) { b.string(f.handle) })
+	if err != nil {
+		return nil, err
+	}
+	fi, err := expectAttrs(resp)
+	if err != nil {
+		return nil, err
+	}
+	fi.Name = path.Base(f.path)
+	return fi, nil
+}
+
+// ReadAt reads len(p) bytes at off, one chunk per request
+func (f *SFTPFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		resp, err := f.client.request(sftpRead, func(b *sftpBuffer) {
+			b.string(f.handle)
+			b.uint64(uint64(off + int64(n)))
+			b.uint32(uint32(min(len(p)-n, sftpChunk)))
+		})
+		if err != nil {
+			return n, err
+		}
+		data, err := expectData(resp)
+		if isEOF(err) {
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+// WriteAt writes p at off, one chunk per request
+func (f *SFTPFile) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+sftpChunk)]
+		resp, err := f.client.request(sftpWrite, func(b *sftpBuffer) {
+			b.string(f.handle)
+			b.uint64(uint64(off + int64(n)))
+			b.bytes(chunk)
+		})
+		if err != nil {
+			return n, err
+		}
+		if err := expectOK(resp); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Close closes the remote handle
+func (f *SFTPFile) Close() error {
+	return f.client.closeHandle(f.handle)
+}
+
+func expectOK(resp sftpPacket) error {
+	if resp.typ != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d", resp.typ)
+	}
+	return statusError(resp.data)
+}
+
+func expectHandle(resp sftpPacket) (string, error) {
+	if resp.typ == sftpStatus {
+		return "", statusError(resp.data)
+	}
+	if resp.typ != sftpHandle {
+		return "", fmt.Errorf("sftp: unexpected packet type %d", resp.typ)
+	}
+	handle, _, err := decodeString(resp.data)
+	return handle, err
+}
+
+func expectData(resp sftpPacket) ([]byte, error) {
+	if resp.typ == sftpStatus {
+		return nil, statusError(resp.data)
+	}
+	if resp.typ != sftpData {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d", resp.typ)
+	}
+	data, _, err := decodeString(resp.data)
+	return []byte(data), err
+}
+
+func expectAttrs(resp sftpPacket) (*FileInfo, error) {
+	if resp.typ == sftpStatus {
+		return nil, statusError(resp.data)
+	}
+	if resp.typ != sftpAttrs {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d", resp.typ)
+	}
+	fi, _, err := decodeAttrs(resp.data)
+	return fi, err
+}
+
+func expectNames(resp sftpPacket) ([]*FileInfo, error) {
+	if resp.typ == sftpStatus {
+		return nil, statusError(resp.data)
+	}
+	if resp.typ != sftpName {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d", resp.typ)
+	}
+
+	count, rest, err := decodeUint32(resp.data)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]*FileInfo, 0, min(count, 1024))
+	for i := uint32(0); i < count; i++ {
+		var name string
+		if name, rest, err = decodeString(rest); err != nil {
+			return nil, err
+		}
+		// Skip the ls -l style long name
+		if _, rest, err = decodeString(rest); err != nil {
+			return nil, err
+		}
+		var fi *FileInfo
+		if fi, rest, err = decodeAttrs(rest); err != nil {
+			return nil, err
+		}
+		fi.Name = name
+		names = append(names, fi)
+	}
+	return names, nil
+}
+
+// statusError turns a STATUS body into an error, nil for SSH_FX_OK
+func statusError(data []byte) error {
+	code, rest, err := decodeUint32(data)
+	if err != nil {
+		return err
+	}
+	if code == sftpOK {
+		return nil
+	}
+	// Servers older than version 3 omit the message
+	message, _, _ := decodeString(rest)
+	return &StatusError{Code: code, Message: message}
+}
+
+func isEOF(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && status.Code == sftpEOF
+}
+
+func decodeAttrs(data []byte) (*FileInfo, []byte, error) {
+	flags, data, err := decodeUint32(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi := &FileInfo{}
+	if flags&attrSize != 0 {
+		var size uint64
+		if size, data, err = decodeUint64(data); err != nil {
+			return nil, nil, err
+		}
+		fi.Size = int64(size)
+	}
+	if flags&attrUIDGID != 0 {
+		if _, data, err = decodeUint64(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if flags&attrPermissions != 0 {
+		var mode uint32
+		if mode, data, err = decodeUint32(data); err != nil {
+			return nil, nil, err
+		}
+		fi.Mode = fileMode(mode)
+	}
+	if flags&attrACModTime != 0 {
+		var mtime uint32
+		if _, data, err = decodeUint32(data); err != nil {
+			return nil, nil, err
+		}
+		if mtime, data, err = decodeUint32(data); err != nil {
+			return nil, nil, err
+		}
+		fi.ModTime = time.Unix(int64(mtime), 0)
+	}
+	if flags&attrExtended != 0 {
+		var count uint32
+		if count, data, err = decodeUint32(data); err != nil {
+			return nil, nil, err
+		}
+		for i := uint32(0); i < 2*count; i++ {
+			if _, data, err = decodeString(data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return fi, data, nil
+}
+
+// fileMode converts POSIX mode bits to an fs.FileMode
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= fs.ModeDir
+	case 0120000:
+		m |= fs.ModeSymlink
+	case 0100000:
+	default:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
+
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxSFTPPacket {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[4], body, nil
+}
+
+// sftpBuffer builds a packet body
+type sftpBuffer []byte
+
+func (b *sftpBuffer) byte(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *sftpBuffer) uint32(v uint32) {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+}
+
+func (b *sftpBuffer) uint64(v uint64) {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+}
+
+func (b *sftpBuffer) string(v string) {
+	b.uint32(uint32(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *sftpBuffer) bytes(v []byte) {
+	b.uint32(uint32(len(v)))
+	*b = append(*b, v...)
+}
+
+var errShortPacket = errors.New("sftp: short packet")
+
+func decodeUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errShortPacket
+	}
+	return binary.BigEndian.Uint32(data), data[4:], nil
+}
+
+func decodeUint64(data []byte) (uint64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, errShortPacket
+	}
+	return binary.BigEndian.Uint64(data), data[8:], nil
+}
+
+func decodeString(data []byte) (string, []byte, error) {
+	length, data, err := decodeUint32(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(data)) < length {
+		return "", nil, errShortPacket
+	}
+	return string(data[:length]), data[length:], nil
+}
@@ -0,0 +1,419 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSFTPServer is a minimal SFTP v3 server rooted at a directory. Reads
+// return at most maxRead bytes to exercise short reads.
+type testSFTPServer struct {
+	root    string
+	maxRead int
+	handles map[string]interface{}
+	next    int
+
+	// extraNames are listed as empty files in every directory, like a
+	// hostile server would
+	extraNames []string
+}
+
+func startTestSFTP(t *testing.T, root string) *SFTPClient {
+	t.Helper()
+	return startTestSFTPServer(t, &testSFTPServer{root: root})
+}
+
+func startTestSFTPServer(t *testing.T, srv *testSFTPServer) *SFTPClient {
+	t.Helper()
+
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	srv.maxRead = 10000
+	srv.handles = make(map[string]interface{})
+	go srv.serve(serverR, serverW)
+
+	client, err := NewSFTPClient(clientR, clientW)
+	if err != nil {
+		t.Fatalf("NewSFTPClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (s *testSFTPServer) serve(r io.ReadCloser, w io.WriteCloser) {
+	defer w.Close()
+	defer r.Close()
+
+	for {
+		typ, body, err := readSFTPPacket(r)
+		if err != nil {
+			return
+		}
+
+		var resp sftpBuffer
+		if typ == sftpInit {
+			resp.byte(sftpVersion)
+			resp.uint32(3)
+		} else {
+			id, rest, _ := decodeUint32(body)
+			resp = s.handle(typ, id, rest)
+		}
+
+		frame := binary.BigEndian.AppendUint32(nil, uint32(len(resp)))
+		if _, err := w.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testSFTPServer) path(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(p))
+}
+
+func (s *testSFTPServer) handle(typ byte, id uint32, data []byte) sftpBuffer {
+	status := func(err error) sftpBuffer {
+		var b sftpBuffer
+		b.byte(sftpStatus)
+		b.uint32(id)
+		switch {
+		case err == nil:
+			b.uint32(sftpOK)
+		case err == io.EOF:
+			b.uint32(sftpEOF)
+		case errors.Is(err, fs.ErrNotExist):
+			b.uint32(sftpNoSuchFile)
+		default:
+			b.uint32(sftpFailure)
+		}
+		b.string(fmt.Sprint(err))
+		b.string("")
+		return b
+	}
+	attrs := func(b *sftpBuffer, fi os.FileInfo) {
+		mode := uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			mode |= 0040000
+		} else {
+			mode |= 0100000
+		}
+		b.uint32(attrSize | attrPermissions | attrACModTime)
+		b.uint64(uint64(fi.Size()))
+		b.uint32(mode)
+		b.uint32(uint32(fi.ModTime().Unix()))
+		b.uint32(uint32(fi.ModTime().Unix()))
+	}
+	newHandle := func(v interface{}) sftpBuffer {
+		s.next++
+		h := fmt.Sprint(s.next)
+		s.handles[h] = v
+		var b sftpBuffer
+		b.byte(sftpHandle)
+		b.uint32(id)
+		b.string(h)
+		return b
+	}
+
+	name, rest, _ := decodeString(data)
+	switch typ {
+	case sftpStat, sftpLstat, sftpFstat:
+		var fi os.FileInfo
+		var err error
+		if typ == sftpFstat {
+			fi, err = s.handles[name].(*os.File).Stat()
+		} else {
+			fi, err = os.Stat(s.path(name))
+		}
+		if err != nil {
+			return status(err)
+		}
+		var b sftpBuffer
+		b.byte(sftpAttrs)
+		b.uint32(id)
+		attrs(&b, fi)
+		return b
+
+	case sftpOpen:
+		pflags, _, _ := decodeUint32(rest)
+		flags := os.O_RDONLY
+		if pflags&SFTPWrite != 0 {
+			flags = os.O_WRONLY
+		}
+		if pflags&SFTPCreate != 0 {
+			flags |= os.O_CREATE
+		}
+		if pflags&SFTPTrunc != 0 {
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(s.path(name), flags, 0644)
+		if err != nil {
+			return status(err)
+		}
+		return newHandle(f)
+
+	case sftpOpendir:
+		entries, err := os.ReadDir(s.path(name))
+		if err != nil {
+			return status(err)
+		}
+		return newHandle(entries)
+
+	case sftpReaddir:
+		entries, _ := s.handles[name].([]os.DirEntry)
+		if len(entries) == 0 {
+			return status(io.EOF)
+		}
+		s.handles[name] = []os.DirEntry(nil)
+
+		var b sftpBuffer
+		b.byte(sftpName)
+		b.uint32(id)
+		b.uint32(uint32(len(entries) + len(s.extraNames)))
+		for _, e := range entries {
+			fi, _ := e.Info()
+			b.string(e.Name())
+			b.string("")
+			attrs(&b, fi)
+		}
+		for _, extra := range s.extraNames {
+			b.string(extra)
+			b.string("")
+			b.uint32(attrSize | attrPermissions)
+			b.uint64(0)
+			b.uint32(0100644)
+		}
+		return b
+
+	case sftpClose:
+		if f, ok := s.handles[name].(*os.File); ok {
+			f.Close()
+		}
+		delete(s.handles, name)
+		return status(nil)
+
+	case sftpRead:
+		off, rest, _ := decodeUint64(rest)
+		n, _, _ := decodeUint32(rest)
+		buf := make([]byte, min(int(n), s.maxRead))
+		read, err := s.handles[name].(*os.File).ReadAt(buf, int64(off))
+		if read == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return status(err)
+		}
+		var b sftpBuffer
+		b.byte(sftpData)
+		b.uint32(id)
+		b.bytes(buf[:read])
+		return b
+
+	case sftpWrite:
+		off, rest, _ := decodeUint64(rest)
+		chunk, _, _ := decodeString(rest)
+		_, err := s.handles[name].(*os.File).WriteAt([]byte(chunk), int64(off))
+		return status(err)
+
+	case sftpMkdir:
+		return status(os.Mkdir(s.path(name), 0755))
+
+	case sftpSetstat:
+		flags, rest, _ := decodeUint32(rest)
+		if flags&attrACModTime != 0 {
+			atime, rest, _ := decodeUint32(rest)
+			mtime, _, _ := decodeUint32(rest)
+			return status(os.Chtimes(s.path(name), time.Unix(int64(atime), 0), time.Unix(int64(mtime), 0)))
+		}
+		return status(nil)
+	}
+
+	var b sftpBuffer
+	b.byte(sftpStatus)
+	b.uint32(id)
+	b.uint32(8) // SSH_FX_OP_UNSUPPORTED
+	b.string("unsupported")
+	b.string("")
+	return b
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSFTPGetPut(t *testing.T) {
+	remoteRoot, localRoot := t.TempDir(), t.TempDir()
+	client := startTestSFTP(t, remoteRoot)
+
+	var logged []string
+	tr := &transfer{
+		sftp: client,
+		opts: TransferOptions{Verify: true},
+		logf: func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) },
+	}
+
+	data := randomBytes(t, 300*1024+17)
+	local := filepath.Join(localRoot, "payload.bin")
+	if err := os.WriteFile(local, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var result TransferResult
+	if err := tr.put(local, "/payload.bin", &result); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remoteRoot, "payload.bin")); !bytes.Equal(got, data) {
+		t.Fatal("uploaded file differs")
+	}
+
+	// Downloading into a directory keeps the remote name
+	downloads := filepath.Join(localRoot, "downloads")
+	os.Mkdir(downloads, 0755)
+	if err := tr.get("/payload.bin", downloads, &result); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(downloads, "payload.bin")); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs")
+	}
+
+	if result.Files != 2 || result.Bytes != 2*int64(len(data)) {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(logged) != 2 || !strings.HasPrefix(logged[0], "SFTP PUT: ") || !strings.Contains(logged[1], "sha256 ") {
+		t.Errorf("unexpected log %q", logged)
+	}
+
+	if err := tr.get("/missing", downloads, &result); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestSFTPResume(t *testing.T) {
+	remoteRoot, localRoot := t.TempDir(), t.TempDir()
+	client := startTestSFTP(t, remoteRoot)
+	tr := &transfer{sftp: client, opts: TransferOptions{Resume: true, Verify: true}, logf: func(string, ...interface{}) {}}
+
+	data := randomBytes(t, 100*1024)
+	os.WriteFile(filepath.Join(remoteRoot, "big.bin"), data, 0644)
+
+	local := filepath.Join(localRoot, "big.bin")
+	os.WriteFile(local, data[:40*1024], 0644)
+
+	var result TransferResult
+	if err := tr.get("/big.bin", local, &result); err != nil {
+		t.Fatalf("resumed get failed: %v", err)
+	}
+	if result.Bytes != 60*1024 {
+		t.Errorf("expected 60KiB transferred, got %d", result.Bytes)
+	}
+	if got, _ := os.ReadFile(local); !bytes.Equal(got, data) {
+		t.Fatal("resumed file differs")
+	}
+
+	// A stale partial copy fails verification
+	stale := append([]byte(nil), data[:40*1024]...)
+	stale[0] ^= 0xff
+	os.WriteFile(local, stale, 0644)
+	if err := tr.get("/big.bin", local, &result); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestSFTPSync(t *testing.T) {
+	remoteRoot, localRoot := t.TempDir(), t.TempDir()
+	client := startTestSFTP(t, remoteRoot)
+	tr := &transfer{sftp: client, opts: TransferOptions{Verify: true}, logf: func(string, ...interface{}) {}}
+
+	src := filepath.Join(localRoot, "site")
+	os.MkdirAll(filepath.Join(src, "css"), 0755)
+	os.WriteFile(filepath.Join(src, "index.html"), []byte("<h1>hi</h1>"), 0644)
+	os.WriteFile(filepath.Join(src, "css", "main.css"), []byte("h1 {}"), 0644)
+
+	var result TransferResult
+	if err := tr.push(src, "/srv/site", &result); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if result.Files != 2 {
+		t.Errorf("expected 2 files pushed, got %+v", result)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remoteRoot, "srv", "site", "css", "main.css")); string(got) != "h1 {}" {
+		t.Errorf("unexpected remote content %q", got)
+	}
+
+	// Unchanged files are skipped on the next run
+	result = TransferResult{}
+	if err := tr.push(src, "/srv/site", &result); err != nil {
+		t.Fatalf("second push failed: %v", err)
+	}
+	if result.Files != 0 || result.Skipped != 2 {
+		t.Errorf("expected everything skipped, got %+v", result)
+	}
+
+	dst := filepath.Join(localRoot, "mirror")
+	result = TransferResult{}
+	if err := tr.pull("/srv/site", dst, &result); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "index.html")); string(got) != "<h1>hi</h1>" {
+		t.Errorf("unexpected pulled content %q", got)
+	}
+	if result.Files != 2 {
+		t.Errorf("expected 2 files pulled, got %+v", result)
+	}
+}
+
+func TestSFTPPullUnsafeNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"../../.bashrc", true},
+		{"a/b", true},
+		{"", true},
+		// Dropped by ReadDir like a real server's own entries
+		{".", false},
+		{"..", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteRoot, localRoot := t.TempDir(), t.TempDir()
+			os.WriteFile(filepath.Join(remoteRoot, "ok.txt"), []byte("ok"), 0644)
+			client := startTestSFTPServer(t, &testSFTPServer{root: remoteRoot, extraNames: []string{tt.name}})
+			tr := &transfer{sftp: client, logf: func(string, ...interface{}) {}}
+
+			dst := filepath.Join(localRoot, "a", "mirror")
+			var result TransferResult
+			err := tr.pull("/", dst, &result)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "unsafe file name") {
+					t.Fatalf("expected unsafe name error, got %v", err)
+				}
+			} else if err != nil || result.Files != 1 {
+				t.Fatalf("expected ok.txt pulled, got %+v, %v", result, err)
+			}
+			if _, err := os.Stat(filepath.Join(localRoot, ".bashrc")); err == nil {
+				t.Error("file written outside the target directory")
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("it's here"); got != `'it'\''s here'` {
+		t.Errorf("unexpected quoting %s", got)
+	}
+}
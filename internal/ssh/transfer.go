@@ -0,0 +1,650 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transferWindow is how many chunk requests are kept in flight, so a
+// transfer is not limited to one chunk per round trip through the relay
+const transferWindow = 16
+
+// TransferOptions controls Get, Put and Sync
+type TransferOptions struct {
+	// Resume continues a partial copy at the destination instead of
+	// starting over
+	Resume bool
+	// Verify compares SHA-256 checksums of both ends after each copy
+	Verify bool
+	// Progress receives a progress line per file; nil shows none
+	Progress io.Writer
+}
+
+// transfer copies files over an SFTP session
+type transfer struct {
+	sftp *SFTPClient
+	opts TransferOptions
+
+	// remoteSum hashes a remote file; nil reads it back over SFTP
+	remoteSum func(path string) (string, error)
+	// logf records completed transfers
+	logf func(format string, args ...interface{})
+}
+
+// TransferResult summarizes the files copied by a transfer
+type TransferResult struct {
+	Files   int
+	Skipped int
+	Bytes   int64
+}
+
+// SFTP returns an SFTP session on the connection, opening it on first use
+func (c *SSHClient) SFTP() (*SFTPClient, error) {
+	if c.sftp != nil {
+		return c.sftp, nil
+	}
+
+	session, err := c.sshClient.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("create session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdin pipe: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("start sftp subsystem: %w", err)
+	}
+
+	client, err := NewSFTPClient(stdout, stdin)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	c.sftp = client
+	c.sftpSession = session
+	return client, nil
+}
+
+// Get downloads a remote file; local may be a directory
+func (c *SSHClient) Get(remote, local string, opts TransferOptions) (*TransferResult, error) {
+	return c.runTransfer("get", remote, local, opts, (*transfer).get)
+}
+
+// Put uploads a local file; remote may be a directory
+func (c *SSHClient) Put(local, remote string, opts TransferOptions) (*TransferResult, error) {
+	return c.runTransfer("put", local, remote, opts, (*transfer).put)
+}
+
+// Sync recursively uploads the local directory to remote, or downloads
+// remote into local when pull is set. Files whose size and modification
+// time already match are skipped; nothing is deleted.
+func (c *SSHClient) Sync(local, remote string, pull bool, opts TransferOptions) (*TransferResult, error) {
+	if pull {
+		return c.runTransfer("sync", remote, local, opts, (*transfer).pull)
+	}
+	return c.runTransfer("sync", local, remote, opts, (*transfer).push)
+}
+
+func (c *SSHClient) runTransfer(op, src, dst string, opts TransferOptions, run func(*transfer, string, string, *TransferResult) error) (*TransferResult, error) {
+	client, err := c.SFTP()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transfer{
+		sftp:      client,
+		opts:      opts,
+		remoteSum: c.remoteChecksum,
+		logf: func(format string, args ...interface{}) {
+			c.logCommand(fmt.Sprintf(format, args...))
+		},
+	}
+	result := &TransferResult{}
+	if err := run(t, src, dst, result); err != nil {
+		c.logCommand(fmt.Sprintf("SFTP %s: %s -> %s failed: %v", strings.ToUpper(op), src, dst, err))
+		return result, err
+	}
+	return result, nil
+}
+
+// remoteChecksum runs sha256sum on the server, falling back to reading the
+// file back over SFTP when it is not available
+func (c *SSHClient) remoteChecksum(remote string) (string, error) {
+	session, err := c.sshClient.NewSession()
+	if err == nil {
+		output, runErr := session.Output("sha256sum -- " + shellQuote(remote))
+		session.Close()
+		if fields := strings.Fields(string(output)); runErr == nil && len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+			return fields[0], nil
+		}
+	}
+
+	t := &transfer{sftp: c.sftp}
+	return t.sftpChecksum(remote)
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (t *transfer) get(remote, local string, result *TransferResult) error {
+	f, err := t.sftp.Open(remote)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", remote, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", remote, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory, use sync", remote)
+	}
+
+	if st, err := os.Stat(local); err == nil && st.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	var offset int64
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if t.opts.Resume {
+		if st, err := os.Stat(local); err == nil && st.Mode().IsRegular() && st.Size() <= fi.Size {
+			offset = st.Size()
+			flags = os.O_WRONLY
+		}
+	}
+
+	out, err := os.OpenFile(local, flags, filePerm(fi.Mode))
+	if err != nil {
+		return err
+	}
+
+	p := newProgress(t.opts.Progress, path.Base(remote), fi.Size, offset)
+	err = f.download(out, offset, fi.Size, p.add)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	p.finish(err)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", remote, err)
+	}
+
+	sum, err := t.verify(local, remote)
+	if err != nil {
+		return err
+	}
+
+	t.logf("SFTP GET: %s -> %s (%d bytes%s)", remote, local, fi.Size-offset, describeTransfer(offset, sum))
+	result.Files++
+	result.Bytes += fi.Size - offset
+	return nil
+}
+
+func (t *transfer) put(local, remote string, result *TransferResult) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s is a directory, use sync", local)
+	}
+
+	if fi, err := t.sftp.Stat(remote); err == nil && fi.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+
+	var offset int64
+	flags := uint32(SFTPWrite | SFTPCreate | SFTPTrunc)
+	if t.opts.Resume {
+		if fi, err := t.sftp.Stat(remote); err == nil && fi.Mode.IsRegular() && fi.Size <= st.Size() {
+			offset = fi.Size
+			flags = SFTPWrite
+		}
+	}
+
+	f, err := t.sftp.OpenFile(remote, flags, st.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("open %s: %w", remote, err)
+	}
+
+	p := newProgress(t.opts.Progress, filepath.Base(local), st.Size(), offset)
+	err = f.upload(in, offset, st.Size(), p.add)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	p.finish(err)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", remote, err)
+	}
+
+	sum, err := t.verify(local, remote)
+	if err != nil {
+		return err
+	}
+
+	t.logf("SFTP PUT: %s -> %s (%d bytes%s)", local, remote, st.Size()-offset, describeTransfer(offset, sum))
+	result.Files++
+	result.Bytes += st.Size() - offset
+	return nil
+}
+
+// push copies the files below a local directory that are missing or differ
+// in size or modification time at the remote end
+func (t *transfer) push(local, remote string, result *TransferResult) error {
+	return filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remote, filepath.ToSlash(rel))
+
+		if d.IsDir() {
+			return t.sftp.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			log.Printf("Skipping %s: not a regular file", p)
+			return nil
+		}
+
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi, err := t.sftp.Stat(target); err == nil && sameFile(fi.Size, fi.ModTime, st.Size(), st.ModTime()) {
+			result.Skipped++
+			return nil
+		}
+
+		if err := t.put(p, target, result); err != nil {
+			return err
+		}
+		return t.sftp.Chtimes(target, st.ModTime(), st.ModTime())
+	})
+}
+
+// pull copies the files below a remote directory that are missing or differ
+// in size or modification time locally
+func (t *transfer) pull(remote, local string, result *TransferResult) error {
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+
+	entries, err := t.sftp.ReadDir(remote)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", remote, err)
+	}
+
+	for _, fi := range entries {
+		// Names come from the server and must stay inside local
+		if !safeEntryName(fi.Name) {
+			return fmt.Errorf("list %s: refusing unsafe file name %q", remote, fi.Name)
+		}
+		source := path.Join(remote, fi.Name)
+		target := filepath.Join(local, fi.Name)
+
+		if fi.IsDir() {
+			if err := t.pull(source, target, result); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode.IsRegular() {
+			log.Printf("Skipping %s: not a regular file", source)
+			continue
+		}
+
+		if st, err := os.Stat(target); err == nil && sameFile(fi.Size, fi.ModTime, st.Size(), st.ModTime()) {
+			result.Skipped++
+			continue
+		}
+
+		if err := t.get(source, target, result); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, fi.ModTime, fi.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safeEntryName reports whether a directory entry name is a single path
+// element
+func safeEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsRune(name, '/') && !strings.ContainsRune(name, filepath.Separator)
+}
+
+// verify compares the SHA-256 of both copies when enabled and returns it
+func (t *transfer) verify(local, remote string) (string, error) {
+	if !t.opts.Verify {
+		return "", nil
+	}
+
+	localSum, err := fileChecksum(local)
+	if err != nil {
+		return "", fmt.Errorf("checksum %s: %w", local, err)
+	}
+
+	remoteSum := t.sftpChecksum
+	if t.remoteSum != nil {
+		remoteSum = t.remoteSum
+	}
+	sum, err := remoteSum(remote)
+	if err != nil {
+		return "", fmt.Errorf("checksum %s: %w", remote, err)
+	}
+
+	if sum != localSum {
+		hint := ""
+		if t.opts.Resume {
+			hint = "; the partial copy may be stale, retry without resume"
+		}
+		return "", fmt.Errorf("checksum mismatch for %s: local %s, remote %s%s", remote, localSum, sum, hint)
+	}
+	return sum, nil
+}
+
+// sftpChecksum hashes a remote file by reading it back
+func (t *transfer) sftpChecksum(remote string) (string, error) {
+	f, err := t.sftp.Open(remote)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if err := f.download(&sequentialWriter{w: h}, 0, fi.Size, nil); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sameFile reports whether a copy is up to date; SFTP v3 carries whole
+// seconds only
+func sameFile(size1 int64, mtime1 time.Time, size2 int64, mtime2 time.Time) bool {
+	return size1 == size2 && mtime1.Unix() == mtime2.Unix()
+}
+
+func filePerm(mode fs.FileMode) fs.FileMode {
+	if mode.Perm() == 0 {
+		return 0644
+	}
+	return mode.Perm()
+}
+
+func describeTransfer(offset int64, sum string) string {
+	var parts []string
+	if offset > 0 {
+		parts = append(parts, fmt.Sprintf("resumed at %d", offset))
+	}
+	if sum != "" {
+		parts = append(parts, "sha256 "+sum)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, ", ")
+}
+
+// download copies [offset, size) of the file to w, keeping transferWindow
+// reads in flight
+func (f *SFTPFile) download(w io.WriterAt, offset, size int64, progress func(int64)) error {
+	type pendingRead struct {
+		off  int64
+		size int
+		ch   <-chan sftpPacket
+	}
+
+	var queue []pendingRead
+	next := offset
+	fill := func() error {
+		for next < size && len(queue) < transferWindow {
+			n := int(min(size-next, sftpChunk))
+			off := next
+			ch, err := f.client.send(sftpRead, func(b *sftpBuffer) {
+				b.string(f.handle)
+				b.uint64(uint64(off))
+				b.uint32(uint32(n))
+			})
+			if err != nil {
+				return err
+			}
+			queue = append(queue, pendingRead{off: off, size: n, ch: ch})
+			next += int64(n)
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	for len(queue) > 0 {
+		req := queue[0]
+		queue = queue[1:]
+
+		resp := <-req.ch
+		if resp.err != nil {
+			return resp.err
+		}
+		data, err := expectData(resp)
+		if isEOF(err) {
+			return fmt.Errorf("%s shrank during transfer", f.path)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(data, req.off); err != nil {
+			return err
+		}
+
+		// Servers may return less than asked; fetch the rest in place
+		if len(data) < req.size {
+			rest := make([]byte, req.size-len(data))
+			n, err := f.ReadAt(rest, req.off+int64(len(data)))
+			if err != nil && !(err == io.EOF && n == len(rest)) {
+				return err
+			}
+			if _, err := w.WriteAt(rest[:n], req.off+int64(len(data))); err != nil {
+				return err
+			}
+		}
+
+		if progress != nil {
+			progress(int64(req.size))
+		}
+		if err := fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload copies [offset, size) of r to the file, keeping transferWindow
+// writes in flight
+func (f *SFTPFile) upload(r io.ReaderAt, offset, size int64, progress func(int64)) error {
+	type pendingWrite struct {
+		size int
+		ch   <-chan sftpPacket
+	}
+
+	var queue []pendingWrite
+	next := offset
+	buf := make([]byte, sftpChunk)
+	fill := func() error {
+		for next < size && len(queue) < transferWindow {
+			n, err := r.ReadAt(buf[:min(size-next, sftpChunk)], next)
+			if err != nil && !(err == io.EOF && n > 0) {
+				if err == io.EOF {
+					return errors.New("local file shrank during transfer")
+				}
+				return err
+			}
+			off, chunk := next, buf[:n]
+			ch, err := f.client.send(sftpWrite, func(b *sftpBuffer) {
+				b.string(f.handle)
+				b.uint64(uint64(off))
+				b.bytes(chunk)
+			})
+			if err != nil {
+				return err
+			}
+			queue = append(queue, pendingWrite{size: n, ch: ch})
+			next += int64(n)
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	for len(queue) > 0 {
+		req := queue[0]
+		queue = queue[1:]
+
+		resp := <-req.ch
+		if resp.err != nil {
+			return resp.err
+		}
+		if err := expectOK(resp); err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(int64(req.size))
+		}
+		if err := fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequentialWriter adapts an io.Writer to the in-order WriteAt calls made
+// by download
+type sequentialWriter struct {
+	w   io.Writer
+	off int64
+}
+
+func (s *sequentialWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != s.off {
+		return 0, fmt.Errorf("out of order write at %d, expected %d", off, s.off)
+	}
+	n, err := s.w.Write(p)
+	s.off += int64(n)
+	return n, err
+}
+
+// progress prints a transfer progress line at most every progressInterval
+type progress struct {
+	w     io.Writer
+	name  string
+	total int64
+	done  int64
+	start time.Time
+	base  int64
+	last  time.Time
+}
+
+const progressInterval = 250 * time.Millisecond
+
+func newProgress(w io.Writer, name string, total, offset int64) *progress {
+	return &progress{w: w, name: name, total: total, done: offset, base: offset, start: time.Now()}
+}
+
+func (p *progress) add(n int64) {
+	p.done += n
+	if p.w != nil && time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.print()
+	}
+}
+
+func (p *progress) finish(err error) {
+	if p.w == nil {
+		return
+	}
+	p.print()
+	if err != nil {
+		fmt.Fprintln(p.w, " failed")
+		return
+	}
+	fmt.Fprintln(p.w)
+}
+
+func (p *progress) print() {
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+
+	rate := float64(0)
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		rate = float64(p.done-p.base) / elapsed
+	}
+
+	fmt.Fprintf(p.w, "\r%-32s %3d%% %10s %10s/s", p.name, percent, formatBytes(float64(p.done)), formatBytes(rate))
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 3 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", n/unit, "KMGT"[exp])
+}
@@ -1,32 +1,147 @@
 package stream
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"strings"
 )
 
-// CompressedReader wraps a reader with gzip decompression
+// Codec names exchanged in the DIAL/ACCEPT handshake
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+)
+
+// Frame types on a compressed stream. Every frame is
+// [type:1][length:4][payload] so raw and compressed chunks can be mixed.
+const (
+	frameRaw  byte = 0
+	frameGzip byte = 1
+
+	frameHeaderSize = 5
+	maxFrameSize    = 1 << 20
+
+	// A chunk must shrink by at least this fraction to be sent compressed
+	minSavingsRatio = 0.1
+	// After this many incompressible chunks in a row the writer stops trying
+	maxIncompressible = 8
+)
+
+// SupportedCodecs lists codecs this build can use, in order of preference
+func SupportedCodecs() []string {
+	return []string{CodecGzip}
+}
+
+// NegotiateCodec picks the first supported codec from a comma separated
+// offer. It returns CodecNone when nothing in the offer is supported.
+func NegotiateCodec(offer string) string {
+	for _, name := range strings.Split(offer, ",") {
+		name = strings.TrimSpace(name)
+		for _, supported := range SupportedCodecs() {
+			if name == supported {
+				return name
+			}
+		}
+	}
+	return CodecNone
+}
+
+// magicPrefixes identify payloads that are already compressed or encrypted
+var magicPrefixes = [][]byte{
+	{0x1f, 0x8b},             // gzip
+	{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+	{0x50, 0x4b, 0x03, 0x04}, // zip
+	{0x89, 0x50, 0x4e, 0x47}, // png
+	{0xff, 0xd8, 0xff},       // jpeg
+	{0x16, 0x03},             // TLS handshake record
+	{0x17, 0x03},             // TLS application data record
+}
+
+// looksCompressed reports whether a chunk starts with a known compressed or
+// encrypted format, in which case compressing it again is wasted work.
+func looksCompressed(p []byte) bool {
+	for _, magic := range magicPrefixes {
+		if bytes.HasPrefix(p, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressedReader decodes a framed compressed stream
 type CompressedReader struct {
 	underlying io.Reader
 	gzipReader *gzip.Reader
+	frame      bytes.Buffer
+	pending    []byte
 }
 
 // NewCompressedReader creates a new compressed reader
-func NewCompressedReader(r io.Reader) (*CompressedReader, error) {
-	gr, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, err
-	}
-	
+func NewCompressedReader(r io.Reader) *CompressedReader {
 	return &CompressedReader{
 		underlying: r,
-		gzipReader: gr,
-	}, nil
+	}
 }
 
 // Read implements io.Reader interface with decompression
 func (cr *CompressedReader) Read(p []byte) (int, error) {
-	return cr.gzipReader.Read(p)
+	for len(cr.pending) == 0 {
+		if err := cr.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+func (cr *CompressedReader) readFrame() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(cr.underlying, header[:]); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return fmt.Errorf("compressed frame too large: %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(cr.underlying, payload); err != nil {
+		return fmt.Errorf("read frame: %w", err)
+	}
+
+	switch header[0] {
+	case frameRaw:
+		cr.pending = payload
+	case frameGzip:
+		var err error
+		if cr.gzipReader == nil {
+			cr.gzipReader, err = gzip.NewReader(bytes.NewReader(payload))
+		} else {
+			err = cr.gzipReader.Reset(bytes.NewReader(payload))
+		}
+		if err != nil {
+			return fmt.Errorf("gzip frame: %w", err)
+		}
+
+		cr.frame.Reset()
+		if _, err := cr.frame.ReadFrom(io.LimitReader(cr.gzipReader, maxFrameSize+1)); err != nil {
+			return fmt.Errorf("decompress frame: %w", err)
+		}
+		if cr.frame.Len() > maxFrameSize {
+			return fmt.Errorf("decompressed frame exceeds %d bytes", maxFrameSize)
+		}
+		cr.pending = cr.frame.Bytes()
+	default:
+		return fmt.Errorf("unknown frame type %d", header[0])
+	}
+
+	return nil
 }
 
 // Close closes the gzip reader
@@ -37,36 +152,84 @@ func (cr *CompressedReader) Close() error {
 	return nil
 }
 
-// CompressedWriter wraps a writer with gzip compression
+// CompressedWriter writes each chunk as one frame, compressing it unless the
+// data is already compressed or does not shrink.
 type CompressedWriter struct {
-	underlying io.Writer
-	gzipWriter *gzip.Writer
+	underlying     io.Writer
+	gzipWriter     *gzip.Writer
+	buf            bytes.Buffer
+	incompressible int
 }
 
 // NewCompressedWriter creates a new compressed writer
 func NewCompressedWriter(w io.Writer) *CompressedWriter {
-	gw := gzip.NewWriter(w)
-	
-	return &CompressedWriter{
+	cw := &CompressedWriter{
 		underlying: w,
-		gzipWriter: gw,
 	}
+	cw.gzipWriter = gzip.NewWriter(&cw.buf)
+
+	return cw
 }
 
-// Write implements io.Writer interface with compression
+// Write implements io.Writer interface with compression. Each call emits
+// one self-contained frame, so the peer can decode it without waiting.
 func (cw *CompressedWriter) Write(p []byte) (int, error) {
-	return cw.gzipWriter.Write(p)
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+
+		if err := cw.writeFrame(chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
 }
 
-// Flush flushes the gzip writer
+func (cw *CompressedWriter) writeFrame(p []byte) error {
+	frameType := frameRaw
+	payload := p
+
+	if cw.incompressible < maxIncompressible && !looksCompressed(p) {
+		cw.buf.Reset()
+		cw.gzipWriter.Reset(&cw.buf)
+		if _, err := cw.gzipWriter.Write(p); err != nil {
+			return fmt.Errorf("compress frame: %w", err)
+		}
+		if err := cw.gzipWriter.Close(); err != nil {
+			return fmt.Errorf("compress frame: %w", err)
+		}
+
+		if float64(cw.buf.Len()) <= float64(len(p))*(1-minSavingsRatio) {
+			frameType = frameGzip
+			payload = cw.buf.Bytes()
+			cw.incompressible = 0
+		} else {
+			cw.incompressible++
+		}
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err := cw.underlying.Write(frame)
+	return err
+}
+
+// Flush is a no-op; every Write is already flushed as a complete frame
 func (cw *CompressedWriter) Flush() error {
-	return cw.gzipWriter.Flush()
+	return nil
 }
 
-// Close closes the gzip writer
+// Close is a no-op; frames are self-contained and need no trailer
 func (cw *CompressedWriter) Close() error {
-	if cw.gzipWriter != nil {
-		return cw.gzipWriter.Close()
-	}
 	return nil
 }
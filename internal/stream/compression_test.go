@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		offer string
+		want  string
+	}{
+		{"gzip", CodecGzip},
+		{"zstd, gzip", CodecGzip},
+		{"zstd", CodecNone},
+		{"", CodecNone},
+	}
+
+	for _, tt := range tests {
+		if got := NegotiateCodec(tt.offer); got != tt.want {
+			t.Errorf("NegotiateCodec(%q) = %s, want %s", tt.offer, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("SELECT * FROM users WHERE id = 1;\n"), 2000)
+	gzipped := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0x42}, 4096)...)
+
+	for name, payload := range map[string][]byte{"text": text, "already compressed": gzipped} {
+		t.Run(name, func(t *testing.T) {
+			options := DefaultStreamOptions()
+			options.EnableCompression = true
+			options.Codec = CodecGzip
+			processor := NewStreamProcessor(options)
+
+			var wire bytes.Buffer
+			n, err := processor.CopyWithCompression(&wire, bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("Failed to compress: %v", err)
+			}
+			if n != int64(len(payload)) {
+				t.Errorf("Compressed copy reported %d bytes, want %d", n, len(payload))
+			}
+
+			var out bytes.Buffer
+			if _, err := processor.CopyWithDecompression(&out, &wire); err != nil && err != io.EOF {
+				t.Fatalf("Failed to decompress: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Fatalf("Round trip mismatch: got %d bytes, want %d", out.Len(), len(payload))
+			}
+		})
+	}
+}
+
+func TestCompressedWriterSkipsCompressedData(t *testing.T) {
+	var wire bytes.Buffer
+	writer := NewCompressedWriter(&wire)
+
+	payload := append([]byte{0x16, 0x03, 0x01}, bytes.Repeat([]byte{0}, 1024)...)
+	if _, err := writer.Write(payload); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	if wire.Bytes()[0] != frameRaw {
+		t.Errorf("TLS record was compressed, expected raw frame")
+	}
+}
@@ -1,7 +1,6 @@
 package stream
 
 import (
-	"compress/gzip"
 	"fmt"
 	"io"
 	"net"
@@ -10,6 +9,7 @@ import (
 // StreamOptions holds configuration for stream processing
 type StreamOptions struct {
 	EnableCompression bool
+	Codec             string
 	BufferSize        int
 }
 
@@ -17,6 +17,7 @@ type StreamOptions struct {
 func DefaultStreamOptions() *StreamOptions {
 	return &StreamOptions{
 		EnableCompression: false,
+		Codec:             CodecNone,
 		BufferSize:        32 * 1024, // 32KB buffer
 	}
 }
@@ -36,28 +37,120 @@ func NewStreamProcessor(options *StreamOptions) *StreamProcessor {
 	}
 }
 
-// CopyWithCompression copies data between connections with optional compression
+// compressing reports whether the negotiated codec actually compresses
+func (sp *StreamProcessor) compressing() bool {
+	return sp.options.EnableCompression && sp.options.Codec != "" && sp.options.Codec != CodecNone
+}
+
+// CopyWithCompression copies plain data from src and writes it to dst in
+// the negotiated codec. Without compression it is a plain copy.
 func (sp *StreamProcessor) CopyWithCompression(dst io.Writer, src io.Reader) (int64, error) {
-	// For now, disable compression as it interferes with protocol compatibility
-	// TODO: Implement intelligent compression that detects data type
-	return io.Copy(dst, src)
+	if !sp.compressing() {
+		return sp.bufferedCopy(dst, src)
+	}
+
+	return sp.copyCompressed(dst, src)
 }
 
-// copyCompressed performs compressed data copy
-func (sp *StreamProcessor) copyCompressed(dst io.Writer, src io.Reader) (int64, error) {
-	// Create gzip writer
-	gzWriter := gzip.NewWriter(dst)
-	defer gzWriter.Close()
+// CopyWithDecompression reads codec frames from src and writes the decoded
+// data to dst. Without compression it is a plain copy.
+func (sp *StreamProcessor) CopyWithDecompression(dst io.Writer, src io.Reader) (int64, error) {
+	if !sp.compressing() {
+		return sp.bufferedCopy(dst, src)
+	}
+
+	reader := NewCompressedReader(src)
+	defer reader.Close()
 
-	// Copy with compression
-	written, err := io.Copy(gzWriter, src)
+	buf := make([]byte, sp.options.BufferSize)
+	written, err := io.CopyBuffer(dst, reader, buf)
 	if err != nil {
-		return written, fmt.Errorf("compressed copy error: %w", err)
+		return written, fmt.Errorf("decompressed copy error: %w", err)
 	}
 
-	// Ensure all data is flushed
-	if err := gzWriter.Flush(); err != nil {
-		return written, fmt.Errorf("compression flush error: %w", err)
+	return written, nil
+}
+
+// copyCompressed performs compressed data copy with flush-on-idle framing:
+// reads are batched while more data is immediately available and a frame is
+// emitted as soon as the source goes quiet or the buffer fills.
+func (sp *StreamProcessor) copyCompressed(dst io.Writer, src io.Reader) (int64, error) {
+	writer := NewCompressedWriter(dst)
+	defer writer.Close()
+
+	type chunk struct {
+		data []byte
+		err  error
+	}
+
+	chunks := make(chan chunk, 4)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, sp.options.BufferSize)
+			n, err := src.Read(buf)
+			select {
+			case chunks <- chunk{data: buf[:n], err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		written int64
+		pending []byte
+		readErr error
+	)
+
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if _, err := writer.Write(pending); err != nil {
+			return fmt.Errorf("compressed copy error: %w", err)
+		}
+		written += int64(len(pending))
+		pending = pending[:0]
+		return nil
+	}
+
+	for readErr == nil {
+		// Block for the first chunk, then drain whatever is already queued
+		c, ok := <-chunks
+		if !ok {
+			break
+		}
+		pending = append(pending, c.data...)
+		readErr = c.err
+
+	drain:
+		for readErr == nil && len(pending) < maxFrameSize/2 {
+			select {
+			case c, ok := <-chunks:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, c.data...)
+				readErr = c.err
+			default:
+				break drain
+			}
+		}
+
+		if err := flush(); err != nil {
+			return written, err
+		}
+	}
+
+	if readErr != nil && readErr != io.EOF {
+		return written, readErr
 	}
 
 	return written, nil
@@ -65,40 +158,36 @@ func (sp *StreamProcessor) copyCompressed(dst io.Writer, src io.Reader) (int64,
 
 // CreateCompressedReader creates a reader that decompresses data
 func (sp *StreamProcessor) CreateCompressedReader(r io.Reader) (io.ReadCloser, error) {
-	if !sp.options.EnableCompression {
+	if !sp.compressing() {
 		return io.NopCloser(r), nil
 	}
 
-	gzReader, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
-	}
-
-	return gzReader, nil
+	return NewCompressedReader(r), nil
 }
 
 // CreateCompressedWriter creates a writer that compresses data
 func (sp *StreamProcessor) CreateCompressedWriter(w io.Writer) io.WriteCloser {
-	if !sp.options.EnableCompression {
+	if !sp.compressing() {
 		return &nopWriteCloser{w}
 	}
 
-	return gzip.NewWriter(w)
+	return NewCompressedWriter(w)
 }
 
-// ProxyConnection proxies data between two connections with optional compression
-func (sp *StreamProcessor) ProxyConnection(conn1, conn2 net.Conn) error {
+// ProxyConnection proxies data between a tunnel stream and a plain local
+// connection, compressing towards the tunnel and decompressing from it.
+func (sp *StreamProcessor) ProxyConnection(tunnelConn, localConn net.Conn) error {
 	errCh := make(chan error, 2)
 
-	// Copy conn1 -> conn2
+	// Copy local -> tunnel
 	go func() {
-		_, err := sp.CopyWithCompression(conn2, conn1)
+		_, err := sp.CopyWithCompression(tunnelConn, localConn)
 		errCh <- err
 	}()
 
-	// Copy conn2 -> conn1
+	// Copy tunnel -> local
 	go func() {
-		_, err := sp.CopyWithCompression(conn1, conn2)
+		_, err := sp.CopyWithDecompression(localConn, tunnelConn)
 		errCh <- err
 	}()
 
@@ -117,11 +206,7 @@ func (nwc *nopWriteCloser) Close() error {
 
 // BufferedCopyWithCompression copies data with buffering and optional compression
 func (sp *StreamProcessor) BufferedCopyWithCompression(dst io.Writer, src io.Reader) (int64, error) {
-	if !sp.options.EnableCompression {
-		return sp.bufferedCopy(dst, src)
-	}
-
-	return sp.bufferedCopyCompressed(dst, src)
+	return sp.CopyWithCompression(dst, src)
 }
 
 // bufferedCopy performs buffered copy without compression
@@ -129,21 +214,3 @@ func (sp *StreamProcessor) bufferedCopy(dst io.Writer, src io.Reader) (int64, er
 	buf := make([]byte, sp.options.BufferSize)
 	return io.CopyBuffer(dst, src, buf)
 }
-
-// bufferedCopyCompressed performs buffered copy with compression
-func (sp *StreamProcessor) bufferedCopyCompressed(dst io.Writer, src io.Reader) (int64, error) {
-	gzWriter := gzip.NewWriter(dst)
-	defer gzWriter.Close()
-
-	buf := make([]byte, sp.options.BufferSize)
-	written, err := io.CopyBuffer(gzWriter, src, buf)
-	if err != nil {
-		return written, fmt.Errorf("buffered compressed copy error: %w", err)
-	}
-
-	if err := gzWriter.Flush(); err != nil {
-		return written, fmt.Errorf("compression flush error: %w", err)
-	}
-
-	return written, nil
-}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the largest payload a single datagram frame can carry
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes one length-prefixed datagram to a stream. Header and
+// payload go out in a single Write so frames are never interleaved.
+func WriteDatagram(w io.Writer, payload []byte) error {
+	if len(payload) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(payload))
+	}
+
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads one length-prefixed datagram into buf and returns its size
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds buffer of %d", size, len(buf))
+	}
+
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, fmt.Errorf("read datagram: %w", err)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("dns query"),
+		{},
+		bytes.Repeat([]byte{0xab}, MaxDatagramSize),
+	}
+
+	var stream bytes.Buffer
+	for _, p := range payloads {
+		if err := WriteDatagram(&stream, p); err != nil {
+			t.Fatalf("Failed to write datagram: %v", err)
+		}
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	for i, want := range payloads {
+		n, err := ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatalf("Failed to read datagram %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("Datagram %d mismatch: got %d bytes, want %d", i, n, len(want))
+		}
+	}
+
+	if err := WriteDatagram(&stream, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Errorf("Expected error for oversized datagram")
+	}
+}
@@ -1,7 +1,9 @@
 package transport
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,12 +21,44 @@ const (
 	DialTimeout     = 30 * time.Second
 )
 
+// Control messages are JSON, sent as newline-terminated lines (protocol
+// version 1) or, once both sides have negotiated version 2, as frames: a
+// marker byte, a uint32 length and the JSON. A line always starts with '{',
+// so both can be read on the same stream.
+const (
+	controlFrameMarker = 0x01
+	maxControlLine     = 8192
+	maxControlFrame    = 1 << 20
+)
+
 // MuxSession wraps yamux session with control channel
 type MuxSession struct {
 	session     *yamux.Session
 	controlConn net.Conn
 	mu          sync.RWMutex
 	closed      bool
+
+	// sendMu keeps concurrent control messages from interleaving and
+	// guards framed, set once the peer is known to read frames
+	sendMu sync.Mutex
+	framed bool
+
+	reader *bufio.Reader
+	server bool
+
+	// Negotiated by HELLO; peerCaps stays nil for version 1 peers
+	version  int
+	peerCaps map[string]bool
+}
+
+func newMuxSession(session *yamux.Session, controlConn net.Conn, server bool) *MuxSession {
+	return &MuxSession{
+		session:     session,
+		controlConn: controlConn,
+		reader:      bufio.NewReaderSize(controlConn, maxControlLine+1),
+		server:      server,
+		version:     1,
+	}
 }
 
 func NewMuxServer(conn net.Conn) (*MuxSession, error) {
@@ -32,8 +66,8 @@ func NewMuxServer(conn net.Conn) (*MuxSession, error) {
 }
 
 func NewMuxServerWithCompression(conn net.Conn, enableCompression bool) (*MuxSession, error) {
-	// TODO: Implement compression at stream level, not connection level
-	// For now, ignore compression to prevent yamux protocol conflicts
+	// Compression is negotiated per stream in the DIAL/ACCEPT handshake and
+	// applied by internal/stream, never to the yamux frames themselves
 	_ = enableCompression
 	
 	config := yamux.DefaultConfig()
@@ -75,10 +109,14 @@ func NewMuxServerWithCompression(conn net.Conn, enableCompression bool) (*MuxSes
 		return nil, fmt.Errorf("timeout accepting control stream")
 	}
 	
-	return &MuxSession{
-		session:     session,
-		controlConn: controlConn,
-	}, nil
+	// Offer a newer protocol; older clients log HELLO as unknown and keep
+	// speaking version 1
+	m := newMuxSession(session, controlConn, true)
+	if err := m.SendControl(proto.NewHello()); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("send hello: %w", err)
+	}
+	return m, nil
 }
 
 func NewMuxClient(conn net.Conn) (*MuxSession, error) {
@@ -86,8 +124,8 @@ func NewMuxClient(conn net.Conn) (*MuxSession, error) {
 }
 
 func NewMuxClientWithCompression(conn net.Conn, enableCompression bool) (*MuxSession, error) {
-	// Compression is now handled at stream level, not connection level
-	// This avoids conflicts with yamux protocol frames
+	// Compression is negotiated per stream in the DIAL/ACCEPT handshake and
+	// applied by internal/stream, never to the yamux frames themselves
 	if enableCompression {
 		log.Printf("Stream-level compression enabled")
 	}
@@ -124,17 +162,16 @@ func NewMuxClientWithCompression(conn net.Conn, enableCompression bool) (*MuxSes
 		return nil, fmt.Errorf("open control stream after retries: %w", err)
 	}
 	
-	return &MuxSession{
-		session:     session,
-		controlConn: controlConn,
-	}, nil
+	return newMuxSession(session, controlConn, false), nil
 }
 
 func (m *MuxSession) OpenStream() (net.Conn, error) {
+	// Don't hold mu while yamux waits for window or an open ack
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	closed := m.closed
+	m.mu.RUnlock()
 	
-	if m.closed {
+	if closed {
 		return nil, fmt.Errorf("session closed")
 	}
 	
@@ -142,10 +179,13 @@ func (m *MuxSession) OpenStream() (net.Conn, error) {
 }
 
 func (m *MuxSession) AcceptStream() (net.Conn, error) {
+	// Don't hold mu while waiting for the peer; handleHello takes it to
+	// record the negotiated version
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	closed := m.closed
+	m.mu.RUnlock()
 	
-	if m.closed {
+	if closed {
 		return nil, fmt.Errorf("session closed")
 	}
 	
@@ -153,10 +193,12 @@ func (m *MuxSession) AcceptStream() (net.Conn, error) {
 }
 
 func (m *MuxSession) SendControl(msg *proto.Control) error {
+	// Don't hold mu during I/O so Close never waits on a blocked write
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	closed := m.closed
+	m.mu.RUnlock()
 	
-	if m.closed {
+	if closed {
 		return fmt.Errorf("session closed")
 	}
 	
@@ -165,10 +207,15 @@ func (m *MuxSession) SendControl(msg *proto.Control) error {
 		return fmt.Errorf("marshal control: %w", err)
 	}
 	
-	// Add newline delimiter for easier parsing
-	data = append(data, '\n')
-	
+	m.sendMu.Lock()
+	if m.framed {
+		header := binary.BigEndian.AppendUint32([]byte{controlFrameMarker}, uint32(len(data)))
+		data = append(header, data...)
+	} else {
+		data = append(data, '\n')
+	}
 	_, err = m.controlConn.Write(data)
+	m.sendMu.Unlock()
 	if err != nil {
 		return fmt.Errorf("write control: %w", err)
 	}
@@ -177,10 +224,12 @@ func (m *MuxSession) SendControl(msg *proto.Control) error {
 }
 
 func (m *MuxSession) ReceiveControl() (*proto.Control, error) {
+	// Don't hold mu while blocked reading; Close unblocks the read instead
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	closed := m.closed
+	m.mu.RUnlock()
 	
-	if m.closed {
+	if closed {
 		return nil, fmt.Errorf("session closed")
 	}
 	
@@ -190,40 +239,109 @@ func (m *MuxSession) ReceiveControl() (*proto.Control, error) {
 		defer tcpConn.SetReadDeadline(time.Time{}) // Clear deadline
 	}
 	
-	// Read until newline delimiter
-	buffer := make([]byte, 1)
-	var msgBytes []byte
-	
 	for {
-		n, err := m.controlConn.Read(buffer)
+		msg, err := m.readControl()
 		if err != nil {
-			if err == io.EOF {
-				return nil, fmt.Errorf("connection closed: %w", err)
-			}
+			return nil, err
+		}
+		if msg.Type != proto.MsgHello {
+			return msg, nil
+		}
+		if err := m.handleHello(msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readControl reads one control message in either encoding
+func (m *MuxSession) readControl() (*proto.Control, error) {
+	first, err := m.reader.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("connection closed: %w", err)
+		}
+		return nil, fmt.Errorf("read control: %w", err)
+	}
+
+	var data []byte
+	if first[0] == controlFrameMarker {
+		var header [5]byte
+		if _, err := io.ReadFull(m.reader, header[:]); err != nil {
 			return nil, fmt.Errorf("read control: %w", err)
 		}
-		
-		if n > 0 {
-			if buffer[0] == '\n' {
-				break
-			}
-			msgBytes = append(msgBytes, buffer[0])
+		length := binary.BigEndian.Uint32(header[1:])
+		if length > maxControlFrame {
+			return nil, fmt.Errorf("control frame too large (%d bytes)", length)
 		}
-		
-		// Safety check to prevent infinite loop
-		if len(msgBytes) > 8192 {
+		data = make([]byte, length)
+		if _, err := io.ReadFull(m.reader, data); err != nil {
+			return nil, fmt.Errorf("read control: %w", err)
+		}
+	} else {
+		line, err := m.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
 			return nil, fmt.Errorf("control message too large")
 		}
+		if err != nil {
+			return nil, fmt.Errorf("read control: %w", err)
+		}
+		data = line[:len(line)-1]
 	}
-	
+
 	var msg proto.Control
-	if err := json.Unmarshal(msgBytes, &msg); err != nil {
+	if err := json.Unmarshal(data, &msg); err != nil {
 		return nil, fmt.Errorf("unmarshal control: %w", err)
 	}
-	
+
 	return &msg, nil
 }
 
+// handleHello completes version negotiation: the accepting side has sent
+// its HELLO already, the connecting side answers with its own. Both then
+// send frames if the agreed version has them.
+func (m *MuxSession) handleHello(hello *proto.Control) error {
+	version, err := proto.NegotiateVersion(hello)
+	if err != nil {
+		m.SendControl(&proto.Control{Type: proto.MsgError, Error: err.Error()})
+		return err
+	}
+
+	if !m.server {
+		if err := m.SendControl(proto.NewHello()); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	m.version = version
+	m.peerCaps = proto.ParseCapabilities(hello.Capabilities)
+	m.mu.Unlock()
+
+	m.sendMu.Lock()
+	m.framed = version >= proto.VersionFramed
+	m.sendMu.Unlock()
+
+	log.Printf("Control protocol version %d negotiated (peer capabilities: %s)", version, hello.Capabilities)
+	return nil
+}
+
+// Version returns the negotiated control protocol version, 1 until the
+// peer has sent HELLO
+func (m *MuxSession) Version() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
+}
+
+// PeerSupports reports whether the peer announced a capability. Version 1
+// peers announce nothing and are assumed to support everything, as before
+// negotiation existed.
+func (m *MuxSession) PeerSupports(capability string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.peerCaps == nil || m.peerCaps[capability]
+}
+
 func (m *MuxSession) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
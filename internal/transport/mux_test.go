@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"remote-tunnel/internal/proto"
+)
+
+// receiveAll delivers control messages until the session fails
+func receiveAll(session *MuxSession) <-chan *proto.Control {
+	ch := make(chan *proto.Control, 16)
+	go func() {
+		defer close(ch)
+		for {
+			msg, err := session.ReceiveControl()
+			if err != nil {
+				return
+			}
+			ch <- msg
+		}
+	}()
+	return ch
+}
+
+func expectControl(t *testing.T, ch <-chan *proto.Control, want proto.MsgType) *proto.Control {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatalf("session closed waiting for %s", want)
+		}
+		if msg.Type != want {
+			t.Fatalf("got %s, want %s", msg.Type, want)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+	return nil
+}
+
+func TestControlNegotiation(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	serverCh := make(chan *MuxSession, 1)
+	go func() {
+		server, err := NewMuxServer(serverConn)
+		if err != nil {
+			t.Errorf("NewMuxServer failed: %v", err)
+		}
+		serverCh <- server
+	}()
+
+	client, err := NewMuxClient(clientConn)
+	if err != nil {
+		t.Fatalf("NewMuxClient failed: %v", err)
+	}
+	defer client.Close()
+	server := <-serverCh
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	// Messages sent before the HELLO exchange go out as JSON lines
+	if err := client.SendControl(&proto.Control{Type: proto.MsgRegister, AgentID: "agent-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fromClient, fromServer := receiveAll(server), receiveAll(client)
+	expectControl(t, fromClient, proto.MsgRegister)
+
+	// The client answers HELLO before it reads the PING, and the server
+	// reads that answer before the PONG
+	server.SendControl(&proto.Control{Type: proto.MsgPing})
+	expectControl(t, fromServer, proto.MsgPing)
+	client.SendControl(&proto.Control{Type: proto.MsgPong})
+	expectControl(t, fromClient, proto.MsgPong)
+
+	if server.Version() != proto.Version || client.Version() != proto.Version {
+		t.Fatalf("negotiated versions %d/%d, want %d", server.Version(), client.Version(), proto.Version)
+	}
+	if !server.PeerSupports(proto.CapUDP) || server.PeerSupports("teleport") {
+		t.Error("unexpected peer capabilities")
+	}
+
+	// Frames are not bound by the line limit
+	big := strings.Repeat("x", 3*maxControlLine)
+	if err := client.SendControl(&proto.Control{Type: proto.MsgDial, TargetAddr: big}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectControl(t, fromClient, proto.MsgDial); msg.TargetAddr != big {
+		t.Error("large control message corrupted")
+	}
+}
+
+// legacyPeer is the control stream of a version 1 peer
+func legacyPeer(t *testing.T) (*MuxSession, net.Conn, *bufio.Reader) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return newMuxSession(nil, local, false), remote, bufio.NewReader(remote)
+}
+
+func TestControlLegacyPeer(t *testing.T) {
+	session, peer, _ := legacyPeer(t)
+
+	go peer.Write([]byte(`{"type":"PING"}` + "\n"))
+	msg, err := session.ReceiveControl()
+	if err != nil || msg.Type != proto.MsgPing {
+		t.Fatalf("unexpected message %+v, %v", msg, err)
+	}
+	if session.Version() != 1 || !session.PeerSupports(proto.CapReverse) {
+		t.Error("version 1 peers should keep the old behavior")
+	}
+
+	go peer.Write([]byte(`{"type":"DIAL","target_addr":"` + strings.Repeat("x", maxControlLine) + `"}` + "\n"))
+	if _, err := session.ReceiveControl(); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected oversized line to fail, got %v", err)
+	}
+}
+
+func TestControlIncompatibleVersion(t *testing.T) {
+	session, peer, reader := legacyPeer(t)
+
+	hello, _ := json.Marshal(&proto.Control{Type: proto.MsgHello, Version: proto.Version + 2, MinVersion: proto.Version + 1})
+	go peer.Write(append(hello, '\n'))
+
+	replyCh := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		replyCh <- line
+	}()
+
+	_, err := session.ReceiveControl()
+	var versionErr *proto.VersionError
+	if !errors.As(err, &versionErr) {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+	if reply := <-replyCh; !strings.Contains(reply, `"type":"ERROR"`) || !strings.Contains(reply, "incompatible control protocol") {
+		t.Errorf("peer not told about the mismatch: %q", reply)
+	}
+}
+
+func TestHelloWhileAcceptingStreams(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	serverCh := make(chan *MuxSession, 1)
+	go func() {
+		server, err := NewMuxServer(serverConn)
+		if err != nil {
+			t.Errorf("NewMuxServer failed: %v", err)
+		}
+		serverCh <- server
+	}()
+
+	client, err := NewMuxClient(clientConn)
+	if err != nil {
+		t.Fatalf("NewMuxClient failed: %v", err)
+	}
+	defer client.Close()
+	server := <-serverCh
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	// The relay routes streams before the peer's HELLO answer arrives
+	go server.RouteStreams(NewStreamRouter())
+	time.Sleep(50 * time.Millisecond)
+
+	fromClient, fromServer := receiveAll(server), receiveAll(client)
+	client.SendControl(&proto.Control{Type: proto.MsgPing})
+	expectControl(t, fromClient, proto.MsgPing)
+	server.SendControl(&proto.Control{Type: proto.MsgPong})
+	expectControl(t, fromServer, proto.MsgPong)
+
+	if server.Version() != proto.Version {
+		t.Errorf("negotiated version %d, want %d", server.Version(), proto.Version)
+	}
+}
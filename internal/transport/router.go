@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every data stream starts with a header frame naming the stream ID it
+// belongs to: [length:1][stream id]. The peer uses it to match the stream
+// to the DIAL or INBOUND request that expects it.
+const (
+	maxStreamIDLength   = 255
+	streamHeaderTimeout = 10 * time.Second
+)
+
+// WriteStreamHeader writes the stream ID header frame
+func WriteStreamHeader(conn net.Conn, streamID string) error {
+	if streamID == "" || len(streamID) > maxStreamIDLength {
+		return fmt.Errorf("invalid stream ID %q", streamID)
+	}
+
+	frame := make([]byte, 1+len(streamID))
+	frame[0] = byte(len(streamID))
+	copy(frame[1:], streamID)
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+// ReadStreamHeader reads the stream ID header frame
+func ReadStreamHeader(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var length [1]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return "", fmt.Errorf("read stream header: %w", err)
+	}
+	if length[0] == 0 {
+		return "", fmt.Errorf("empty stream ID")
+	}
+
+	id := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, id); err != nil {
+		return "", fmt.Errorf("read stream header: %w", err)
+	}
+
+	return string(id), nil
+}
+
+// OpenStreamWithID opens a stream and tags it with streamID
+func (m *MuxSession) OpenStreamWithID(streamID string) (net.Conn, error) {
+	stream, err := m.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteStreamHeader(stream, streamID); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("write stream header: %w", err)
+	}
+
+	return stream, nil
+}
+
+// RouteStreams accepts every stream the peer opens and hands it to router
+// until the session closes.
+func (m *MuxSession) RouteStreams(router *StreamRouter) error {
+	for {
+		stream, err := m.AcceptStream()
+		if err != nil {
+			return err
+		}
+
+		go router.Route(stream)
+	}
+}
+
+// StreamRouter matches streams opened by the peer to the request waiting
+// for them. A stream may arrive before or after its request registers.
+type StreamRouter struct {
+	mu      sync.Mutex
+	waiting map[string]chan net.Conn
+}
+
+func NewStreamRouter() *StreamRouter {
+	return &StreamRouter{
+		waiting: make(map[string]chan net.Conn),
+	}
+}
+
+func (r *StreamRouter) slot(streamID string) chan net.Conn {
+	ch, exists := r.waiting[streamID]
+	if !exists {
+		ch = make(chan net.Conn, 1)
+		r.waiting[streamID] = ch
+	}
+	return ch
+}
+
+// Expect registers interest in streamID; call Forget when done
+func (r *StreamRouter) Expect(streamID string) {
+	r.mu.Lock()
+	r.slot(streamID)
+	r.mu.Unlock()
+}
+
+// Wait blocks until the stream tagged streamID arrives or timeout passes
+func (r *StreamRouter) Wait(streamID string, timeout time.Duration) (net.Conn, error) {
+	r.mu.Lock()
+	ch := r.slot(streamID)
+	r.mu.Unlock()
+
+	select {
+	case stream := <-ch:
+		r.mu.Lock()
+		if r.waiting[streamID] == ch {
+			delete(r.waiting, streamID)
+		}
+		r.mu.Unlock()
+		return stream, nil
+	case <-time.After(timeout):
+		r.Forget(streamID)
+		return nil, fmt.Errorf("timeout waiting for stream %s", streamID)
+	}
+}
+
+// Forget drops the registration for streamID and closes any stream that
+// arrived for it but was never collected.
+func (r *StreamRouter) Forget(streamID string) {
+	r.mu.Lock()
+	ch, exists := r.waiting[streamID]
+	delete(r.waiting, streamID)
+	r.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	select {
+	case stream := <-ch:
+		stream.Close()
+	default:
+	}
+}
+
+// Route reads the header of a newly accepted stream and delivers it. Streams
+// nobody asks for within DialTimeout are closed.
+func (r *StreamRouter) Route(stream net.Conn) {
+	streamID, err := ReadStreamHeader(stream)
+	if err != nil {
+		log.Printf("Dropping stream without header: %v", err)
+		stream.Close()
+		return
+	}
+
+	r.mu.Lock()
+	_, expected := r.waiting[streamID]
+	ch := r.slot(streamID)
+	r.mu.Unlock()
+
+	select {
+	case ch <- stream:
+	default:
+		log.Printf("Duplicate stream %s, closing", streamID)
+		stream.Close()
+		return
+	}
+
+	if !expected {
+		// Control message for this stream may still be in flight
+		time.AfterFunc(DialTimeout, func() {
+			r.mu.Lock()
+			current, exists := r.waiting[streamID]
+			r.mu.Unlock()
+			if exists && current == ch && len(ch) > 0 {
+				log.Printf("Stream %s was never claimed, closing", streamID)
+				r.Forget(streamID)
+			}
+		})
+	}
+}
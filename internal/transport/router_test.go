@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamRouterMatchesByID(t *testing.T) {
+	router := NewStreamRouter()
+	router.Expect("stream-a")
+	router.Expect("stream-b")
+
+	// Deliver in the opposite order the requests were made
+	for _, id := range []string{"stream-b", "stream-a"} {
+		local, remote := net.Pipe()
+		go func(id string) {
+			WriteStreamHeader(remote, id)
+			remote.Write([]byte(id))
+		}(id)
+		go router.Route(local)
+	}
+
+	for _, id := range []string{"stream-a", "stream-b"} {
+		stream, err := router.Wait(id, time.Second)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", id, err)
+		}
+
+		buf := make([]byte, len(id))
+		if _, err := stream.Read(buf); err != nil {
+			t.Fatalf("Failed to read %s: %v", id, err)
+		}
+		if string(buf) != id {
+			t.Errorf("Stream mismatch: waited for %s, got data for %s", id, buf)
+		}
+	}
+}
+
+func TestStreamRouterTimeout(t *testing.T) {
+	router := NewStreamRouter()
+	if _, err := router.Wait("missing", 10*time.Millisecond); err == nil {
+		t.Errorf("Expected timeout for missing stream")
+	}
+}
@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// CreateMutualTLSConfig creates a server TLS config that verifies client
+// certificates signed by the CA in clientCAFile. Handshakes without a
+// certificate fail unless allowNoCert is set, which leaves those peers to
+// token authentication.
+func CreateMutualTLSConfig(certFile, keyFile, clientCAFile string, allowNoCert bool) (*tls.Config, error) {
+	config, err := CreateTLSConfig(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if allowNoCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// CreateClientTLSConfig creates a TLS config for agents and clients. When
+// caFile is set only relay certificates signed by that CA are trusted; when
+// certFile is set the certificate is presented to the relay.
+func CreateClientTLSConfig(certFile, keyFile, caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// PeerCertificate returns the verified client certificate of r, or nil
+func PeerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// CertificateNames returns the certificate CN followed by its DNS SANs
+func CertificateNames(cert *x509.Certificate) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -82,6 +84,18 @@ func DialWSInsecure(ctx context.Context, url, token string, insecure bool) (*WSC
 
 // DialWSInsecureWithCompression connects to WebSocket server with optional TLS skip verification and compression
 func DialWSInsecureWithCompression(ctx context.Context, url, token string, insecure bool, enableCompression bool) (*WSConn, error) {
+	var tlsConfig *tls.Config
+	if insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return DialWSWithTLS(ctx, url, token, tlsConfig, enableCompression)
+}
+
+// DialWSWithTLS connects to WebSocket server using tlsConfig, e.g. to pin
+// the relay CA and present a client certificate. A nil tlsConfig uses the
+// system defaults.
+func DialWSWithTLS(ctx context.Context, url, token string, tlsConfig *tls.Config, enableCompression bool) (*WSConn, error) {
 	opts := &websocket.DialOptions{
 		HTTPHeader: http.Header{
 			"X-Tunnel-Token": []string{token},
@@ -95,13 +109,10 @@ func DialWSInsecureWithCompression(ctx context.Context, url, token string, insec
 		// No HTTP header needed as compression is at stream level
 	}
 	
-	// Skip TLS verification if insecure mode is enabled
-	if insecure {
+	if tlsConfig != nil {
 		opts.HTTPClient = &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
+				TLSClientConfig: tlsConfig,
 			},
 		}
 	}
@@ -121,10 +132,27 @@ func AcceptWS(w http.ResponseWriter, r *http.Request, expectedToken string) (*WS
 
 // AcceptWSWithCompression accepts WebSocket connection with compression support
 func AcceptWSWithCompression(w http.ResponseWriter, r *http.Request, expectedToken string, enableCompression bool) (*WSConn, error) {
-	token := r.Header.Get("X-Tunnel-Token")
-	if token != expectedToken {
+	return AcceptWSWithAuth(w, r, func(token string) error {
+		if !TokenEqual(token, expectedToken) {
+			return fmt.Errorf("invalid token")
+		}
+		return nil
+	}, enableCompression)
+}
+
+// TokenEqual compares tokens in constant time
+func TokenEqual(token, expected string) bool {
+	got := sha256.Sum256([]byte(token))
+	want := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// AcceptWSWithAuth accepts a WebSocket connection once authorize approves
+// the X-Tunnel-Token header
+func AcceptWSWithAuth(w http.ResponseWriter, r *http.Request, authorize func(token string) error, enableCompression bool) (*WSConn, error) {
+	if err := authorize(r.Header.Get("X-Tunnel-Token")); err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return nil, fmt.Errorf("invalid token")
+		return nil, err
 	}
 	
 	// Compression is handled at application level, not in WebSocket handshake
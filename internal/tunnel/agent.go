@@ -2,12 +2,15 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"strings"
+	"sync"
 	"time"
 
+	"remote-tunnel/internal/policy"
 	"remote-tunnel/internal/proto"
 	streamutil "remote-tunnel/internal/stream"
 	"remote-tunnel/internal/transport"
@@ -15,30 +18,58 @@ import (
 
 type Agent struct {
 	id          string
-	relayURL    string
+	relays      *relayPool
 	token       string
-	allowedHosts []string
+	policy      *policy.Engine
 	session     *transport.MuxSession
+	sessionMu   sync.Mutex
 	ctx         context.Context
 	cancel      context.CancelFunc
 	insecure    bool
 	compress    bool
+	tlsConfig   *tls.Config
+
+	listenPolicy  *policy.Engine
+	listeners     map[string]*agentListener
+	listenersMu   sync.Mutex
+
+	metrics *tunnelMetrics
 }
 
 func NewAgent(id, relayURL, token string, allowedHosts []string) *Agent {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Agent{
 		id:           id,
-		relayURL:     relayURL,
+		relays:       newRelayPool(relayURL),
 		token:        token,
-		allowedHosts: allowedHosts,
+		policy:       allowListEngine(allowedHosts),
+		listenPolicy: allowListEngine(nil),
 		ctx:          ctx,
 		cancel:       cancel,
 		insecure:     false,
 		compress:     false,
+		listeners:    make(map[string]*agentListener),
+		metrics:      newTunnelMetrics("agent"),
 	}
 }
 
+// allowListEngine builds a policy engine from -allow style entries. Invalid
+// entries leave a deny-all policy so a typo never opens access.
+func allowListEngine(entries []string) *policy.Engine {
+	p, err := policy.FromAllowList(entries)
+	if err != nil {
+		log.Printf("Invalid allow list %v: %v (denying all targets)", entries, err)
+		p = &policy.Policy{Default: policy.ActionDeny}
+	}
+	return policy.NewEngine(p)
+}
+
+// SetPolicy replaces the allow-list with a policy engine, e.g. one loaded
+// from a file that is reloaded on SIGHUP.
+func (a *Agent) SetPolicy(engine *policy.Engine) {
+	a.policy = engine
+}
+
 func (a *Agent) SetInsecure(insecure bool) {
 	a.insecure = insecure
 }
@@ -47,6 +78,25 @@ func (a *Agent) SetCompression(compress bool) {
 	a.compress = compress
 }
 
+// SetTLSConfig sets the TLS config used to reach the relay, e.g. with a
+// pinned relay CA and a client certificate for mTLS. It overrides SetInsecure.
+func (a *Agent) SetTLSConfig(config *tls.Config) {
+	a.tlsConfig = config
+}
+
+func (a *Agent) dialRelay(relayURL string) (*transport.WSConn, error) {
+	if a.tlsConfig != nil {
+		return transport.DialWSWithTLS(a.ctx, relayURL, a.token, a.tlsConfig, a.compress)
+	}
+	return transport.DialWSInsecureWithCompression(a.ctx, relayURL, a.token, a.insecure, a.compress)
+}
+
+// SetAllowedListen sets the local addresses clients may ask the agent to
+// listen on for reverse forwarding. Reverse forwarding is off when empty.
+func (a *Agent) SetAllowedListen(addrs []string) {
+	a.listenPolicy = allowListEngine(addrs)
+}
+
 func (a *Agent) Run() error {
 	for {
 		select {
@@ -55,39 +105,61 @@ func (a *Agent) Run() error {
 		default:
 		}
 
-		err := a.connect()
+		relayURL := a.relays.URL()
+		start := time.Now()
+
+		err := a.connect(relayURL)
+		if errors.Is(err, errGoingAway) {
+			a.relays.GoingAway()
+			log.Printf("Reconnecting to %s", a.relays.URL())
+			continue
+		}
 		if err != nil {
-			log.Printf("Connection failed: %v", err)
-			log.Printf("Reconnecting in 5 seconds...")
-			
-			select {
-			case <-time.After(5 * time.Second):
-				continue
-			case <-a.ctx.Done():
-				return a.ctx.Err()
-			}
+			log.Printf("Connection to %s failed: %v", relayURL, err)
+		}
+
+		// Sessions that end quickly count against the relay
+		delay := a.relays.Done(time.Since(start))
+		log.Printf("Reconnecting to %s in %v...", a.relays.URL(), delay.Round(time.Millisecond))
+
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+			return a.ctx.Err()
 		}
 	}
 }
 
-func (a *Agent) connect() error {
-	log.Printf("Connecting to relay: %s", a.relayURL)
+func (a *Agent) connect(relayURL string) error {
+	log.Printf("Connecting to relay: %s", relayURL)
 
-	wsConn, err := transport.DialWSInsecureWithCompression(a.ctx, a.relayURL, a.token, a.insecure, a.compress)
+	wsConn, err := a.dialRelay(relayURL)
 	if err != nil {
 		return fmt.Errorf("websocket dial: %w", err)
 	}
-	defer wsConn.Close()
 
 	wsConn.StartPingPong()
 
 	session, err := transport.NewMuxClientWithCompression(wsConn, a.compress)
 	if err != nil {
+		wsConn.Close()
 		return fmt.Errorf("mux client: %w", err)
 	}
-	defer session.Close()
 
+	// A session detached after GOING_AWAY keeps its listeners and is
+	// closed by its drain goroutine instead
+	detached := false
+	defer func() {
+		if !detached {
+			a.closeListeners(session)
+			session.Close()
+			wsConn.Close()
+		}
+	}()
+
+	a.sessionMu.Lock()
 	a.session = session
+	a.sessionMu.Unlock()
 
 	// Send REGISTER
 	err = session.SendControl(&proto.Control{
@@ -100,12 +172,27 @@ func (a *Agent) connect() error {
 	}
 
 	log.Printf("Agent %s registered", a.id)
+	a.metrics.connected.Set(1)
+	defer a.metrics.connected.Set(0)
 
 	// Handle control messages
-	return a.handleControl()
+	err = a.handleControl(session)
+	if errors.Is(err, errGoingAway) {
+		// Keep serving streams already open through the draining relay
+		// until it closes the session, while Run connects elsewhere
+		detached = true
+		go func(drained *transport.MuxSession) {
+			a.handleControl(drained)
+			a.closeListeners(drained)
+			drained.Close()
+			wsConn.Close()
+			log.Printf("Drained session to %s closed", relayURL)
+		}(session)
+	}
+	return err
 }
 
-func (a *Agent) handleControl() error {
+func (a *Agent) handleControl(session *transport.MuxSession) error {
 	for {
 		select {
 		case <-a.ctx.Done():
@@ -113,18 +200,25 @@ func (a *Agent) handleControl() error {
 		default:
 		}
 
-		msg, err := a.session.ReceiveControl()
+		msg, err := session.ReceiveControl()
 		if err != nil {
 			return fmt.Errorf("receive control: %w", err)
 		}
 
 		switch msg.Type {
 		case proto.MsgDial:
-			go a.handleDial(msg)
+			go a.handleDial(session, msg)
+		case proto.MsgListen:
+			go a.handleListen(session, msg)
+		case proto.MsgUnlisten:
+			a.closeListener(msg.ListenerID)
 		case proto.MsgPing:
-			a.session.SendControl(&proto.Control{Type: proto.MsgPong})
+			session.SendControl(&proto.Control{Type: proto.MsgPong})
 		case proto.MsgPong:
 			// Keep alive received
+		case proto.MsgGoingAway:
+			log.Printf("Relay going away: %s", msg.Error)
+			return errGoingAway
 		case proto.MsgError:
 			log.Printf("Received error: %s", msg.Error)
 		default:
@@ -133,58 +227,82 @@ func (a *Agent) handleControl() error {
 	}
 }
 
-func (a *Agent) handleDial(msg *proto.Control) {
+func (a *Agent) handleDial(session *transport.MuxSession, msg *proto.Control) {
 	streamID := msg.StreamID
 	targetAddr := msg.TargetAddr
+	start := time.Now()
 
-	log.Printf("Dial request: target=%s, stream=%s", targetAddr, streamID)
+	log.Printf("Dial request: target=%s, network=%s, stream=%s", targetAddr, msg.Network, streamID)
 
-	// Check if target is allowed
-	if !a.isAllowed(targetAddr) {
-		log.Printf("Target %s not allowed", targetAddr)
+	// Check the target against the policy after DNS resolution
+	decision := a.policy.Evaluate(a.ctx, targetAddr)
+	if !decision.Allowed {
+		log.Printf("Policy deny: target=%s rule=%s reason=%s", targetAddr, decision.Rule, decision.Reason)
+		a.metrics.dialFailures.With(dialPolicy).Inc()
+		a.replyDial(session, proto.MsgRefuse, streamID, fmt.Sprintf("target %s not allowed by agent %s: %s", targetAddr, a.id, decision.Reason))
 		return
 	}
+	log.Printf("Policy allow: target=%s rule=%s dial=%s", targetAddr, decision.Rule, decision.DialAddr)
 
-	// Open stream to relay
-	stream, err := a.session.OpenStream()
-	if err != nil {
-		log.Printf("Failed to open stream: %v", err)
-		return
+	network := proto.NetworkTCP
+	if msg.Network == proto.NetworkUDP {
+		network = proto.NetworkUDP
 	}
-	defer stream.Close()
 
-	// Dial to target
-	conn, err := net.DialTimeout("tcp", targetAddr, 30*time.Second)
+	// Dial the address the policy approved, not a fresh DNS answer
+	conn, err := net.DialTimeout(network, decision.DialAddr, 30*time.Second)
 	if err != nil {
 		log.Printf("Failed to dial target %s: %v", targetAddr, err)
+		a.metrics.dialFailures.With(dialTarget).Inc()
+		a.replyDial(session, proto.MsgError, streamID, fmt.Sprintf("dial %s: %v", targetAddr, err))
 		return
 	}
 	defer conn.Close()
 
-	log.Printf("Connected to target %s, bridging with stream %s", targetAddr, streamID)
+	// Pick a codec from the client's offer; datagrams are never compressed
+	codec := streamutil.CodecNone
+	if a.compress && network == proto.NetworkTCP {
+		codec = streamutil.NegotiateCodec(msg.Compression)
+	}
 
-	// Create stream processor with compression if enabled  
-	streamOpts := streamutil.DefaultStreamOptions()
-	streamOpts.EnableCompression = a.compress
-	processor := streamutil.NewStreamProcessor(streamOpts)
+	err = session.SendControl(&proto.Control{
+		Type:        proto.MsgAccept,
+		StreamID:    streamID,
+		Compression: codec,
+	})
+	if err != nil {
+		log.Printf("Failed to send accept: %v", err)
+		a.metrics.dialFailures.With(dialStream).Inc()
+		return
+	}
 
-	// Bridge connections with optional compression
-	errCh := make(chan error, 2)
+	// Open stream to relay, tagged so the relay can match it to this DIAL
+	relayStream, err := session.OpenStreamWithID(streamID)
+	if err != nil {
+		log.Printf("Failed to open stream: %v", err)
+		a.metrics.dialFailures.With(dialStream).Inc()
+		return
+	}
+	a.metrics.dialLatency.Observe(time.Since(start).Seconds())
 
-	// Copy stream -> conn
-	go func() {
-		_, err := processor.CopyWithCompression(conn, stream)
-		errCh <- err
-	}()
+	stream := a.metrics.track(relayStream)
+	defer stream.Close()
 
-	// Copy conn -> stream
-	go func() {
-		_, err := processor.CopyWithCompression(stream, conn)
-		errCh <- err
-	}()
+	if network == proto.NetworkUDP {
+		a.relayUDP(stream, conn, streamID)
+		return
+	}
+
+	log.Printf("Connected to target %s, bridging with stream %s (compression: %s)", targetAddr, streamID, codec)
 
-	// Wait for first error or completion
-	err = <-errCh
+	// Create stream processor with the negotiated codec
+	streamOpts := streamutil.DefaultStreamOptions()
+	streamOpts.EnableCompression = codec != streamutil.CodecNone
+	streamOpts.Codec = codec
+	processor := streamutil.NewStreamProcessor(streamOpts)
+
+	// Bridge connections, compressing towards the relay
+	err = processor.ProxyConnection(stream, conn)
 	if err != nil {
 		log.Printf("Bridge error: %v", err)
 	}
@@ -192,19 +310,25 @@ func (a *Agent) handleDial(msg *proto.Control) {
 	log.Printf("Stream %s closed", streamID)
 }
 
-func (a *Agent) isAllowed(targetAddr string) bool {
-	for _, allowed := range a.allowedHosts {
-		if strings.HasPrefix(targetAddr, allowed) {
-			return true
-		}
+// replyDial answers a DIAL with REFUSE (policy) or ERROR (failure)
+func (a *Agent) replyDial(session *transport.MuxSession, msgType proto.MsgType, streamID, reason string) {
+	err := session.SendControl(&proto.Control{
+		Type:     msgType,
+		StreamID: streamID,
+		Error:    reason,
+	})
+	if err != nil {
+		log.Printf("Failed to send %s for stream %s: %v", msgType, streamID, err)
 	}
-	return false
 }
 
 func (a *Agent) Close() error {
 	a.cancel()
-	if a.session != nil {
-		return a.session.Close()
+	a.sessionMu.Lock()
+	session := a.session
+	a.sessionMu.Unlock()
+	if session != nil {
+		return session.Close()
 	}
 	return nil
 }
@@ -2,9 +2,12 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,28 +19,41 @@ import (
 
 type Client struct {
 	localAddr  string
-	relayURL   string
+	relays     *relayPool
 	agentID    string
 	targetAddr string
 	token      string
 	session    *transport.MuxSession
-	listener   net.Listener
 	ctx        context.Context
 	cancel     context.CancelFunc
 	insecure   bool
 	compress   bool
+	tlsConfig  *tls.Config
+	proxy      bool
+	udp        bool
 
 	controlMutex   sync.RWMutex
 	connected      bool
 	responses      map[string]chan *proto.Control
 	responsesMutex sync.RWMutex
+
+	// streams matches streams opened by the relay to their stream ID
+	streams *transport.StreamRouter
+
+	reverse      map[string]*reverseForward
+	reverseMutex sync.RWMutex
+
+	forwards      map[string]*forward
+	forwardsMutex sync.Mutex
+
+	metrics *tunnelMetrics
 }
 
 func NewClient(localAddr, relayURL, agentID, targetAddr, token string) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
 		localAddr:  localAddr,
-		relayURL:   relayURL,
+		relays:     newRelayPool(relayURL),
 		agentID:    agentID,
 		targetAddr: targetAddr,
 		token:      token,
@@ -46,6 +62,10 @@ func NewClient(localAddr, relayURL, agentID, targetAddr, token string) *Client {
 		insecure:   false,
 		compress:   false,
 		responses:  make(map[string]chan *proto.Control),
+		streams:    transport.NewStreamRouter(),
+		reverse:    make(map[string]*reverseForward),
+		forwards:   make(map[string]*forward),
+		metrics:    newTunnelMetrics("client"),
 	}
 }
 
@@ -57,16 +77,54 @@ func (c *Client) SetCompression(compress bool) {
 	c.compress = compress
 }
 
-func (c *Client) Run() error {
-	// Start local listener
-	err := c.startListener()
-	if err != nil {
-		return fmt.Errorf("start listener: %w", err)
+// SetTLSConfig sets the TLS config used to reach the relay, e.g. with a
+// pinned relay CA and a client certificate for mTLS. It overrides SetInsecure.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+func (c *Client) dialRelay(relayURL string) (*transport.WSConn, error) {
+	if c.tlsConfig != nil {
+		return transport.DialWSWithTLS(c.ctx, relayURL, c.token, c.tlsConfig, c.compress)
 	}
-	defer c.listener.Close()
+	return transport.DialWSInsecureWithCompression(c.ctx, relayURL, c.token, c.insecure, c.compress)
+}
 
-	log.Printf("Client listening on %s, forwarding to agent %s target %s", 
-		c.localAddr, c.agentID, c.targetAddr)
+// SetProxyMode turns the local listener into a SOCKS5 / HTTP CONNECT proxy
+// where each connection names its own target instead of using targetAddr.
+func (c *Client) SetProxyMode(proxy bool) {
+	c.proxy = proxy
+}
+
+// SetUDP forwards UDP datagrams received on localAddr instead of TCP
+// connections. Each source address gets its own tunnel stream.
+func (c *Client) SetUDP(udp bool) {
+	c.udp = udp
+}
+
+func (c *Client) Run() error {
+	// Start local listener unless the client only does reverse forwarding
+	// or its forwards come from ApplyForwards
+	if c.localAddr != "" {
+		mode := ModeTCP
+		if c.udp {
+			mode = ModeUDP
+		} else if c.proxy {
+			mode = ModeProxy
+		}
+
+		err := c.ApplyForwards([]Forward{{
+			Name:   c.localAddr,
+			Local:  c.localAddr,
+			Agent:  c.agentID,
+			Target: c.targetAddr,
+			Mode:   mode,
+		}})
+		if err != nil {
+			return fmt.Errorf("start listener: %w", err)
+		}
+	}
+	defer c.closeForwards()
 
 	// Start connection and message handling
 	go c.connectionLoop()
@@ -77,7 +135,8 @@ func (c *Client) Run() error {
 }
 
 func (c *Client) connectToRelay() error {
-	log.Printf("Connecting to relay: %s (goroutine starting)", c.relayURL)
+	relayURL := c.relays.URL()
+	log.Printf("Connecting to relay: %s (goroutine starting)", relayURL)
 
 	// Close any existing session first
 	c.controlMutex.Lock()
@@ -90,7 +149,7 @@ func (c *Client) connectToRelay() error {
 	// Add a small delay to ensure cleanup
 	time.Sleep(200 * time.Millisecond)
 
-	wsConn, err := transport.DialWSInsecureWithCompression(c.ctx, c.relayURL, c.token, c.insecure, c.compress)
+	wsConn, err := c.dialRelay(relayURL)
 	if err != nil {
 		return fmt.Errorf("websocket dial: %w", err)
 	}
@@ -118,9 +177,7 @@ func (c *Client) connectToRelay() error {
 
 func (c *Client) connectionLoop() {
 	log.Printf("Starting connection loop")
-	backoff := 1 * time.Second
-	maxBackoff := 30 * time.Second
-	
+
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -134,24 +191,17 @@ func (c *Client) connectionLoop() {
 		err := c.connectToRelay()
 		if err != nil {
 			log.Printf("Failed to connect to relay: %v", err)
-			log.Printf("Retrying in %v...", backoff)
-			time.Sleep(backoff)
-			
-			// Exponential backoff
-			backoff *= 2
-			if backoff > maxBackoff {
-				backoff = maxBackoff
-			}
+			c.waitReconnect(0)
 			continue
 		}
 
-		// Reset backoff on successful connection
-		backoff = 1 * time.Second
+		connectedAt := time.Now()
 
 		c.controlMutex.Lock()
 		c.connected = true
 		session := c.session
 		c.controlMutex.Unlock()
+		c.metrics.connected.Set(1)
 
 		log.Printf("Control message handler started")
 
@@ -160,27 +210,58 @@ func (c *Client) connectionLoop() {
 		if err != nil {
 			log.Printf("Failed to send initial ping: %v", err)
 			c.markDisconnected()
+			c.waitReconnect(0)
 			continue
 		}
 
+		go session.RouteStreams(c.streams)
+
+		// Ask the agent to open reverse listeners on this session
+		c.registerReverse(session)
+
 		// Handle control messages until connection fails
-		c.handleControlMessages(session)
+		if err := c.handleControlMessages(session); errors.Is(err, errGoingAway) {
+			// Streams already open on the draining relay keep running on the
+			// old session; new dials use the next relay right away
+			c.detachSession(session)
+			go func() {
+				c.handleControlMessages(session)
+				session.Close()
+				log.Printf("Drained relay session closed")
+			}()
+			c.relays.GoingAway()
+			continue
+		}
 
 		// Connection failed, mark as disconnected
 		c.markDisconnected()
 		log.Printf("Disconnected from relay, will retry...")
-		time.Sleep(2 * time.Second)
+		c.waitReconnect(time.Since(connectedAt))
 	}
 }
 
-func (c *Client) handleControlMessages(session *transport.MuxSession) {
+// waitReconnect sleeps before the next relay attempt, failing over to the
+// next relay when the last one failed or dropped the session early
+func (c *Client) waitReconnect(connectedFor time.Duration) {
+	delay := c.relays.Done(connectedFor)
+	log.Printf("Retrying %s in %v...", c.relays.URL(), delay.Round(time.Millisecond))
+
+	select {
+	case <-time.After(delay):
+	case <-c.ctx.Done():
+	}
+}
+
+// handleControlMessages processes control messages until the session fails,
+// or returns errGoingAway when the relay starts draining
+func (c *Client) handleControlMessages(session *transport.MuxSession) error {
 	defer log.Printf("Control message handler stopped")
 	
 	for {
 		select {
 		case <-c.ctx.Done():
 			log.Printf("Control message handler exiting due to context cancellation")
-			return
+			return nil
 		default:
 		}
 
@@ -192,11 +273,11 @@ func (c *Client) handleControlMessages(session *transport.MuxSession) {
 			select {
 			case <-c.ctx.Done():
 				log.Printf("Context cancelled during control message receive")
-				return
+				return nil
 			default:
 				// Connection issue, return to trigger reconnection
 				log.Printf("Connection issue detected, returning from control handler")
-				return
+				return nil
 			}
 		}
 
@@ -206,11 +287,27 @@ func (c *Client) handleControlMessages(session *transport.MuxSession) {
 			err := session.SendControl(&proto.Control{Type: proto.MsgPong})
 			if err != nil {
 				log.Printf("Failed to send pong: %v", err)
-				return
+				return nil
 			}
 		case proto.MsgPong:
 			// Ignore pong messages
-		case proto.MsgAccept, proto.MsgRefuse:
+		case proto.MsgGoingAway:
+			log.Printf("Relay going away: %s", msg.Error)
+			return errGoingAway
+		case proto.MsgInbound:
+			go c.handleInbound(msg)
+		case proto.MsgPending:
+			c.handleListenReply(msg)
+		case proto.MsgAccept, proto.MsgRefuse, proto.MsgError:
+			if msg.Type == proto.MsgError && msg.StreamID == "" {
+				log.Printf("Relay error: %s", msg.Error)
+				continue
+			}
+			if msg.ListenerID != "" {
+				c.handleListenReply(msg)
+				continue
+			}
+
 			// Route to waiting handler
 			c.responsesMutex.RLock()
 			respChan, exists := c.responses[msg.StreamID]
@@ -231,12 +328,25 @@ func (c *Client) handleControlMessages(session *transport.MuxSession) {
 	}
 }
 
+// detachSession stops using session for new tunnels without closing it
+func (c *Client) detachSession(session *transport.MuxSession) {
+	c.controlMutex.Lock()
+	defer c.controlMutex.Unlock()
+
+	if c.session == session {
+		c.connected = false
+		c.session = nil
+		c.metrics.connected.Set(0)
+	}
+}
+
 func (c *Client) markDisconnected() {
 	c.controlMutex.Lock()
 	defer c.controlMutex.Unlock()
 	
 	if c.connected {
 		c.connected = false
+		c.metrics.connected.Set(0)
 		if c.session != nil {
 			c.session.Close()
 			c.session = nil
@@ -244,24 +354,12 @@ func (c *Client) markDisconnected() {
 	}
 }
 
-func (c *Client) startListener() error {
-	listener, err := net.Listen("tcp", c.localAddr)
-	if err != nil {
-		return fmt.Errorf("listen: %w", err)
-	}
-
-	c.listener = listener
-
-	go c.acceptLoop()
-	return nil
-}
-
-func (c *Client) acceptLoop() {
+func (c *Client) acceptLoop(fwd *forward) {
 	for {
-		conn, err := c.listener.Accept()
+		conn, err := fwd.listener.Accept()
 		if err != nil {
 			select {
-			case <-c.ctx.Done():
+			case <-fwd.ctx.Done():
 				return
 			default:
 				log.Printf("Accept error: %v", err)
@@ -269,15 +367,54 @@ func (c *Client) acceptLoop() {
 			}
 		}
 
-		go c.handleConnection(conn)
+		go func() {
+			fwd.active.Add(1)
+			defer fwd.active.Add(-1)
+
+			if fwd.Mode == ModeProxy {
+				c.handleProxyConnection(fwd, conn)
+			} else {
+				c.handleConnection(fwd, conn)
+			}
+		}()
 	}
 }
 
-func (c *Client) handleConnection(localConn net.Conn) {
+func (c *Client) handleConnection(fwd *forward, localConn net.Conn) {
 	defer localConn.Close()
 
+	relayStream, err := c.openForward(fwd, proto.NetworkTCP, fwd.Target)
+	if err != nil {
+		log.Printf("Tunnel to %s failed: %v", fwd.Target, err)
+		return
+	}
+	defer relayStream.Close()
+
+	c.bridgeLocal(localConn, relayStream)
+}
+
+// tunnelStream is an accepted relay stream and the codec negotiated for it
+type tunnelStream struct {
+	net.Conn
+	id    string
+	codec string
+}
+
+// DialRefusedError reports a DIAL that the relay or agent answered with REFUSE
+type DialRefusedError struct {
+	Reason string
+}
+
+func (e *DialRefusedError) Error() string {
+	return fmt.Sprintf("dial refused: %s", e.Reason)
+}
+
+// openTunnel sends a DIAL for targetAddr on agentID over the current relay
+// session and returns the relay stream once the dial has been accepted.
+func (c *Client) openTunnel(agentID, network, targetAddr string) (*tunnelStream, error) {
 	streamID := uuid.New().String()
 	log.Printf("New connection, stream ID: %s", streamID)
+	start := time.Now()
 
 	// Wait for connection to be established and stable
 	var session *transport.MuxSession
@@ -291,14 +428,19 @@ func (c *Client) handleConnection(localConn net.Conn) {
 			break
 		}
 		c.controlMutex.RUnlock()
-		
+
 		log.Printf("Waiting for relay connection... (%d/10)", i+1)
 		time.Sleep(1 * time.Second)
 	}
 
 	if session == nil {
-		log.Printf("No connection to relay available, dropping connection")
-		return
+		c.metrics.dialFailures.With(dialNoRelay).Inc()
+		return nil, fmt.Errorf("no connection to relay available")
+	}
+
+	if network == proto.NetworkUDP && !session.PeerSupports(proto.CapUDP) {
+		c.metrics.dialFailures.With(dialRefused).Inc()
+		return nil, &DialRefusedError{Reason: "relay does not support UDP"}
 	}
 
 	// Create response channel
@@ -311,19 +453,29 @@ func (c *Client) handleConnection(localConn net.Conn) {
 		c.responsesMutex.Lock()
 		delete(c.responses, streamID)
 		c.responsesMutex.Unlock()
-		close(respChan)
 	}()
 
+	c.streams.Expect(streamID)
+	defer c.streams.Forget(streamID)
+
+	// Offer compression for TCP streams; the agent picks the codec
+	var offer string
+	if c.compress && network == proto.NetworkTCP {
+		offer = strings.Join(streamutil.SupportedCodecs(), ",")
+	}
+
 	// Send DIAL request
 	err := session.SendControl(&proto.Control{
-		Type:       proto.MsgDial,
-		AgentID:    c.agentID,
-		StreamID:   streamID,
-		TargetAddr: c.targetAddr,
+		Type:        proto.MsgDial,
+		AgentID:     agentID,
+		StreamID:    streamID,
+		TargetAddr:  targetAddr,
+		Network:     network,
+		Compression: offer,
 	})
 	if err != nil {
-		log.Printf("Failed to send dial: %v", err)
-		return
+		c.metrics.dialFailures.With(dialError).Inc()
+		return nil, fmt.Errorf("send dial: %w", err)
 	}
 
 	// Wait for ACCEPT/REFUSE
@@ -331,69 +483,67 @@ func (c *Client) handleConnection(localConn net.Conn) {
 	select {
 	case response = <-respChan:
 	case <-time.After(30 * time.Second):
-		log.Printf("Timeout waiting for response for stream %s", streamID)
-		return
+		c.metrics.dialFailures.With(dialTimeout).Inc()
+		return nil, fmt.Errorf("timeout waiting for response for stream %s", streamID)
 	case <-c.ctx.Done():
-		return
+		return nil, c.ctx.Err()
 	}
 
 	if response.Type == proto.MsgRefuse {
-		log.Printf("Dial refused: %s", response.Error)
-		return
+		c.metrics.dialFailures.With(dialRefused).Inc()
+		return nil, &DialRefusedError{Reason: response.Error}
+	}
+
+	if response.Type == proto.MsgError {
+		c.metrics.dialFailures.With(dialError).Inc()
+		return nil, fmt.Errorf("dial failed: %s", response.Error)
 	}
 
 	if response.Type != proto.MsgAccept {
-		log.Printf("Unexpected response: %s", response.Type)
-		return
+		c.metrics.dialFailures.With(dialError).Inc()
+		return nil, fmt.Errorf("unexpected response: %s", response.Type)
 	}
 
 	log.Printf("Dial accepted for stream %s", streamID)
 
-	// Accept stream from relay
-	relayStream, err := session.AcceptStream()
+	// Wait for the relay stream tagged with this stream ID
+	relayStream, err := c.streams.Wait(streamID, transport.DialTimeout)
 	if err != nil {
-		log.Printf("Failed to accept relay stream: %v", err)
-		return
+		c.metrics.dialFailures.With(dialStream).Inc()
+		return nil, fmt.Errorf("relay stream: %w", err)
 	}
-	defer relayStream.Close()
+	c.metrics.dialLatency.Observe(time.Since(start).Seconds())
 
-	log.Printf("Bridging local connection with relay stream %s", streamID)
+	codec := response.Compression
+	if codec == "" {
+		codec = streamutil.CodecNone
+	}
 
-	// Create stream processor with compression if enabled  
-	streamOpts := streamutil.DefaultStreamOptions()
-	streamOpts.EnableCompression = c.compress
-	processor := streamutil.NewStreamProcessor(streamOpts)
+	return &tunnelStream{Conn: c.metrics.track(relayStream), id: streamID, codec: codec}, nil
+}
 
-	// Bridge connections with optional compression
-	errCh := make(chan error, 2)
+// bridgeLocal copies data between a local connection and its relay stream
+func (c *Client) bridgeLocal(localConn net.Conn, relayStream *tunnelStream) {
+	log.Printf("Bridging local connection with relay stream %s (compression: %s)", relayStream.id, relayStream.codec)
 
-	// Copy local -> relay
-	go func() {
-		_, err := processor.CopyWithCompression(relayStream, localConn)
-		errCh <- err
-	}()
-
-	// Copy relay -> local
-	go func() {
-		_, err := processor.CopyWithCompression(localConn, relayStream)
-		errCh <- err
-	}()
+	// Create stream processor with the negotiated codec
+	streamOpts := streamutil.DefaultStreamOptions()
+	streamOpts.EnableCompression = relayStream.codec != streamutil.CodecNone
+	streamOpts.Codec = relayStream.codec
+	processor := streamutil.NewStreamProcessor(streamOpts)
 
-	// Wait for first error or completion
-	err = <-errCh
+	// Bridge connections, compressing towards the relay
+	err := processor.ProxyConnection(relayStream, localConn)
 	if err != nil {
 		log.Printf("Bridge error: %v", err)
 	}
 
-	log.Printf("Connection closed for stream %s", streamID)
+	log.Printf("Connection closed for stream %s", relayStream.id)
 }
 
 func (c *Client) Close() error {
 	c.cancel()
-	
-	if c.listener != nil {
-		c.listener.Close()
-	}
+	c.closeForwards()
 	
 	if c.session != nil {
 		return c.session.Close()
@@ -405,73 +555,58 @@ func (c *Client) Close() error {
 // CreateDirectConnection creates a direct tunnel connection without local listener
 // This is useful for applications like SSH client that need direct access
 func (c *Client) CreateDirectConnection() (net.Conn, error) {
-	// Connect to relay if not already connected
-	err := c.connectToRelay()
-	if err != nil {
-		return nil, fmt.Errorf("connect to relay: %w", err)
-	}
+	c.controlMutex.RLock()
+	connected := c.connected && c.session != nil
+	c.controlMutex.RUnlock()
 
-	// Create a new stream for this connection
-	stream, err := c.session.OpenStream()
-	if err != nil {
-		return nil, fmt.Errorf("open stream: %w", err)
-	}
+	// Connect to relay if not already connected
+	if !connected {
+		err := c.connectToRelay()
+		if err != nil {
+			return nil, fmt.Errorf("connect to relay: %w", err)
+		}
 
-	// Send dial request via control connection
-	streamID := uuid.New().String()
-	dialReq := &proto.Control{
-		Type:       proto.MsgDial,
-		AgentID:    c.agentID,
-		StreamID:   streamID,
-		TargetAddr: c.targetAddr,
-	}
+		c.controlMutex.Lock()
+		c.connected = true
+		session := c.session
+		c.controlMutex.Unlock()
+		c.metrics.connected.Set(1)
 
-	err = c.session.SendControl(dialReq)
-	if err != nil {
-		stream.Close()
-		return nil, fmt.Errorf("send dial request: %w", err)
+		go session.RouteStreams(c.streams)
+		go func() {
+			c.handleControlMessages(session)
+			c.markDisconnected()
+		}()
 	}
 
-	// Wait for accept/refuse response
-	response, err := c.waitForResponse(streamID, 30*time.Second)
+	stream, err := c.openTunnel(c.agentID, proto.NetworkTCP, c.targetAddr)
 	if err != nil {
-		stream.Close()
-		return nil, fmt.Errorf("wait for dial response: %w", err)
+		return nil, fmt.Errorf("open tunnel: %w", err)
 	}
 
-	if response.Type == proto.MsgRefuse {
-		stream.Close()
-		return nil, fmt.Errorf("dial request refused: %s", response.Error)
-	}
+	log.Printf("Direct tunnel connection established to agent %s target %s", c.agentID, c.targetAddr)
 
-	if response.Type != proto.MsgAccept {
-		stream.Close()
-		return nil, fmt.Errorf("unexpected response type: %s", response.Type)
+	if stream.codec != streamutil.CodecNone {
+		return &codecConn{
+			Conn:   stream,
+			reader: streamutil.NewCompressedReader(stream),
+			writer: streamutil.NewCompressedWriter(stream),
+		}, nil
 	}
-
-	log.Printf("Direct tunnel connection established to agent %s target %s", c.agentID, c.targetAddr)
 	return stream, nil
 }
 
-// waitForResponse waits for a control response with the given stream ID
-func (c *Client) waitForResponse(streamID string, timeout time.Duration) (*proto.Control, error) {
-	c.responsesMutex.Lock()
-	respCh := make(chan *proto.Control, 1)
-	c.responses[streamID] = respCh
-	c.responsesMutex.Unlock()
+// codecConn applies the negotiated codec to a stream handed out directly
+type codecConn struct {
+	net.Conn
+	reader *streamutil.CompressedReader
+	writer *streamutil.CompressedWriter
+}
 
-	defer func() {
-		c.responsesMutex.Lock()
-		delete(c.responses, streamID)
-		c.responsesMutex.Unlock()
-	}()
+func (cc *codecConn) Read(p []byte) (int, error) {
+	return cc.reader.Read(p)
+}
 
-	select {
-	case response := <-respCh:
-		return response, nil
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("timeout waiting for response")
-	case <-c.ctx.Done():
-		return nil, c.ctx.Err()
-	}
+func (cc *codecConn) Write(p []byte) (int, error) {
+	return cc.writer.Write(p)
 }
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthySession is how long a relay session must last before the relay
+	// is trusted again; shorter sessions count as failures
+	healthySession = 30 * time.Second
+
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// errGoingAway ends a relay session after the relay announced GOING_AWAY
+var errGoingAway = errors.New("relay going away")
+
+// relayPool picks the relay to connect to from a comma-separated list. A
+// relay that fails, or drops the session soon after connecting, is demoted
+// and the next one is tried; once every relay has failed the delay between
+// attempts grows exponentially with jitter.
+type relayPool struct {
+	mu       sync.Mutex
+	urls     []string
+	current  int
+	failures int
+}
+
+func newRelayPool(relayURLs string) *relayPool {
+	var urls []string
+	for _, url := range strings.Split(relayURLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		urls = []string{""}
+	}
+
+	return &relayPool{urls: urls}
+}
+
+// URL returns the relay to try next
+func (p *relayPool) URL() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.urls[p.current]
+}
+
+// Len returns the number of configured relays
+func (p *relayPool) Len() int {
+	return len(p.urls)
+}
+
+// Done records how long the last session lasted (zero if the connection
+// failed) and returns how long to wait before the next attempt
+func (p *relayPool) Done(connectedFor time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if connectedFor >= healthySession {
+		// A healthy relay that went away is retried first
+		p.failures = 0
+		return jitter(minBackoff)
+	}
+
+	p.failures++
+	p.current = (p.current + 1) % len(p.urls)
+
+	// Fail over to the remaining relays quickly, then back off per round
+	round := (p.failures - 1) / len(p.urls)
+	delay := minBackoff
+	for i := 0; i < round && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return jitter(delay)
+}
+
+// GoingAway moves on from a draining relay. It is not counted as a
+// failure, and the next relay is tried straight away.
+func (p *relayPool) GoingAway() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures = 0
+	p.current = (p.current + 1) % len(p.urls)
+}
+
+// jitter spreads reconnects over [d/2, d) so agents do not stampede a relay
+// that just came back
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayPoolFailover(t *testing.T) {
+	pool := newRelayPool("wss://a/ws/agent, wss://b/ws/agent")
+
+	if pool.Len() != 2 || pool.URL() != "wss://a/ws/agent" {
+		t.Fatalf("unexpected pool %v", pool.urls)
+	}
+
+	// A failed relay fails over to the next one quickly
+	if delay := pool.Done(0); delay > minBackoff {
+		t.Errorf("first failover delay %v exceeds %v", delay, minBackoff)
+	}
+	if pool.URL() != "wss://b/ws/agent" {
+		t.Errorf("expected failover to b, got %s", pool.URL())
+	}
+
+	// Once every relay failed the delay keeps growing up to maxBackoff
+	var delay time.Duration
+	for i := 0; i < 20; i++ {
+		delay = pool.Done(time.Second)
+	}
+	if delay < maxBackoff/2 || delay > maxBackoff {
+		t.Errorf("expected backoff near %v, got %v", maxBackoff, delay)
+	}
+
+	// A healthy session resets the backoff and keeps the current relay
+	current := pool.URL()
+	if delay := pool.Done(healthySession); delay > minBackoff {
+		t.Errorf("delay after healthy session %v exceeds %v", delay, minBackoff)
+	}
+	if pool.URL() != current {
+		t.Errorf("healthy relay %s was demoted to %s", current, pool.URL())
+	}
+}
@@ -0,0 +1,331 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forward modes
+const (
+	ModeTCP   = "tcp"
+	ModeUDP   = "udp"
+	ModeProxy = "proxy"
+)
+
+// Forward states reported in ForwardStatus
+const (
+	StateListening = "listening"
+	StateFailed    = "failed"
+)
+
+// Forward is one local listener whose connections are tunnelled to a target
+// through an agent. All forwards of a client share its relay session.
+type Forward struct {
+	Name   string `json:"name"`
+	Local  string `json:"local"`
+	Agent  string `json:"agent"`
+	Target string `json:"target,omitempty"` // unused in proxy mode
+	Mode   string `json:"mode,omitempty"`   // tcp (default), udp or proxy
+}
+
+// Profile is a client's list of forwards. Agent is the default for
+// forwards that do not name their own.
+type Profile struct {
+	Agent    string    `json:"agent,omitempty"`
+	Forwards []Forward `json:"forwards"`
+}
+
+// ParseProfile parses and validates a JSON profile document
+func ParseProfile(data []byte) (*Profile, error) {
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse profile: %w", err)
+	}
+
+	if err := p.normalize(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// LoadProfile reads a JSON profile file
+func LoadProfile(filename string) (*Profile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read profile: %w", err)
+	}
+
+	return ParseProfile(data)
+}
+
+// normalize fills in defaults and rejects incomplete or clashing forwards
+func (p *Profile) normalize() error {
+	names := make(map[string]bool)
+	binds := make(map[string]string)
+
+	for i := range p.Forwards {
+		f := &p.Forwards[i]
+
+		if f.Local == "" {
+			return fmt.Errorf("forward %d: local address required", i+1)
+		}
+		if f.Name == "" {
+			f.Name = f.Local
+		}
+		if f.Agent == "" {
+			f.Agent = p.Agent
+		}
+		if f.Mode == "" {
+			f.Mode = ModeTCP
+		}
+
+		switch f.Mode {
+		case ModeTCP, ModeUDP:
+			if f.Target == "" {
+				return fmt.Errorf("forward %s: target required", f.Name)
+			}
+		case ModeProxy:
+		default:
+			return fmt.Errorf("forward %s: invalid mode %q", f.Name, f.Mode)
+		}
+
+		if f.Agent == "" {
+			return fmt.Errorf("forward %s: agent required", f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("duplicate forward name %s", f.Name)
+		}
+		names[f.Name] = true
+
+		bind := f.network() + " " + f.Local
+		if other, exists := binds[bind]; exists {
+			return fmt.Errorf("forward %s: %s already used by forward %s", f.Name, f.Local, other)
+		}
+		binds[bind] = f.Name
+	}
+
+	return nil
+}
+
+func (f Forward) network() string {
+	if f.Mode == ModeUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// ForwardStatus reports the state of one forward. Active counts open
+// connections (or UDP flows), Total the tunnels opened and Failed the
+// tunnels the relay or agent could not open.
+type ForwardStatus struct {
+	Forward
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Since     time.Time `json:"since"`
+	Active    int64     `json:"active"`
+	Total     int64     `json:"total"`
+	Failed    int64     `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// forward is a running Forward and its counters
+type forward struct {
+	Forward
+	ctx        context.Context
+	cancel     context.CancelFunc
+	listener   net.Listener
+	packetConn net.PacketConn
+	since      time.Time
+	startErr   error
+
+	active atomic.Int64
+	total  atomic.Int64
+	failed atomic.Int64
+
+	mu        sync.Mutex
+	lastError string
+}
+
+func (f *forward) fail(err error) {
+	f.failed.Add(1)
+	f.mu.Lock()
+	f.lastError = err.Error()
+	f.mu.Unlock()
+}
+
+// stop closes the listener. Connections already open run to completion.
+func (f *forward) stop() {
+	f.cancel()
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.packetConn != nil {
+		f.packetConn.Close()
+	}
+}
+
+func (f *forward) status() ForwardStatus {
+	status := ForwardStatus{
+		Forward: f.Forward,
+		State:   StateListening,
+		Since:   f.since,
+		Active:  f.active.Load(),
+		Total:   f.total.Load(),
+		Failed:  f.failed.Load(),
+	}
+	if f.startErr != nil {
+		status.State = StateFailed
+		status.Error = f.startErr.Error()
+	}
+
+	f.mu.Lock()
+	status.LastError = f.lastError
+	f.mu.Unlock()
+
+	return status
+}
+
+// ApplyForwards replaces the client's forwards with forwards. Unchanged
+// forwards keep their listener and connections, removed and changed ones
+// stop listening, and new ones start. A forward that cannot listen is kept
+// with a failed status and retried by the next ApplyForwards.
+func (c *Client) ApplyForwards(forwards []Forward) error {
+	c.forwardsMutex.Lock()
+	defer c.forwardsMutex.Unlock()
+
+	wanted := make(map[string]Forward, len(forwards))
+	for _, f := range forwards {
+		wanted[f.Name] = f
+	}
+
+	// Stop first so a changed forward can bind its address again
+	for name, fwd := range c.forwards {
+		if f, keep := wanted[name]; keep && f == fwd.Forward && fwd.startErr == nil {
+			continue
+		}
+		fwd.stop()
+		delete(c.forwards, name)
+		if fwd.startErr == nil {
+			log.Printf("Forward %s stopped listening on %s", name, fwd.Local)
+		}
+	}
+
+	var errs []error
+	for _, f := range forwards {
+		if _, running := c.forwards[f.Name]; running {
+			continue
+		}
+		fwd := c.startForward(f)
+		c.forwards[f.Name] = fwd
+		if fwd.startErr != nil {
+			errs = append(errs, fmt.Errorf("forward %s: %w", f.Name, fwd.startErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Client) startForward(f Forward) *forward {
+	ctx, cancel := context.WithCancel(c.ctx)
+	fwd := &forward{
+		Forward: f,
+		ctx:     ctx,
+		cancel:  cancel,
+		since:   time.Now(),
+	}
+
+	if f.Mode == ModeUDP {
+		fwd.packetConn, fwd.startErr = net.ListenPacket("udp", f.Local)
+	} else {
+		fwd.listener, fwd.startErr = net.Listen("tcp", f.Local)
+	}
+	if fwd.startErr != nil {
+		cancel()
+		log.Printf("Forward %s failed to listen on %s: %v", f.Name, f.Local, fwd.startErr)
+		return fwd
+	}
+
+	switch f.Mode {
+	case ModeUDP:
+		log.Printf("Forward %s listening on udp %s, forwarding to agent %s target %s",
+			f.Name, f.Local, f.Agent, f.Target)
+		go c.udpReadLoop(fwd)
+	case ModeProxy:
+		log.Printf("Forward %s proxy listening on %s, forwarding to agent %s",
+			f.Name, f.Local, f.Agent)
+		go c.acceptLoop(fwd)
+	default:
+		log.Printf("Forward %s listening on %s, forwarding to agent %s target %s",
+			f.Name, f.Local, f.Agent, f.Target)
+		go c.acceptLoop(fwd)
+	}
+
+	return fwd
+}
+
+func (c *Client) closeForwards() {
+	c.forwardsMutex.Lock()
+	defer c.forwardsMutex.Unlock()
+
+	for name, fwd := range c.forwards {
+		fwd.stop()
+		delete(c.forwards, name)
+	}
+}
+
+// Forwards returns the status of every forward, sorted by name
+func (c *Client) Forwards() []ForwardStatus {
+	c.forwardsMutex.Lock()
+	statuses := make([]ForwardStatus, 0, len(c.forwards))
+	for _, fwd := range c.forwards {
+		statuses = append(statuses, fwd.status())
+	}
+	c.forwardsMutex.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// HandleStatus serves the forward statuses and relay connection state as JSON
+func (c *Client) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	c.controlMutex.RLock()
+	connected := c.connected
+	c.controlMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Connected bool            `json:"connected"`
+		Relay     string          `json:"relay"`
+		Forwards  []ForwardStatus `json:"forwards"`
+	}{
+		Connected: connected,
+		Relay:     c.relays.URL(),
+		Forwards:  c.Forwards(),
+	})
+}
+
+// openForward opens a tunnel for a connection accepted by fwd and records
+// the outcome in its status
+func (c *Client) openForward(fwd *forward, network, targetAddr string) (*tunnelStream, error) {
+	stream, err := c.openTunnel(fwd.Agent, network, targetAddr)
+	if err != nil {
+		fwd.fail(err)
+		return nil, err
+	}
+
+	fwd.total.Add(1)
+	return stream, nil
+}
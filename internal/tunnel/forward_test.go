@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	p, err := ParseProfile([]byte(`{
+		"agent": "office",
+		"forwards": [
+			{"name": "db", "local": "127.0.0.1:5432", "target": "10.0.0.20:5432"},
+			{"local": ":1080", "agent": "lab", "mode": "proxy"},
+			{"name": "dns", "local": "127.0.0.1:5432", "target": "10.0.0.1:53", "mode": "udp"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse profile: %v", err)
+	}
+
+	want := []Forward{
+		{Name: "db", Local: "127.0.0.1:5432", Agent: "office", Target: "10.0.0.20:5432", Mode: ModeTCP},
+		{Name: ":1080", Local: ":1080", Agent: "lab", Mode: ModeProxy},
+		{Name: "dns", Local: "127.0.0.1:5432", Agent: "office", Target: "10.0.0.1:53", Mode: ModeUDP},
+	}
+	if len(p.Forwards) != len(want) {
+		t.Fatalf("expected %d forwards, got %d", len(want), len(p.Forwards))
+	}
+	for i, f := range p.Forwards {
+		if f != want[i] {
+			t.Errorf("forward %d: expected %+v, got %+v", i, want[i], f)
+		}
+	}
+}
+
+func TestParseProfileInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"Missing local", `{"agent": "a", "forwards": [{"target": "x:1"}]}`},
+		{"Missing agent", `{"forwards": [{"local": ":1", "target": "x:1"}]}`},
+		{"Missing target", `{"agent": "a", "forwards": [{"local": ":1"}]}`},
+		{"Invalid mode", `{"agent": "a", "forwards": [{"local": ":1", "target": "x:1", "mode": "sctp"}]}`},
+		{"Duplicate name", `{"agent": "a", "forwards": [{"name": "f", "local": ":1", "target": "x:1"}, {"name": "f", "local": ":2", "target": "x:1"}]}`},
+		{"Duplicate bind", `{"agent": "a", "forwards": [{"local": ":1", "target": "x:1"}, {"name": "g", "local": ":1", "mode": "proxy"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseProfile([]byte(tt.doc)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestApplyForwards(t *testing.T) {
+	c := NewClient("", "wss://relay/ws/client", "", "", "t")
+	defer c.Close()
+
+	db := Forward{Name: "db", Local: "127.0.0.1:0", Agent: "a", Target: "x:1", Mode: ModeTCP}
+	if err := c.ApplyForwards([]Forward{db}); err != nil {
+		t.Fatalf("ApplyForwards failed: %v", err)
+	}
+
+	c.forwardsMutex.Lock()
+	listener := c.forwards["db"].listener
+	c.forwardsMutex.Unlock()
+
+	// An address that is already taken is reported as failed, the rest run
+	busy := Forward{Name: "busy", Local: listener.Addr().String(), Agent: "a", Target: "x:1", Mode: ModeTCP}
+	if err := c.ApplyForwards([]Forward{db, busy}); err == nil {
+		t.Error("expected error for busy address")
+	}
+
+	statuses := c.Forwards()
+	if len(statuses) != 2 || statuses[0].Name != "busy" || statuses[0].State != StateFailed {
+		t.Fatalf("unexpected statuses %+v", statuses)
+	}
+	if statuses[1].State != StateListening {
+		t.Errorf("unchanged forward not listening: %+v", statuses[1])
+	}
+
+	// Unchanged forwards keep their listener; removed ones stop
+	c.forwardsMutex.Lock()
+	kept := c.forwards["db"].listener == listener
+	c.forwardsMutex.Unlock()
+	if !kept {
+		t.Error("unchanged forward was restarted")
+	}
+
+	if err := c.ApplyForwards(nil); err != nil {
+		t.Fatalf("ApplyForwards failed: %v", err)
+	}
+	if len(c.Forwards()) != 0 {
+		t.Errorf("forwards not removed: %+v", c.Forwards())
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("removed forward still accepting connections")
+	}
+}
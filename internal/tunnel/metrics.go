@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"remote-tunnel/internal/metrics"
+)
+
+// Dial failure reasons used as metric labels
+const (
+	dialPolicy  = "policy"   // agent: target denied by policy
+	dialTarget  = "target"   // agent: connecting to the target failed
+	dialNoRelay = "no_relay" // client: no relay session available
+	dialRefused = "refused"
+	dialError   = "error"
+	dialTimeout = "timeout"
+	dialStream  = "stream"
+)
+
+// tunnelMetrics are the counters an agent or client serves on its local
+// metrics listener
+type tunnelMetrics struct {
+	registry     *metrics.Registry
+	connected    *metrics.Gauge
+	streams      *metrics.Gauge
+	bytes        *metrics.CounterVec // direction
+	dialLatency  *metrics.Histogram
+	dialFailures *metrics.CounterVec // reason
+}
+
+// newTunnelMetrics registers the metrics for role ("agent" or "client")
+func newTunnelMetrics(role string) *tunnelMetrics {
+	r := metrics.NewRegistry()
+	prefix := "tunnel_" + role + "_"
+
+	return &tunnelMetrics{
+		registry: r,
+		connected: r.NewGauge(prefix+"relay_connected",
+			"1 while connected to a relay."),
+		streams: r.NewGauge(prefix+"active_streams",
+			"Streams currently bridged through the relay."),
+		bytes: r.NewCounterVec(prefix+"bytes_total",
+			"Bytes bridged; direction in is received from the relay, out is sent to it.", "direction"),
+		dialLatency: r.NewHistogram(prefix+"dial_duration_seconds",
+			"Time to complete a DIAL.", metrics.DurationBuckets),
+		dialFailures: r.NewCounterVec(prefix+"dial_failures_total",
+			"DIALs that failed, by reason.", "reason"),
+	}
+}
+
+// track counts the bytes on a relay stream and counts it as active until
+// it is closed
+func (m *tunnelMetrics) track(stream net.Conn) net.Conn {
+	m.streams.Inc()
+	return &trackedConn{
+		Conn: metrics.CountConn(stream, m.bytes.With("in"), m.bytes.With("out")),
+		done: m.streams.Dec,
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	done func()
+	once sync.Once
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(t.done)
+	return t.Conn.Close()
+}
+
+// HandleMetrics serves the agent metrics in the Prometheus text format
+func (a *Agent) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	a.metrics.registry.ServeHTTP(w, r)
+}
+
+// HandleMetrics serves the client metrics in the Prometheus text format
+func (c *Client) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	c.metrics.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,233 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"remote-tunnel/internal/proto"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded          = 0x00
+	socks5ReplyGeneralFailure     = 0x01
+	socks5ReplyNotAllowed         = 0x02
+	socks5ReplyCommandUnsupported = 0x07
+	socks5ReplyAddrUnsupported    = 0x08
+
+	proxyHandshakeTimeout = 30 * time.Second
+)
+
+// bufferedConn keeps bytes already read while sniffing the proxy protocol
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// handleProxyConnection serves one SOCKS5 or HTTP CONNECT request. The
+// protocol is detected from the first byte sent by the application.
+func (c *Client) handleProxyConnection(fwd *forward, localConn net.Conn) {
+	defer localConn.Close()
+
+	conn := &bufferedConn{Conn: localConn, reader: bufio.NewReader(localConn)}
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		log.Printf("Proxy handshake read failed: %v", err)
+		return
+	}
+
+	if first[0] == socks5Version {
+		c.serveSOCKS5(fwd, conn)
+	} else {
+		c.serveHTTPConnect(fwd, conn)
+	}
+}
+
+func (c *Client) serveSOCKS5(fwd *forward, conn *bufferedConn) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		log.Printf("SOCKS5 greeting read failed: %v", err)
+		return
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		log.Printf("SOCKS5 methods read failed: %v", err)
+		return
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+			break
+		}
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+	if method == socks5AuthNoAcceptable {
+		log.Printf("SOCKS5 client offered no supported auth method")
+		return
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		log.Printf("SOCKS5 request read failed: %v", err)
+		return
+	}
+
+	if request[0] != socks5Version {
+		log.Printf("SOCKS5 request with version %d", request[0])
+		writeSOCKS5Reply(conn, socks5ReplyGeneralFailure)
+		return
+	}
+
+	if request[1] != socks5CmdConnect {
+		log.Printf("SOCKS5 command %d not supported", request[1])
+		writeSOCKS5Reply(conn, socks5ReplyCommandUnsupported)
+		return
+	}
+
+	targetAddr, err := readSOCKS5Addr(conn, request[3])
+	if err != nil {
+		log.Printf("SOCKS5 address read failed: %v", err)
+		writeSOCKS5Reply(conn, socks5ReplyAddrUnsupported)
+		return
+	}
+
+	log.Printf("SOCKS5 CONNECT %s via agent %s", targetAddr, fwd.Agent)
+
+	relayStream, err := c.openForward(fwd, proto.NetworkTCP, targetAddr)
+	if err != nil {
+		log.Printf("Tunnel to %s failed: %v", targetAddr, err)
+		var refused *DialRefusedError
+		if errors.As(err, &refused) {
+			writeSOCKS5Reply(conn, socks5ReplyNotAllowed)
+		} else {
+			writeSOCKS5Reply(conn, socks5ReplyGeneralFailure)
+		}
+		return
+	}
+	defer relayStream.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	c.bridgeLocal(conn, relayStream)
+}
+
+func readSOCKS5Addr(r io.Reader, addrType byte) (string, error) {
+	var host string
+
+	switch addrType {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", addrType)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply sends a reply with an empty IPv4 bind address; the real
+// outbound address lives on the agent side and is not known to the client.
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (c *Client) serveHTTPConnect(fwd *forward, conn *bufferedConn) {
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		log.Printf("HTTP proxy request read failed: %v", err)
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		log.Printf("HTTP proxy method %s not supported", req.Method)
+		fmt.Fprintf(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	targetAddr := req.Host
+	if _, _, err := net.SplitHostPort(targetAddr); err != nil {
+		targetAddr = net.JoinHostPort(targetAddr, "443")
+	}
+
+	log.Printf("HTTP CONNECT %s via agent %s", targetAddr, fwd.Agent)
+
+	relayStream, err := c.openForward(fwd, proto.NetworkTCP, targetAddr)
+	if err != nil {
+		log.Printf("Tunnel to %s failed: %v", targetAddr, err)
+		var refused *DialRefusedError
+		if errors.As(err, &refused) {
+			fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		} else {
+			fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		}
+		return
+	}
+	defer relayStream.Close()
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	c.bridgeLocal(conn, relayStream)
+}
@@ -0,0 +1,267 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// Targets the fake relay refuses or fails instead of accepting
+const (
+	refusedTarget = "refused.example:80"
+	brokenTarget  = "broken.example:80"
+)
+
+// proxyTestClient returns a client connected to a fake relay that echoes
+// every accepted stream, and the targets it was asked to dial
+func proxyTestClient(t *testing.T) (*Client, *forward, <-chan string) {
+	t.Helper()
+
+	relayConn, clientConn := net.Pipe()
+	relayCh := make(chan *transport.MuxSession, 1)
+	go func() {
+		relay, err := transport.NewMuxServer(relayConn)
+		if err != nil {
+			t.Errorf("NewMuxServer failed: %v", err)
+		}
+		relayCh <- relay
+	}()
+
+	session, err := transport.NewMuxClient(clientConn)
+	if err != nil {
+		t.Fatalf("NewMuxClient failed: %v", err)
+	}
+	relay := <-relayCh
+	if relay == nil {
+		t.FailNow()
+	}
+
+	c := NewClient("", "wss://relay/ws/client", "", "", "t")
+	c.session = session
+	c.connected = true
+	t.Cleanup(func() {
+		// Closing the pipe first ends blocked control reads
+		relayConn.Close()
+		clientConn.Close()
+		c.Close()
+		session.Close()
+		relay.Close()
+	})
+	go session.RouteStreams(c.streams)
+	go c.handleControlMessages(session)
+
+	dials := make(chan string, 4)
+	go func() {
+		for {
+			msg, err := relay.ReceiveControl()
+			if err != nil {
+				return
+			}
+			if msg.Type != proto.MsgDial {
+				continue
+			}
+			dials <- msg.TargetAddr
+
+			switch msg.TargetAddr {
+			case refusedTarget:
+				relay.SendControl(&proto.Control{Type: proto.MsgRefuse, StreamID: msg.StreamID, Error: "not allowed"})
+			case brokenTarget:
+				relay.SendControl(&proto.Control{Type: proto.MsgError, StreamID: msg.StreamID, Error: "connection refused"})
+			default:
+				relay.SendControl(&proto.Control{Type: proto.MsgAccept, StreamID: msg.StreamID})
+				stream, err := relay.OpenStreamWithID(msg.StreamID)
+				if err != nil {
+					t.Errorf("OpenStreamWithID failed: %v", err)
+					continue
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}
+	}()
+
+	fwd := &forward{Forward: Forward{Name: "proxy", Local: ":0", Agent: "agent-1", Mode: ModeProxy}}
+	return c, fwd, dials
+}
+
+// proxyConn starts a proxy connection and returns the application's end
+func proxyConn(t *testing.T, c *Client, fwd *forward) net.Conn {
+	t.Helper()
+	app, local := net.Pipe()
+	go c.handleProxyConnection(fwd, local)
+	app.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	return buf
+}
+
+func expectDial(t *testing.T, dials <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-dials:
+		if got != want {
+			t.Errorf("dialed %q, want %q", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no DIAL for %s", want)
+	}
+}
+
+// expectEcho checks that data reaches the fake relay's echo stream
+func expectEcho(t *testing.T, conn io.ReadWriter) {
+	t.Helper()
+	conn.Write([]byte("ping"))
+	if got := readN(t, conn, 4); string(got) != "ping" {
+		t.Errorf("echoed %q", got)
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	c, fwd, dials := proxyTestClient(t)
+
+	tests := []struct {
+		name    string
+		request []byte
+		target  string
+	}{
+		{"IPv4", []byte{5, 1, 0, 1, 10, 0, 0, 20, 0x15, 0x38}, "10.0.0.20:5432"},
+		{"Domain", append(append([]byte{5, 1, 0, 3, 11}, "db.internal"...), 0, 22), "db.internal:22"},
+		{"IPv6", append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 0x1f, 0x90), "[2001:db8::1]:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := proxyConn(t, c, fwd)
+
+			// No-auth is picked from the offered methods
+			app.Write([]byte{5, 2, 2, 0})
+			if got := readN(t, app, 2); !bytes.Equal(got, []byte{5, 0}) {
+				t.Fatalf("greeting reply %v", got)
+			}
+
+			app.Write(tt.request)
+			expectDial(t, dials, tt.target)
+			if got := readN(t, app, 10); got[0] != 5 || got[1] != socks5ReplySucceeded {
+				t.Fatalf("request reply %v", got)
+			}
+			expectEcho(t, app)
+		})
+	}
+}
+
+func TestSOCKS5Errors(t *testing.T) {
+	c, fwd, dials := proxyTestClient(t)
+
+	// CONNECT to host port 80 by name
+	domain := func(host string) []byte {
+		return append(append([]byte{5, 1, 0, 3, byte(len(host))}, host...), 0, 80)
+	}
+
+	tests := []struct {
+		name    string
+		request []byte
+		reply   byte
+		dial    string
+	}{
+		{"Wrong version", []byte{4, 1, 0, 1, 10, 0, 0, 1, 0, 80}, socks5ReplyGeneralFailure, ""},
+		{"Bind", []byte{5, 2, 0, 1, 10, 0, 0, 1, 0, 80}, socks5ReplyCommandUnsupported, ""},
+		{"Unknown address type", []byte{5, 1, 0, 9, 10, 0, 0, 1, 0, 80}, socks5ReplyAddrUnsupported, ""},
+		{"Refused", domain("refused.example"), socks5ReplyNotAllowed, refusedTarget},
+		{"Dial error", domain("broken.example"), socks5ReplyGeneralFailure, brokenTarget},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := proxyConn(t, c, fwd)
+			app.Write([]byte{5, 1, 0})
+			readN(t, app, 2)
+
+			go app.Write(tt.request)
+			if tt.dial != "" {
+				expectDial(t, dials, tt.dial)
+			}
+			if got := readN(t, app, 10); got[1] != tt.reply {
+				t.Errorf("reply code %d, want %d", got[1], tt.reply)
+			}
+			if _, err := app.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("connection not closed after error: %v", err)
+			}
+		})
+	}
+
+	t.Run("No acceptable auth", func(t *testing.T) {
+		app := proxyConn(t, c, fwd)
+		app.Write([]byte{5, 1, 2}) // username/password only
+		if got := readN(t, app, 2); !bytes.Equal(got, []byte{5, socks5AuthNoAcceptable}) {
+			t.Errorf("greeting reply %v", got)
+		}
+		if _, err := app.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection not closed: %v", err)
+		}
+	})
+}
+
+func TestHTTPConnect(t *testing.T) {
+	c, fwd, dials := proxyTestClient(t)
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		status int
+		dial   string
+	}{
+		{"Host and port", "CONNECT", "db.internal:5432", http.StatusOK, "db.internal:5432"},
+		{"Default port", "CONNECT", "example.com", http.StatusOK, "example.com:443"},
+		{"Refused", "CONNECT", refusedTarget, http.StatusForbidden, refusedTarget},
+		{"Dial error", "CONNECT", brokenTarget, http.StatusBadGateway, brokenTarget},
+		{"Not CONNECT", "GET", "example.com", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := proxyConn(t, c, fwd)
+			target := tt.host
+			if tt.method != "CONNECT" {
+				target = "http://" + tt.host + "/"
+			}
+			go io.WriteString(app, tt.method+" "+target+" HTTP/1.1\r\nHost: "+tt.host+"\r\n\r\n")
+
+			if tt.dial != "" {
+				expectDial(t, dials, tt.dial)
+			}
+
+			reader := bufio.NewReader(app)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				app.Write([]byte("ping"))
+				if got := readN(t, reader, 4); string(got) != "ping" {
+					t.Errorf("echoed %q", got)
+				}
+			}
+		})
+	}
+}
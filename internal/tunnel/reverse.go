@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"remote-tunnel/internal/proto"
+	streamutil "remote-tunnel/internal/stream"
+	"remote-tunnel/internal/transport"
+)
+
+// reverseForward exposes a service on the client machine through a
+// listener opened on the agent side.
+type reverseForward struct {
+	id         string
+	remoteAddr string // address the agent listens on
+	localAddr  string // service reachable from the client
+}
+
+// agentListener is a reverse listener opened on the agent and the relay
+// session that requested it, which carries its inbound connections
+type agentListener struct {
+	net.Listener
+	session *transport.MuxSession
+}
+
+// AddReverseForward asks the agent to listen on remoteAddr and carry every
+// accepted connection back to localAddr on the client machine. Forwards are
+// (re)registered each time the client connects to the relay.
+func (c *Client) AddReverseForward(remoteAddr, localAddr string) {
+	forward := &reverseForward{
+		id:         uuid.New().String(),
+		remoteAddr: remoteAddr,
+		localAddr:  localAddr,
+	}
+
+	c.reverseMutex.Lock()
+	c.reverse[forward.id] = forward
+	c.reverseMutex.Unlock()
+}
+
+func (c *Client) registerReverse(session *transport.MuxSession) {
+	c.reverseMutex.RLock()
+	defer c.reverseMutex.RUnlock()
+
+	for _, forward := range c.reverse {
+		err := session.SendControl(&proto.Control{
+			Type:       proto.MsgListen,
+			AgentID:    c.agentID,
+			ListenerID: forward.id,
+			ListenAddr: forward.remoteAddr,
+		})
+		if err != nil {
+			log.Printf("Failed to send listen for %s: %v", forward.remoteAddr, err)
+			continue
+		}
+		log.Printf("Requested reverse forward: agent %s %s -> local %s",
+			c.agentID, forward.remoteAddr, forward.localAddr)
+	}
+}
+
+func (c *Client) handleListenReply(msg *proto.Control) {
+	c.reverseMutex.RLock()
+	forward, exists := c.reverse[msg.ListenerID]
+	c.reverseMutex.RUnlock()
+
+	if !exists {
+		log.Printf("Reply for unknown reverse listener %s", msg.ListenerID)
+		return
+	}
+
+	if msg.Type == proto.MsgRefuse {
+		log.Printf("Reverse forward %s refused: %s", forward.remoteAddr, msg.Error)
+		return
+	}
+
+	if msg.Type == proto.MsgPending {
+		log.Printf("Reverse forward %s waiting for agent %s to connect", forward.remoteAddr, c.agentID)
+		return
+	}
+
+	log.Printf("Reverse forward active: agent %s %s -> local %s",
+		c.agentID, forward.remoteAddr, forward.localAddr)
+}
+
+func (c *Client) handleInbound(msg *proto.Control) {
+	streamID := msg.StreamID
+
+	// Wait for the relay stream tagged with this stream ID
+	stream, err := c.streams.Wait(streamID, transport.DialTimeout)
+	if err != nil {
+		log.Printf("Failed to get inbound relay stream: %v", err)
+		return
+	}
+	relayStream := c.metrics.track(stream)
+	defer relayStream.Close()
+
+	c.reverseMutex.RLock()
+	forward, exists := c.reverse[msg.ListenerID]
+	c.reverseMutex.RUnlock()
+
+	if !exists {
+		log.Printf("Inbound connection for unknown reverse listener %s", msg.ListenerID)
+		return
+	}
+
+	localConn, err := net.DialTimeout("tcp", forward.localAddr, 30*time.Second)
+	if err != nil {
+		log.Printf("Failed to dial local service %s: %v", forward.localAddr, err)
+		return
+	}
+	defer localConn.Close()
+
+	log.Printf("Inbound connection from %s bridged to %s (stream %s)",
+		forward.remoteAddr, forward.localAddr, streamID)
+
+	bridgeStreams(relayStream, localConn)
+
+	log.Printf("Inbound connection closed for stream %s", streamID)
+}
+
+func (a *Agent) handleListen(session *transport.MuxSession, msg *proto.Control) {
+	listenerID := msg.ListenerID
+	listenAddr := msg.ListenAddr
+
+	log.Printf("Listen request: listen=%s, listener=%s", listenAddr, listenerID)
+
+	decision := a.listenPolicy.Evaluate(a.ctx, listenAddr)
+	if !decision.Allowed {
+		log.Printf("Listen address %s not allowed: %s", listenAddr, decision.Reason)
+		session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listenerID,
+			Error:      fmt.Sprintf("listen address %s not allowed", listenAddr),
+		})
+		return
+	}
+
+	// A relay replaying the listener after a reconnect reuses its ID and
+	// address, so the listener of the previous session is closed first
+	a.closeListener(listenerID)
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Printf("Failed to listen on %s: %v", listenAddr, err)
+		session.SendControl(&proto.Control{
+			Type:       proto.MsgRefuse,
+			ListenerID: listenerID,
+			Error:      err.Error(),
+		})
+		return
+	}
+
+	a.listenersMu.Lock()
+	if old, exists := a.listeners[listenerID]; exists {
+		old.Close()
+	}
+	a.listeners[listenerID] = &agentListener{Listener: listener, session: session}
+	a.listenersMu.Unlock()
+
+	session.SendControl(&proto.Control{
+		Type:       proto.MsgAccept,
+		ListenerID: listenerID,
+	})
+
+	log.Printf("Listening on %s for reverse listener %s", listener.Addr(), listenerID)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Reverse listener %s stopped: %v", listenerID, err)
+			return
+		}
+
+		go a.handleInboundConn(session, listenerID, conn)
+	}
+}
+
+func (a *Agent) handleInboundConn(session *transport.MuxSession, listenerID string, conn net.Conn) {
+	defer conn.Close()
+
+	streamID := uuid.New().String()
+	log.Printf("Inbound connection from %s, listener=%s, stream=%s", conn.RemoteAddr(), listenerID, streamID)
+
+	// Tell the relay which listener this stream belongs to, then open it
+	err := session.SendControl(&proto.Control{
+		Type:       proto.MsgInbound,
+		StreamID:   streamID,
+		ListenerID: listenerID,
+	})
+	if err != nil {
+		log.Printf("Failed to send inbound: %v", err)
+		return
+	}
+
+	stream, err := session.OpenStreamWithID(streamID)
+	if err != nil {
+		log.Printf("Failed to open stream: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	bridgeStreams(a.metrics.track(stream), conn)
+
+	log.Printf("Inbound stream %s closed", streamID)
+}
+
+func (a *Agent) closeListener(listenerID string) {
+	a.listenersMu.Lock()
+	listener, exists := a.listeners[listenerID]
+	delete(a.listeners, listenerID)
+	a.listenersMu.Unlock()
+
+	if exists {
+		log.Printf("Closing reverse listener %s", listenerID)
+		listener.Close()
+	}
+}
+
+// closeListeners closes the reverse listeners requested over session when
+// it ends; the relay re-requests them after the agent registers again.
+// Listeners already taken over by a newer session are kept.
+func (a *Agent) closeListeners(session *transport.MuxSession) {
+	a.listenersMu.Lock()
+	defer a.listenersMu.Unlock()
+
+	for id, listener := range a.listeners {
+		if listener.session == session {
+			listener.Close()
+			delete(a.listeners, id)
+		}
+	}
+}
+
+// bridgeStreams copies data both ways until either side finishes. Reverse
+// connections carry no DIAL/ACCEPT handshake, so they are never compressed.
+func bridgeStreams(stream, conn net.Conn) {
+	processor := streamutil.NewStreamProcessor(streamutil.DefaultStreamOptions())
+
+	if err := processor.ProxyConnection(stream, conn); err != nil {
+		log.Printf("Bridge error: %v", err)
+	}
+}
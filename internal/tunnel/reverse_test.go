@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+// agentSessionPair connects an agent-side mux session to a fake relay over
+// a pipe
+func agentSessionPair(t *testing.T) (agentSide, relay *transport.MuxSession) {
+	t.Helper()
+	relayConn, agentConn := net.Pipe()
+
+	relayCh := make(chan *transport.MuxSession, 1)
+	go func() {
+		relay, err := transport.NewMuxServer(relayConn)
+		if err != nil {
+			t.Errorf("NewMuxServer failed: %v", err)
+		}
+		relayCh <- relay
+	}()
+
+	agentSide, err := transport.NewMuxClient(agentConn)
+	if err != nil {
+		t.Fatalf("NewMuxClient failed: %v", err)
+	}
+	relay = <-relayCh
+	if relay == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		// Closing the pipe first ends blocked control reads
+		relayConn.Close()
+		agentConn.Close()
+		agentSide.Close()
+		relay.Close()
+	})
+	return agentSide, relay
+}
+
+// expectRelayControl reads the next message the fake relay receives
+func expectRelayControl(t *testing.T, relay *transport.MuxSession, want proto.MsgType) *proto.Control {
+	t.Helper()
+	ch := make(chan *proto.Control, 1)
+	go func() {
+		msg, err := relay.ReceiveControl()
+		if err != nil {
+			t.Errorf("ReceiveControl failed: %v", err)
+		}
+		ch <- msg
+	}()
+
+	select {
+	case msg := <-ch:
+		if msg == nil || msg.Type != want {
+			t.Fatalf("got %+v, want %s", msg, want)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+	return nil
+}
+
+func TestListenerHandoverAfterGoingAway(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	a := NewAgent("agent-1", "wss://relay/ws/agent", "t", nil)
+	a.SetAllowedListen([]string{addr})
+	listen := &proto.Control{Type: proto.MsgListen, ListenerID: "listener-1", ListenAddr: addr}
+
+	// The draining relay's listener, then the same one replayed by the
+	// relay the agent moved to
+	drained, drainedRelay := agentSessionPair(t)
+	go a.handleListen(drained, listen)
+	expectRelayControl(t, drainedRelay, proto.MsgAccept)
+
+	current, currentRelay := agentSessionPair(t)
+	go a.handleListen(current, listen)
+	expectRelayControl(t, currentRelay, proto.MsgAccept)
+
+	// Ending the drained session leaves the replayed listener open
+	a.closeListeners(drained)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("replayed listener closed with the drained session: %v", err)
+	}
+	defer conn.Close()
+	if msg := expectRelayControl(t, currentRelay, proto.MsgInbound); msg.ListenerID != "listener-1" {
+		t.Errorf("INBOUND for listener %q", msg.ListenerID)
+	}
+
+	a.closeListeners(current)
+	a.listenersMu.Lock()
+	remaining := len(a.listeners)
+	a.listenersMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d listeners left after their session ended", remaining)
+	}
+}
@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"remote-tunnel/internal/proto"
+	"remote-tunnel/internal/transport"
+)
+
+const (
+	// UDPIdleTimeout closes a UDP flow after no datagram has passed either way
+	UDPIdleTimeout = 60 * time.Second
+
+	udpFlowQueue = 64
+)
+
+// udpFlow carries datagrams from one local source address over its own stream
+type udpFlow struct {
+	src     net.Addr
+	packets chan []byte
+}
+
+func (c *Client) udpReadLoop(fwd *forward) {
+	var (
+		flows   = make(map[string]*udpFlow)
+		flowsMu sync.Mutex
+	)
+
+	buf := make([]byte, transport.MaxDatagramSize)
+	for {
+		n, src, err := fwd.packetConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-fwd.ctx.Done():
+			default:
+				log.Printf("UDP read error: %v", err)
+			}
+			return
+		}
+
+		key := src.String()
+
+		flowsMu.Lock()
+		flow, exists := flows[key]
+		if !exists {
+			flow = &udpFlow{
+				src:     src,
+				packets: make(chan []byte, udpFlowQueue),
+			}
+			flows[key] = flow
+
+			go c.runUDPFlow(fwd, flow, func() {
+				flowsMu.Lock()
+				if flows[key] == flow {
+					delete(flows, key)
+				}
+				flowsMu.Unlock()
+			})
+		}
+		flowsMu.Unlock()
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		// Drop instead of blocking the socket when a flow falls behind
+		select {
+		case flow.packets <- packet:
+		default:
+			log.Printf("UDP flow %s queue full, dropping datagram", key)
+		}
+	}
+}
+
+func (c *Client) runUDPFlow(fwd *forward, flow *udpFlow, done func()) {
+	defer done()
+
+	fwd.active.Add(1)
+	defer fwd.active.Add(-1)
+
+	stream, err := c.openForward(fwd, proto.NetworkUDP, fwd.Target)
+	if err != nil {
+		log.Printf("UDP tunnel to %s failed: %v", fwd.Target, err)
+		return
+	}
+	defer stream.Close()
+
+	streamID := stream.id
+	log.Printf("UDP flow %s -> %s on stream %s", flow.src, fwd.Target, streamID)
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	// Copy relay -> local socket
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		buf := make([]byte, transport.MaxDatagramSize)
+		for {
+			n, err := transport.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := fwd.packetConn.WriteTo(buf[:n], flow.src); err != nil {
+				log.Printf("UDP write to %s failed: %v", flow.src, err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(UDPIdleTimeout / 4)
+	defer ticker.Stop()
+
+	// Copy local socket -> relay until the flow goes idle
+	for {
+		select {
+		case packet := <-flow.packets:
+			if err := transport.WriteDatagram(stream, packet); err != nil {
+				log.Printf("UDP stream write failed: %v", err)
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastActive.Load())) >= UDPIdleTimeout {
+				log.Printf("UDP flow %s idle, closing stream %s", flow.src, streamID)
+				return
+			}
+		case <-readerDone:
+			return
+		case <-fwd.ctx.Done():
+			return
+		}
+	}
+}
+
+// relayUDP relays datagrams between a tunnel stream and a connected UDP
+// socket until either side fails or the flow goes idle.
+func (a *Agent) relayUDP(stream, conn net.Conn, streamID string) {
+	log.Printf("UDP flow to %s on stream %s", conn.RemoteAddr(), streamID)
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	errCh := make(chan error, 2)
+
+	// Copy stream -> udp socket
+	go func() {
+		buf := make([]byte, transport.MaxDatagramSize)
+		for {
+			n, err := transport.ReadDatagram(stream, buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := conn.Write(buf[:n]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	// Copy udp socket -> stream
+	go func() {
+		buf := make([]byte, transport.MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if err := transport.WriteDatagram(stream, buf[:n]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(UDPIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errCh:
+			log.Printf("UDP stream %s closed: %v", streamID, err)
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastActive.Load())) >= UDPIdleTimeout {
+				log.Printf("UDP stream %s idle, closing", streamID)
+				return
+			}
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
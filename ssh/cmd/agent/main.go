@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -35,8 +32,11 @@ type SSHLogRequest struct {
 	Port      string `json:"port"`
 	Command   string `json:"command"`
 	Data      string `json:"data"`
+	Seq       uint64 `json:"seq"`
 }
 
+func (r *SSHLogRequest) SetSeq(seq uint64) { r.Seq = seq }
+
 type Agent struct {
 	id        string
 	token     string
@@ -50,12 +50,14 @@ type Agent struct {
 	logger    *common.Logger
 	running   bool
 	heartbeat *time.Ticker
+	logSender *common.LogSender
 }
 
 func NewAgent(id, token, relayURL string) *Agent {
 	return &Agent{
 		id:        id,
 		token:     token,
+		logSender: common.NewLogSender(common.LogSourceAgent, id, token),
 		relayURL:  relayURL,
 		sessions:  make(map[string]net.Conn),
 		dbLoggers: make(map[string]*common.DatabaseQueryLogger),
@@ -945,7 +947,7 @@ func (a *Agent) logSSHCommand(sessionID, clientID, command, direction string) {
 		relayHost = u.Host
 	}
 
-	logReq := SSHLogRequest{
+	logReq := &SSHLogRequest{
 		SessionID: sessionID,
 		ClientID:  clientID,
 		AgentID:   a.id,
@@ -959,29 +961,16 @@ func (a *Agent) logSSHCommand(sessionID, clientID, command, direction string) {
 
 	// Send to relay API
 	go func() {
-		jsonData, err := json.Marshal(logReq)
-		if err != nil {
-			a.logger.Error("Failed to marshal SSH log: %v", err)
-			return
-		}
-
 		// Extract relay server HTTP URL from WebSocket URL
 		relayHTTP := strings.Replace(a.relayURL, "ws://", "http://", 1)
 		relayHTTP = strings.Replace(relayHTTP, "/ws", "", 1)
 		apiURL := relayHTTP + "/api/log-ssh"
 
-		resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
+		if err := a.logSender.Send(apiURL, logReq); err != nil {
 			a.logger.Error("Failed to send SSH command log: %v", err)
 			return
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == 200 {
-			a.logger.Debug("SSH command logged: %s -> %s", direction, command)
-		} else {
-			a.logger.Error("Failed to log SSH command, status: %d", resp.StatusCode)
-		}
+		a.logger.Debug("SSH command logged: %s -> %s", direction, command)
 	}()
 }
 
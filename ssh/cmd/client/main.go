@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -25,6 +22,7 @@ import (
 type Client struct {
 	id        string
 	name      string
+	token     string
 	relayURL  string
 	conn      *websocket.Conn
 	sessions  map[string]net.Conn
@@ -35,6 +33,7 @@ type Client struct {
 	logger    *common.Logger
 	running   bool
 	heartbeat *time.Ticker
+	logSender *common.LogSender
 }
 
 type QueryLogData struct {
@@ -46,12 +45,17 @@ type QueryLogData struct {
 	Operation string `json:"operation"`
 	TableName string `json:"table_name"`
 	QueryText string `json:"query_text"`
+	Seq       uint64 `json:"seq"`
 }
 
-func NewClient(id, name, relayURL string) *Client {
+func (d *QueryLogData) SetSeq(seq uint64) { d.Seq = seq }
+
+func NewClient(id, name, token, relayURL string) *Client {
 	return &Client{
 		id:        id,
 		name:      name,
+		token:     token,
+		logSender: common.NewLogSender(common.LogSourceClient, id, token),
 		relayURL:  relayURL,
 		sessions:  make(map[string]net.Conn),
 		dbLoggers: make(map[string]*common.DatabaseQueryLogger),
@@ -81,6 +85,7 @@ func (c *Client) connect() error {
 	registerMsg := common.NewMessage(common.MsgTypeRegister)
 	registerMsg.ClientID = c.id
 	registerMsg.ClientName = c.name
+	registerMsg.Token = c.token
 	if err := c.sendMessage(registerMsg); err != nil {
 		return fmt.Errorf("failed to register: %v", err)
 	}
@@ -259,7 +264,7 @@ func (c *Client) handleLocalConnection(conn net.Conn, agentID, target string) {
 		c.mutex.RUnlock()
 
 		if agentID != "" {
-			logData := QueryLogData{
+			logData := &QueryLogData{
 				SessionID: sessionID,
 				ClientID:  c.id,
 				AgentID:   agentID,
@@ -394,7 +399,7 @@ func (c *Client) sendMessage(msg *common.Message) error {
 	return c.conn.WriteMessage(websocket.TextMessage, data)
 }
 
-func (c *Client) sendQueryLogToAPI(logData QueryLogData) {
+func (c *Client) sendQueryLogToAPI(logData *QueryLogData) {
 	// Parse relay URL to get the base URL
 	u, err := url.Parse(c.relayURL)
 	if err != nil {
@@ -406,23 +411,10 @@ func (c *Client) sendQueryLogToAPI(logData QueryLogData) {
 	apiURL := strings.Replace(u.String(), "ws://", "http://", 1)
 	apiURL = strings.Replace(apiURL, "/ws/client", "/api/log-query", 1)
 
-	jsonData, err := json.Marshal(logData)
-	if err != nil {
-		c.logger.Error("Failed to marshal query log data: %v", err)
-		return
-	}
-
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
+	if err := c.logSender.Send(apiURL, logData); err != nil {
 		c.logger.Error("Failed to send query log to API: %v", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		c.logger.Error("API returned error status: %d", resp.StatusCode)
-		return
-	}
 
 	c.logger.Debug("Successfully sent query log via API: %s %s", logData.Operation, logData.Protocol)
 }
@@ -522,6 +514,7 @@ func main() {
 		clientID    string
 		clientName  string
 		relayURL    string
+		token       string
 		localAddr   string
 		agentID     string
 		target      string
@@ -541,7 +534,11 @@ func main() {
 				clientName = fmt.Sprintf("client-%s", clientID[:8])
 			}
 
-			client := NewClient(clientID, clientName, relayURL)
+			if token == "" {
+				log.Fatal("Token is required. Use --token to provide your user token.")
+			}
+
+			client := NewClient(clientID, clientName, token, relayURL)
 
 			// Setup signal handling for graceful shutdown
 			sigChan := make(chan os.Signal, 1)
@@ -619,6 +616,7 @@ func main() {
 	rootCmd.Flags().StringVarP(&clientID, "client-id", "c", "", "Client ID (auto-generated if not provided)")
 	rootCmd.Flags().StringVarP(&clientName, "name", "n", "", "Client name (auto-generated if not provided)")
 	rootCmd.Flags().StringVarP(&relayURL, "relay-url", "r", "ws://localhost:8080/ws/client", "Relay server WebSocket URL")
+	rootCmd.Flags().StringVar(&token, "token", "", "User token for relay authentication (required)")
 	rootCmd.Flags().StringVarP(&localAddr, "local", "L", "", "Local address to listen on (e.g., :2222)")
 	rootCmd.Flags().StringVarP(&agentID, "agent", "a", "", "Target agent ID")
 	rootCmd.Flags().StringVarP(&target, "target", "t", "", "Target address (e.g., localhost:22)")
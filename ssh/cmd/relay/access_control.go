@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errAccessDenied is the cause of every refused CONNECT; the wrapped reason
+// is sent to the client
+var errAccessDenied = errors.New("access denied")
+
+func denyAccess(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errAccessDenied, fmt.Sprintf(format, args...))
+}
+
+// connectUser resolves the user behind a client token: a signed session
+// token from /login or the SSO device flow, or the user's static token.
+// The current users row of the session's backend decides, so a deleted
+// user or changed role takes effect on the next connect and a directory
+// user never gets the role of a same-named local account. LDAP users need
+// no row: without one they keep their session's role (LDAP_DEFAULT_ROLE)
+// and have no project assignments or target rules.
+func (rs *RelayServer) connectUser(token string) (id int, username, role string, err error) {
+	session, err := rs.sessionFromToken(token)
+	if err != nil {
+		err := rs.db.QueryRow("SELECT id, username, role FROM users WHERE token = ?", rs.cleanString(token)).Scan(&id, &username, &role)
+		if err == sql.ErrNoRows {
+			return 0, "", "", denyAccess("invalid or expired user token")
+		}
+		if err != nil {
+			return 0, "", "", fmt.Errorf("query user token: %w", err)
+		}
+		return id, username, role, nil
+	}
+
+	err = rs.db.QueryRow("SELECT id, role FROM users WHERE username = ? AND auth_source = ?",
+		session.Username, session.Backend).Scan(&id, &role)
+	switch {
+	case err == sql.ErrNoRows && session.Backend == "ldap":
+		return 0, session.Username, session.Role, nil
+	case err == sql.ErrNoRows:
+		return 0, "", "", denyAccess("user %s no longer exists", session.Username)
+	case err != nil:
+		return 0, "", "", fmt.Errorf("query user: %w", err)
+	}
+	return id, session.Username, role, nil
+}
+
+// checkClientOwner refuses to register a client ID for username when it is
+// bound to another user, either by a live registration or by the user
+// recorded in clients. Clients pick their ID freely, and individual client
+// assignments grant access by that ID. The caller holds rs.mutex.
+func (rs *RelayServer) checkClientOwner(clientID, username string) error {
+	if existing, ok := rs.clients[clientID]; ok && existing.Username != username {
+		return denyAccess("client ID %s is registered by another user", clientID)
+	}
+	if rs.db == nil {
+		return nil
+	}
+
+	var owner sql.NullString
+	err := rs.db.QueryRow("SELECT username FROM clients WHERE client_id = ?", rs.cleanString(clientID)).Scan(&owner)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return fmt.Errorf("query client: %w", err)
+	case owner.String != "" && owner.String != "unknown" && owner.String != username:
+		return denyAccess("client ID %s is registered by another user", clientID)
+	}
+	return nil
+}
+
+// authorizeConnect decides whether a client may open a tunnel through an
+// agent. Admins reach every agent; other users need an active assignment
+// to the agent's project or an individual client assignment to the agent.
+// Users with target rules may only reach targets matching one of them.
+// It returns the resolved username, also when access is denied.
+func (rs *RelayServer) authorizeConnect(clientID, token, agentID, target string) (string, error) {
+	if rs.db == nil {
+		return "", denyAccess("access check unavailable")
+	}
+
+	userID, username, role, err := rs.connectUser(token)
+	if err != nil {
+		return "", err
+	}
+
+	if role != "admin" {
+		allowed, err := rs.canReachAgent(userID, username, clientID, agentID)
+		if err != nil {
+			return username, err
+		}
+		if !allowed {
+			return username, denyAccess("user %s has no access to agent %s", username, agentID)
+		}
+	}
+
+	patterns, err := rs.targetPatterns(userID)
+	if err != nil {
+		return username, err
+	}
+	if len(patterns) > 0 && !matchAnyTarget(patterns, target) {
+		return username, denyAccess("target %s is not allowed for user %s", target, username)
+	}
+	return username, nil
+}
+
+// canReachAgent checks project and client assignments covering an agent.
+// Client assignments only count for a client ID registered by the user.
+func (rs *RelayServer) canReachAgent(userID int, username, clientID, agentID string) (bool, error) {
+	var count int
+	err := rs.db.QueryRow(`
+		SELECT COUNT(*) FROM agents a
+		JOIN user_project_assignments upa ON upa.project_id = a.project_id
+		JOIN projects p ON p.id = a.project_id
+		WHERE a.agent_id = ? AND upa.user_id = ? AND upa.status = 'active' AND p.status = 'active'`,
+		agentID, userID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("query project access: %w", err)
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	err = rs.db.QueryRow(`
+		SELECT COUNT(*) FROM client_assignments ca
+		JOIN clients c ON c.client_id = ca.client_id
+		WHERE ca.client_id = ? AND ca.agent_id = ? AND ca.assignment_type = 'individual' AND ca.status = 'active'
+		AND c.username = ?`,
+		clientID, agentID, username).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("query client assignment: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (rs *RelayServer) targetPatterns(userID int) ([]string, error) {
+	rows, err := rs.db.Query("SELECT pattern FROM user_target_rules WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("query target rules: %w", err)
+	}
+	defer rows.Close()
+
+	var patterns []string
+	for rows.Next() {
+		var pattern string
+		if err := rows.Scan(&pattern); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, rows.Err()
+}
+
+func matchAnyTarget(patterns []string, target string) bool {
+	for _, pattern := range patterns {
+		if matchTarget(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTarget matches host:port against a rule. The host part is a glob
+// (db-*.internal, *) or a CIDR (10.0.0.0/24); the port part is a number, a
+// range (8000-8100) or *.
+func matchTarget(pattern, target string) bool {
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return false
+	}
+	return matchTargetHost(patternHost, host) && matchTargetPort(patternPort, port)
+}
+
+func matchTargetHost(pattern, host string) bool {
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && network.Contains(ip)
+	}
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return err == nil && ok
+}
+
+func matchTargetPort(pattern string, port int) bool {
+	if pattern == "*" {
+		return true
+	}
+	from, to, err := parsePortRange(pattern)
+	return err == nil && port >= from && port <= to
+}
+
+// parsePortRange reads a port number or a from-to range
+func parsePortRange(text string) (int, int, error) {
+	low, high, isRange := strings.Cut(text, "-")
+	from, err := strconv.Atoi(low)
+	if err != nil {
+		return 0, 0, err
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.Atoi(high); err != nil {
+			return 0, 0, err
+		}
+	}
+	return from, to, nil
+}
+
+// validateTargetPattern rejects rules that could never match
+func validateTargetPattern(pattern string) error {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("pattern must be host:port")
+	}
+	if strings.Contains(host, "/") {
+		if _, _, err := net.ParseCIDR(host); err != nil {
+			return fmt.Errorf("invalid CIDR %q", host)
+		}
+	} else if _, err := path.Match(host, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q", host)
+	}
+	if port != "*" {
+		from, to, err := parsePortRange(port)
+		if err != nil || from < 1 || to > 65535 || from > to {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return nil
+}
+
+// handleAPITargetRules manages per-user target restrictions (admin only):
+// GET ?username=, POST {"username", "pattern", "description"} and
+// DELETE /api/target-rules/{id}
+func (rs *RelayServer) handleAPITargetRules(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Forbidden: Admin access required", http.StatusForbidden)
+		return
+	}
+	if rs.db == nil {
+		http.Error(w, "Database not connected", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		query := `
+			SELECT r.id, u.username, r.pattern, r.description, r.created_by, r.created_at
+			FROM user_target_rules r JOIN users u ON r.user_id = u.id`
+		args := []interface{}{}
+		if username := r.URL.Query().Get("username"); username != "" {
+			query += " WHERE u.username = ?"
+			args = append(args, username)
+		}
+		rows, err := rs.db.Query(query+" ORDER BY u.username, r.id", args...)
+		if err != nil {
+			rs.logger.Error("Failed to query target rules: %v", err)
+			http.Error(w, "Failed to retrieve target rules", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		rules := []map[string]interface{}{}
+		for rows.Next() {
+			var id int
+			var username, pattern string
+			var description, createdBy sql.NullString
+			var createdAt time.Time
+			if err := rows.Scan(&id, &username, &pattern, &description, &createdBy, &createdAt); err != nil {
+				rs.logger.Error("Failed to scan target rule: %v", err)
+				continue
+			}
+			rules = append(rules, map[string]interface{}{
+				"id":          id,
+				"username":    username,
+				"pattern":     pattern,
+				"description": description.String,
+				"created_by":  createdBy.String,
+				"created_at":  createdAt,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+
+	case "POST":
+		var req struct {
+			Username    string `json:"username"`
+			Pattern     string `json:"pattern"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+			http.Error(w, "username and pattern are required", http.StatusBadRequest)
+			return
+		}
+		req.Pattern = strings.TrimSpace(req.Pattern)
+		if err := validateTargetPattern(req.Pattern); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var userID int
+		if err := rs.db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		admin := r.Header.Get("X-Username")
+		result, err := rs.db.Exec("INSERT INTO user_target_rules (user_id, pattern, description, created_by) VALUES (?, ?, ?, ?)",
+			userID, req.Pattern, req.Description, admin)
+		if err != nil {
+			rs.logger.Error("Failed to create target rule: %v", err)
+			http.Error(w, "Failed to create target rule", http.StatusInternalServerError)
+			return
+		}
+		id, _ := result.LastInsertId()
+		rs.logger.Info("Admin %s allowed target %s for user %s", admin, req.Pattern, req.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"id":      id,
+		})
+
+	case "DELETE":
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/target-rules/"))
+		if err != nil {
+			http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+			return
+		}
+		result, err := rs.db.Exec("DELETE FROM user_target_rules WHERE id = ?", id)
+		if err != nil {
+			rs.logger.Error("Failed to delete target rule %d: %v", id, err)
+			http.Error(w, "Failed to delete target rule", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Target rule not found", http.StatusNotFound)
+			return
+		}
+		rs.logger.Info("Admin %s deleted target rule %d", r.Header.Get("X-Username"), id)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Target rule deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	"ssh-tunnel/internal/common"
+)
+
+func TestMatchTarget(t *testing.T) {
+	tests := []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		// Host globs
+		{"db.internal:5432", "db.internal:5432", true},
+		{"db.internal:5432", "DB.Internal:5432", true},
+		{"db-*.internal:5432", "db-eu1.internal:5432", true},
+		{"db-*.internal:5432", "web-eu1.internal:5432", false},
+		{"db-?.internal:5432", "db-1.internal:5432", true},
+		{"db-?.internal:5432", "db-12.internal:5432", false},
+		{"*.internal:22", "db.internal:22", true},
+		{"*.internal:22", "internal:22", false},
+		{"*:22", "anything.example.com:22", true},
+		{"*:22", "10.1.2.3:22", true},
+
+		// CIDR hosts
+		{"10.0.0.0/24:5432", "10.0.0.17:5432", true},
+		{"10.0.0.0/24:5432", "10.0.1.17:5432", false},
+		{"10.0.0.0/24:5432", "db.internal:5432", false},
+		{"10.0.0.5/32:22", "10.0.0.5:22", true},
+		{"[2001:db8::/32]:443", "[2001:db8::1]:443", true},
+		{"[2001:db8::/32]:443", "[2001:db9::1]:443", false},
+		{"10.0.0.0/33:22", "10.0.0.1:22", false},
+
+		// Ports
+		{"db.internal:*", "db.internal:1", true},
+		{"db.internal:*", "db.internal:65535", true},
+		{"db.internal:8000-8100", "db.internal:8000", true},
+		{"db.internal:8000-8100", "db.internal:8100", true},
+		{"db.internal:8000-8100", "db.internal:8050", true},
+		{"db.internal:8000-8100", "db.internal:7999", false},
+		{"db.internal:8000-8100", "db.internal:8101", false},
+		{"db.internal:5432", "db.internal:5433", false},
+		{"*:*", "db.internal:5432", true},
+
+		// Malformed input
+		{"db.internal", "db.internal:5432", false},
+		{"db.internal:5432", "db.internal", false},
+		{"db.internal:5432", "db.internal:postgres", false},
+		{"db.internal:abc", "db.internal:5432", false},
+		{"[db:5432", "db:5432", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchTarget(tt.pattern, tt.target); got != tt.want {
+			t.Errorf("matchTarget(%q, %q) = %v, want %v", tt.pattern, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTargetPattern(t *testing.T) {
+	for _, pattern := range []string{"db.internal:5432", "*:*", "db-*.internal:8000-8100", "10.0.0.0/8:22", "[2001:db8::/32]:443"} {
+		if err := validateTargetPattern(pattern); err != nil {
+			t.Errorf("validateTargetPattern(%q): %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"db.internal", ":22", "db.internal:", "10.0.0.0/33:22", "[a-:22", "db:0", "db:70000", "db:9000-8000", "db:http"} {
+		if err := validateTargetPattern(pattern); err == nil {
+			t.Errorf("validateTargetPattern(%q) accepted", pattern)
+		}
+	}
+}
+
+// connectGrant describes what the database knows about the user behind
+// the token "user-token"
+type connectGrant struct {
+	role     string // empty when the token is unknown
+	project  bool   // assigned to the agent's project
+	client   bool   // individual assignment of the client to the agent
+	patterns []string
+}
+
+// expectConnectQueries sets up the lookups authorizeConnect makes for grant
+func expectConnectQueries(mock sqlmock.Sqlmock, grant connectGrant) {
+	query := mock.ExpectQuery("SELECT id, username, role FROM users WHERE token = ?").WithArgs("user-token")
+	if grant.role == "" {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"id", "username", "role"}).AddRow(7, "alice", grant.role))
+
+	count := func(ok bool) *sqlmock.Rows {
+		n := 0
+		if ok {
+			n = 1
+		}
+		return sqlmock.NewRows([]string{"count"}).AddRow(n)
+	}
+	if grant.role != "admin" {
+		mock.ExpectQuery("JOIN user_project_assignments upa").WithArgs("agent-1", 7).WillReturnRows(count(grant.project))
+		if !grant.project {
+			mock.ExpectQuery("FROM client_assignments").WithArgs("client-1", "agent-1", "alice").WillReturnRows(count(grant.client))
+			if !grant.client {
+				return
+			}
+		}
+	}
+
+	rows := sqlmock.NewRows([]string{"pattern"})
+	for _, pattern := range grant.patterns {
+		rows.AddRow(pattern)
+	}
+	mock.ExpectQuery("SELECT pattern FROM user_target_rules WHERE user_id = ?").WithArgs(7).WillReturnRows(rows)
+}
+
+func TestAuthorizeConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		grant    connectGrant
+		target   string
+		allowed  bool
+		username string
+	}{
+		{"Admin without assignments", connectGrant{role: "admin"}, "db.internal:5432", true, "alice"},
+		{"Admin outside target rules", connectGrant{role: "admin", patterns: []string{"10.0.0.0/8:*"}}, "db.internal:5432", false, "alice"},
+		{"Project assignment", connectGrant{role: "user", project: true}, "db.internal:5432", true, "alice"},
+		{"Individual client assignment", connectGrant{role: "user", client: true}, "db.internal:5432", true, "alice"},
+		{"No assignment", connectGrant{role: "user"}, "db.internal:5432", false, "alice"},
+		{"Target rule matches", connectGrant{role: "user", project: true, patterns: []string{"web:80", "db-*:5432", "db.internal:5400-5500"}}, "db.internal:5432", true, "alice"},
+		{"Target rule does not match", connectGrant{role: "user", project: true, patterns: []string{"db.internal:3306"}}, "db.internal:5432", false, "alice"},
+		{"Unknown token", connectGrant{}, "db.internal:5432", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			expectConnectQueries(mock, tt.grant)
+
+			username, err := rs.authorizeConnect("client-1", "user-token", "agent-1", tt.target)
+			if tt.allowed && err != nil {
+				t.Errorf("denied: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, errAccessDenied) {
+				t.Errorf("err = %v, want access denied", err)
+			}
+			if username != tt.username {
+				t.Errorf("username %q, want %q", username, tt.username)
+			}
+		})
+	}
+}
+
+func TestAuthorizeConnectUserLookup(t *testing.T) {
+	// sessionToken returns a token for a live session of alice logged in
+	// through backend, with the role stored in the session
+	sessionToken := func(rs *RelayServer, mock sqlmock.Sqlmock, backend, role string) string {
+		login := time.Now().UTC().Add(-time.Minute)
+		mock.ExpectQuery(sessionQuery).WithArgs("session-1").WillReturnRows(
+			sqlmock.NewRows([]string{"session_id", "username", "role", "auth_backend", "remote_addr", "user_agent", "created_at", "last_seen_at", "expires_at"}).
+				AddRow("session-1", "alice", role, backend, "10.0.0.1:5000", "test", login, time.Now().UTC(), login.Add(24*time.Hour)))
+		return rs.tokens.Sign(testWebSession(login.Add(time.Hour)))
+	}
+
+	t.Run("Session token", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		token := sessionToken(rs, mock, "local", "user")
+		// The users row decides the role, not the session
+		mock.ExpectQuery("SELECT id, role FROM users WHERE username = ? AND auth_source = ?").WithArgs("alice", "local").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow(7, "admin"))
+		mock.ExpectQuery("FROM user_target_rules").WillReturnRows(sqlmock.NewRows([]string{"pattern"}))
+
+		if username, err := rs.authorizeConnect("client-1", token, "agent-1", "db:5432"); err != nil || username != "alice" {
+			t.Errorf("authorizeConnect = %q, %v", username, err)
+		}
+	})
+
+	t.Run("Deleted user", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		token := sessionToken(rs, mock, "local", "user")
+		mock.ExpectQuery("SELECT id, role FROM users WHERE username = ? AND auth_source = ?").WithArgs("alice", "local").
+			WillReturnError(sql.ErrNoRows)
+
+		if _, err := rs.authorizeConnect("client-1", token, "agent-1", "db:5432"); !errors.Is(err, errAccessDenied) {
+			t.Errorf("err = %v, want access denied", err)
+		}
+	})
+
+	t.Run("LDAP user without a row", func(t *testing.T) {
+		// A local admin of the same name does not count: only ldap rows
+		// are looked up, and without one the session's role applies
+		rs, mock := testSessionRelay(t)
+		token := sessionToken(rs, mock, "ldap", "user")
+		mock.ExpectQuery("SELECT id, role FROM users WHERE username = ? AND auth_source = ?").WithArgs("alice", "ldap").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("JOIN user_project_assignments upa").WithArgs("agent-1", 0).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery("FROM client_assignments").WithArgs("client-1", "agent-1", "alice").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		if _, err := rs.authorizeConnect("client-1", token, "agent-1", "db:5432"); !errors.Is(err, errAccessDenied) {
+			t.Errorf("err = %v, want access denied", err)
+		}
+	})
+
+	t.Run("Removed SSO user", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		token := sessionToken(rs, mock, "oidc", "admin")
+		mock.ExpectQuery("SELECT id, role FROM users WHERE username = ? AND auth_source = ?").WithArgs("alice", "oidc").
+			WillReturnError(sql.ErrNoRows)
+
+		if _, err := rs.authorizeConnect("client-1", token, "agent-1", "db:5432"); !errors.Is(err, errAccessDenied) {
+			t.Errorf("err = %v, want access denied", err)
+		}
+	})
+
+	t.Run("Database failure", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		mock.ExpectQuery("SELECT id, username, role FROM users WHERE token = ?").WillReturnError(errors.New("connection lost"))
+
+		_, err := rs.authorizeConnect("client-1", "user-token", "agent-1", "db:5432")
+		if err == nil || errors.Is(err, errAccessDenied) {
+			t.Errorf("err = %v, want a lookup failure", err)
+		}
+	})
+}
+
+// A refused CONNECT is answered with an error message and recorded in
+// connection_logs
+func TestConnectDenied(t *testing.T) {
+	rs, mock := testSessionRelay(t)
+	rs.clients = map[string]*Client{"client-1": {ID: "client-1", Token: "user-token"}}
+	rs.connToClient = make(map[*websocket.Conn]string)
+	rs.sessions = make(map[string]*Session)
+
+	expectConnectQueries(mock, connectGrant{role: "user"})
+	var details driver.Value
+	mock.ExpectExec("INSERT INTO connection_logs (type, agent_id, client_id, event, details)").
+		WithArgs("client", "agent-1", "client-1", "access_denied", captureArg{&details}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rs.connMutex.Lock()
+		rs.connToClient[conn] = "client-1"
+		rs.connMutex.Unlock()
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := common.FromJSON(data)
+		if err != nil {
+			return
+		}
+		rs.handleConnect(conn, msg)
+		conn.ReadMessage() // until the client hangs up
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	connect := common.NewMessage(common.MsgTypeConnect)
+	connect.ClientID = "someone-else" // replaced by the registered client ID
+	connect.AgentID = "agent-1"
+	connect.Target = "db.internal:5432"
+	connect.SessionID = "session-9"
+	data, _ := connect.ToJSON()
+	conn.WriteMessage(websocket.TextMessage, data)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := common.FromJSON(data)
+	if reply.Type != common.MsgTypeError || reply.SessionID != "session-9" || !strings.Contains(reply.Error, "no access to agent agent-1") {
+		t.Errorf("reply %+v", reply)
+	}
+
+	// The log row is written in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if text, _ := details.(string); !strings.Contains(text, "user: alice") || !strings.Contains(text, "target: db.internal:5432") {
+		t.Errorf("logged details %q", text)
+	}
+	if len(rs.sessions) != 0 {
+		t.Error("session created for a refused connect")
+	}
+}
+
+func TestCheckClientOwner(t *testing.T) {
+	ownerRows := func(owner interface{}) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"username"}).AddRow(owner)
+	}
+	tests := []struct {
+		name    string
+		live    string      // user of a live registration of the ID, if any
+		owner   interface{} // clients.username, nil for no row
+		allowed bool
+	}{
+		{"New client ID", "", nil, true},
+		{"Own client ID", "", "alice", true},
+		{"Unclaimed row", "", "unknown", true},
+		{"Another user's client ID", "", "bob", false},
+		{"Live registration by another user", "bob", "alice", false},
+		{"Own live registration", "alice", "alice", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			rs.clients = make(map[string]*Client)
+			if tt.live != "" {
+				rs.clients["client-1"] = &Client{ID: "client-1", Username: tt.live}
+			}
+			if tt.live == "" || tt.live == "alice" {
+				query := mock.ExpectQuery("SELECT username FROM clients WHERE client_id = ?").WithArgs("client-1")
+				if tt.owner == nil {
+					query.WillReturnError(sql.ErrNoRows)
+				} else {
+					query.WillReturnRows(ownerRows(tt.owner))
+				}
+			}
+
+			err := rs.checkClientOwner("client-1", "alice")
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, errAccessDenied) {
+				t.Errorf("err = %v, want access denied", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthUser is a user confirmed by one of the authentication backends
+type AuthUser struct {
+	Username string
+	Role     string
+	Backend  string
+}
+
+// Authenticator checks a username and password against one identity source
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (*AuthUser, error)
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	// errUnknownUser means the backend has no such user and the next one
+	// may be tried
+	errUnknownUser = errors.New("unknown user")
+)
+
+// passwordCost is the bcrypt cost for new hashes; older hashes with a lower
+// cost are upgraded on the next login
+const passwordCost = 12
+
+// dummyPasswordHash is compared against for unknown users, so a login takes
+// as long whether or not the username exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), passwordCost)
+
+// hashPassword returns the bcrypt hash stored in users.password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash tells bcrypt hashes apart from plaintext passwords stored
+// before hashing was introduced
+func isPasswordHash(stored string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword compares a password with a stored hash or legacy plaintext
+// value and reports whether the stored value should be replaced by a fresh
+// hash
+func checkPassword(stored, password string) (match, rehash bool) {
+	if !isPasswordHash(stored) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < passwordCost
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localAuthenticator checks the users table
+type localAuthenticator struct {
+	rs *RelayServer
+}
+
+func (a *localAuthenticator) Name() string { return "local" }
+
+func (a *localAuthenticator) Authenticate(username, password string) (*AuthUser, error) {
+	if a.rs.db == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	var stored, role string
+	var source sql.NullString
+	err := a.rs.db.QueryRow("SELECT password, role, auth_source FROM users WHERE username = ?", username).Scan(&stored, &role, &source)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query user: %w", err)
+	}
+	// Rows linked to a directory or created by SSO belong to that backend
+	if err == sql.ErrNoRows || (source.String != "" && source.String != a.Name()) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, errUnknownUser
+	}
+
+	match, rehash := checkPassword(stored, password)
+	if !match {
+		return nil, errInvalidCredentials
+	}
+
+	// Rows created before hashing hold plaintext; replace them the first
+	// time the right password is seen
+	if rehash {
+		if hash, err := hashPassword(password); err != nil {
+			a.rs.logger.Error("Failed to rehash password for %s: %v", username, err)
+		} else if _, err := a.rs.db.Exec("UPDATE users SET password = ? WHERE username = ? AND password = ?", hash, username, stored); err != nil {
+			a.rs.logger.Error("Failed to store password hash for %s: %v", username, err)
+		} else {
+			a.rs.logger.Info("Upgraded stored password of user %s to bcrypt", username)
+		}
+	}
+
+	return &AuthUser{Username: username, Role: role, Backend: a.Name()}, nil
+}
+
+// linkedRole returns the role of a users row linked to an external backend
+// through auth_source, or fallback when there is none. Rows of other
+// sources are ignored, so a directory user cannot take over the role of a
+// local account that happens to have the same name.
+func (rs *RelayServer) linkedRole(username, backend, fallback string) string {
+	if rs.db == nil {
+		return fallback
+	}
+	var role string
+	err := rs.db.QueryRow("SELECT role FROM users WHERE username = ? AND auth_source = ?", username, backend).Scan(&role)
+	if err != nil || role == "" {
+		return fallback
+	}
+	return role
+}
+
+// initAuth sets up the backends listed in AUTH_BACKENDS (local, ldap,
+// oidc; default local) in the order they are tried, the session store and
+// the session token signer
+func (rs *RelayServer) initAuth() error {
+	backends := os.Getenv("AUTH_BACKENDS")
+	if backends == "" {
+		backends = "local"
+	}
+
+	// Single sign-on is available whenever an issuer is configured; the
+	// oidc backend additionally accepts passwords through it
+	rs.sso = nil
+	if os.Getenv("OIDC_ISSUER") != "" {
+		sso, err := newOIDCSSO(rs)
+		if err != nil {
+			return fmt.Errorf("oidc: %w", err)
+		}
+		rs.sso = sso
+	}
+
+	rs.authenticators = nil
+	for _, name := range strings.Split(backends, ",") {
+		var auth Authenticator
+		var err error
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "local":
+			auth = &localAuthenticator{rs: rs}
+		case "ldap":
+			auth, err = newLDAPAuthenticator(rs)
+		case "oidc":
+			auth, err = newOIDCAuthenticator(rs)
+		case "":
+			continue
+		default:
+			err = fmt.Errorf("unknown backend %q", name)
+		}
+		if err != nil {
+			return fmt.Errorf("auth backend %s: %w", name, err)
+		}
+		rs.authenticators = append(rs.authenticators, auth)
+	}
+	if len(rs.authenticators) == 0 {
+		return fmt.Errorf("AUTH_BACKENDS lists no backend")
+	}
+
+	ttl, err := parseSessionTTL(os.Getenv("SESSION_TTL"))
+	if err != nil {
+		return err
+	}
+	sessions, err := newSessionStore(rs, os.Getenv("SESSION_IDLE_TIMEOUT"), ttl)
+	if err != nil {
+		return err
+	}
+	rs.webSessions = sessions
+
+	signer, err := newTokenSigner(os.Getenv("SESSION_SECRET"))
+	if err != nil {
+		return err
+	}
+	if os.Getenv("SESSION_SECRET") == "" {
+		rs.logger.Info("SESSION_SECRET not set, using a random key: bearer tokens stop working when the relay restarts")
+	}
+	rs.tokens = signer
+	return nil
+}
+
+// authenticate tries each backend in turn and returns the first match. A
+// backend that knows the user but rejects the password ends the search, so
+// a wrong password for one account is never retried against another
+// source.
+func (rs *RelayServer) authenticate(username, password string) (*AuthUser, error) {
+	if username == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	for _, auth := range rs.authenticators {
+		user, err := auth.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			break
+		}
+		if !errors.Is(err, errUnknownUser) {
+			rs.logger.Error("Authentication backend %s failed for %s: %v", auth.Name(), username, err)
+		}
+	}
+	return nil, errInvalidCredentials
+}
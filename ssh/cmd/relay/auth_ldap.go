@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// LDAP result codes (RFC 4511 section 4.1.9)
+const (
+	ldapSuccess            = 0
+	ldapNoSuchObject       = 32
+	ldapInvalidCredentials = 49
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapAuthenticator checks passwords with a simple bind as the user.
+// Configured by LDAP_URL (ldap:// or ldaps://), LDAP_USER_DN, a DN with %s
+// for the username such as uid=%s,ou=people,dc=example,dc=com, and
+// LDAP_DEFAULT_ROLE for directory users without a users row whose
+// auth_source is ldap.
+type ldapAuthenticator struct {
+	rs          *RelayServer
+	address     string
+	useTLS      bool
+	serverName  string
+	userDN      string
+	defaultRole string
+}
+
+func newLDAPAuthenticator(rs *RelayServer) (*ldapAuthenticator, error) {
+	u, err := url.Parse(os.Getenv("LDAP_URL"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("LDAP_URL must be ldap://host[:port] or ldaps://host[:port]")
+	}
+
+	a := &ldapAuthenticator{
+		rs:          rs,
+		serverName:  u.Hostname(),
+		userDN:      os.Getenv("LDAP_USER_DN"),
+		defaultRole: os.Getenv("LDAP_DEFAULT_ROLE"),
+	}
+	switch u.Scheme {
+	case "ldap":
+		a.address = hostWithDefaultPort(u, "389")
+		rs.logger.Info("LDAP_URL uses ldap://, passwords are sent to %s unencrypted", a.address)
+	case "ldaps":
+		a.address = hostWithDefaultPort(u, "636")
+		a.useTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported LDAP_URL scheme %q", u.Scheme)
+	}
+	if strings.Count(a.userDN, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP_USER_DN must contain one %%s for the username")
+	}
+	if a.defaultRole == "" {
+		a.defaultRole = "user"
+	}
+	return a, nil
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (a *ldapAuthenticator) Name() string { return "ldap" }
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*AuthUser, error) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	if a.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", a.address, &tls.Config{ServerName: a.serverName})
+	} else {
+		conn, err = dialer.Dial("tcp", a.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", a.address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	dn := strings.Replace(a.userDN, "%s", ldapEscapeDN(username), 1)
+	code, message, err := ldapBind(conn, dn, password)
+	if err != nil {
+		return nil, err
+	}
+	conn.Write(ldapUnbindRequest)
+
+	switch code {
+	case ldapSuccess:
+		return &AuthUser{Username: username, Role: a.rs.linkedRole(username, a.Name(), a.defaultRole), Backend: a.Name()}, nil
+	case ldapInvalidCredentials:
+		return nil, errInvalidCredentials
+	case ldapNoSuchObject:
+		return nil, errUnknownUser
+	default:
+		return nil, fmt.Errorf("bind failed with result %d: %s", code, message)
+	}
+}
+
+// ldapEscapeDN escapes an attribute value for use in a DN (RFC 4514)
+func ldapEscapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapUnbindRequest is message 2, an UnbindRequest
+var ldapUnbindRequest = []byte{0x30, 0x05, 0x02, 0x01, 0x02, 0x42, 0x00}
+
+// ldapBind sends a simple BindRequest as message 1 and returns the result
+// code and diagnostic message of the BindResponse
+func ldapBind(conn io.ReadWriter, dn, password string) (int, string, error) {
+	bind := berTLV(0x02, []byte{3}) // version
+	bind = append(bind, berTLV(0x04, []byte(dn))...)
+	bind = append(bind, berTLV(0x80, []byte(password))...) // [0] simple
+
+	message := berTLV(0x02, []byte{1}) // messageID
+	message = append(message, berTLV(0x60, bind)...)
+	if _, err := conn.Write(berTLV(0x30, message)); err != nil {
+		return 0, "", fmt.Errorf("send bind request: %w", err)
+	}
+
+	tag, body, err := berRead(conn)
+	if err != nil {
+		return 0, "", fmt.Errorf("read bind response: %w", err)
+	}
+	if tag != 0x30 {
+		return 0, "", fmt.Errorf("malformed bind response")
+	}
+	fields, err := berElements(body)
+	if err != nil || len(fields) < 2 || fields[1].tag != 0x61 {
+		return 0, "", fmt.Errorf("malformed bind response")
+	}
+	result, err := berElements(fields[1].value)
+	if err != nil || len(result) < 3 || result[0].tag != 0x0a {
+		return 0, "", fmt.Errorf("malformed bind response")
+	}
+
+	code := 0
+	for _, b := range result[0].value {
+		code = code<<8 | int(b)
+	}
+	return code, string(result[2].value), nil
+}
+
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// berTLV encodes one element with a definite length
+func berTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+// berRead reads one element from the connection
+func berRead(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, fmt.Errorf("unsupported BER length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+		if length > 1<<20 {
+			return 0, nil, fmt.Errorf("BER element too large")
+		}
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return header[0], value, nil
+}
+
+// berElements splits the contents of a constructed element
+func berElements(data []byte) ([]berElement, error) {
+	var elements []berElement
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		tag, value, err := berRead(r)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, berElement{tag, value})
+	}
+	return elements, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLDAPEscapeDN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "alice"},
+		{"smith, john", `smith\, john`},
+		{"a+b=c", `a\+b\=c`},
+		{`"quoted"`, `\"quoted\"`},
+		{`back\slash`, `back\\slash`},
+		{"<admin>;", `\<admin\>\;`},
+		{"#hash", `\#hash`},
+		{"mid#hash", "mid#hash"},
+		{" padded ", `\ padded\ `},
+		{"in side", "in side"},
+		{"nul\x00byte", `nul\00byte`},
+		{"admin,ou=admins", `admin\,ou\=admins`},
+	}
+
+	for _, tt := range tests {
+		if got := ldapEscapeDN(tt.value); got != tt.want {
+			t.Errorf("ldapEscapeDN(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBERRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		value := bytes.Repeat([]byte{0xab}, n)
+		tag, got, err := berRead(bytes.NewReader(berTLV(0x04, value)))
+		if err != nil || tag != 0x04 || !bytes.Equal(got, value) {
+			t.Errorf("length %d: tag %#x, %d bytes, %v", n, tag, len(got), err)
+		}
+	}
+
+	elements, err := berElements(append(berTLV(0x02, []byte{7}), berTLV(0x04, []byte("dn"))...))
+	if err != nil || len(elements) != 2 || elements[0].tag != 0x02 || string(elements[1].value) != "dn" {
+		t.Errorf("berElements = %v, %v", elements, err)
+	}
+}
+
+func TestBERReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Truncated header", []byte{0x30}},
+		{"Indefinite length", []byte{0x30, 0x80, 0x00, 0x00}},
+		{"Length of length too long", []byte{0x30, 0x85, 1, 0, 0, 0, 0}},
+		{"Too large", []byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}},
+		{"Truncated length", []byte{0x30, 0x82, 0x01}},
+		{"Truncated value", []byte{0x04, 0x05, 'a', 'b'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := berRead(bytes.NewReader(tt.data)); err == nil {
+				t.Error("berRead accepted malformed input")
+			}
+		})
+	}
+
+	if _, err := berElements([]byte{0x02, 0x01, 0x01, 0x04, 0x03, 'a'}); err == nil {
+		t.Error("berElements accepted a truncated element")
+	}
+}
+
+// bindResponse encodes a BindResponse to message 1
+func bindResponse(code byte, message string) []byte {
+	result := berTLV(0x0a, []byte{code})
+	result = append(result, berTLV(0x04, nil)...)
+	result = append(result, berTLV(0x04, []byte(message))...)
+	return berTLV(0x30, append(berTLV(0x02, []byte{1}), berTLV(0x61, result)...))
+}
+
+// fakeDirectory is an LDAP server that answers simple binds from a table
+// of DNs and passwords
+type fakeDirectory struct {
+	listener  net.Listener
+	passwords map[string]string
+
+	mu    sync.Mutex
+	binds []string // DNs bound to, in order
+}
+
+func startFakeDirectory(t *testing.T, passwords map[string]string) *fakeDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{listener: listener, passwords: passwords}
+	t.Cleanup(func() { listener.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.Write(d.answer(conn))
+		}()
+	}
+}
+
+func (d *fakeDirectory) answer(conn net.Conn) []byte {
+	tag, body, err := berRead(conn)
+	if err != nil || tag != 0x30 {
+		return nil
+	}
+	message, err := berElements(body)
+	if err != nil || len(message) != 2 || message[1].tag != 0x60 {
+		return bindResponse(2, "protocol error")
+	}
+	bind, err := berElements(message[1].value)
+	if err != nil || len(bind) != 3 || bind[2].tag != 0x80 {
+		return bindResponse(2, "protocol error")
+	}
+
+	dn, password := string(bind[1].value), string(bind[2].value)
+	d.mu.Lock()
+	d.binds = append(d.binds, dn)
+	d.mu.Unlock()
+
+	stored, ok := d.passwords[dn]
+	switch {
+	case !ok:
+		return bindResponse(ldapNoSuchObject, "no such object")
+	case stored != password:
+		return bindResponse(ldapInvalidCredentials, "invalid credentials")
+	default:
+		return bindResponse(ldapSuccess, "")
+	}
+}
+
+func (d *fakeDirectory) bound() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func TestLDAPBindResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		code     int
+		message  string
+		ok       bool
+	}{
+		{"Success", bindResponse(0, ""), 0, "", true},
+		{"Invalid credentials", bindResponse(49, "bad password"), 49, "bad password", true},
+		{"Not a sequence", berTLV(0x31, nil), 0, "", false},
+		{"Not a bind response", berTLV(0x30, append(berTLV(0x02, []byte{1}), berTLV(0x65, nil)...)), 0, "", false},
+		{"Short result", berTLV(0x30, append(berTLV(0x02, []byte{1}), berTLV(0x61, berTLV(0x0a, []byte{0}))...)), 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(tt.response), &sent}
+
+			code, message, err := ldapBind(conn, "uid=alice", "secret")
+			if (err == nil) != tt.ok {
+				t.Fatalf("ldapBind error %v", err)
+			}
+			if code != tt.code || message != tt.message {
+				t.Errorf("ldapBind = %d %q, want %d %q", code, message, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	directory := startFakeDirectory(t, map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com": "directory",
+		"uid=admin,ou=people,dc=example,dc=com": "directory",
+	})
+	const roleQuery = "SELECT role FROM users WHERE username = ? AND auth_source = ?"
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		role     string // linked users row, empty for none
+		err      error
+		want     string
+	}{
+		{"Default role", "alice", "directory", "", nil, "user"},
+		{"Linked row", "alice", "directory", "admin", nil, "admin"},
+		// A local admin account of the same name is not linked, so its role
+		// is not inherited
+		{"Local account of the same name", "admin", "directory", "", nil, "user"},
+		{"Wrong password", "alice", "guess", "", errInvalidCredentials, ""},
+		{"Unknown user", "bob", "directory", "", errUnknownUser, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testRelay(t)
+			if tt.err == nil {
+				query := mock.ExpectQuery(roleQuery).WithArgs(tt.username, "ldap")
+				if tt.role != "" {
+					query.WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(tt.role))
+				} else {
+					query.WillReturnError(sql.ErrNoRows)
+				}
+			}
+			a := &ldapAuthenticator{
+				rs:          rs,
+				address:     directory.listener.Addr().String(),
+				userDN:      "uid=%s,ou=people,dc=example,dc=com",
+				defaultRole: "user",
+			}
+
+			user, err := a.Authenticate(tt.username, tt.password)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && (user.Role != tt.want || user.Backend != "ldap") {
+				t.Errorf("got %+v, want role %s", user, tt.want)
+			}
+		})
+	}
+
+	if _, err := (&ldapAuthenticator{}).Authenticate("alice", ""); err != errInvalidCredentials {
+		t.Errorf("empty password: err = %v", err)
+	}
+}
+
+// A wrong password for a local account must not be retried as a directory
+// bind of the same name
+func TestLDAPAfterLocalRejection(t *testing.T) {
+	directory := startFakeDirectory(t, map[string]string{"uid=admin,dc=example,dc=com": "directory"})
+	rs, mock := testRelay(t)
+	hash, _ := hashPassword("local")
+	mock.ExpectQuery("SELECT password, role, auth_source FROM users WHERE username = ?").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"password", "role", "auth_source"}).AddRow(hash, "admin", "local"))
+
+	rs.authenticators = []Authenticator{
+		&localAuthenticator{rs: rs},
+		&ldapAuthenticator{rs: rs, address: directory.listener.Addr().String(), userDN: "uid=%s,dc=example,dc=com", defaultRole: "user"},
+	}
+	if _, err := rs.authenticate("admin", "directory"); err != errInvalidCredentials {
+		t.Errorf("err = %v, want %v", err, errInvalidCredentials)
+	}
+	if binds := directory.bound(); len(binds) != 0 {
+		t.Errorf("directory asked to bind %s", strings.Join(binds, ", "))
+	}
+}
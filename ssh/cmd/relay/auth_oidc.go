@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcProvider talks to an OpenID Connect issuer: discovery, the token
+// endpoint and ID token verification against the issuer's JWKS
+type oidcProvider struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	scopes        string
+	usernameClaim string
+	httpClient    *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// newOIDCProvider reads OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET,
+// OIDC_SCOPES and OIDC_USERNAME_CLAIM (default preferred_username)
+func newOIDCProvider() (*oidcProvider, error) {
+	p := &oidcProvider{
+		issuer:        strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		clientID:      os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		scopes:        os.Getenv("OIDC_SCOPES"),
+		usernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.issuer == "" || p.clientID == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER and OIDC_CLIENT_ID are required")
+	}
+	if p.scopes == "" {
+		p.scopes = "openid profile email"
+	}
+	if p.usernameClaim == "" {
+		p.usernameClaim = "preferred_username"
+	}
+	return p, nil
+}
+
+// discover fetches and caches the issuer's openid-configuration
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", d.Issuer, p.issuer)
+	}
+	if d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: missing token_endpoint or jwks_uri")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) getJSON(rawURL string, v interface{}) error {
+	resp, err := p.httpClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// exchange posts a grant to the token endpoint; errors reported by the
+// issuer come back in the response's Error field
+func (p *oidcProvider) exchange(form url.Values) (*oidcTokenResponse, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var token oidcTokenResponse
+	if err := p.postForm(d.TokenEndpoint, form, &token); err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	return &token, nil
+}
+
+// postForm sends a client-authenticated form and decodes the JSON reply;
+// setStatus records the HTTP status when the issuer fails without an OAuth
+// error code
+func (p *oidcProvider) postForm(endpoint string, form url.Values, v interface{ setStatus(string) }) error {
+	form.Set("client_id", p.clientID)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	resp, err := p.httpClient.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		v.setStatus(resp.Status)
+	}
+	return nil
+}
+
+func (t *oidcTokenResponse) setStatus(status string) {
+	if t.Error == "" {
+		t.Error = status
+	}
+}
+
+// verifyIDToken checks an RS256 ID token's signature, issuer, audience and
+// expiry and returns its claims
+func (p *oidcProvider) verifyIDToken(raw string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id_token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id_token algorithm %q", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id_token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("id_token signature: %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("id_token issued by %q", iss)
+	}
+	if !audienceContains(claims["aud"], p.clientID) {
+		return nil, fmt.Errorf("id_token not issued for %s", p.clientID)
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Unix() >= int64(exp) {
+		return nil, fmt.Errorf("id_token expired")
+	}
+	return claims, nil
+}
+
+// username returns the configured username claim of verified claims
+func (p *oidcProvider) username(claims map[string]interface{}) (string, error) {
+	username, _ := claims[p.usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("id_token has no %s claim", p.usernameClaim)
+	}
+	return username, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed id_token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed id_token")
+	}
+	return nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given ID, refetching the JWKS for
+// unknown IDs (at most once a minute) so key rotation is picked up
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	recent := time.Since(p.keysFetched) < time.Minute
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if recent {
+		return nil, fmt.Errorf("no signing key %q in jwks", kid)
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key %q in jwks", kid)
+}
+
+// oidcAuthenticator checks passwords with the issuer's resource owner
+// password grant, for clients that cannot use the SSO redirect
+type oidcAuthenticator struct {
+	sso *oidcSSO
+}
+
+func newOIDCAuthenticator(rs *RelayServer) (*oidcAuthenticator, error) {
+	if rs.sso == nil {
+		return nil, fmt.Errorf("OIDC_ISSUER is not set")
+	}
+	return &oidcAuthenticator{sso: rs.sso}, nil
+}
+
+func (a *oidcAuthenticator) Name() string { return "oidc" }
+
+func (a *oidcAuthenticator) Authenticate(username, password string) (*AuthUser, error) {
+	provider := a.sso.provider
+	token, err := provider.exchange(url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+		"scope":      {provider.scopes},
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch token.Error {
+	case "":
+	case "invalid_grant":
+		return nil, errInvalidCredentials
+	default:
+		return nil, fmt.Errorf("token request refused: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	claims, err := provider.verifyIDToken(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	name, err := provider.username(claims)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(name, username) {
+		return nil, fmt.Errorf("id_token is for %s, not %s", name, username)
+	}
+	return a.sso.provision(claims)
+}
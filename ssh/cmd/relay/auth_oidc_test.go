@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://sso.example.com/realms/main"
+	testClientID = "tunnel-relay"
+)
+
+var testSigningKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// signJWT encodes header and claims and signs them with key using RS256,
+// whatever alg the header names
+func signJWT(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// idTokenClaims returns valid claims for alice, changed by the given
+// overrides; a nil override removes the claim
+func idTokenClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":                testIssuer,
+		"aud":                testClientID,
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	// The key is already cached, so no JWKS request is made
+	p := &oidcProvider{
+		issuer:        testIssuer,
+		clientID:      testClientID,
+		usernameClaim: "preferred_username",
+		keys:          map[string]*rsa.PublicKey{"key-1": &testSigningKey.PublicKey},
+		keysFetched:   time.Now(),
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "key-1"}
+
+	valid := signJWT(t, testSigningKey, rs256, idTokenClaims(nil))
+	claims, err := p.verifyIDToken(valid)
+	if err != nil {
+		t.Fatalf("verifyIDToken: %v", err)
+	}
+	if name, err := p.username(claims); err != nil || name != "alice" {
+		t.Errorf("username = %q, %v", name, err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"Audience list", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"aud": []string{"other", testClientID}})), true},
+		{"Issuer with trailing slash", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"iss": testIssuer + "/"})), true},
+		{"HS256", signJWT(t, testSigningKey, map[string]interface{}{"alg": "HS256", "kid": "key-1"}, idTokenClaims(nil)), false},
+		{"Alg none", signJWT(t, testSigningKey, map[string]interface{}{"alg": "none", "kid": "key-1"}, idTokenClaims(nil)), false},
+		{"Other signing key", signJWT(t, otherKey, rs256, idTokenClaims(nil)), false},
+		{"Unknown key ID", signJWT(t, testSigningKey, map[string]interface{}{"alg": "RS256", "kid": "key-2"}, idTokenClaims(nil)), false},
+		{"Wrong issuer", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"No issuer", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"iss": nil})), false},
+		{"Wrong audience", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"aud": "other-client"})), false},
+		{"Audience list without client", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"aud": []string{"other"}})), false},
+		{"Expired", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+		{"No expiry", signJWT(t, testSigningKey, rs256, idTokenClaims(map[string]interface{}{"exp": nil})), false},
+		{"Tampered claims", valid[:len(valid)/2] + "x" + valid[len(valid)/2+1:], false},
+		{"Two parts", "header.claims", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.verifyIDToken(tt.token)
+			if (err == nil) != tt.ok {
+				t.Errorf("verifyIDToken error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
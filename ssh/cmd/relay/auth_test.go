@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+	"ssh-tunnel/internal/common"
+)
+
+// containsQuery matches statements that contain the expected SQL, ignoring
+// differences in whitespace
+var containsQuery = sqlmock.QueryMatcherFunc(func(expected, actual string) error {
+	if !strings.Contains(strings.Join(strings.Fields(actual), " "), strings.Join(strings.Fields(expected), " ")) {
+		return fmt.Errorf("query %q does not contain %q", actual, expected)
+	}
+	return nil
+})
+
+// mockDB returns a mock database that is closed when the test ends
+func mockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(containsQuery))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+// testRelay returns a relay backed by a mock database whose expectations
+// must all be met by the end of the test
+func testRelay(t *testing.T) (*RelayServer, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock := mockDB(t)
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return &RelayServer{db: db, logger: &common.Logger{}}, mock
+}
+
+func TestCheckPassword(t *testing.T) {
+	current, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		match    bool
+		rehash   bool
+	}{
+		{"Hash", current, "secret", true, false},
+		{"Hash, wrong password", current, "guess", false, false},
+		{"Low cost hash", string(weak), "secret", true, true},
+		{"Low cost hash, wrong password", string(weak), "guess", false, false},
+		{"Plaintext", "secret", "secret", true, true},
+		{"Plaintext, wrong password", "secret", "guess", false, false},
+		{"Plaintext, prefix", "secret", "secre", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash := checkPassword(tt.stored, tt.password)
+			if match != tt.match || rehash != tt.rehash {
+				t.Errorf("checkPassword = %v, %v, want %v, %v", match, rehash, tt.match, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestLocalAuthenticator(t *testing.T) {
+	const query = "SELECT password, role, auth_source FROM users WHERE username = ?"
+	row := func(password, source string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"password", "role", "auth_source"}).AddRow(password, "admin", source)
+	}
+
+	t.Run("Plaintext is migrated", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		mock.ExpectQuery(query).WithArgs("alice").WillReturnRows(row("secret", "local"))
+		mock.ExpectExec("UPDATE users SET password = ? WHERE username = ? AND password = ?").
+			WithArgs(sqlmock.AnyArg(), "alice", "secret").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		user, err := (&localAuthenticator{rs: rs}).Authenticate("alice", "secret")
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if user.Role != "admin" || user.Backend != "local" {
+			t.Errorf("got %+v", user)
+		}
+	})
+
+	t.Run("Wrong plaintext password", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		mock.ExpectQuery(query).WithArgs("alice").WillReturnRows(row("secret", "local"))
+
+		if _, err := (&localAuthenticator{rs: rs}).Authenticate("alice", "guess"); err != errInvalidCredentials {
+			t.Errorf("err = %v, want %v", err, errInvalidCredentials)
+		}
+	})
+
+	t.Run("Current hash is kept", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		hash, _ := hashPassword("secret")
+		mock.ExpectQuery(query).WithArgs("alice").WillReturnRows(row(hash, ""))
+
+		if _, err := (&localAuthenticator{rs: rs}).Authenticate("alice", "secret"); err != nil {
+			t.Errorf("Authenticate: %v", err)
+		}
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		mock.ExpectQuery(query).WithArgs("bob").WillReturnError(sql.ErrNoRows)
+
+		if _, err := (&localAuthenticator{rs: rs}).Authenticate("bob", "secret"); err != errUnknownUser {
+			t.Errorf("err = %v, want %v", err, errUnknownUser)
+		}
+	})
+
+	t.Run("Row of another backend", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		mock.ExpectQuery(query).WithArgs("carol").WillReturnRows(row("secret", "ldap"))
+
+		if _, err := (&localAuthenticator{rs: rs}).Authenticate("carol", "secret"); err != errUnknownUser {
+			t.Errorf("err = %v, want %v", err, errUnknownUser)
+		}
+	})
+}
+
+// stubAuthenticator knows a fixed set of passwords and records its calls
+type stubAuthenticator struct {
+	name      string
+	passwords map[string]string
+	err       error
+	calls     int
+}
+
+func (a *stubAuthenticator) Name() string { return a.name }
+
+func (a *stubAuthenticator) Authenticate(username, password string) (*AuthUser, error) {
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	stored, ok := a.passwords[username]
+	if !ok {
+		return nil, errUnknownUser
+	}
+	if stored != password {
+		return nil, errInvalidCredentials
+	}
+	return &AuthUser{Username: username, Role: "user", Backend: a.name}, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		first    *stubAuthenticator
+		backend  string // backend that accepts, empty for a rejected login
+		tried    int    // backends called
+	}{
+		{"First backend", "alice", "secret", &stubAuthenticator{passwords: map[string]string{"alice": "secret"}}, "first", 1},
+		{"Unknown user falls through", "bob", "directory", &stubAuthenticator{}, "second", 2},
+		{"Backend failure falls through", "bob", "directory", &stubAuthenticator{err: errors.New("connection refused")}, "second", 2},
+		{"Wrong password stops", "bob", "directory", &stubAuthenticator{passwords: map[string]string{"bob": "local"}}, "", 1},
+		{"Unknown everywhere", "mallory", "secret", &stubAuthenticator{}, "", 2},
+		{"Empty password", "bob", "", &stubAuthenticator{}, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := tt.first
+			first.name = "first"
+			second := &stubAuthenticator{name: "second", passwords: map[string]string{"bob": "directory"}}
+			rs := &RelayServer{logger: &common.Logger{}, authenticators: []Authenticator{first, second}}
+
+			user, err := rs.authenticate(tt.username, tt.password)
+			if tt.backend == "" {
+				if err != errInvalidCredentials {
+					t.Errorf("err = %v, want %v", err, errInvalidCredentials)
+				}
+			} else if err != nil || user.Backend != tt.backend {
+				t.Errorf("got %+v, %v, want a login through %s", user, err, tt.backend)
+			}
+			if tried := first.calls + second.calls; tried != tt.tried {
+				t.Errorf("%d backends tried, want %d", tried, tt.tried)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"ssh-tunnel/internal/common"
+)
+
+const (
+	maxLogBatchSize = 4 << 20
+	maxLogStreamLen = 32
+
+	// At most one bad_signature event is stored per source and interval;
+	// the rest only go to the relay log
+	badSignatureEventInterval = time.Minute
+)
+
+// Integrity of an ingested log entry, shown in the dashboard
+const (
+	logIntegrityOK  = "ok"
+	logIntegrityGap = "gap" // entries before this one never arrived
+)
+
+// Kinds of log_integrity_events
+const (
+	logEventGap          = "gap"
+	logEventReplay       = "replay"
+	logEventBadSignature = "bad_signature"
+)
+
+// badSignatureEvent is the last stored bad_signature event of a source
+type badSignatureEvent struct {
+	recorded   time.Time
+	suppressed int // forged batches since then that were only logged
+}
+
+// logOrigin tells which authenticated source sent a log entry and how its
+// sequence number checked out; entries logged by the relay itself have none
+type logOrigin struct {
+	Source    string
+	Seq       uint64
+	Integrity string
+}
+
+// columns returns the log_source, seq and integrity column values
+func (o *logOrigin) columns() (interface{}, interface{}, interface{}) {
+	if o == nil {
+		return nil, nil, nil
+	}
+	return o.Source, o.Seq, o.Integrity
+}
+
+// logSourceToken returns the token an agent or client registered with,
+// which keys its log batches
+func (rs *RelayServer) logSourceToken(source, sourceID string) (string, error) {
+	var token sql.NullString
+	switch source {
+	case common.LogSourceAgent:
+		if err := rs.db.QueryRow("SELECT token FROM agents WHERE agent_id = ?", sourceID).Scan(&token); err != nil {
+			return "", err
+		}
+	case common.LogSourceClient:
+		rs.mutex.RLock()
+		client, connected := rs.clients[sourceID]
+		rs.mutex.RUnlock()
+		if connected && client.Token != "" {
+			return client.Token, nil
+		}
+		if err := rs.db.QueryRow("SELECT token FROM clients WHERE client_id = ?", sourceID).Scan(&token); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown log source %q", source)
+	}
+	if !token.Valid || token.String == "" {
+		return "", fmt.Errorf("%s %s has no token", source, sourceID)
+	}
+	return token.String, nil
+}
+
+// readLogBatch reads a posted log batch and checks its signature. On
+// failure it writes the error response and returns nil.
+func (rs *RelayServer) readLogBatch(w http.ResponseWriter, r *http.Request) *common.LogBatch {
+	if rs.db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLogBatchSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return nil
+	}
+	if len(body) > maxLogBatchSize {
+		http.Error(w, "Log batch too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	var batch common.LogBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return nil
+	}
+	if batch.SourceID == "" || batch.Stream == "" || len(batch.Stream) > maxLogStreamLen {
+		http.Error(w, "Missing required fields: source, source_id, stream", http.StatusBadRequest)
+		return nil
+	}
+
+	token, err := rs.logSourceToken(batch.Source, batch.SourceID)
+	if err != nil {
+		rs.logger.Error("Rejected log batch from %s %s: %v", batch.Source, batch.SourceID, err)
+		http.Error(w, "Unknown log source", http.StatusUnauthorized)
+		return nil
+	}
+	key := common.LogSigningKey(token, batch.Source, batch.SourceID)
+	if !common.VerifyLogBatch(key, body, r.Header.Get(common.LogSignatureHeader)) {
+		rs.logger.Error("Rejected log batch from %s %s: bad signature from %s", batch.Source, batch.SourceID, r.RemoteAddr)
+		rs.recordBadSignature(&batch, r.RemoteAddr)
+		http.Error(w, "Invalid log signature", http.StatusUnauthorized)
+		return nil
+	}
+	return &batch
+}
+
+// sequenceLogEntries checks the entries' sequence numbers against the
+// last one seen on the batch's stream and returns an origin per entry.
+// Replayed entries get a nil origin and must be dropped.
+func (rs *RelayServer) sequenceLogEntries(batch *common.LogBatch, seqs []uint64) ([]*logOrigin, error) {
+	for i, seq := range seqs {
+		if seq == 0 {
+			return nil, fmt.Errorf("entry %d has no seq", i)
+		}
+	}
+
+	rs.logStreamMutex.Lock()
+	defer rs.logStreamMutex.Unlock()
+
+	var last uint64
+	err := rs.db.QueryRow("SELECT last_seq FROM log_streams WHERE source = ? AND source_id = ? AND stream = ?",
+		batch.Source, batch.SourceID, batch.Stream).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query log stream: %w", err)
+	}
+
+	source := batch.Source + ":" + batch.SourceID
+	origins := make([]*logOrigin, len(seqs))
+	for i, seq := range seqs {
+		switch {
+		case seq <= last:
+			rs.recordLogIntegrity(batch, logEventReplay, last+1, seq, "")
+		case seq > last+1:
+			rs.recordLogIntegrity(batch, logEventGap, last+1, seq, fmt.Sprintf("%d entries missing", seq-last-1))
+			origins[i] = &logOrigin{Source: source, Seq: seq, Integrity: logIntegrityGap}
+			last = seq
+		default:
+			origins[i] = &logOrigin{Source: source, Seq: seq, Integrity: logIntegrityOK}
+			last = seq
+		}
+	}
+
+	_, err = rs.db.Exec(`
+		INSERT INTO log_streams (source, source_id, stream, last_seq, updated_at) VALUES (?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE last_seq = GREATEST(last_seq, VALUES(last_seq)), updated_at = NOW()`,
+		batch.Source, batch.SourceID, batch.Stream, last)
+	if err != nil {
+		return nil, fmt.Errorf("update log stream: %w", err)
+	}
+	return origins, nil
+}
+
+// recordLogIntegrity stores a gap, replay or forged batch for the dashboard
+func (rs *RelayServer) recordLogIntegrity(batch *common.LogBatch, kind string, expected, received uint64, details string) {
+	rs.logger.Error("Log integrity: %s from %s %s stream %s (expected seq %d, got %d) %s",
+		kind, batch.Source, batch.SourceID, batch.Stream, expected, received, details)
+
+	_, err := rs.db.Exec(`
+		INSERT INTO log_integrity_events (source, source_id, stream, kind, expected_seq, received_seq, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rs.cleanString(batch.Source), rs.cleanString(batch.SourceID), rs.cleanString(batch.Stream),
+		kind, expected, received, details)
+	if err != nil {
+		rs.logger.Error("Failed to record log integrity event: %v", err)
+	}
+}
+
+// recordBadSignature stores a forged batch as a bad_signature event unless
+// one was stored for the same source within badSignatureEventInterval.
+// The batch's source is known to exist, which bounds the map.
+func (rs *RelayServer) recordBadSignature(batch *common.LogBatch, remoteAddr string) {
+	key := batch.Source + ":" + batch.SourceID
+	now := time.Now()
+
+	rs.badSignatureMutex.Lock()
+	if rs.badSignatures == nil {
+		rs.badSignatures = make(map[string]*badSignatureEvent)
+	}
+	last := rs.badSignatures[key]
+	if last != nil && now.Sub(last.recorded) < badSignatureEventInterval {
+		last.suppressed++
+		rs.badSignatureMutex.Unlock()
+		return
+	}
+	rs.badSignatures[key] = &badSignatureEvent{recorded: now}
+	rs.badSignatureMutex.Unlock()
+
+	details := "from " + remoteAddr
+	if last != nil && last.suppressed > 0 {
+		details += fmt.Sprintf(", %d more since the last event", last.suppressed)
+	}
+	rs.recordLogIntegrity(batch, logEventBadSignature, 0, 0, details)
+}
+
+// handleAPILogIntegrity lists the latest log gaps, replays and forged
+// batches
+func (rs *RelayServer) handleAPILogIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rs.db == nil {
+		http.Error(w, "Database not connected", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := rs.db.Query(`
+		SELECT id, source, source_id, stream, kind, expected_seq, received_seq, details, timestamp
+		FROM log_integrity_events ORDER BY id DESC LIMIT 100`)
+	if err != nil {
+		rs.logger.Error("Failed to query log integrity events: %v", err)
+		http.Error(w, "Failed to retrieve log integrity events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []map[string]interface{}{}
+	for rows.Next() {
+		var id int
+		var source, sourceID, stream, kind string
+		var expected, received uint64
+		var details sql.NullString
+		var timestamp time.Time
+		if err := rows.Scan(&id, &source, &sourceID, &stream, &kind, &expected, &received, &details, &timestamp); err != nil {
+			continue
+		}
+		events = append(events, map[string]interface{}{
+			"id":           id,
+			"source":       source,
+			"source_id":    sourceID,
+			"stream":       stream,
+			"kind":         kind,
+			"expected_seq": expected,
+			"received_seq": received,
+			"details":      details.String,
+			"timestamp":    timestamp,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
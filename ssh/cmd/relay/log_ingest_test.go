@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"ssh-tunnel/internal/common"
+)
+
+// logBatchRequest posts batch signed with key
+func logBatchRequest(t *testing.T, batch common.LogBatch, key []byte) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/log-ssh", bytes.NewReader(body))
+	r.Header.Set(common.LogSignatureHeader, common.SignLogBatch(key, body))
+	return r
+}
+
+// agentKey is the batch key of an agent registered with token
+func agentKey(token, agentID string) []byte {
+	return common.LogSigningKey(token, common.LogSourceAgent, agentID)
+}
+
+func testLogBatch(sourceID string) common.LogBatch {
+	return common.LogBatch{Source: common.LogSourceAgent, SourceID: sourceID, Stream: "stream-1", Entries: json.RawMessage(`[]`)}
+}
+
+func expectAgentToken(mock sqlmock.Sqlmock, agentID string) {
+	mock.ExpectQuery("SELECT token FROM agents WHERE agent_id = ?").WithArgs(agentID).
+		WillReturnRows(sqlmock.NewRows([]string{"token"}).AddRow("agent-token"))
+}
+
+func TestReadLogBatch(t *testing.T) {
+	rs, mock := testRelay(t)
+	expectAgentToken(mock, "agent-1")
+
+	w := httptest.NewRecorder()
+	batch := rs.readLogBatch(w, logBatchRequest(t, testLogBatch("agent-1"), agentKey("agent-token", "agent-1")))
+	if batch == nil {
+		t.Fatalf("valid batch refused: %d %s", w.Code, w.Body)
+	}
+	if batch.SourceID != "agent-1" || batch.Stream != "stream-1" {
+		t.Errorf("batch %+v", batch)
+	}
+}
+
+func TestReadLogBatchRejected(t *testing.T) {
+	tooLarge := testLogBatch("agent-1")
+	tooLarge.Entries = json.RawMessage(`["` + strings.Repeat("x", maxLogBatchSize) + `"]`)
+	noStream := testLogBatch("agent-1")
+	noStream.Stream = ""
+	longStream := testLogBatch("agent-1")
+	longStream.Stream = strings.Repeat("s", maxLogStreamLen+1)
+	otherSource := testLogBatch("agent-1")
+	otherSource.Source = "robot"
+
+	tests := []struct {
+		name   string
+		req    func(t *testing.T) *http.Request
+		expect func(mock sqlmock.Sqlmock)
+		status int
+	}{
+		{
+			name: "Invalid JSON",
+			req: func(t *testing.T) *http.Request {
+				return httptest.NewRequest("POST", "/api/log-ssh", strings.NewReader("{"))
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "Too large",
+			req: func(t *testing.T) *http.Request {
+				return logBatchRequest(t, tooLarge, agentKey("agent-token", "agent-1"))
+			},
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "No stream",
+			req: func(t *testing.T) *http.Request {
+				return logBatchRequest(t, noStream, agentKey("agent-token", "agent-1"))
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "Stream too long",
+			req: func(t *testing.T) *http.Request {
+				return logBatchRequest(t, longStream, agentKey("agent-token", "agent-1"))
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "Unknown source kind",
+			req: func(t *testing.T) *http.Request {
+				return logBatchRequest(t, otherSource, agentKey("agent-token", "agent-1"))
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			// No integrity event for sources that do not exist
+			name: "Unknown agent",
+			req: func(t *testing.T) *http.Request {
+				return logBatchRequest(t, testLogBatch("agent-9"), agentKey("agent-token", "agent-9"))
+			},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT token FROM agents WHERE agent_id = ?").WithArgs("agent-9").WillReturnError(sql.ErrNoRows)
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testRelay(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			w := httptest.NewRecorder()
+			if batch := rs.readLogBatch(w, tt.req(t)); batch != nil {
+				t.Fatalf("batch accepted: %+v", batch)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadLogBatchBadSignature(t *testing.T) {
+	rs, mock := testRelay(t)
+	forged := func(t *testing.T, sourceID string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if batch := rs.readLogBatch(w, logBatchRequest(t, testLogBatch(sourceID), agentKey("guessed-token", sourceID))); batch != nil {
+			t.Fatalf("forged batch accepted: %+v", batch)
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", w.Code)
+		}
+	}
+	expectEvent := func(sourceID string, details *driver.Value) {
+		mock.ExpectExec("INSERT INTO log_integrity_events").
+			WithArgs("agent", sourceID, "stream-1", logEventBadSignature, 0, 0, captureArg{details}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	// The first forged batch of a source is stored
+	var first driver.Value
+	expectAgentToken(mock, "agent-1")
+	expectEvent("agent-1", &first)
+	forged(t, "agent-1")
+	if first != "from 192.0.2.1:1234" {
+		t.Errorf("details %q", first)
+	}
+
+	// Within the interval further ones are only logged
+	for i := 0; i < 3; i++ {
+		expectAgentToken(mock, "agent-1")
+		forged(t, "agent-1")
+	}
+
+	// A batch signed by agent-1 cannot pass for agent-2, which gets its
+	// own event
+	var other driver.Value
+	expectAgentToken(mock, "agent-2")
+	expectEvent("agent-2", &other)
+	w := httptest.NewRecorder()
+	if rs.readLogBatch(w, logBatchRequest(t, testLogBatch("agent-2"), agentKey("agent-token", "agent-1"))) != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("batch for agent-2 signed with agent-1's key: status %d", w.Code)
+	}
+
+	// Once the interval has passed the next event counts the suppressed ones
+	rs.badSignatures["agent:agent-1"].recorded = time.Now().Add(-badSignatureEventInterval)
+	var next driver.Value
+	expectAgentToken(mock, "agent-1")
+	expectEvent("agent-1", &next)
+	forged(t, "agent-1")
+	if next != "from 192.0.2.1:1234, 3 more since the last event" {
+		t.Errorf("details %q", next)
+	}
+}
+
+// logEvent is an expected log_integrity_events row
+type logEvent struct {
+	kind               string
+	expected, received uint64
+	details            string
+}
+
+func TestSequenceLogEntries(t *testing.T) {
+	tests := []struct {
+		name   string
+		last   uint64 // 0 for a new stream
+		seqs   []uint64
+		want   []string // integrity per entry, "" for a dropped replay
+		events []logEvent
+		stored uint64
+	}{
+		{
+			name:   "New stream in order",
+			seqs:   []uint64{1, 2, 3},
+			want:   []string{logIntegrityOK, logIntegrityOK, logIntegrityOK},
+			stored: 3,
+		},
+		{
+			name:   "Continues stream",
+			last:   5,
+			seqs:   []uint64{6, 7},
+			want:   []string{logIntegrityOK, logIntegrityOK},
+			stored: 7,
+		},
+		{
+			name:   "Gap",
+			last:   5,
+			seqs:   []uint64{8, 9},
+			want:   []string{logIntegrityGap, logIntegrityOK},
+			events: []logEvent{{logEventGap, 6, 8, "2 entries missing"}},
+			stored: 9,
+		},
+		{
+			name:   "Gap at the start of a new stream",
+			seqs:   []uint64{2},
+			want:   []string{logIntegrityGap},
+			events: []logEvent{{logEventGap, 1, 2, "1 entries missing"}},
+			stored: 2,
+		},
+		{
+			name:   "Replay",
+			last:   5,
+			seqs:   []uint64{4, 5},
+			want:   []string{"", ""},
+			events: []logEvent{{logEventReplay, 6, 4, ""}, {logEventReplay, 6, 5, ""}},
+			stored: 5,
+		},
+		{
+			name:   "Mixed",
+			last:   5,
+			seqs:   []uint64{5, 6, 9, 7, 10},
+			want:   []string{"", logIntegrityOK, logIntegrityGap, "", logIntegrityOK},
+			events: []logEvent{{logEventReplay, 6, 5, ""}, {logEventGap, 7, 9, "2 entries missing"}, {logEventReplay, 10, 7, ""}},
+			stored: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testRelay(t)
+			batch := testLogBatch("agent-1")
+
+			query := mock.ExpectQuery("SELECT last_seq FROM log_streams WHERE source = ? AND source_id = ? AND stream = ?").
+				WithArgs("agent", "agent-1", "stream-1")
+			if tt.last == 0 {
+				query.WillReturnError(sql.ErrNoRows)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(tt.last))
+			}
+			for _, e := range tt.events {
+				mock.ExpectExec("INSERT INTO log_integrity_events").
+					WithArgs("agent", "agent-1", "stream-1", e.kind, e.expected, e.received, e.details).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectExec("INSERT INTO log_streams").WithArgs("agent", "agent-1", "stream-1", tt.stored).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			origins, err := rs.sequenceLogEntries(&batch, tt.seqs)
+			if err != nil {
+				t.Fatalf("sequenceLogEntries: %v", err)
+			}
+			if len(origins) != len(tt.seqs) {
+				t.Fatalf("%d origins for %d entries", len(origins), len(tt.seqs))
+			}
+			for i, origin := range origins {
+				switch {
+				case tt.want[i] == "" && origin != nil:
+					t.Errorf("entry %d (seq %d) kept as %+v, want dropped", i, tt.seqs[i], origin)
+				case tt.want[i] == "":
+				case origin == nil:
+					t.Errorf("entry %d (seq %d) dropped, want %s", i, tt.seqs[i], tt.want[i])
+				case origin.Integrity != tt.want[i] || origin.Seq != tt.seqs[i] || origin.Source != "agent:agent-1":
+					t.Errorf("entry %d origin %+v, want %s seq %d", i, origin, tt.want[i], tt.seqs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceLogEntriesErrors(t *testing.T) {
+	batch := testLogBatch("agent-1")
+
+	t.Run("Missing seq", func(t *testing.T) {
+		rs, _ := testRelay(t)
+		if _, err := rs.sequenceLogEntries(&batch, []uint64{1, 0, 2}); err == nil {
+			t.Error("entry without seq accepted")
+		}
+	})
+
+	t.Run("Database failure", func(t *testing.T) {
+		rs, mock := testRelay(t)
+		mock.ExpectQuery("SELECT last_seq FROM log_streams").WillReturnError(errors.New("connection lost"))
+		if _, err := rs.sequenceLogEntries(&batch, []uint64{1}); err == nil {
+			t.Error("no error when the stream lookup fails")
+		}
+	})
+}
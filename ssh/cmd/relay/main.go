@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -33,7 +34,12 @@ type RelayServer struct {
 	mutex       sync.RWMutex
 	logger      *common.Logger
 	db          *sql.DB
-	webSessions map[string]*WebSession // Enhanced session storage with user info
+	webSessions *sessionStore // Dashboard and API logins, kept in MySQL
+
+	// Login backends tried in order, and the signer of API session tokens
+	authenticators []Authenticator
+	tokens         *tokenSigner
+	sso            *oidcSSO
 
 	// Performance optimization: fast connection lookup
 	connToAgent  map[*websocket.Conn]string
@@ -42,6 +48,14 @@ type RelayServer struct {
 
 	// Batch logging for performance
 	logBuffer *LogBuffer
+
+	// Serializes sequence checks of ingested log batches
+	logStreamMutex sync.Mutex
+
+	// Last bad_signature event per log source, so forged batches cannot
+	// flood log_integrity_events
+	badSignatures     map[string]*badSignatureEvent
+	badSignatureMutex sync.Mutex
 }
 
 // LogBuffer for batch logging to improve performance
@@ -66,6 +80,7 @@ type SSHLogEntry struct {
 	IsBase64  bool
 	DataSize  int
 	Timestamp time.Time
+	Origin    *logOrigin // Set for entries posted to /api/log-ssh
 }
 
 type QueryLogEntry struct {
@@ -80,12 +95,6 @@ type QueryLogEntry struct {
 	Timestamp time.Time
 }
 
-type WebSession struct {
-	Username  string
-	Role      string
-	LoginTime time.Time
-}
-
 type Agent struct {
 	ID          string          `json:"id"`
 	Connection  *websocket.Conn `json:"-"`
@@ -104,7 +113,8 @@ type Client struct {
 	LocalPort   string          `json:"local_port"`
 	TargetAddr  string          `json:"target_addr"`
 	Status      string          `json:"status"`
-	Token       string          `json:"token"` // Store client token for username lookup
+	Token       string          `json:"-"` // Store client token for username lookup
+	Username    string          `json:"username"`
 }
 
 type Session struct {
@@ -153,6 +163,7 @@ type SSHTunnelLogRequest struct {
 	Port      string `json:"port"`
 	Data      string `json:"data"`
 	IsBase64  bool   `json:"is_base64"`
+	Seq       uint64 `json:"seq"`
 }
 
 type QueryLogRequest struct {
@@ -165,6 +176,7 @@ type QueryLogRequest struct {
 	TableName    string `json:"table_name"`
 	DatabaseName string `json:"database_name"`
 	QueryText    string `json:"query_text"`
+	Seq          uint64 `json:"seq"`
 }
 
 var upgrader = websocket.Upgrader{
@@ -187,12 +199,15 @@ func NewRelayServer() *RelayServer {
 		clients:      make(map[string]*Client),
 		sessions:     make(map[string]*Session),
 		logger:       common.NewLogger("RELAY"),
-		webSessions:  make(map[string]*WebSession),
 		connToAgent:  make(map[*websocket.Conn]string),
 		connToClient: make(map[*websocket.Conn]string),
 		logBuffer:    &LogBuffer{lastFlush: time.Now()},
 	}
 
+	if err := rs.initAuth(); err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+
 	// Get database configuration from environment variables
 	dbHost := os.Getenv("DB_HOST")
 	if dbHost == "" {
@@ -253,6 +268,7 @@ func NewRelayServer() *RelayServer {
 
 	// Start periodic log flusher for performance
 	go rs.periodicFlush()
+	go rs.webSessions.periodicCleanup()
 
 	return rs
 }
@@ -414,6 +430,53 @@ func (rs *RelayServer) initDatabase() {
             updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
             created_by VARCHAR(100),
             INDEX idx_name (name)
+        )`,
+		`CREATE TABLE IF NOT EXISTS web_sessions (
+            id INT AUTO_INCREMENT PRIMARY KEY,
+            session_id VARCHAR(32) UNIQUE NOT NULL,
+            secret_hash CHAR(64) UNIQUE NOT NULL,
+            username VARCHAR(50) NOT NULL,
+            role VARCHAR(20) NOT NULL,
+            auth_backend VARCHAR(20) NOT NULL DEFAULT 'local',
+            remote_addr VARCHAR(64),
+            user_agent VARCHAR(255),
+            created_at DATETIME NOT NULL,
+            last_seen_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            revoked_at DATETIME NULL,
+            revoked_by VARCHAR(50) NULL,
+            INDEX idx_username (username),
+            INDEX idx_expires_at (expires_at)
+        )`,
+		`CREATE TABLE IF NOT EXISTS user_target_rules (
+            id INT AUTO_INCREMENT PRIMARY KEY,
+            user_id INT NOT NULL,
+            pattern VARCHAR(255) NOT NULL,
+            description VARCHAR(255),
+            created_by VARCHAR(100),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_user_id (user_id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+        )`,
+		`CREATE TABLE IF NOT EXISTS log_streams (
+            source VARCHAR(10) NOT NULL,
+            source_id VARCHAR(100) NOT NULL,
+            stream VARCHAR(32) NOT NULL,
+            last_seq BIGINT UNSIGNED NOT NULL DEFAULT 0,
+            updated_at DATETIME NOT NULL,
+            PRIMARY KEY (source, source_id, stream)
+        )`,
+		`CREATE TABLE IF NOT EXISTS log_integrity_events (
+            id INT AUTO_INCREMENT PRIMARY KEY,
+            source VARCHAR(10) NOT NULL,
+            source_id VARCHAR(100) NOT NULL,
+            stream VARCHAR(32) NOT NULL,
+            kind VARCHAR(20) NOT NULL,
+            expected_seq BIGINT UNSIGNED NOT NULL DEFAULT 0,
+            received_seq BIGINT UNSIGNED NOT NULL DEFAULT 0,
+            details TEXT,
+            timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_timestamp (timestamp)
         )`,
 	}
 
@@ -433,10 +496,21 @@ func (rs *RelayServer) initDatabase() {
 		`ALTER TABLE agents ADD COLUMN agent_name VARCHAR(255) AFTER agent_id`,
 		`ALTER TABLE agents ADD COLUMN project_id INT AFTER agent_name`,
 		`ALTER TABLE agents ADD COLUMN ssh_management BOOLEAN DEFAULT FALSE AFTER project_id`,
+		`ALTER TABLE clients ADD COLUMN agent_id VARCHAR(100) AFTER client_name`,
 		`ALTER TABLE clients ADD COLUMN token VARCHAR(255) AFTER agent_id`,
+		`ALTER TABLE clients ADD COLUMN username VARCHAR(50) AFTER token`,
 		`ALTER TABLE users ADD COLUMN id INT AUTO_INCREMENT PRIMARY KEY FIRST`,
+		`ALTER TABLE users ADD COLUMN auth_source VARCHAR(20) DEFAULT 'local'`,
+		`ALTER TABLE users ADD COLUMN oidc_subject VARCHAR(255) NULL`,
+		`ALTER TABLE users ADD UNIQUE INDEX idx_users_oidc_subject (oidc_subject)`,
 		`ALTER TABLE ssh_tunnels ADD COLUMN password VARCHAR(255) NOT NULL DEFAULT '' AFTER username`,
 		`ALTER TABLE ssh_tunnels ADD COLUMN group_name VARCHAR(100) DEFAULT 'Default' AFTER description`,
+		`ALTER TABLE ssh_logs ADD COLUMN log_source VARCHAR(120)`,
+		`ALTER TABLE ssh_logs ADD COLUMN seq BIGINT UNSIGNED`,
+		`ALTER TABLE ssh_logs ADD COLUMN integrity VARCHAR(10)`,
+		`ALTER TABLE tunnel_logs ADD COLUMN log_source VARCHAR(120)`,
+		`ALTER TABLE tunnel_logs ADD COLUMN seq BIGINT UNSIGNED`,
+		`ALTER TABLE tunnel_logs ADD COLUMN integrity VARCHAR(10)`,
 	}
 
 	for _, query := range alterQueries {
@@ -464,7 +538,10 @@ func (rs *RelayServer) initDatabase() {
 			adminPassword = "admin123"
 		}
 
-		_, err := rs.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", adminUsername, adminPassword, "admin")
+		adminHash, err := hashPassword(adminPassword)
+		if err == nil {
+			_, err = rs.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", adminUsername, adminHash, "admin")
+		}
 		if err != nil {
 			rs.logger.Error("Failed to create default admin user: %v", err)
 		} else {
@@ -482,7 +559,10 @@ func (rs *RelayServer) initDatabase() {
 			userPassword = "user123"
 		}
 
-		_, err = rs.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", userUsername, userPassword, "user")
+		userHash, err := hashPassword(userPassword)
+		if err == nil {
+			_, err = rs.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", userUsername, userHash, "user")
+		}
 		if err != nil {
 			rs.logger.Error("Failed to create default regular user: %v", err)
 		} else {
@@ -616,7 +696,9 @@ func (rs *RelayServer) saveClientToDatabase(clientID, clientName, agentID, statu
 
 	// Get username from token
 	var username string
-	if token != "" {
+	if session, err := rs.sessionFromToken(token); err == nil {
+		username = session.Username
+	} else if token != "" {
 		err := rs.db.QueryRow("SELECT username FROM users WHERE token = ?", token).Scan(&username)
 		if err != nil {
 			username = "unknown"
@@ -880,7 +962,7 @@ func (rs *RelayServer) isAllowedOperation(operation string) bool {
 	return false
 }
 
-func (rs *RelayServer) logTunnelQuery(sessionID, agentID, clientID, direction, protocol, operation, tableName, databaseName, queryText string) {
+func (rs *RelayServer) logTunnelQuery(sessionID, agentID, clientID, direction, protocol, operation, tableName, databaseName, queryText string, origin *logOrigin) {
 	// Clean all string parameters before processing
 	sessionID = rs.cleanString(sessionID)
 	agentID = rs.cleanString(agentID)
@@ -898,9 +980,10 @@ func (rs *RelayServer) logTunnelQuery(sessionID, agentID, clientID, direction, p
 		return
 	}
 
+	logSource, seq, integrity := origin.columns()
 	_, err := rs.db.Exec(
-		"INSERT INTO tunnel_logs (session_id, agent_id, client_id, direction, protocol, operation, table_name, database_name, query_text) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		sessionID, agentID, clientID, direction, protocol, operation, tableName, databaseName, queryText,
+		"INSERT INTO tunnel_logs (session_id, agent_id, client_id, direction, protocol, operation, table_name, database_name, query_text, log_source, seq, integrity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		sessionID, agentID, clientID, direction, protocol, operation, tableName, databaseName, queryText, logSource, seq, integrity,
 	)
 	if err != nil {
 		rs.logger.Error("Failed to log tunnel query: %v", err)
@@ -1120,6 +1203,12 @@ func (rs *RelayServer) validateUserToken(token string) (string, bool) {
 		return "", false
 	}
 
+	// Session tokens from /login or the SSO device flow
+	if session, err := rs.sessionFromToken(token); err == nil {
+		rs.logger.Info("Session token validation successful for user: %s (role: %s)", session.Username, session.Role)
+		return session.Username, true
+	}
+
 	// Clean inputs
 	token = rs.cleanString(token)
 
@@ -1194,6 +1283,21 @@ func (rs *RelayServer) handleRegister(conn *websocket.Conn, msg *common.Message)
 
 		rs.logger.Info("Client %s authenticated as user: %s", msg.ClientID, username)
 
+		if err := rs.checkClientOwner(msg.ClientID, username); err != nil {
+			rs.logger.Error("Client registration failed for %s as %s: %v", msg.ClientID, username, err)
+
+			errorResponse := common.NewMessage(common.MsgTypeError)
+			errorResponse.ClientID = msg.ClientID
+			errorResponse.Error = "Client ID is registered by another user"
+			if !errors.Is(err, errAccessDenied) {
+				errorResponse.Error = "Client registration unavailable"
+			}
+			rs.sendMessage(conn, errorResponse)
+
+			conn.Close()
+			return
+		}
+
 		client := &Client{
 			ID:          msg.ClientID,
 			Name:        msg.ClientName,
@@ -1202,6 +1306,8 @@ func (rs *RelayServer) handleRegister(conn *websocket.Conn, msg *common.Message)
 			LastPing:    time.Now(),
 			AgentID:     msg.AgentID, // Target agent ID from -a parameter
 			Status:      "connected",
+			Token:       msg.Token,
+			Username:    username,
 		}
 		rs.clients[msg.ClientID] = client
 
@@ -1259,6 +1365,30 @@ func (rs *RelayServer) handleRegister(conn *websocket.Conn, msg *common.Message)
 }
 
 func (rs *RelayServer) handleConnect(conn *websocket.Conn, msg *common.Message) {
+	// Only registered clients may connect, and always as themselves
+	rs.connMutex.RLock()
+	clientID, isClient := rs.connToClient[conn]
+	rs.connMutex.RUnlock()
+	var client *Client
+	if isClient {
+		rs.mutex.RLock()
+		client = rs.clients[clientID]
+		rs.mutex.RUnlock()
+	}
+	if client == nil {
+		rs.denyConnect(conn, msg, "", fmt.Errorf("%w: client not registered", errAccessDenied))
+		return
+	}
+	msg.ClientID = client.ID
+
+	// Checked on every connect so revoked tokens and removed assignments
+	// take effect without reconnecting the client
+	username, err := rs.authorizeConnect(client.ID, client.Token, msg.AgentID, msg.Target)
+	if err != nil {
+		rs.denyConnect(conn, msg, username, err)
+		return
+	}
+
 	rs.mutex.Lock()
 	defer rs.mutex.Unlock()
 
@@ -1312,6 +1442,28 @@ func (rs *RelayServer) handleConnect(conn *websocket.Conn, msg *common.Message)
 	}
 }
 
+// denyConnect refuses a CONNECT and records why in connection_logs
+func (rs *RelayServer) denyConnect(conn *websocket.Conn, msg *common.Message, username string, err error) {
+	reason := err.Error()
+	if !errors.Is(err, errAccessDenied) {
+		// Lookup failures are not shown to the client
+		rs.logger.Error("Access check failed for client %s: %v", msg.ClientID, err)
+		reason = errAccessDenied.Error() + ": access check failed"
+	}
+	rs.logger.Info("Denied connect - Client: %s, User: %s, Agent: %s, Target: %s: %s",
+		msg.ClientID, username, msg.AgentID, msg.Target, reason)
+
+	errorMsg := common.NewMessage(common.MsgTypeError)
+	errorMsg.SessionID = msg.SessionID
+	errorMsg.ClientID = msg.ClientID
+	errorMsg.AgentID = msg.AgentID
+	errorMsg.Error = reason
+	rs.sendMessage(conn, errorMsg)
+
+	go rs.logConnection("client", msg.AgentID, msg.ClientID, "access_denied",
+		fmt.Sprintf("user: %s, target: %s, reason: %s", username, msg.Target, reason))
+}
+
 func (rs *RelayServer) handleData(conn *websocket.Conn, msg *common.Message) {
 	// Check for special tunnel listening log message
 	if len(msg.Data) > 0 && strings.HasPrefix(string(msg.Data), "tunnel_listening:") {
@@ -1465,7 +1617,7 @@ func (rs *RelayServer) handleDBQuery(conn *websocket.Conn, msg *common.Message)
 	rs.logger.Info("Query: %s", msg.DBQuery[:min(100, len(msg.DBQuery))])
 
 	// Log database query to tunnel_logs table only
-	rs.logTunnelQuery(msg.SessionID, msg.AgentID, msg.ClientID, "inbound", msg.DBProtocol, msg.DBOperation, msg.DBTable, msg.DBDatabase, msg.DBQuery)
+	rs.logTunnelQuery(msg.SessionID, msg.AgentID, msg.ClientID, "inbound", msg.DBProtocol, msg.DBOperation, msg.DBTable, msg.DBDatabase, msg.DBQuery, nil)
 
 	rs.logger.Info("Database query logged from client %s: %s %s.%s",
 		msg.ClientID, msg.DBOperation, msg.DBDatabase, msg.DBTable)
@@ -1536,11 +1688,11 @@ func (rs *RelayServer) handleSSHLog(conn *websocket.Conn, msg *common.Message) {
 	data := getString(logRequest, "data")
 	isBase64 := getBool(logRequest, "is_base64")
 
-	// Get username from client token
+	// Username the client authenticated as
 	username := "unknown"
 	rs.mutex.RLock()
-	if client, exists := rs.clients[clientID]; exists {
-		username = getUsernameFromToken(client.Token)
+	if client, exists := rs.clients[clientID]; exists && client.Username != "" {
+		username = client.Username
 	}
 	rs.mutex.RUnlock()
 
@@ -1594,24 +1746,6 @@ func getBool(m map[string]interface{}, key string) bool {
 	return false
 }
 
-// Helper function to extract username from token
-func getUsernameFromToken(token string) string {
-	// Query database to get username based on token
-	db, err := sql.Open("mysql", "tunnel_user:secure_password_2024@tcp(192.168.56.101:3306)/tunnel")
-	if err != nil {
-		return "unknown"
-	}
-	defer db.Close()
-
-	var username string
-	err = db.QueryRow("SELECT username FROM users WHERE token = ?", token).Scan(&username)
-	if err != nil {
-		return "unknown"
-	}
-
-	return username
-}
-
 // handleShellResponse forwards shell command responses from agent to client
 func (rs *RelayServer) handleShellResponse(conn *websocket.Conn, msg *common.Message) {
 	// rs.logger.Info("=== SHELL RESPONSE ROUTING ===")
@@ -1816,6 +1950,13 @@ func (rs *RelayServer) setupRoutes() {
 	http.HandleFunc("/login", rs.corsMiddleware(rs.handleLogin))
 	http.HandleFunc("/logout", rs.corsMiddleware(rs.handleLogout))
 
+	// Single sign-on
+	http.HandleFunc("/auth/providers", rs.corsMiddleware(rs.handleAuthProviders))
+	http.HandleFunc("/auth/oidc/login", rs.handleOIDCLogin)
+	http.HandleFunc("/auth/oidc/callback", rs.handleOIDCCallback)
+	http.HandleFunc("/auth/device", rs.corsMiddleware(rs.handleDeviceAuthorization))
+	http.HandleFunc("/auth/device/token", rs.corsMiddleware(rs.handleDeviceToken))
+
 	// API endpoints
 	http.HandleFunc("/api/agents", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIAgents)))
 	http.HandleFunc("/api/agents/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIAgents))) // Handle /api/agents/{id}
@@ -1831,13 +1972,19 @@ func (rs *RelayServer) setupRoutes() {
 	http.HandleFunc("/api/settings", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPISettings)))
 	http.HandleFunc("/api/users", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIUsers)))
 	http.HandleFunc("/api/users/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIUsers)))                 // Handle /api/users/{id}
+	http.HandleFunc("/api/auth/sessions", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIWebSessions)))
+	http.HandleFunc("/api/auth/sessions/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIWebSessions))) // Handle /api/auth/sessions/{id}
+	http.HandleFunc("/api/auth/force-logout", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPIForceLogout)))
+	http.HandleFunc("/api/target-rules", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPITargetRules)))
+	http.HandleFunc("/api/target-rules/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPITargetRules))) // Handle /api/target-rules/{id}
 	http.HandleFunc("/api/ssh-management", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPISSHManagement))) // Handle SSH Management CRUD
 	http.HandleFunc("/api/tunnels", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPITunnels)))               // Handle SSH Tunnels CRUD
 	http.HandleFunc("/api/tunnels/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPITunnels)))              // Handle /api/tunnels/{id}
 	http.HandleFunc("/api/ssh-groups", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPISSHGroups)))           // Handle SSH Groups CRUD
 	http.HandleFunc("/api/ssh-groups/", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPISSHGroups)))          // Handle /api/ssh-groups/{id}
-	http.HandleFunc("/api/log-query", rs.corsMiddleware(rs.handleAPILogQuery))
-	http.HandleFunc("/api/log-ssh", rs.corsMiddleware(rs.handleAPILogSSH))
+	http.HandleFunc("/api/log-query", rs.corsMiddleware(rs.handleAPILogQuery)) // Signed by the agent or client token
+	http.HandleFunc("/api/log-ssh", rs.corsMiddleware(rs.handleAPILogSSH))     // Signed by the agent or client token
+	http.HandleFunc("/api/log-integrity", rs.corsMiddleware(rs.requireAPIAuth(rs.handleAPILogIntegrity)))
 
 	// SSH WebSocket endpoint
 	http.HandleFunc("/ssh-ws", rs.corsMiddleware(rs.handleSSHWebSocket))
@@ -1857,55 +2004,44 @@ func (rs *RelayServer) setupRoutes() {
 	}))
 }
 
-// API Authentication Middleware (supports Basic Auth)
+// API Authentication Middleware (supports Bearer session tokens and Basic Auth)
 func (rs *RelayServer) requireAPIAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// rs.logger.Info("=== API AUTH CHECK ===")
 		// rs.logger.Info("Method: %s, URL: %s", r.Method, r.URL.Path)
 		// rs.logger.Info("Authorization header present: %t", r.Header.Get("Authorization") != "")
 
-		// Check for Basic Auth header
+		// Session token issued by /login
 		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Basic ") {
-			// Parse Basic Auth
-			// rs.logger.Info("Found Basic Auth header")
-			payload := strings.TrimPrefix(authHeader, "Basic ")
-			data, err := base64.StdEncoding.DecodeString(payload)
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			session, err := rs.sessionFromToken(strings.TrimPrefix(authHeader, "Bearer "))
 			if err != nil {
-				rs.logger.Error("Failed to decode Basic Auth: %v", err)
+				rs.logger.Error("Rejected session token: %v", err)
 				http.Error(w, "Invalid authentication", http.StatusUnauthorized)
 				return
 			}
 
-			credentials := strings.SplitN(string(data), ":", 2)
-			if len(credentials) != 2 {
-				rs.logger.Error("Invalid Basic Auth format")
-				http.Error(w, "Invalid authentication", http.StatusUnauthorized)
-				return
-			}
+			r.Header.Set("X-User-Role", session.Role)
+			r.Header.Set("X-Username", session.Username)
+			r.Header.Set("X-Session-ID", session.ID)
 
-			username, password := credentials[0], credentials[1]
-			// rs.logger.Info("Basic Auth - Username: %s", username)
+			handler(w, r)
+			return
+		}
 
-			// Validate credentials against database
-			var storedPassword, role string
-			err = rs.db.QueryRow("SELECT password, role FROM users WHERE username = ?", username).Scan(&storedPassword, &role)
+		// Basic Auth for scripts, checked against the login backends
+		if username, password, ok := r.BasicAuth(); ok {
+			user, err := rs.authenticate(username, password)
 			if err != nil {
-				rs.logger.Error("Database auth query failed: %v", err)
+				rs.logger.Error("Basic Auth failed for user: %s", username)
 				http.Error(w, "Invalid authentication", http.StatusUnauthorized)
 				return
 			}
 
-			if storedPassword != password {
-				rs.logger.Error("Password mismatch for user: %s", username)
-				http.Error(w, "Invalid authentication", http.StatusUnauthorized)
-				return
-			}
-
-			// rs.logger.Info("Basic Auth SUCCESS - User: %s, Role: %s", username, role)
 			// Set user info in headers for handler
-			r.Header.Set("X-User-Role", role)
-			r.Header.Set("X-Username", username)
+			r.Header.Set("X-User-Role", user.Role)
+			r.Header.Set("X-Username", user.Username)
+			r.Header.Del("X-Session-ID")
 
 			handler(w, r)
 			return
@@ -1913,16 +2049,14 @@ func (rs *RelayServer) requireAPIAuth(handler http.HandlerFunc) http.HandlerFunc
 
 		// rs.logger.Info("No Basic Auth header, checking cookie auth")
 		// Fallback to cookie-based auth (for web interface)
-		cookie, err := r.Cookie("tunnel-session")
-		if err != nil || cookie.Value == "" {
+		session, err := rs.sessionFromCookie(r)
+		if err == errSessionNotFound {
 			// rs.logger.Error("No session cookie found")
 			http.Error(w, "Authentication required", http.StatusUnauthorized)
 			return
 		}
-
-		session, exists := rs.webSessions[cookie.Value]
-		if !exists {
-			rs.logger.Error("Invalid session cookie")
+		if err != nil {
+			rs.logger.Error("Invalid session cookie: %v", err)
 			http.Error(w, "Invalid session", http.StatusUnauthorized)
 			return
 		}
@@ -1931,6 +2065,7 @@ func (rs *RelayServer) requireAPIAuth(handler http.HandlerFunc) http.HandlerFunc
 		// Store user info in request context for later use
 		r.Header.Set("X-User-Role", session.Role)
 		r.Header.Set("X-Username", session.Username)
+		r.Header.Set("X-Session-ID", session.ID)
 
 		handler(w, r)
 	}
@@ -1940,14 +2075,8 @@ func (rs *RelayServer) requireAPIAuth(handler http.HandlerFunc) http.HandlerFunc
 func (rs *RelayServer) requireAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Simple session check using cookies
-		cookie, err := r.Cookie("tunnel-session")
-		if err != nil || cookie.Value == "" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		session, exists := rs.webSessions[cookie.Value]
-		if !exists {
+		session, err := rs.sessionFromCookie(r)
+		if err != nil {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
@@ -1955,6 +2084,7 @@ func (rs *RelayServer) requireAuth(handler http.HandlerFunc) http.HandlerFunc {
 		// Store user info in request context for later use
 		r.Header.Set("X-User-Role", session.Role)
 		r.Header.Set("X-Username", session.Username)
+		r.Header.Set("X-Session-ID", session.ID)
 
 		handler(w, r)
 	}
@@ -2086,9 +2216,9 @@ func (rs *RelayServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 			password = r.FormValue("password")
 		}
 
-		var dbPassword, dbRole string
-		err := rs.db.QueryRow("SELECT password, role FROM users WHERE username = ?", username).Scan(&dbPassword, &dbRole)
-		if err != nil || dbPassword != password {
+		user, err := rs.authenticate(username, password)
+		if err != nil {
+			rs.logger.Info("Failed login for user: %s", username)
 			if strings.Contains(contentType, "application/json") {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(http.StatusUnauthorized)
@@ -2100,36 +2230,32 @@ func (rs *RelayServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Create session
-		sessionID := fmt.Sprintf("sess_%d", time.Now().UnixNano())
-		rs.webSessions[sessionID] = &WebSession{
-			Username:  username,
-			Role:      dbRole,
-			LoginTime: time.Now(),
+		session, secret, err := rs.webSessions.Create(user, r)
+		if err != nil {
+			rs.logger.Error("Failed to create session for %s: %v", user.Username, err)
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
 		}
+		rs.logger.Info("User %s logged in via %s (session %s)", user.Username, user.Backend, session.ID)
 
 		if strings.Contains(contentType, "application/json") {
-			// Return JSON response for API
-			token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+			// Return a signed session token for the Authorization header
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": true,
-				"token":   token,
+				"success":    true,
+				"token":      rs.tokens.Sign(session),
+				"token_type": "Bearer",
+				"expires_at": session.ExpiresAt,
+				"role":       user.Role,
 				"user": map[string]string{
-					"username": username,
-					"role":     dbRole,
+					"username": user.Username,
+					"role":     user.Role,
 				},
-				"session_id": sessionID,
+				"session_id": session.ID,
 			})
 		} else {
 			// Set cookie and redirect for HTML form
-			cookie := &http.Cookie{
-				Name:     "tunnel-session",
-				Value:    sessionID,
-				Path:     "/",
-				MaxAge:   86400, // 24 hours
-				HttpOnly: true,
-			}
-			http.SetCookie(w, cookie)
+			setSessionCookie(w, r, session, secret)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 		}
 		return
@@ -2180,22 +2306,14 @@ func (rs *RelayServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	// Handle both GET (web) and POST (API) requests
 	if r.Method == "POST" {
 		// API logout - return JSON response
-		// Clean up session from cookie
-		cookie, err := r.Cookie("tunnel-session")
-		if err == nil && cookie.Value != "" {
-			delete(rs.webSessions, cookie.Value)
-		}
+		// End the session behind the cookie and the bearer token
+		rs.endWebSession(r)
 
-		// Also clean up any Basic Auth session if present
 		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Basic ") {
-			// Decode and get username to potentially clean up any user-specific sessions
-			payload := strings.TrimPrefix(authHeader, "Basic ")
-			if data, err := base64.StdEncoding.DecodeString(payload); err == nil {
-				credentials := strings.SplitN(string(data), ":", 2)
-				if len(credentials) == 2 {
-					username := credentials[0]
-					rs.logger.Info("User %s logged out via API", username)
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			if session, err := rs.sessionFromToken(strings.TrimPrefix(authHeader, "Bearer ")); err == nil {
+				if err := rs.webSessions.Revoke(session.ID, session.Username); err == nil {
+					rs.logger.Info("User %s logged out via API", session.Username)
 				}
 			}
 		}
@@ -2217,10 +2335,7 @@ func (rs *RelayServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 		})
 	} else {
 		// Web logout - redirect to login page
-		cookie, err := r.Cookie("tunnel-session")
-		if err == nil && cookie.Value != "" {
-			delete(rs.webSessions, cookie.Value)
-		}
+		rs.endWebSession(r)
 
 		// Clear cookie
 		clearCookie := &http.Cookie{
@@ -3686,7 +3801,7 @@ func cleanHTMLEntities(text string) string {
 }
 
 func (rs *RelayServer) handleAPITunnelLogs(w http.ResponseWriter, r *http.Request) {
-	rows, err := rs.db.Query("SELECT session_id, agent_id, client_id, direction, protocol, operation, table_name, database_name, query_text, timestamp FROM tunnel_logs ORDER BY timestamp DESC LIMIT 100")
+	rows, err := rs.db.Query("SELECT session_id, agent_id, client_id, direction, protocol, operation, table_name, database_name, query_text, timestamp, log_source, seq, integrity FROM tunnel_logs ORDER BY timestamp DESC LIMIT 100")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3696,9 +3811,11 @@ func (rs *RelayServer) handleAPITunnelLogs(w http.ResponseWriter, r *http.Reques
 	var logs []map[string]interface{}
 	for rows.Next() {
 		var sessionID, agentID, clientID, direction, protocol, operation, tableName, databaseName, queryText sql.NullString
+		var logSource, integrity sql.NullString
+		var seq sql.NullInt64
 		var timestamp time.Time
 
-		err := rows.Scan(&sessionID, &agentID, &clientID, &direction, &protocol, &operation, &tableName, &databaseName, &queryText, &timestamp)
+		err := rows.Scan(&sessionID, &agentID, &clientID, &direction, &protocol, &operation, &tableName, &databaseName, &queryText, &timestamp, &logSource, &seq, &integrity)
 		if err != nil {
 			continue
 		}
@@ -3717,6 +3834,9 @@ func (rs *RelayServer) handleAPITunnelLogs(w http.ResponseWriter, r *http.Reques
 			"database_name": rs.cleanString(databaseName.String),
 			"query_text":    cleanedQueryText,
 			"timestamp":     timestamp,
+			"log_source":    logSource.String,
+			"seq":           seq.Int64,
+			"integrity":     integrity.String,
 		}
 		logs = append(logs, log)
 	}
@@ -3732,20 +3852,44 @@ func (rs *RelayServer) handleAPILogQuery(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var req QueryLogRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	batch := rs.readLogBatch(w, r)
+	if batch == nil {
+		return
+	}
+	var entries []QueryLogRequest
+	if err := json.Unmarshal(batch.Entries, &entries); err != nil {
+		http.Error(w, "Invalid log entries", http.StatusBadRequest)
 		return
 	}
 
 	// Validate required fields
-	if req.SessionID == "" || req.ClientID == "" {
-		http.Error(w, "Missing required fields: session_id, client_id", http.StatusBadRequest)
+	seqs := make([]uint64, len(entries))
+	for i := range entries {
+		if entries[i].SessionID == "" {
+			http.Error(w, "Missing required field: session_id", http.StatusBadRequest)
+			return
+		}
+		seqs[i] = entries[i].Seq
+	}
+	origins, err := rs.sequenceLogEntries(batch, seqs)
+	if err != nil {
+		rs.logger.Error("Rejected query log batch from %s %s: %v", batch.Source, batch.SourceID, err)
+		http.Error(w, "Invalid log sequence", http.StatusBadRequest)
 		return
 	}
 
-	// Log the query
-	rs.logTunnelQuery(req.SessionID, req.AgentID, req.ClientID, req.Direction, req.Protocol, req.Operation, req.TableName, req.DatabaseName, req.QueryText)
+	// Log the queries, attributed to the authenticated source
+	for i, req := range entries {
+		if origins[i] == nil {
+			continue
+		}
+		if batch.Source == common.LogSourceClient {
+			req.ClientID = batch.SourceID
+		} else {
+			req.AgentID = batch.SourceID
+		}
+		rs.logTunnelQuery(req.SessionID, req.AgentID, req.ClientID, req.Direction, req.Protocol, req.Operation, req.TableName, req.DatabaseName, req.QueryText, origins[i])
+	}
 
 	// Return success response
 	response := map[string]interface{}{
@@ -3759,7 +3903,7 @@ func (rs *RelayServer) handleAPILogQuery(w http.ResponseWriter, r *http.Request)
 
 // Handle API for SSH logs retrieval
 func (rs *RelayServer) handleAPISSHLogs(w http.ResponseWriter, r *http.Request) {
-	rows, err := rs.db.Query("SELECT session_id, agent_id, client_id, direction, ssh_user, ssh_host, ssh_port, command, data, is_base64, data_size, timestamp FROM ssh_logs ORDER BY timestamp DESC LIMIT 100")
+	rows, err := rs.db.Query("SELECT session_id, agent_id, client_id, direction, ssh_user, ssh_host, ssh_port, command, data, is_base64, data_size, timestamp, log_source, seq, integrity FROM ssh_logs ORDER BY timestamp DESC LIMIT 100")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3771,9 +3915,11 @@ func (rs *RelayServer) handleAPISSHLogs(w http.ResponseWriter, r *http.Request)
 		var sessionID, agentID, clientID, direction, sshUser, sshHost, sshPort, command, data sql.NullString
 		var isBase64 sql.NullBool
 		var dataSize sql.NullInt64
+		var logSource, integrity sql.NullString
+		var seq sql.NullInt64
 		var timestamp time.Time
 
-		err := rows.Scan(&sessionID, &agentID, &clientID, &direction, &sshUser, &sshHost, &sshPort, &command, &data, &isBase64, &dataSize, &timestamp)
+		err := rows.Scan(&sessionID, &agentID, &clientID, &direction, &sshUser, &sshHost, &sshPort, &command, &data, &isBase64, &dataSize, &timestamp, &logSource, &seq, &integrity)
 		if err != nil {
 			continue
 		}
@@ -3801,6 +3947,9 @@ func (rs *RelayServer) handleAPISSHLogs(w http.ResponseWriter, r *http.Request)
 			"data":       actualData,
 			"data_size":  dataSize.Int64,
 			"timestamp":  timestamp,
+			"log_source": logSource.String,
+			"seq":        seq.Int64,
+			"integrity":  integrity.String,
 		}
 		logs = append(logs, log)
 	}
@@ -3816,39 +3965,59 @@ func (rs *RelayServer) handleAPILogSSH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req SSHTunnelLogRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	batch := rs.readLogBatch(w, r)
+	if batch == nil {
+		return
+	}
+	var entries []SSHTunnelLogRequest
+	if err := json.Unmarshal(batch.Entries, &entries); err != nil {
+		http.Error(w, "Invalid log entries", http.StatusBadRequest)
 		return
 	}
 
 	// Validate required fields
-	if req.SessionID == "" || req.ClientID == "" {
-		http.Error(w, "Missing required fields: session_id, client_id", http.StatusBadRequest)
+	seqs := make([]uint64, len(entries))
+	for i := range entries {
+		if entries[i].SessionID == "" {
+			http.Error(w, "Missing required field: session_id", http.StatusBadRequest)
+			return
+		}
+		seqs[i] = entries[i].Seq
+	}
+	origins, err := rs.sequenceLogEntries(batch, seqs)
+	if err != nil {
+		rs.logger.Error("Rejected SSH log batch from %s %s: %v", batch.Source, batch.SourceID, err)
+		http.Error(w, "Invalid log sequence", http.StatusBadRequest)
 		return
 	}
 
-	// Calculate data size
-	dataSize := len(req.Data)
-
 	// Add to batch logging buffer instead of direct logging
-	entry := SSHLogEntry{
-		SessionID: req.SessionID,
-		AgentID:   req.AgentID,
-		ClientID:  req.ClientID,
-		Direction: req.Direction,
-		User:      req.User,
-		Host:      req.Host,
-		Port:      req.Port,
-		Command:   req.Command,
-		Data:      req.Data,
-		IsBase64:  req.IsBase64,
-		DataSize:  dataSize,
-		Timestamp: time.Now(),
-	}
-
 	rs.logBuffer.mutex.Lock()
-	rs.logBuffer.sshLogs = append(rs.logBuffer.sshLogs, entry)
+	for i, req := range entries {
+		if origins[i] == nil {
+			continue
+		}
+		if batch.Source == common.LogSourceClient {
+			req.ClientID = batch.SourceID
+		} else {
+			req.AgentID = batch.SourceID
+		}
+		rs.logBuffer.sshLogs = append(rs.logBuffer.sshLogs, SSHLogEntry{
+			SessionID: req.SessionID,
+			AgentID:   req.AgentID,
+			ClientID:  req.ClientID,
+			Direction: req.Direction,
+			User:      req.User,
+			Host:      req.Host,
+			Port:      req.Port,
+			Command:   req.Command,
+			Data:      req.Data,
+			IsBase64:  req.IsBase64,
+			DataSize:  len(req.Data),
+			Timestamp: time.Now(),
+			Origin:    origins[i],
+		})
+	}
 	rs.logBuffer.mutex.Unlock()
 
 	// Return success response
@@ -3959,7 +4128,7 @@ func (rs *RelayServer) flushSSHLogs() {
 			return
 		}
 
-		stmt, err := tx.Prepare("INSERT INTO ssh_logs (session_id, agent_id, client_id, direction, ssh_user, ssh_host, ssh_port, command, data, is_base64, data_size, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		stmt, err := tx.Prepare("INSERT INTO ssh_logs (session_id, agent_id, client_id, direction, ssh_user, ssh_host, ssh_port, command, data, is_base64, data_size, timestamp, log_source, seq, integrity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			tx.Rollback()
 			rs.logger.Error("Failed to prepare SSH log statement: %v", err)
@@ -3967,9 +4136,11 @@ func (rs *RelayServer) flushSSHLogs() {
 		}
 
 		for _, log := range logs {
+			logSource, seq, integrity := log.Origin.columns()
 			_, err := stmt.Exec(log.SessionID, log.AgentID, log.ClientID,
 				log.Direction, log.User, log.Host, log.Port,
-				log.Command, log.Data, log.IsBase64, log.DataSize, log.Timestamp)
+				log.Command, log.Data, log.IsBase64, log.DataSize, log.Timestamp,
+				logSource, seq, integrity)
 			if err != nil {
 				rs.logger.Error("Failed to insert SSH log: %v", err)
 			}
@@ -4259,10 +4430,11 @@ func (rs *RelayServer) handleCreateUser(w http.ResponseWriter, r *http.Request)
 	rs.logger.Info("=== CREATE USER REQUEST ===")
 
 	var userData struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-		Role     string `json:"role"`
-		Token    string `json:"token"`
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		Role       string `json:"role"`
+		Token      string `json:"token"`
+		AuthSource string `json:"auth_source"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
@@ -4271,6 +4443,20 @@ func (rs *RelayServer) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// An ldap row only grants its role to the directory user of that name;
+	// the password is checked by the directory
+	switch userData.AuthSource {
+	case "", "local":
+		userData.AuthSource = "local"
+	case "ldap":
+		if userData.Password == "" {
+			userData.Password = randomToken(32)
+		}
+	default:
+		http.Error(w, "Invalid auth_source. Must be 'local' or 'ldap'", http.StatusBadRequest)
+		return
+	}
+
 	// Validate required fields
 	if userData.Username == "" || userData.Password == "" {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
@@ -4287,9 +4473,15 @@ func (rs *RelayServer) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		userData.Token = rs.generateSecureToken()
 	}
 
+	passwordHash, err := hashPassword(userData.Password)
+	if err != nil {
+		http.Error(w, "Invalid password", http.StatusBadRequest)
+		return
+	}
+
 	// Check if username already exists
 	var count int
-	err := rs.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", userData.Username).Scan(&count)
+	err = rs.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", userData.Username).Scan(&count)
 	if err != nil {
 		rs.logger.Error("Failed to check username uniqueness: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -4302,9 +4494,9 @@ func (rs *RelayServer) handleCreateUser(w http.ResponseWriter, r *http.Request)
 
 	// Insert new user
 	result, err := rs.db.Exec(`
-		INSERT INTO users (username, password, role, token) 
-		VALUES (?, ?, ?, ?)
-	`, userData.Username, userData.Password, userData.Role, userData.Token)
+		INSERT INTO users (username, password, role, token, auth_source) 
+		VALUES (?, ?, ?, ?, ?)
+	`, userData.Username, passwordHash, userData.Role, userData.Token, userData.AuthSource)
 
 	if err != nil {
 		rs.logger.Error("Failed to create user: %v", err)
@@ -4320,10 +4512,11 @@ func (rs *RelayServer) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		"success": true,
 		"message": "User created successfully",
 		"data": map[string]interface{}{
-			"id":       userID,
-			"username": userData.Username,
-			"role":     userData.Role,
-			"token":    userData.Token,
+			"id":          userID,
+			"username":    userData.Username,
+			"role":        userData.Role,
+			"token":       userData.Token,
+			"auth_source": userData.AuthSource,
 		},
 	})
 }
@@ -4361,8 +4554,13 @@ func (rs *RelayServer) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		args = append(args, userData.Username)
 	}
 	if userData.Password != "" {
+		passwordHash, err := hashPassword(userData.Password)
+		if err != nil {
+			http.Error(w, "Invalid password", http.StatusBadRequest)
+			return
+		}
 		setParts = append(setParts, "password = ?")
-		args = append(args, userData.Password)
+		args = append(args, passwordHash)
 	}
 	if userData.Role != "" {
 		setParts = append(setParts, "role = ?")
@@ -4374,6 +4572,13 @@ func (rs *RelayServer) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	var username string
+	if err := rs.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		rs.logger.Error("Failed to find user: %v", err)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
 	// Add user ID to args
 	args = append(args, userID)
 
@@ -4387,6 +4592,7 @@ func (rs *RelayServer) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 	}
 
 	rs.logger.Info("Updated user ID %d", userID)
+	rs.revokeChangedUser(username, r.Header.Get("X-Username"))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -4428,6 +4634,13 @@ func (rs *RelayServer) handleUpdateUserRole(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	var username string
+	if err := rs.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		rs.logger.Error("Failed to find user: %v", err)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
 	_, err = rs.db.Exec("UPDATE users SET role = ? WHERE id = ?", roleData.Role, userID)
 	if err != nil {
 		rs.logger.Error("Failed to update user role: %v", err)
@@ -4436,6 +4649,7 @@ func (rs *RelayServer) handleUpdateUserRole(w http.ResponseWriter, r *http.Reque
 	}
 
 	rs.logger.Info("Updated role for user ID %d to %s", userID, roleData.Role)
+	rs.revokeChangedUser(username, r.Header.Get("X-Username"))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -4479,6 +4693,10 @@ func (rs *RelayServer) handleDeleteUser(w http.ResponseWriter, r *http.Request)
 
 	rs.logger.Info("Deleted user %s (ID %d)", username, userID)
 
+	if _, err := rs.webSessions.RevokeUser(username, r.Header.Get("X-Username")); err != nil {
+		rs.logger.Error("Failed to revoke sessions of deleted user %s: %v", username, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -5165,29 +5383,13 @@ func (rs *RelayServer) logSSHCommandToDatabase(host, sshUsername, command, webUs
 }
 
 func (rs *RelayServer) handleSSHWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Debug: log all cookies received
-	rs.logger.Info("=== SSH WebSocket Debug ===")
-	rs.logger.Info("Cookies received: %d", len(r.Cookies()))
-	for _, cookie := range r.Cookies() {
-		rs.logger.Info("Cookie: %s = %s", cookie.Name, cookie.Value)
-	}
-	
 	// Get web user session
 	var webUsername string = "anonymous"
-	if cookie, err := r.Cookie("tunnel-session"); err == nil {
-		rs.logger.Info("Found tunnel-session cookie: %s", cookie.Value)
-		if session, exists := rs.webSessions[cookie.Value]; exists {
-			webUsername = session.Username
-			rs.logger.Info("Found web session for user: %s", webUsername)
-		} else {
-			rs.logger.Info("Session not found in webSessions map")
-			rs.logger.Info("Available sessions: %d", len(rs.webSessions))
-			for sid, sess := range rs.webSessions {
-				rs.logger.Info("Session %s -> %s", sid, sess.Username)
-			}
-		}
+	if session, err := rs.sessionFromCookie(r); err == nil {
+		webUsername = session.Username
+		rs.logger.Info("Found web session %s for user: %s", session.ID, webUsername)
 	} else {
-		rs.logger.Info("No tunnel-session cookie found: %v", err)
+		rs.logger.Info("No valid web session for SSH WebSocket: %v", err)
 	}
 	
 	upgrader := websocket.Upgrader{
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginTimeout   = 10 * time.Minute
+	maxPendingLogins   = 10000
+	oidcStateCookie    = "tunnel-oidc-state"
+	oidcAssignedBy     = "oidc"
+	deviceCodeGrant    = "urn:ietf:params:oauth:grant-type:device_code"
+	maxUsernameLength  = 50
+	defaultGroupsClaim = "groups"
+)
+
+// projectRoles are the user_project_assignments roles, lowest first
+var projectRoles = []string{"viewer", "operator", "admin"}
+
+func projectRoleRank(role string) int {
+	for i, r := range projectRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// groupMapping grants Role on a project, or on every project for "*", to
+// members of an IdP group
+type groupMapping struct {
+	Group   string
+	Project string
+	Role    string
+}
+
+// parseGroupMappings reads OIDC_GROUP_ROLES entries of the form
+// group=project:role separated by commas
+func parseGroupMappings(spec string) ([]groupMapping, error) {
+	var mappings []groupMapping
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, grant, ok := strings.Cut(entry, "=")
+		i := strings.LastIndex(grant, ":")
+		if !ok || group == "" || i <= 0 {
+			return nil, fmt.Errorf("invalid group mapping %q, want group=project:role", entry)
+		}
+		m := groupMapping{Group: group, Project: grant[:i], Role: grant[i+1:]}
+		if projectRoleRank(m.Role) < 0 {
+			return nil, fmt.Errorf("invalid role %q in group mapping %q (viewer, operator or admin)", m.Role, entry)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// oidcSSO serves the single sign-on logins: the browser authorization code
+// flow with PKCE and the device code flow for the CLI clients. Users are
+// created on their first login and their project roles follow their IdP
+// groups.
+type oidcSSO struct {
+	rs          *RelayServer
+	provider    *oidcProvider
+	redirectURL string
+	frontendURL string
+	groupsClaim string
+	adminGroups map[string]bool
+	mappings    []groupMapping
+
+	mu      sync.Mutex
+	pending map[string]*oidcLogin // by state
+}
+
+// oidcLogin is a browser login waiting for its callback
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// newOIDCSSO reads OIDC_REDIRECT_URL (the public URL of
+// /auth/oidc/callback, needed for browser logins), OIDC_FRONTEND_URL (where
+// the dashboard picks up its token; the relay's own page when empty),
+// OIDC_GROUPS_CLAIM, OIDC_ADMIN_GROUPS and OIDC_GROUP_ROLES
+func newOIDCSSO(rs *RelayServer) (*oidcSSO, error) {
+	provider, err := newOIDCProvider()
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := parseGroupMappings(os.Getenv("OIDC_GROUP_ROLES"))
+	if err != nil {
+		return nil, err
+	}
+
+	sso := &oidcSSO{
+		rs:          rs,
+		provider:    provider,
+		redirectURL: os.Getenv("OIDC_REDIRECT_URL"),
+		frontendURL: os.Getenv("OIDC_FRONTEND_URL"),
+		groupsClaim: os.Getenv("OIDC_GROUPS_CLAIM"),
+		adminGroups: make(map[string]bool),
+		mappings:    mappings,
+		pending:     make(map[string]*oidcLogin),
+	}
+	if sso.groupsClaim == "" {
+		sso.groupsClaim = defaultGroupsClaim
+	}
+	for _, group := range strings.Split(os.Getenv("OIDC_ADMIN_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			sso.adminGroups[group] = true
+		}
+	}
+	if sso.redirectURL == "" {
+		rs.logger.Info("OIDC_REDIRECT_URL not set, browser SSO disabled")
+	}
+	return sso, nil
+}
+
+// claimStrings reads a claim holding a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// provision creates or updates the user of verified ID token claims and
+// syncs their project roles. SSO accounts are keyed by the issuer's stable
+// sub claim, not the username claim, and take their role from
+// OIDC_ADMIN_GROUPS.
+func (sso *oidcSSO) provision(claims map[string]interface{}) (*AuthUser, error) {
+	db := sso.rs.db
+	if db == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("id_token has no sub claim")
+	}
+	username, err := sso.provider.username(claims)
+	if err != nil {
+		return nil, err
+	}
+	if len(username) > maxUsernameLength {
+		return nil, fmt.Errorf("username %q longer than %d characters", username, maxUsernameLength)
+	}
+
+	groups := claimStrings(claims[sso.groupsClaim])
+	role := "user"
+	for _, group := range groups {
+		if sso.adminGroups[group] {
+			role = "admin"
+		}
+	}
+
+	// A known subject keeps the username it was provisioned with
+	var userID int
+	var currentRole string
+	err = db.QueryRow("SELECT id, username, role FROM users WHERE auth_source = ? AND oidc_subject = ?",
+		oidcAssignedBy, subject).Scan(&userID, &username, &currentRole)
+	if err == sql.ErrNoRows {
+		userID, currentRole, err = sso.linkUser(username, subject, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if currentRole != role {
+		if _, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+			return nil, fmt.Errorf("update user role: %w", err)
+		}
+		sso.rs.logger.Info("Role of SSO user %s changed from %s to %s", username, currentRole, role)
+		sso.rs.revokeChangedUser(username, oidcAssignedBy)
+	}
+
+	if err := sso.syncAssignments(userID, groups); err != nil {
+		sso.rs.logger.Error("Failed to sync project roles of %s: %v", username, err)
+	}
+	return &AuthUser{Username: username, Role: role, Backend: "oidc"}, nil
+}
+
+// linkUser returns the account for a subject logging in for the first
+// time, creating it if the username is free. A username held by a local or
+// LDAP account or by another subject is refused, so whoever controls a
+// name at the IdP cannot take over that account; SSO accounts created
+// before subjects were recorded are linked to the first subject using them.
+func (sso *oidcSSO) linkUser(username, subject, role string) (int, string, error) {
+	db := sso.rs.db
+	var userID int
+	var currentRole string
+	var source, linked sql.NullString
+	err := db.QueryRow("SELECT id, role, auth_source, oidc_subject FROM users WHERE username = ?", username).
+		Scan(&userID, &currentRole, &source, &linked)
+	switch {
+	case err == sql.ErrNoRows:
+		// The random password is never shown, so SSO users cannot log in
+		// with the local backend
+		hash, err := hashPassword(randomToken(32))
+		if err != nil {
+			return 0, "", err
+		}
+		result, err := db.Exec("INSERT INTO users (username, password, role, token, auth_source, oidc_subject) VALUES (?, ?, ?, ?, ?, ?)",
+			username, hash, role, randomToken(24), oidcAssignedBy, subject)
+		if err != nil {
+			return 0, "", fmt.Errorf("provision user: %w", err)
+		}
+		id, _ := result.LastInsertId()
+		sso.rs.logger.Info("Provisioned SSO user %s (role: %s)", username, role)
+		return int(id), role, nil
+	case err != nil:
+		return 0, "", fmt.Errorf("query user: %w", err)
+	case source.String != oidcAssignedBy || linked.String != "":
+		sso.rs.logger.Error("Refused SSO login of subject %s: username %s belongs to another account (auth_source %s)",
+			subject, username, source.String)
+		return 0, "", fmt.Errorf("username %s is already taken by another account", username)
+	}
+
+	if _, err := db.Exec("UPDATE users SET oidc_subject = ? WHERE id = ?", subject, userID); err != nil {
+		return 0, "", fmt.Errorf("link user: %w", err)
+	}
+	sso.rs.logger.Info("Linked SSO user %s to subject %s", username, subject)
+	return userID, currentRole, nil
+}
+
+// syncAssignments makes the user's SSO-managed project assignments match
+// their groups. Assignments made by hand in the dashboard are left alone.
+func (sso *oidcSSO) syncAssignments(userID int, groups []string) error {
+	db := sso.rs.db
+	member := make(map[string]bool)
+	for _, group := range groups {
+		member[group] = true
+	}
+
+	// Highest role per project over all of the user's groups
+	desired := make(map[int]string)
+	grant := func(projectID int, role string) {
+		if projectRoleRank(role) > projectRoleRank(desired[projectID]) {
+			desired[projectID] = role
+		}
+	}
+	for _, m := range sso.mappings {
+		if !member[m.Group] {
+			continue
+		}
+		if m.Project == "*" {
+			rows, err := db.Query("SELECT id FROM projects WHERE status = 'active'")
+			if err != nil {
+				return fmt.Errorf("list projects: %w", err)
+			}
+			for rows.Next() {
+				var projectID int
+				if rows.Scan(&projectID) == nil {
+					grant(projectID, m.Role)
+				}
+			}
+			rows.Close()
+			continue
+		}
+		var projectID int
+		if err := db.QueryRow("SELECT id FROM projects WHERE project_name = ?", m.Project).Scan(&projectID); err != nil {
+			sso.rs.logger.Debug("Group mapping %s: project %s not found", m.Group, m.Project)
+			continue
+		}
+		grant(projectID, m.Role)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type assignment struct {
+		role       string
+		assignedBy string
+	}
+	existing := make(map[int]assignment)
+	rows, err := tx.Query("SELECT project_id, role, assigned_by FROM user_project_assignments WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var projectID int
+		var role string
+		var assignedBy sql.NullString
+		if rows.Scan(&projectID, &role, &assignedBy) == nil {
+			existing[projectID] = assignment{role, assignedBy.String}
+		}
+	}
+	rows.Close()
+
+	for projectID, role := range desired {
+		current, ok := existing[projectID]
+		switch {
+		case !ok:
+			_, err = tx.Exec("INSERT INTO user_project_assignments (user_id, project_id, role, assigned_by, status) VALUES (?, ?, ?, ?, 'active')",
+				userID, projectID, role, oidcAssignedBy)
+		case current.assignedBy == oidcAssignedBy && current.role != role:
+			_, err = tx.Exec("UPDATE user_project_assignments SET role = ?, status = 'active' WHERE user_id = ? AND project_id = ?",
+				role, userID, projectID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for projectID, current := range existing {
+		if current.assignedBy == oidcAssignedBy && desired[projectID] == "" {
+			if _, err := tx.Exec("DELETE FROM user_project_assignments WHERE user_id = ? AND project_id = ?", userID, projectID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// takeLogin removes and returns the pending login for a state
+func (sso *oidcSSO) takeLogin(state string) *oidcLogin {
+	sso.mu.Lock()
+	defer sso.mu.Unlock()
+	login := sso.pending[state]
+	delete(sso.pending, state)
+	if login == nil || time.Now().After(login.expires) {
+		return nil
+	}
+	return login
+}
+
+// addLogin records a new browser login, dropping expired ones
+func (sso *oidcSSO) addLogin(state string, login *oidcLogin) error {
+	sso.mu.Lock()
+	defer sso.mu.Unlock()
+	now := time.Now()
+	for s, l := range sso.pending {
+		if now.After(l.expires) {
+			delete(sso.pending, s)
+		}
+	}
+	if len(sso.pending) >= maxPendingLogins {
+		return fmt.Errorf("too many pending logins")
+	}
+	sso.pending[state] = login
+	return nil
+}
+
+// handleAuthProviders tells the login page which sign-in options exist
+func (rs *RelayServer) handleAuthProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sso":        rs.sso != nil && rs.sso.redirectURL != "",
+		"sso_login":  "/auth/oidc/login",
+		"device_sso": rs.sso != nil,
+	})
+}
+
+// handleOIDCLogin starts a browser login by redirecting to the IdP
+func (rs *RelayServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	sso := rs.sso
+	if sso == nil || sso.redirectURL == "" {
+		http.Error(w, "SSO is not configured", http.StatusNotFound)
+		return
+	}
+	d, err := sso.provider.discover()
+	if err != nil || d.AuthorizationEndpoint == "" {
+		rs.logger.Error("SSO login unavailable: %v", err)
+		http.Error(w, "SSO provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := randomToken(24)
+	login := &oidcLogin{
+		verifier: randomToken(32),
+		nonce:    randomToken(16),
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	if err := sso.addLogin(state, login); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The state cookie ties the callback to this browser
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {sso.provider.clientID},
+		"redirect_uri":          {sso.redirectURL},
+		"scope":                 {sso.provider.scopes},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback finishes a browser login: it redeems the code with the
+// PKCE verifier, provisions the user and starts a dashboard session
+func (rs *RelayServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	sso := rs.sso
+	if sso == nil || sso.redirectURL == "" {
+		http.Error(w, "SSO is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		rs.logger.Info("SSO login refused by provider: %s %s", e, query.Get("error_description"))
+		http.Error(w, "SSO login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+	login := sso.takeLogin(state)
+	if login == nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	token, err := sso.provider.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {sso.redirectURL},
+		"code_verifier": {login.verifier},
+	})
+	if err != nil {
+		rs.logger.Error("SSO code exchange failed: %v", err)
+		http.Error(w, "SSO provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if token.Error != "" {
+		rs.logger.Info("SSO code exchange refused: %s %s", token.Error, token.ErrorDescription)
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := sso.provider.verifyIDToken(token.IDToken)
+	if err == nil {
+		if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+			err = fmt.Errorf("id_token nonce mismatch")
+		}
+	}
+	var user *AuthUser
+	if err == nil {
+		user, err = sso.provision(claims)
+	}
+	if err != nil {
+		rs.logger.Error("SSO login failed: %v", err)
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	session, secret, err := rs.webSessions.Create(user, r)
+	if err != nil {
+		rs.logger.Error("Failed to create session for %s: %v", user.Username, err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	rs.logger.Info("User %s logged in via SSO (session %s)", user.Username, session.ID)
+	setSessionCookie(w, r, session, secret)
+
+	if sso.frontendURL == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// The fragment never reaches a server, the dashboard reads it
+	fragment := url.Values{
+		"token":      {rs.tokens.Sign(session)},
+		"username":   {user.Username},
+		"role":       {user.Role},
+		"expires_at": {session.ExpiresAt.Format(time.RFC3339)},
+	}
+	http.Redirect(w, r, sso.frontendURL+"#"+fragment.Encode(), http.StatusSeeOther)
+}
+
+// oidcDeviceResponse is the device authorization reply of the IdP, passed
+// on to the CLI
+type oidcDeviceResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+	Error                   string `json:"error,omitempty"`
+	ErrorDescription        string `json:"error_description,omitempty"`
+}
+
+func (d *oidcDeviceResponse) setStatus(status string) {
+	if d.Error == "" {
+		d.Error = status
+	}
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// handleDeviceAuthorization starts a device code login for a CLI client
+func (rs *RelayServer) handleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rs.sso == nil {
+		writeOAuthError(w, http.StatusNotFound, "unsupported", "SSO is not configured")
+		return
+	}
+	d, err := rs.sso.provider.discover()
+	if err != nil || d.DeviceAuthorizationEndpoint == "" {
+		rs.logger.Error("Device login unavailable: %v", err)
+		writeOAuthError(w, http.StatusNotImplemented, "unsupported", "SSO provider has no device authorization endpoint")
+		return
+	}
+
+	var device oidcDeviceResponse
+	err = rs.sso.provider.postForm(d.DeviceAuthorizationEndpoint, url.Values{"scope": {rs.sso.provider.scopes}}, &device)
+	if err != nil || device.Error != "" {
+		rs.logger.Error("Device authorization failed: %v %s", err, device.Error)
+		writeOAuthError(w, http.StatusBadGateway, "server_error", "device authorization failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&device)
+}
+
+// handleDeviceToken is polled by the CLI until the user has approved the
+// device code, then answers with a relay session token
+func (rs *RelayServer) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rs.sso == nil {
+		writeOAuthError(w, http.StatusNotFound, "unsupported", "SSO is not configured")
+		return
+	}
+
+	var req struct {
+		DeviceCode string `json:"device_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceCode == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "device_code is required")
+		return
+	}
+
+	token, err := rs.sso.provider.exchange(url.Values{
+		"grant_type":  {deviceCodeGrant},
+		"device_code": {req.DeviceCode},
+	})
+	if err != nil {
+		rs.logger.Error("Device token request failed: %v", err)
+		writeOAuthError(w, http.StatusBadGateway, "server_error", "SSO provider unavailable")
+		return
+	}
+	// authorization_pending, slow_down, access_denied and expired_token
+	// go back to the CLI as they are
+	if token.Error != "" {
+		writeOAuthError(w, http.StatusBadRequest, token.Error, token.ErrorDescription)
+		return
+	}
+
+	claims, err := rs.sso.provider.verifyIDToken(token.IDToken)
+	var user *AuthUser
+	if err == nil {
+		user, err = rs.sso.provision(claims)
+	}
+	if err != nil {
+		rs.logger.Error("Device login failed: %v", err)
+		writeOAuthError(w, http.StatusUnauthorized, "access_denied", "SSO login failed")
+		return
+	}
+
+	session, _, err := rs.webSessions.Create(user, r)
+	if err != nil {
+		rs.logger.Error("Failed to create session for %s: %v", user.Username, err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to create session")
+		return
+	}
+	rs.logger.Info("User %s logged in via SSO device code (session %s)", user.Username, session.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"token":      rs.tokens.Sign(session),
+		"token_type": "Bearer",
+		"expires_at": session.ExpiresAt,
+		"user": map[string]string{
+			"username": user.Username,
+			"role":     user.Role,
+		},
+	})
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"ssh-tunnel/internal/common"
+)
+
+const testRedirectURL = "https://relay.example.com/auth/oidc/callback"
+
+// mockIdP is an OpenID provider serving discovery, JWKS, the authorization
+// and device authorization endpoints and the token endpoint. The
+// authorization endpoint approves every request at once, as if the user
+// had signed in.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	claims map[string]interface{} // ID token claims besides iss, aud, exp and nonce
+
+	mu         sync.Mutex
+	codes      map[string]mockGrant // by authorization code
+	devicePoll []string             // token endpoint errors for the device code, in order
+	nonce      string               // replaces the requested nonce when set
+	tokenCalls int
+}
+
+// mockGrant is an issued authorization code
+type mockGrant struct {
+	challenge string
+	nonce     string
+	redirect  string
+}
+
+const mockDeviceCode = "device-code-1"
+
+func startMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := &mockIdP{
+		t:      t,
+		claims: map[string]interface{}{"preferred_username": "alice", "sub": "user-1"},
+		codes:  make(map[string]mockGrant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/jwks", idp.handleJWKS)
+	mux.HandleFunc("/authorize", idp.handleAuthorize)
+	mux.HandleFunc("/device", idp.handleDevice)
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	base := idp.server.URL
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                        base,
+		"authorization_endpoint":        base + "/authorize",
+		"token_endpoint":                base + "/token",
+		"device_authorization_endpoint": base + "/device",
+		"jwks_uri":                      base + "/jwks",
+	})
+}
+
+func (idp *mockIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	key := testSigningKey.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *mockIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomToken(8)
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirect: q.Get("redirect_uri")}
+	idp.mu.Unlock()
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (idp *mockIdP) handleDevice(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.PostForm.Get("client_id") != testClientID {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":      mockDeviceCode,
+		"user_code":        "ABCD-EFGH",
+		"verification_uri": idp.server.URL + "/activate",
+		"expires_in":       600,
+		"interval":         5,
+	})
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	form := r.PostForm
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.tokenCalls++
+
+	if form.Get("client_id") != testClientID {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	var nonce string
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		grant, ok := idp.codes[form.Get("code")]
+		delete(idp.codes, form.Get("code"))
+		verifier := sha256.Sum256([]byte(form.Get("code_verifier")))
+		if !ok || grant.redirect != form.Get("redirect_uri") ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code or verifier mismatch")
+			return
+		}
+		nonce = grant.nonce
+	case deviceCodeGrant:
+		if form.Get("device_code") != mockDeviceCode {
+			writeOAuthError(w, http.StatusBadRequest, "expired_token", "")
+			return
+		}
+		if len(idp.devicePoll) > 0 {
+			code := idp.devicePoll[0]
+			idp.devicePoll = idp.devicePoll[1:]
+			writeOAuthError(w, http.StatusBadRequest, code, "")
+			return
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	if idp.nonce != "" {
+		nonce = idp.nonce
+	}
+	claims := idTokenClaims(map[string]interface{}{"iss": idp.server.URL})
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     signJWT(idp.t, testSigningKey, map[string]interface{}{"alg": "RS256", "kid": "key-1"}, claims),
+	})
+}
+
+func (idp *mockIdP) tokenRequests() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.tokenCalls
+}
+
+// testSSORelay returns a relay whose SSO uses idp and whose database is
+// mocked
+func testSSORelay(t *testing.T, idp *mockIdP) (*RelayServer, sqlmock.Sqlmock) {
+	t.Helper()
+	rs, mock := testRelay(t)
+	return withSSO(rs, idp), mock
+}
+
+func withSSO(rs *RelayServer, idp *mockIdP) *RelayServer {
+	rs.webSessions, _ = newSessionStore(rs, "", time.Hour)
+	rs.tokens, _ = newTokenSigner(testSessionSecret)
+	rs.sso = &oidcSSO{
+		rs: rs,
+		provider: &oidcProvider{
+			issuer:        idp.server.URL,
+			clientID:      testClientID,
+			scopes:        "openid profile",
+			usernameClaim: "preferred_username",
+			httpClient:    idp.server.Client(),
+		},
+		redirectURL: testRedirectURL,
+		groupsClaim: defaultGroupsClaim,
+		adminGroups: map[string]bool{"tunnel-admins": true},
+		pending:     make(map[string]*oidcLogin),
+	}
+	return rs
+}
+
+// expectNewSSOUser expects the first login of alice: the user is
+// provisioned, has no project assignments and gets a web session
+func expectNewSSOUser(mock sqlmock.Sqlmock, role string) {
+	mock.ExpectQuery("SELECT id, username, role FROM users WHERE auth_source = ? AND oidc_subject = ?").WithArgs("oidc", "user-1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id, role, auth_source, oidc_subject FROM users WHERE username = ?").WithArgs("alice").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO users (username, password, role, token, auth_source, oidc_subject)").
+		WithArgs("alice", sqlmock.AnyArg(), role, sqlmock.AnyArg(), "oidc", "user-1").WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT project_id, role, assigned_by FROM user_project_assignments WHERE user_id = ?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"project_id", "role", "assigned_by"}))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO web_sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// browserLogin starts a login on the relay and lets the IdP approve it. It
+// returns the callback request the browser would make.
+func browserLogin(t *testing.T, rs *RelayServer, idp *mockIdP) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rs.handleOIDCLogin(rec, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d", rec.Code)
+	}
+	authorize := rec.Header().Get("Location")
+	if !strings.HasPrefix(authorize, idp.server.URL+"/authorize?") {
+		t.Fatalf("login redirected to %s", authorize)
+	}
+	q, _ := url.Parse(authorize)
+	if q.Query().Get("state") == "" || q.Query().Get("nonce") == "" || q.Query().Get("code_challenge") == "" {
+		t.Fatalf("authorization request without state, nonce or PKCE: %s", authorize)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(authorize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, testRedirectURL+"?") {
+		t.Fatalf("IdP redirected to %q (%s)", callback, resp.Status)
+	}
+
+	req := httptest.NewRequest("GET", callback, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := startMockIdP(t)
+	idp.claims["groups"] = []string{"tunnel-admins"}
+	rs, mock := testSSORelay(t, idp)
+	expectNewSSOUser(mock, "admin")
+
+	rec := httptest.NewRecorder()
+	rs.handleOIDCCallback(rec, browserLogin(t, rs, idp))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatalf("callback: status %d, location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	var session *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil || session.Value == "" {
+		t.Error("no session cookie")
+	}
+	if len(rs.sso.pending) != 0 {
+		t.Error("pending login kept after the callback")
+	}
+}
+
+func TestOIDCCallbackFrontend(t *testing.T) {
+	idp := startMockIdP(t)
+	rs, mock := testSSORelay(t, idp)
+	rs.sso.frontendURL = "https://dashboard.example.com/sso"
+	expectNewSSOUser(mock, "user")
+
+	rec := httptest.NewRecorder()
+	rs.handleOIDCCallback(rec, browserLogin(t, rs, idp))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusSeeOther || location == nil || location.Host != "dashboard.example.com" {
+		t.Fatalf("callback: status %d, location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	fragment, _ := url.ParseQuery(location.Fragment)
+	claims, err := rs.tokens.Verify(fragment.Get("token"))
+	if err != nil || claims.Username != "alice" || claims.Role != "user" {
+		t.Errorf("token in fragment: %+v, %v", claims, err)
+	}
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		// change alters the login before the callback is made
+		change func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request
+		status int
+		// exchange tells whether the code is sent to the token endpoint
+		exchange bool
+	}{
+		{"State mismatch", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			req.Header.Set("Cookie", oidcStateCookie+"=another-state")
+			return req
+		}, http.StatusBadRequest, false},
+		{"No state cookie", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			req.Header.Del("Cookie")
+			return req
+		}, http.StatusBadRequest, false},
+		{"Unknown state", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			rs.sso.pending = make(map[string]*oidcLogin)
+			return req
+		}, http.StatusBadRequest, false},
+		{"Expired login", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			for _, login := range rs.sso.pending {
+				login.expires = time.Now().Add(-time.Second)
+			}
+			return req
+		}, http.StatusBadRequest, false},
+		{"Wrong PKCE verifier", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			for _, login := range rs.sso.pending {
+				login.verifier = randomToken(32)
+			}
+			return req
+		}, http.StatusUnauthorized, true},
+		{"Nonce mismatch", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			idp.nonce = "replayed-nonce"
+			return req
+		}, http.StatusUnauthorized, true},
+		{"Refused by the provider", func(rs *RelayServer, idp *mockIdP, req *http.Request) *http.Request {
+			return httptest.NewRequest("GET", testRedirectURL+"?error=access_denied", nil)
+		}, http.StatusUnauthorized, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := startMockIdP(t)
+			// The database would let the login through; it must not get
+			// that far
+			db, mock := mockDB(t)
+			rs := withSSO(&RelayServer{db: db, logger: &common.Logger{}}, idp)
+			expectNewSSOUser(mock, "user")
+			req := tt.change(rs, idp, browserLogin(t, rs, idp))
+
+			rec := httptest.NewRecorder()
+			rs.handleOIDCCallback(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if exchanged := idp.tokenRequests() > 0; exchanged != tt.exchange {
+				t.Errorf("code exchanged = %v, want %v", exchanged, tt.exchange)
+			}
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == sessionCookie {
+					t.Error("session cookie set")
+				}
+			}
+			if mock.ExpectationsWereMet() == nil {
+				t.Error("user logged in")
+			}
+		})
+	}
+}
+
+// A callback cannot be replayed: its state is consumed by the first use
+func TestOIDCCallbackReplay(t *testing.T) {
+	idp := startMockIdP(t)
+	rs, mock := testSSORelay(t, idp)
+	expectNewSSOUser(mock, "user")
+
+	req := browserLogin(t, rs, idp)
+	rs.handleOIDCCallback(httptest.NewRecorder(), req)
+
+	replay := httptest.NewRequest("GET", req.URL.String(), nil)
+	replay.Header.Set("Cookie", req.Header.Get("Cookie"))
+	rec := httptest.NewRecorder()
+	rs.handleOIDCCallback(rec, replay)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: status %d", rec.Code)
+	}
+}
+
+// postDeviceToken polls the relay's device token endpoint and decodes the
+// JSON reply
+func postDeviceToken(t *testing.T, rs *RelayServer, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rs.handleDeviceToken(rec, httptest.NewRequest("POST", "/auth/device/token", strings.NewReader(body)))
+	var reply map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+		t.Fatalf("device token reply: %v", err)
+	}
+	return rec.Code, reply
+}
+
+func TestOIDCDeviceFlow(t *testing.T) {
+	idp := startMockIdP(t)
+	idp.devicePoll = []string{"authorization_pending", "slow_down", "authorization_pending"}
+	rs, mock := testSSORelay(t, idp)
+
+	rec := httptest.NewRecorder()
+	rs.handleDeviceAuthorization(rec, httptest.NewRequest("POST", "/auth/device", nil))
+	var device oidcDeviceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&device); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("device authorization: status %d, %v", rec.Code, err)
+	}
+	if device.DeviceCode != mockDeviceCode || device.UserCode != "ABCD-EFGH" || device.Interval != 5 {
+		t.Errorf("device authorization %+v", device)
+	}
+
+	body := `{"device_code": "` + device.DeviceCode + `"}`
+
+	// Until the user approves, the IdP's answers are passed on for the CLI
+	// to keep polling
+	for _, want := range []string{"authorization_pending", "slow_down", "authorization_pending"} {
+		status, reply := postDeviceToken(t, rs, body)
+		if status != http.StatusBadRequest || reply["error"] != want {
+			t.Fatalf("poll: status %d, %v, want %s", status, reply, want)
+		}
+	}
+
+	expectNewSSOUser(mock, "user")
+	status, reply := postDeviceToken(t, rs, body)
+	if status != http.StatusOK || reply["token_type"] != "Bearer" {
+		t.Fatalf("approved poll: status %d, %v", status, reply)
+	}
+	token, _ := reply["token"].(string)
+	claims, err := rs.tokens.Verify(token)
+	if err != nil || claims.Username != "alice" {
+		t.Errorf("device token: %+v, %v", claims, err)
+	}
+}
+
+func TestOIDCDeviceTokenErrors(t *testing.T) {
+	idp := startMockIdP(t)
+	rs, _ := testSSORelay(t, idp)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		error  string
+	}{
+		{"No device code", `{}`, http.StatusBadRequest, "invalid_request"},
+		{"Not JSON", `device_code=x`, http.StatusBadRequest, "invalid_request"},
+		{"Expired device code", `{"device_code": "old"}`, http.StatusBadRequest, "expired_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := postDeviceToken(t, rs, tt.body)
+			if status != tt.status || reply["error"] != tt.error {
+				t.Errorf("status %d, %v, want %d %s", status, reply, tt.status, tt.error)
+			}
+		})
+	}
+}
+
+func TestParseGroupMappings(t *testing.T) {
+	mappings, err := parseGroupMappings(" ops=web:operator, admins=*:admin,,team=db:prod:viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []groupMapping{{"ops", "web", "operator"}, {"admins", "*", "admin"}, {"team", "db:prod", "viewer"}}
+	if len(mappings) != len(want) {
+		t.Fatalf("mappings %v", mappings)
+	}
+	for i := range want {
+		if mappings[i] != want[i] {
+			t.Errorf("mapping %d = %+v, want %+v", i, mappings[i], want[i])
+		}
+	}
+
+	for _, spec := range []string{"ops", "ops=web", "=web:viewer", "ops=:viewer", "ops=web:owner"} {
+		if _, err := parseGroupMappings(spec); err == nil {
+			t.Errorf("parseGroupMappings(%q) accepted", spec)
+		}
+	}
+}
+
+func TestProvisionRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  []string
+		known   bool        // whether the subject is linked to a user already
+		source  interface{} // auth_source of a row holding the username, nil for none
+		subject interface{} // oidc_subject of that row
+		role    string      // role of the existing row
+		want    string
+		update  bool // whether users.role is changed
+		refused bool
+	}{
+		{"New user", []string{"staff"}, false, nil, nil, "", "user", false, false},
+		{"New admin", []string{"staff", "tunnel-admins"}, false, nil, nil, "", "admin", false, false},
+		{"SSO user promoted", []string{"tunnel-admins"}, true, nil, nil, "user", "admin", true, false},
+		{"SSO user demoted", []string{"staff"}, true, nil, nil, "admin", "user", true, false},
+		{"SSO user unchanged", []string{"staff"}, true, nil, nil, "user", "user", false, false},
+		{"SSO user without subject linked", []string{"tunnel-admins"}, false, "oidc", nil, "user", "admin", true, false},
+		{"Local account refused", []string{"staff"}, false, "local", nil, "admin", "", false, true},
+		{"LDAP account refused", []string{"tunnel-admins"}, false, "ldap", nil, "user", "", false, true},
+		{"Other subject refused", []string{"staff"}, false, "oidc", "user-2", "user", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSSORelay(t, startMockIdP(t))
+			query := mock.ExpectQuery("SELECT id, username, role FROM users WHERE auth_source = ? AND oidc_subject = ?").WithArgs("oidc", "user-1")
+			switch {
+			case tt.known:
+				query.WillReturnRows(sqlmock.NewRows([]string{"id", "username", "role"}).AddRow(7, "alice", tt.role))
+			case tt.source == nil:
+				query.WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT id, role, auth_source, oidc_subject FROM users WHERE username = ?").WithArgs("alice").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO users").WithArgs("alice", sqlmock.AnyArg(), tt.want, sqlmock.AnyArg(), "oidc", "user-1").
+					WillReturnResult(sqlmock.NewResult(7, 1))
+			default:
+				query.WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT id, role, auth_source, oidc_subject FROM users WHERE username = ?").WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "role", "auth_source", "oidc_subject"}).AddRow(7, tt.role, tt.source, tt.subject))
+				if !tt.refused {
+					mock.ExpectExec("UPDATE users SET oidc_subject = ? WHERE id = ?").WithArgs("user-1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			if tt.update {
+				mock.ExpectExec("UPDATE users SET role = ? WHERE id = ?").WithArgs(tt.want, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				// Sessions created with the old role end
+				mock.ExpectExec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE username = ?").
+					WithArgs(sqlmock.AnyArg(), "oidc", "alice").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if !tt.refused {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT project_id, role, assigned_by FROM user_project_assignments").
+					WillReturnRows(sqlmock.NewRows([]string{"project_id", "role", "assigned_by"}))
+				mock.ExpectCommit()
+			}
+
+			groups := make([]interface{}, len(tt.groups))
+			for i, g := range tt.groups {
+				groups[i] = g
+			}
+			user, err := rs.sso.provision(map[string]interface{}{"preferred_username": "alice", "sub": "user-1", "groups": groups})
+			if tt.refused {
+				// The account is neither logged in to nor given project roles
+				if err == nil {
+					t.Errorf("SSO login took over the existing account: %+v", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("provision: %v", err)
+			}
+			if user.Role != tt.want {
+				t.Errorf("role %s, want %s", user.Role, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionBySubject(t *testing.T) {
+	rs, mock := testSSORelay(t, startMockIdP(t))
+
+	// The user was renamed at the IdP; the account follows the subject
+	mock.ExpectQuery("SELECT id, username, role FROM users WHERE auth_source = ? AND oidc_subject = ?").WithArgs("oidc", "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "role"}).AddRow(7, "alice", "user"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT project_id, role, assigned_by FROM user_project_assignments").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"project_id", "role", "assigned_by"}))
+	mock.ExpectCommit()
+
+	user, err := rs.sso.provision(map[string]interface{}{"preferred_username": "alice.smith", "sub": "user-1"})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("renamed user logged in as %s", user.Username)
+	}
+
+	if _, err := rs.sso.provision(map[string]interface{}{"preferred_username": "alice"}); err == nil {
+		t.Error("claims without sub accepted")
+	}
+}
+
+func TestSyncAssignments(t *testing.T) {
+	rs, mock := testSSORelay(t, startMockIdP(t))
+	mock.MatchExpectationsInOrder(false)
+	var err error
+	rs.sso.mappings, err = parseGroupMappings("ops=web:viewer,ops=web:operator,dev=db:viewer,ops=ghost:admin,everyone=*:viewer,admins=*:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projectID := func(name string, id int) {
+		mock.ExpectQuery("SELECT id FROM projects WHERE project_name = ?").WithArgs(name).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	}
+	projectID("web", 1)
+	projectID("web", 1)
+	projectID("db", 2)
+	mock.ExpectQuery("SELECT id FROM projects WHERE project_name = ?").WithArgs("ghost").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id FROM projects WHERE status = 'active'").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(5))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT project_id, role, assigned_by FROM user_project_assignments WHERE user_id = ?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"project_id", "role", "assigned_by"}).
+			AddRow(1, "viewer", "oidc").   // raised to operator
+			AddRow(2, "admin", "admin").   // assigned by hand, kept
+			AddRow(3, "operator", "oidc"). // no longer granted, removed
+			AddRow(4, "admin", nil))       // assigned by hand, kept
+	mock.ExpectExec("UPDATE user_project_assignments SET role = ?, status = 'active' WHERE user_id = ? AND project_id = ?").
+		WithArgs("operator", 7, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_project_assignments").WithArgs(7, 5, "viewer", "oidc").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_project_assignments WHERE user_id = ? AND project_id = ?").
+		WithArgs(7, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// Not in admins, so the "*" admin grant does not apply
+	if err := rs.sso.syncAssignments(7, []string{"ops", "dev", "everyone"}); err != nil {
+		t.Fatalf("syncAssignments: %v", err)
+	}
+}
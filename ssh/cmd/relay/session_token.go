@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultSessionTTL = 24 * time.Hour
+
+var errInvalidToken = errors.New("invalid session token")
+
+// SessionClaims is the content of a signed session token
+type SessionClaims struct {
+	Username  string `json:"sub"`
+	Role      string `json:"role"`
+	Backend   string `json:"auth,omitempty"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// tokenSigner issues and checks session tokens: base64url JSON claims and
+// their HMAC-SHA256, joined by a dot. Each token names a web session, so
+// revoking the session also invalidates the token.
+type tokenSigner struct {
+	key []byte
+}
+
+// newTokenSigner uses secret as the HMAC key, or a random key when it is
+// empty
+func newTokenSigner(secret string) (*tokenSigner, error) {
+	s := &tokenSigner{key: []byte(secret)}
+	if secret == "" {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			return nil, fmt.Errorf("generate session key: %w", err)
+		}
+	} else if len(secret) < 32 {
+		return nil, fmt.Errorf("SESSION_SECRET must be at least 32 characters")
+	}
+	return s, nil
+}
+
+// parseSessionTTL reads SESSION_TTL, a Go duration defaulting to 24h
+func parseSessionTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return defaultSessionTTL, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid SESSION_TTL %q", ttl)
+	}
+	return d, nil
+}
+
+// Sign issues a token for a web session; it expires with the session
+func (s *tokenSigner) Sign(session *WebSession) string {
+	payload, _ := json.Marshal(&SessionClaims{
+		Username:  session.Username,
+		Role:      session.Role,
+		Backend:   session.Backend,
+		SessionID: session.ID,
+		IssuedAt:  session.LoginTime.Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded))
+}
+
+// Verify checks the signature and expiry of a token
+func (s *tokenSigner) Verify(token string) (*SessionClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, s.mac(encoded)) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims SessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Username == "" || claims.SessionID == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("session token expired")
+	}
+	return &claims, nil
+}
+
+func (s *tokenSigner) mac(data string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
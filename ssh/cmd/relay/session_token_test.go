@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+func testWebSession(expires time.Time) *WebSession {
+	return &WebSession{
+		ID:        "session-1",
+		Username:  "alice",
+		Role:      "admin",
+		Backend:   "local",
+		LoginTime: time.Now().Add(-time.Minute),
+		ExpiresAt: expires,
+	}
+}
+
+func TestNewTokenSigner(t *testing.T) {
+	if _, err := newTokenSigner("too short"); err == nil {
+		t.Error("secret shorter than 32 characters accepted")
+	}
+	if _, err := newTokenSigner(testSessionSecret); err != nil {
+		t.Errorf("32 character secret refused: %v", err)
+	}
+
+	// Without a secret every signer gets its own random key
+	a, err := newTokenSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newTokenSigner("")
+	if _, err := b.Verify(a.Sign(testWebSession(time.Now().Add(time.Hour)))); err == nil {
+		t.Error("token accepted by a signer with another random key")
+	}
+}
+
+func TestTokenSignerVerify(t *testing.T) {
+	signer, _ := newTokenSigner(testSessionSecret)
+	other, _ := newTokenSigner(strings.Repeat("x", 32))
+	token := signer.Sign(testWebSession(time.Now().Add(time.Hour)))
+	payload, signature, _ := strings.Cut(token, ".")
+
+	claims, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Username != "alice" || claims.Role != "admin" || claims.SessionID != "session-1" {
+		t.Errorf("claims %+v", claims)
+	}
+
+	// A payload naming another session, sent with the original MAC
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","role":"admin","sid":"session-2","exp":9999999999}`))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Tampered payload", forged + "." + signature},
+		{"Tampered signature", payload + "." + base64.RawURLEncoding.EncodeToString([]byte("not the mac"))},
+		{"Signature not base64", payload + ".!!"},
+		{"No signature", payload},
+		{"Empty", ""},
+		{"Other key", other.Sign(testWebSession(time.Now().Add(time.Hour)))},
+		{"Expired", signer.Sign(testWebSession(time.Now().Add(-time.Second)))},
+		{"No session", signer.Sign(&WebSession{Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if claims, err := signer.Verify(tt.token); err == nil {
+				t.Errorf("token accepted: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestParseSessionTTL(t *testing.T) {
+	if d, err := parseSessionTTL(""); err != nil || d != defaultSessionTTL {
+		t.Errorf("default TTL = %v, %v", d, err)
+	}
+	if d, err := parseSessionTTL("90m"); err != nil || d != 90*time.Minute {
+		t.Errorf("parseSessionTTL(90m) = %v, %v", d, err)
+	}
+	for _, ttl := range []string{"0", "-1h", "day"} {
+		if _, err := parseSessionTTL(ttl); err == nil {
+			t.Errorf("parseSessionTTL(%q) accepted", ttl)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie          = "tunnel-session"
+	defaultSessionIdle     = 2 * time.Hour
+	sessionTouchInterval   = time.Minute
+	sessionCleanupInterval = time.Hour
+	// Ended sessions stay listed this long before they are deleted
+	sessionRetention = 7 * 24 * time.Hour
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionExpired  = errors.New("session expired")
+)
+
+// WebSession is a dashboard or API login kept in web_sessions. ID is public
+// and names the session in the API; the secret in the cookie is only stored
+// as a SHA-256 hash.
+type WebSession struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Role       string    `json:"role"`
+	Backend    string    `json:"auth_backend"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	LoginTime  time.Time `json:"login_time"`
+	LastSeen   time.Time `json:"last_seen"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// sessionStore keeps web sessions in MySQL so they survive relay restarts.
+// A session ends after idle without use or absolute after login, whichever
+// comes first, or when it is revoked.
+type sessionStore struct {
+	rs       *RelayServer
+	idle     time.Duration
+	absolute time.Duration
+}
+
+// newSessionStore reads the idle timeout from SESSION_IDLE_TIMEOUT (default
+// 2h); absolute is the SESSION_TTL shared with the signed tokens
+func newSessionStore(rs *RelayServer, idle string, absolute time.Duration) (*sessionStore, error) {
+	s := &sessionStore{rs: rs, idle: defaultSessionIdle, absolute: absolute}
+	if idle != "" {
+		d, err := time.ParseDuration(idle)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_IDLE_TIMEOUT %q", idle)
+		}
+		s.idle = d
+	}
+	return s, nil
+}
+
+func hashSessionSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Create stores a new session and returns it with the cookie secret
+func (s *sessionStore) Create(user *AuthUser, r *http.Request) (*WebSession, string, error) {
+	if s.rs.db == nil {
+		return nil, "", fmt.Errorf("database not connected")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	session := &WebSession{
+		ID:         randomToken(12),
+		Username:   user.Username,
+		Role:       user.Role,
+		Backend:    user.Backend,
+		RemoteAddr: truncate(r.RemoteAddr, 64),
+		UserAgent:  truncate(r.UserAgent(), 255),
+		LoginTime:  now,
+		LastSeen:   now,
+		ExpiresAt:  now.Add(s.absolute),
+	}
+	secret := randomToken(32)
+
+	_, err := s.rs.db.Exec(`
+		INSERT INTO web_sessions (session_id, secret_hash, username, role, auth_backend, remote_addr, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, hashSessionSecret(secret), session.Username, session.Role, session.Backend,
+		session.RemoteAddr, session.UserAgent, session.LoginTime, session.LastSeen, session.ExpiresAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("store session: %w", err)
+	}
+	return session, secret, nil
+}
+
+// BySecret returns the live session for a cookie value
+func (s *sessionStore) BySecret(secret string) (*WebSession, error) {
+	return s.lookup("secret_hash", hashSessionSecret(secret))
+}
+
+// ByID returns the live session with a public ID
+func (s *sessionStore) ByID(id string) (*WebSession, error) {
+	return s.lookup("session_id", id)
+}
+
+// lookup loads a session that is neither revoked nor timed out and records
+// its use
+func (s *sessionStore) lookup(column, value string) (*WebSession, error) {
+	if s.rs.db == nil || value == "" {
+		return nil, errSessionNotFound
+	}
+
+	var session WebSession
+	err := s.rs.db.QueryRow(`
+		SELECT session_id, username, role, auth_backend, remote_addr, user_agent, created_at, last_seen_at, expires_at
+		FROM web_sessions WHERE `+column+` = ? AND revoked_at IS NULL`, value).Scan(
+		&session.ID, &session.Username, &session.Role, &session.Backend, &session.RemoteAddr,
+		&session.UserAgent, &session.LoginTime, &session.LastSeen, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query session: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if now.After(session.ExpiresAt) || now.Sub(session.LastSeen) > s.idle {
+		return nil, errSessionExpired
+	}
+
+	// Writing on every request is not needed for minute-level idle timeouts
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		session.LastSeen = now.Truncate(time.Second)
+		if _, err := s.rs.db.Exec("UPDATE web_sessions SET last_seen_at = ? WHERE session_id = ?", session.LastSeen, session.ID); err != nil {
+			s.rs.logger.Error("Failed to update session %s: %v", session.ID, err)
+		}
+	}
+	return &session, nil
+}
+
+// List returns the live sessions of a user, or of everyone when username
+// is empty, newest first
+func (s *sessionStore) List(username string) ([]*WebSession, error) {
+	if s.rs.db == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	now := time.Now().UTC()
+	query := `
+		SELECT session_id, username, role, auth_backend, remote_addr, user_agent, created_at, last_seen_at, expires_at
+		FROM web_sessions WHERE revoked_at IS NULL AND expires_at > ? AND last_seen_at > ?`
+	args := []interface{}{now, now.Add(-s.idle)}
+	if username != "" {
+		query += " AND username = ?"
+		args = append(args, username)
+	}
+	rows, err := s.rs.db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*WebSession{}
+	for rows.Next() {
+		var session WebSession
+		if err := rows.Scan(&session.ID, &session.Username, &session.Role, &session.Backend, &session.RemoteAddr,
+			&session.UserAgent, &session.LoginTime, &session.LastSeen, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke ends one session
+func (s *sessionStore) Revoke(id, by string) error {
+	if s.rs.db == nil {
+		return fmt.Errorf("database not connected")
+	}
+	result, err := s.rs.db.Exec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE session_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), by, id)
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+// RevokeUser ends every session of a user and returns how many were live
+func (s *sessionStore) RevokeUser(username, by string) (int64, error) {
+	if s.rs.db == nil {
+		return 0, fmt.Errorf("database not connected")
+	}
+	result, err := s.rs.db.Exec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE username = ? AND revoked_at IS NULL",
+		time.Now().UTC(), by, username)
+	if err != nil {
+		return 0, fmt.Errorf("revoke sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// revokeChangedUser ends the sessions of a user whose role, password or
+// username was changed. Sessions keep the role they were created with, so
+// without this a demoted admin stays admin until the session expires.
+func (rs *RelayServer) revokeChangedUser(username, by string) {
+	count, err := rs.webSessions.RevokeUser(username, by)
+	if err != nil {
+		rs.logger.Error("Failed to revoke sessions of %s: %v", username, err)
+		return
+	}
+	if count > 0 {
+		rs.logger.Info("Revoked %d sessions of %s after an account change", count, username)
+	}
+}
+
+// periodicCleanup deletes sessions that ended more than sessionRetention ago
+func (s *sessionStore) periodicCleanup() {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.rs.db == nil {
+			continue
+		}
+		cutoff := time.Now().UTC().Add(-sessionRetention)
+		result, err := s.rs.db.Exec("DELETE FROM web_sessions WHERE expires_at < ? OR last_seen_at < ? OR revoked_at < ?",
+			cutoff, cutoff.Add(-s.idle), cutoff)
+		if err != nil {
+			s.rs.logger.Error("Failed to clean up web sessions: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			s.rs.logger.Debug("Deleted %d ended web sessions", n)
+		}
+	}
+}
+
+// setSessionCookie hands the session's secret to the browser
+func setSessionCookie(w http.ResponseWriter, r *http.Request, session *WebSession, secret string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionFromToken verifies a signed token and returns its live session
+func (rs *RelayServer) sessionFromToken(token string) (*WebSession, error) {
+	claims, err := rs.tokens.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return rs.webSessions.ByID(claims.SessionID)
+}
+
+// sessionFromCookie returns the live session of the request's cookie
+func (rs *RelayServer) sessionFromCookie(r *http.Request) (*WebSession, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, errSessionNotFound
+	}
+	return rs.webSessions.BySecret(cookie.Value)
+}
+
+// endWebSession revokes the session of the request's cookie, if any
+func (rs *RelayServer) endWebSession(r *http.Request) {
+	session, err := rs.sessionFromCookie(r)
+	if err != nil {
+		return
+	}
+	if err := rs.webSessions.Revoke(session.ID, session.Username); err != nil {
+		rs.logger.Error("Failed to revoke session %s: %v", session.ID, err)
+		return
+	}
+	rs.logger.Info("User %s logged out (session %s)", session.Username, session.ID)
+}
+
+// handleAPIWebSessions lists sessions (GET; admins may pass ?username= or
+// ?all=true) and revokes one (DELETE /api/auth/sessions/{id}). Users manage
+// their own sessions, admins everyone's.
+func (rs *RelayServer) handleAPIWebSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("X-Username")
+	isAdmin := r.Header.Get("X-User-Role") == "admin"
+
+	switch r.Method {
+	case "GET":
+		target := username
+		if isAdmin {
+			if r.URL.Query().Get("all") == "true" {
+				target = ""
+			} else if u := r.URL.Query().Get("username"); u != "" {
+				target = u
+			}
+		}
+
+		sessions, err := rs.webSessions.List(target)
+		if err != nil {
+			rs.logger.Error("Failed to list web sessions: %v", err)
+			http.Error(w, "Failed to retrieve sessions", http.StatusInternalServerError)
+			return
+		}
+
+		current := r.Header.Get("X-Session-ID")
+		list := make([]map[string]interface{}, 0, len(sessions))
+		for _, session := range sessions {
+			list = append(list, map[string]interface{}{
+				"id":           session.ID,
+				"username":     session.Username,
+				"role":         session.Role,
+				"auth_backend": session.Backend,
+				"remote_addr":  session.RemoteAddr,
+				"user_agent":   session.UserAgent,
+				"login_time":   session.LoginTime,
+				"last_seen":    session.LastSeen,
+				"expires_at":   session.ExpiresAt,
+				"current":      session.ID == current,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, "/api/auth/sessions/")
+		if id == "" || strings.Contains(id, "/") {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+
+		// Someone else's session is reported as missing to non-admins
+		session, err := rs.webSessions.ByID(id)
+		if err != nil || (!isAdmin && session.Username != username) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err := rs.webSessions.Revoke(id, username); err != nil {
+			rs.logger.Error("Failed to revoke session %s: %v", id, err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		rs.logger.Info("Session %s of %s revoked by %s", id, session.Username, username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Session revoked",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPIForceLogout ends every session of a user (admin only)
+func (rs *RelayServer) handleAPIForceLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Forbidden: Admin access required", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	admin := r.Header.Get("X-Username")
+	count, err := rs.webSessions.RevokeUser(req.Username, admin)
+	if err != nil {
+		rs.logger.Error("Failed to force logout %s: %v", req.Username, err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	rs.logger.Info("Admin %s force-logged out %s (%d sessions)", admin, req.Username, count)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"revoked": count,
+	})
+}
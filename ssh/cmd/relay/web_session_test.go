@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const sessionQuery = "FROM web_sessions WHERE session_id = ? AND revoked_at IS NULL"
+
+// testSessionRelay returns a relay with a 2h idle and 24h absolute session
+// timeout over a mock database
+func testSessionRelay(t *testing.T) (*RelayServer, sqlmock.Sqlmock) {
+	t.Helper()
+	rs, mock := testRelay(t)
+	rs.webSessions, _ = newSessionStore(rs, "2h", 24*time.Hour)
+	rs.tokens, _ = newTokenSigner(testSessionSecret)
+	return rs, mock
+}
+
+// sessionRows returns a web_sessions row for a session of username that
+// was created at login and last used at lastSeen
+func sessionRows(id, username, role string, login, lastSeen time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"session_id", "username", "role", "auth_backend", "remote_addr", "user_agent", "created_at", "last_seen_at", "expires_at"}).
+		AddRow(id, username, role, "local", "10.0.0.1:5000", "test", login, lastSeen, login.Add(24*time.Hour))
+}
+
+// captureArg matches any value and keeps it
+type captureArg struct {
+	value *driver.Value
+}
+
+func (c captureArg) Match(v driver.Value) bool {
+	*c.value = v
+	return true
+}
+
+func TestSessionCreate(t *testing.T) {
+	rs, mock := testSessionRelay(t)
+	var stored driver.Value
+	mock.ExpectExec("INSERT INTO web_sessions").
+		WithArgs(sqlmock.AnyArg(), captureArg{&stored}, "alice", "admin", "ldap", "10.0.0.1:5000", sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	session, secret, err := rs.webSessions.Create(&AuthUser{Username: "alice", Role: "admin", Backend: "ldap"}, req)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Only the hash of the cookie secret is stored
+	if stored != hashSessionSecret(secret) || strings.Contains(stored.(string), secret) {
+		t.Errorf("stored %v for secret %s", stored, secret)
+	}
+	if got := session.ExpiresAt.Sub(session.LoginTime); got != 24*time.Hour {
+		t.Errorf("session lasts %v", got)
+	}
+}
+
+func TestSessionLookup(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		login    time.Time
+		lastSeen time.Time
+		revoked  bool
+		err      error
+		touch    bool
+	}{
+		{"Live", now.Add(-time.Hour), now.Add(-10 * time.Second), false, nil, false},
+		{"Live, last use recorded", now.Add(-time.Hour), now.Add(-30 * time.Minute), false, nil, true},
+		{"Idle timeout", now.Add(-3 * time.Hour), now.Add(-2*time.Hour - time.Minute), false, errSessionExpired, false},
+		{"Absolute timeout", now.Add(-25 * time.Hour), now.Add(-time.Minute), false, errSessionExpired, false},
+		{"Revoked", now.Add(-time.Hour), now.Add(-time.Minute), true, errSessionNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			query := mock.ExpectQuery(sessionQuery).WithArgs("session-1")
+			if tt.revoked {
+				query.WillReturnError(sql.ErrNoRows)
+			} else {
+				query.WillReturnRows(sessionRows("session-1", "alice", "user", tt.login, tt.lastSeen))
+			}
+			if tt.touch {
+				mock.ExpectExec("UPDATE web_sessions SET last_seen_at = ? WHERE session_id = ?").
+					WithArgs(sqlmock.AnyArg(), "session-1").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			session, err := rs.webSessions.ByID("session-1")
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && session.Username != "alice" {
+				t.Errorf("session %+v", session)
+			}
+		})
+	}
+}
+
+// apiRequest sends a request through requireAPIAuth to handler
+func apiRequest(rs *RelayServer, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	rs.requireAPIAuth(handler)(rec, req)
+	return rec
+}
+
+func TestRequireAPIAuthSessions(t *testing.T) {
+	now := time.Now().UTC()
+	live := testWebSession(now.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		auth     func(req *http.Request, rs *RelayServer)
+		lastSeen time.Time
+		login    time.Time
+		query    bool // whether the session is looked up
+		status   int
+	}{
+		{"Cookie", func(req *http.Request, rs *RelayServer) {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "secret"})
+		}, now, now.Add(-time.Hour), true, http.StatusOK},
+		{"Cookie, idle", func(req *http.Request, rs *RelayServer) {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "secret"})
+		}, now.Add(-3 * time.Hour), now.Add(-4 * time.Hour), true, http.StatusUnauthorized},
+		{"Cookie, absolute timeout", func(req *http.Request, rs *RelayServer) {
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "secret"})
+		}, now, now.Add(-25 * time.Hour), true, http.StatusUnauthorized},
+		{"Bearer", func(req *http.Request, rs *RelayServer) {
+			req.Header.Set("Authorization", "Bearer "+rs.tokens.Sign(live))
+		}, now, now.Add(-time.Hour), true, http.StatusOK},
+		{"Bearer, idle", func(req *http.Request, rs *RelayServer) {
+			req.Header.Set("Authorization", "Bearer "+rs.tokens.Sign(live))
+		}, now.Add(-3 * time.Hour), now.Add(-4 * time.Hour), true, http.StatusUnauthorized},
+		{"Bearer, token expired", func(req *http.Request, rs *RelayServer) {
+			req.Header.Set("Authorization", "Bearer "+rs.tokens.Sign(testWebSession(now.Add(-time.Second))))
+		}, now, now.Add(-25 * time.Hour), false, http.StatusUnauthorized},
+		{"Nothing", func(req *http.Request, rs *RelayServer) {}, now, now, false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			if tt.query {
+				mock.ExpectQuery("FROM web_sessions WHERE").
+					WillReturnRows(sessionRows("session-1", "alice", "user", tt.login, tt.lastSeen))
+			}
+
+			req := httptest.NewRequest("GET", "/api/stats", nil)
+			req.Header.Set("X-User-Role", "admin") // set by the client, must be replaced
+			tt.auth(req, rs)
+
+			var role string
+			rec := apiRequest(rs, func(w http.ResponseWriter, r *http.Request) {
+				role = r.Header.Get("X-User-Role")
+			}, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Code == http.StatusOK && role != "user" {
+				t.Errorf("handler saw role %q", role)
+			}
+		})
+	}
+}
+
+// A bearer token stops working once its session is revoked
+func TestBearerTokenRevoked(t *testing.T) {
+	rs, mock := testSessionRelay(t)
+	login := time.Now().UTC().Add(-time.Hour)
+	session := testWebSession(login.Add(24 * time.Hour))
+	token := "Bearer " + rs.tokens.Sign(session)
+	rows := func() *sqlmock.Rows { return sessionRows(session.ID, "alice", "user", login, time.Now().UTC()) }
+
+	// The owner revokes the session with its own token
+	mock.ExpectQuery(sessionQuery).WithArgs(session.ID).WillReturnRows(rows())
+	mock.ExpectQuery(sessionQuery).WithArgs(session.ID).WillReturnRows(rows())
+	mock.ExpectExec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE session_id = ? AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), "alice", session.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("DELETE", "/api/auth/sessions/"+session.ID, nil)
+	req.Header.Set("Authorization", token)
+	if rec := apiRequest(rs, rs.handleAPIWebSessions, req); rec.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The signature is still valid, but the session is gone
+	mock.ExpectQuery(sessionQuery).WithArgs(session.ID).WillReturnError(sql.ErrNoRows)
+	req = httptest.NewRequest("GET", "/api/auth/sessions", nil)
+	req.Header.Set("Authorization", token)
+	if rec := apiRequest(rs, rs.handleAPIWebSessions, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d", rec.Code)
+	}
+}
+
+func TestRevokeSessionAPI(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		path     string
+		username string
+		role     string
+		owner    string // owner of the session, empty when there is none
+		status   int
+	}{
+		{"Own session", "/api/auth/sessions/session-2", "alice", "user", "alice", http.StatusOK},
+		{"Someone else's session", "/api/auth/sessions/session-2", "alice", "user", "bob", http.StatusNotFound},
+		{"Admin", "/api/auth/sessions/session-2", "root", "admin", "bob", http.StatusOK},
+		{"Unknown session", "/api/auth/sessions/session-2", "root", "admin", "", http.StatusNotFound},
+		{"Invalid ID", "/api/auth/sessions/a/b", "root", "admin", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			if tt.status != http.StatusBadRequest {
+				query := mock.ExpectQuery(sessionQuery).WithArgs("session-2")
+				if tt.owner == "" {
+					query.WillReturnError(sql.ErrNoRows)
+				} else {
+					query.WillReturnRows(sessionRows("session-2", tt.owner, "user", now.Add(-time.Hour), now))
+				}
+			}
+			if tt.status == http.StatusOK {
+				mock.ExpectExec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE session_id = ?").
+					WithArgs(sqlmock.AnyArg(), tt.username, "session-2").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req := httptest.NewRequest("DELETE", tt.path, nil)
+			req.Header.Set("X-Username", tt.username)
+			req.Header.Set("X-User-Role", tt.role)
+			rec := httptest.NewRecorder()
+			rs.handleAPIWebSessions(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestForceLogout(t *testing.T) {
+	forceLogout := func(rs *RelayServer, role, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/auth/force-logout", strings.NewReader(body))
+		req.Header.Set("X-Username", "root")
+		req.Header.Set("X-User-Role", role)
+		rec := httptest.NewRecorder()
+		rs.handleAPIForceLogout(rec, req)
+		return rec
+	}
+
+	t.Run("Not an admin", func(t *testing.T) {
+		rs, _ := testSessionRelay(t)
+		if rec := forceLogout(rs, "user", `{"username": "alice"}`); rec.Code != http.StatusForbidden {
+			t.Errorf("status %d", rec.Code)
+		}
+	})
+
+	t.Run("No username", func(t *testing.T) {
+		rs, _ := testSessionRelay(t)
+		if rec := forceLogout(rs, "admin", `{}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d", rec.Code)
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		mock.ExpectExec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE username = ? AND revoked_at IS NULL").
+			WithArgs(sqlmock.AnyArg(), "root", "alice").WillReturnResult(sqlmock.NewResult(0, 2))
+
+		rec := forceLogout(rs, "admin", `{"username": "alice"}`)
+		var reply struct {
+			Revoked int64 `json:"revoked"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil || rec.Code != http.StatusOK || reply.Revoked != 2 {
+			t.Fatalf("status %d, %+v, %v", rec.Code, reply, err)
+		}
+
+		// alice's token is refused from now on
+		mock.ExpectQuery(sessionQuery).WillReturnError(sql.ErrNoRows)
+		req := httptest.NewRequest("GET", "/api/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+rs.tokens.Sign(testWebSession(time.Now().Add(time.Hour))))
+		if rec := apiRequest(rs, func(http.ResponseWriter, *http.Request) {}, req); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token after force logout: status %d", rec.Code)
+		}
+	})
+}
+
+func TestAccountChangeRevokesSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		update string
+		handle func(*RelayServer, http.ResponseWriter, *http.Request)
+	}{
+		{"Role", "/api/users/7/role", `{"role": "user"}`, "UPDATE users SET role = ? WHERE id = ?", (*RelayServer).handleUpdateUserRole},
+		{"Password", "/api/users/7", `{"password": "new secret"}`, "UPDATE users SET password = ? WHERE id = ?", (*RelayServer).handleUpdateUser},
+		{"Role and username", "/api/users/7", `{"username": "alice2", "role": "user"}`, "UPDATE users SET username = ?, role = ? WHERE id = ?", (*RelayServer).handleUpdateUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, mock := testSessionRelay(t)
+			mock.ExpectQuery("SELECT username FROM users WHERE id = ?").WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("alice"))
+			mock.ExpectExec(tt.update).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("UPDATE web_sessions SET revoked_at = ?, revoked_by = ? WHERE username = ? AND revoked_at IS NULL").
+				WithArgs(sqlmock.AnyArg(), "root", "alice").WillReturnResult(sqlmock.NewResult(0, 2))
+
+			req := httptest.NewRequest("PUT", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Username", "root")
+			rec := httptest.NewRecorder()
+			tt.handle(rs, rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	t.Run("Unknown user", func(t *testing.T) {
+		rs, mock := testSessionRelay(t)
+		mock.ExpectQuery("SELECT username FROM users WHERE id = ?").WithArgs(9).WillReturnError(sql.ErrNoRows)
+
+		req := httptest.NewRequest("PUT", "/api/users/9/role", strings.NewReader(`{"role": "user"}`))
+		rec := httptest.NewRecorder()
+		rs.handleUpdateUserRole(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("status %d", rec.Code)
+		}
+	})
+}
@@ -14,7 +14,7 @@ api.interceptors.request.use(
   (config) => {
     const token = localStorage.getItem('auth_token')
     if (token) {
-      config.headers['Authorization'] = `Basic ${token}`
+      config.headers['Authorization'] = `Bearer ${token}`
     }
     
     // Debug logging for DELETE requests
@@ -61,6 +61,41 @@ export const apiService = {
     return api.post('/logout')
   },
 
+  // Sign-in options offered by the relay (SSO)
+  getAuthProviders() {
+    return api.get('/auth/providers')
+  },
+
+  ssoLoginURL() {
+    return `${api.defaults.baseURL}/auth/oidc/login`
+  },
+
+  // Login sessions
+  getSessions(params = {}) {
+    return api.get('/api/auth/sessions', { params })
+  },
+
+  revokeSession(sessionId) {
+    return api.delete(`/api/auth/sessions/${sessionId}`)
+  },
+
+  forceLogout(username) {
+    return api.post('/api/auth/force-logout', { username })
+  },
+
+  // Target restrictions for client connections (admin)
+  getTargetRules(params = {}) {
+    return api.get('/api/target-rules', { params })
+  },
+
+  addTargetRule(ruleData) {
+    return api.post('/api/target-rules', ruleData)
+  },
+
+  deleteTargetRule(ruleId) {
+    return api.delete(`/api/target-rules/${ruleId}`)
+  },
+
   // Agents
   getAgents() {
     return api.get('/api/agents')
@@ -102,14 +137,9 @@ export const apiService = {
     return api.get('/api/ssh-logs')
   },
 
-  // Log SSH Command
-  logSSHCommand(data) {
-    return api.post('/api/log-ssh', data)
-  },
-
-  // Log Database Query
-  logQuery(data) {
-    return api.post('/api/log-query', data)
+  // Gaps, replays and forged batches in ingested logs
+  getLogIntegrity() {
+    return api.get('/api/log-integrity')
   },
 
   // Health Check
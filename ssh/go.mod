@@ -3,6 +3,7 @@ module ssh-tunnel
 go 1.24.0
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/go-sql-driver/mysql v1.9.3
 	github.com/gorilla/websocket v1.5.0
 	github.com/lib/pq v1.10.9
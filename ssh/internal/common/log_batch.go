@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Log sources allowed to post to /api/log-ssh and /api/log-query
+const (
+	LogSourceAgent  = "agent"
+	LogSourceClient = "client"
+)
+
+// LogSignatureHeader carries the hex HMAC-SHA256 of a log batch body
+const LogSignatureHeader = "X-Log-Signature"
+
+// LogBatch is the body posted to the log endpoints. Entries carry a
+// sequence number that increases by one per entry within a stream; a
+// stream is one run of the sender.
+type LogBatch struct {
+	Source   string          `json:"source"`
+	SourceID string          `json:"source_id"`
+	Stream   string          `json:"stream"`
+	Entries  json.RawMessage `json:"entries"`
+}
+
+// SequencedLogEntry is a log entry that LogSender can number
+type SequencedLogEntry interface {
+	SetSeq(seq uint64)
+}
+
+// LogSigningKey derives the batch key of a source from the token it
+// registers with, so the token itself never keys more than one purpose
+func LogSigningKey(token, source, sourceID string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("tunnel-log-v1\x00" + source + "\x00" + sourceID))
+	return mac.Sum(nil)
+}
+
+// SignLogBatch returns the signature of a batch body
+func SignLogBatch(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyLogBatch checks a batch signature in constant time
+func VerifyLogBatch(key, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// LogSender numbers log entries and posts them as signed batches. Batches
+// are sent one at a time so they reach the relay in sequence order.
+type LogSender struct {
+	source   string
+	sourceID string
+	stream   string
+	key      []byte
+	client   *http.Client
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewLogSender creates a sender for an agent or client and its token
+func NewLogSender(source, sourceID, token string) *LogSender {
+	return &LogSender{
+		source:   source,
+		sourceID: sourceID,
+		stream:   GenerateID(),
+		key:      LogSigningKey(token, source, sourceID),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send posts entries to a log endpoint as one batch. A batch that fails
+// still uses up its sequence numbers, so the relay reports the loss.
+func (s *LogSender) Send(url string, entries ...SequencedLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		s.seq++
+		entry.SetSeq(s.seq)
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("marshal log entries: %v", err)
+	}
+	body, err := json.Marshal(&LogBatch{
+		Source:   s.source,
+		SourceID: s.sourceID,
+		Stream:   s.stream,
+		Entries:  raw,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal log batch: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(LogSignatureHeader, SignLogBatch(s.key, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testLogEntry struct {
+	Seq     uint64 `json:"seq"`
+	Message string `json:"message"`
+}
+
+func (e *testLogEntry) SetSeq(seq uint64) { e.Seq = seq }
+
+func TestLogSigningKey(t *testing.T) {
+	key := LogSigningKey("token", LogSourceAgent, "agent-1")
+	if !bytes.Equal(key, LogSigningKey("token", LogSourceAgent, "agent-1")) {
+		t.Fatal("key is not deterministic")
+	}
+
+	// Every input goes into the key, and the separator keeps source and
+	// ID from running together
+	for _, other := range [][]byte{
+		LogSigningKey("other-token", LogSourceAgent, "agent-1"),
+		LogSigningKey("token", LogSourceClient, "agent-1"),
+		LogSigningKey("token", LogSourceAgent, "agent-2"),
+		LogSigningKey("token", "agen", "tagent-1"),
+	} {
+		if bytes.Equal(key, other) {
+			t.Errorf("keys collide: %x", key)
+		}
+	}
+	if bytes.Equal(key, []byte("token")) {
+		t.Error("token used as the key")
+	}
+}
+
+func TestVerifyLogBatch(t *testing.T) {
+	key := LogSigningKey("token", LogSourceAgent, "agent-1")
+	body := []byte(`{"source":"agent","source_id":"agent-1","stream":"s1","entries":[]}`)
+	signature := SignLogBatch(key, body)
+
+	if !VerifyLogBatch(key, body, signature) {
+		t.Fatal("valid signature rejected")
+	}
+
+	tampered := bytes.Replace(body, []byte("agent-1"), []byte("agent-2"), 1)
+	tests := []struct {
+		name      string
+		key       []byte
+		body      []byte
+		signature string
+	}{
+		{"Tampered body", key, tampered, signature},
+		{"Wrong key", LogSigningKey("other-token", LogSourceAgent, "agent-1"), body, signature},
+		{"Signed with the raw token", key, body, SignLogBatch([]byte("token"), body)},
+		{"Truncated signature", key, body, signature[:len(signature)-2]},
+		{"Not hex", key, body, "zz" + signature[2:]},
+		{"Empty signature", key, body, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if VerifyLogBatch(tt.key, tt.body, tt.signature) {
+				t.Error("signature accepted")
+			}
+		})
+	}
+}
+
+func TestLogSenderSend(t *testing.T) {
+	key := LogSigningKey("token", LogSourceAgent, "agent-1")
+	var streams []string
+	var seqs []uint64
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyLogBatch(key, body, r.Header.Get(LogSignatureHeader)) {
+			t.Error("batch signature does not verify")
+		}
+		var batch LogBatch
+		var entries []testLogEntry
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(batch.Entries, &entries); err != nil {
+			t.Error(err)
+		}
+		if batch.Source != LogSourceAgent || batch.SourceID != "agent-1" {
+			t.Errorf("batch from %s %s", batch.Source, batch.SourceID)
+		}
+		streams = append(streams, batch.Stream)
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sender := NewLogSender(LogSourceAgent, "agent-1", "token")
+	if err := sender.Send(server.URL, &testLogEntry{Message: "a"}, &testLogEntry{Message: "b"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// A refused batch still uses up its sequence number
+	status = http.StatusUnauthorized
+	if err := sender.Send(server.URL, &testLogEntry{Message: "c"}); err == nil {
+		t.Error("refused batch reported as sent")
+	}
+	status = http.StatusOK
+	if err := sender.Send(server.URL, &testLogEntry{Message: "d"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	want := []uint64{1, 2, 3, 4}
+	if len(seqs) != len(want) {
+		t.Fatalf("seqs %v, want %v", seqs, want)
+	}
+	for i := range want {
+		if seqs[i] != want[i] {
+			t.Fatalf("seqs %v, want %v", seqs, want)
+		}
+	}
+	for _, stream := range streams {
+		if stream == "" || stream != streams[0] {
+			t.Errorf("streams %v, want one stream per sender", streams)
+		}
+	}
+
+	// Another run of the sender starts a new stream
+	other := NewLogSender(LogSourceAgent, "agent-1", "token")
+	if other.stream == sender.stream {
+		t.Error("new sender reuses the stream")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -61,6 +62,7 @@ type UniversalClient struct {
 	tunnelConn  *websocket.Conn
 	sessionID   string
 	httpClient  *http.Client
+	logSender   *common.LogSender
 	lastCommand string // Store last command for OUTPUT logging
 }
 
@@ -76,8 +78,11 @@ type UniversalSSHLogRequest struct {
 	Command   string `json:"command"`
 	Data      string `json:"data"`
 	IsBase64  bool   `json:"is_base64"`
+	Seq       uint64 `json:"seq"`
 }
 
+func (r *UniversalSSHLogRequest) SetSeq(seq uint64) { r.Seq = seq }
+
 // LogFileReader reads and processes client.log file to send to server
 type LogFileReader struct {
 	client       *UniversalClient
@@ -525,6 +530,103 @@ func getRelayDisplayName(relayURL string) string {
 	return strings.Replace(relayURL, "ws://", "", 1)
 }
 
+// relayHTTPURL turns the relay WebSocket URL into the URL of an HTTP path on
+// the same server
+func relayHTTPURL(relayURL, path string) (string, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid relay URL: %v", err)
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// deviceLogin signs in through the relay's SSO device code flow and returns
+// a session token usable as the client token
+func deviceLogin(relayURL string) (string, error) {
+	deviceURL, err := relayHTTPURL(relayURL, "/auth/device")
+	if err != nil {
+		return "", err
+	}
+	tokenURL, _ := relayHTTPURL(relayURL, "/auth/device/token")
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := httpClient.Post(deviceURL, "application/json", nil)
+	if err != nil {
+		return "", fmt.Errorf("device login: %v", err)
+	}
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+		ErrorDescription        string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&device)
+	resp.Body.Close()
+	if err != nil || device.DeviceCode == "" {
+		return "", fmt.Errorf("device login not available: %s %s", resp.Status, device.ErrorDescription)
+	}
+
+	fmt.Printf("🔐 To sign in, open %s and enter the code %s\n", device.VerificationURI, device.UserCode)
+	if device.VerificationURIComplete != "" {
+		fmt.Printf("   or open %s\n", device.VerificationURIComplete)
+	}
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	if device.ExpiresIn <= 0 {
+		deadline = time.Now().Add(10 * time.Minute)
+	}
+
+	body, _ := json.Marshal(map[string]string{"device_code": device.DeviceCode})
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		resp, err := httpClient.Post(tokenURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("device login: %v", err)
+		}
+		var result struct {
+			Token            string `json:"token"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+			User             struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("device login: unexpected response %s", resp.Status)
+		}
+
+		switch result.Error {
+		case "":
+			fmt.Printf("✅ Signed in as %s\n", result.User.Username)
+			return result.Token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("device login failed: %s %s", result.Error, result.ErrorDescription)
+		}
+	}
+	return "", fmt.Errorf("device login timed out")
+}
+
 // createFileOnlyLogger creates a logger that only writes to file, not console
 func createFileOnlyLogger(prefix string) *common.Logger {
 	logger := &common.Logger{}
@@ -563,6 +665,7 @@ func main() {
 		relayURL   string
 		agentID    string
 		token      string
+		sso        bool
 
 		// Tunnel mode parameters
 		localAddr   string
@@ -595,6 +698,12 @@ func main() {
 			if localPort == "" {
 				localPort = "2222"
 			}
+			if sso && token == "" {
+				var err error
+				if token, err = deviceLogin(relayURL); err != nil {
+					log.Fatalf("SSO login failed: %v", err)
+				}
+			}
 
 			client := &UniversalClient{
 				id:          clientID,
@@ -611,6 +720,7 @@ func main() {
 				sshUser:     sshUser,
 				sshPassword: sshPassword,
 				httpClient:  &http.Client{Timeout: 5 * time.Second},
+				logSender:   common.NewLogSender(common.LogSourceClient, clientID, token),
 			}
 
 			// Debug: Log token status
@@ -669,6 +779,7 @@ func main() {
 	rootCmd.Flags().StringVarP(&relayURL, "relay-url", "r", config.RelayURL, "Relay server WebSocket URL (default from config.json, RELAY_URL env, or built-in)")
 	rootCmd.Flags().StringVarP(&agentID, "agent", "a", "", "Target agent ID")
 	rootCmd.Flags().StringVarP(&token, "token", "T", "", "Client authentication token for relay server connection")
+	rootCmd.Flags().BoolVar(&sso, "sso", false, "Sign in with SSO (device code) instead of a token")
 
 	// Tunnel mode flags
 	rootCmd.Flags().StringVarP(&localAddr, "local", "L", "", "Local address for TUNNEL MODE (e.g., :2222)")
@@ -1299,7 +1410,7 @@ func (c *UniversalClient) logCommand(command string) {
 }
 
 func (c *UniversalClient) sendSSHLogToRelay(command string) {
-	logReq := UniversalSSHLogRequest{
+	logReq := &UniversalSSHLogRequest{
 		SessionID: c.sessionID,
 		ClientID:  c.id,
 		AgentID:   c.agentID,
@@ -1311,21 +1422,12 @@ func (c *UniversalClient) sendSSHLogToRelay(command string) {
 		Data:      command,
 	}
 
-	jsonData, err := json.Marshal(logReq)
-	if err != nil {
-		return
-	}
-
 	// Build API URL
 	apiURL := strings.Replace(c.relayURL, "ws://", "http://", 1)
 	apiURL = strings.Replace(apiURL, "/ws/client", "/api/log-ssh", 1)
 
 	// Send to relay (silent fail)
-	resp, err := c.httpClient.Post(apiURL, "application/json", bytes.NewReader(jsonData))
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
+	c.logSender.Send(apiURL, logReq)
 }
 
 // ================ UTILITY FUNCTIONS ================